@@ -0,0 +1,103 @@
+package respwriter
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Annotate attaches a key/value attribute to the request. Annotations are
+// bound to the logger returned by Logger, added to the request's trace span
+// and, when the key is allow-listed via WithMetricLabels, added as a label to
+// the metrics. Annotating an existing key replaces its value.
+func (rw *RespWriter) Annotate(key string, value any) {
+	attr := slog.Any(key, value)
+	rw.attrsMu.Lock()
+	defer rw.attrsMu.Unlock()
+	replaced := false
+	for i := range rw.attrs {
+		if rw.attrs[i].Key == key {
+			rw.attrs[i] = attr
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		rw.attrs = append(rw.attrs, attr)
+	}
+	rw.boundLogger = nil
+	if rw.span != nil {
+		rw.span.SetAttributes(attr)
+	}
+}
+
+// labels adds the allow-listed annotations to the given metric labels. An
+// allow-listed key which hasn't been annotated gets an empty label, so every
+// series of a metric has the same labels.
+func (rw *RespWriter) labels(labels map[string]string) map[string]string {
+	if len(rw.metricLabels) == 0 {
+		return labels
+	}
+	rw.attrsMu.Lock()
+	defer rw.attrsMu.Unlock()
+	for _, key := range rw.metricLabels {
+		labels[key] = ""
+		for _, a := range rw.attrs {
+			if a.Key == key {
+				labels[key] = a.Value.String()
+				break
+			}
+		}
+	}
+	return labels
+}
+
+// startSpan starts the trace span of the request, which becomes part of the
+// request context.
+func (rw *RespWriter) startSpan(t Tracer) {
+	ctx, span := t.Start(rw.requestCtx, "dns.request")
+	if isNil(ctx) || isNil(span) {
+		return
+	}
+	rw.requestCtx, rw.span = ctx, span
+	attrs := []slog.Attr{slog.String("transport", rw.Transport().String())}
+	if id := rw.RequestID(); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	if q, ok := QuestionFromContext(rw.requestCtx); ok {
+		attrs = append(attrs, slog.String("qname", q.Name), slog.String("qtype", dns.TypeToString[q.Qtype]))
+	}
+	span.SetAttributes(attrs...)
+}
+
+// complete reports the completion of the request, which started at start, to
+// the logger, metrics and trace span, and then calls the funcs registered via
+// onComplete.
+func (rw *RespWriter) complete(start time.Time) {
+	d := rw.clock.Now().Sub(start)
+	rw.mu.Lock()
+	rcode := "none"
+	if rw.rcode >= 0 {
+		rcode = dns.RcodeToString[rw.rcode]
+	}
+	rw.mu.Unlock()
+	transport := rw.Transport().String()
+
+	if logger := rw.Logger(); logger != nil {
+		logger.Debug("request completed", "remote_addr", rw.RemoteAddr().String(), "transport", transport, "rcode", rcode, "duration", d)
+	}
+	if rw.metrics != nil {
+		rw.metrics.ObserveDuration(MetricRequestDuration, d, rw.labels(map[string]string{"transport": transport, "rcode": rcode}))
+	}
+	if rw.span != nil {
+		rw.span.SetAttributes(slog.String("rcode", rcode), slog.Duration("duration", d))
+		rw.span.End()
+	}
+	rw.mu.Lock()
+	funcs := rw.completeFuncs
+	rw.mu.Unlock()
+	for _, f := range funcs {
+		f()
+	}
+}
@@ -0,0 +1,220 @@
+package respwriter
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRespWriter_Annotate(t *testing.T) {
+	t.Parallel()
+
+	t.Run("logger", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+		rw := NewRespWriter(context.Background(), new(mockTCPResponseWriter), WithLogger(logger))
+		assert.Equal(logger, rw.Logger())
+
+		rw.Annotate("tenant", "acme")
+		rw.Annotate("zone", "go.dev.")
+		rw.Annotate("tenant", "globex")
+		rw.Logger().Info("hello")
+		assert.Contains(buf.String(), "tenant=globex zone=go.dev.")
+		assert.NotContains(buf.String(), "acme")
+
+		// the annotations survive a new logger
+		buf.Reset()
+		rw.SetLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+		rw.Logger().Info("hello")
+		assert.Contains(buf.String(), "tenant=globex zone=go.dev.")
+	})
+	t.Run("wrapper", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		var buf syncBuffer
+		logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		metrics := newTestMetrics()
+		var requestID string
+		h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+			rw := w.(*RespWriter)
+			requestID = rw.RequestID()
+			rw.Annotate("tenant", "acme")
+			rw.Annotate("user", "not-a-label")
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			_ = w.WriteMsg(m)
+		}, WithLogger(logger), WithMetrics(metrics), WithMetricLabels("tenant", "region"))
+		require.NoError(err)
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		h(new(mockTCPResponseWriter), r)
+
+		var completed string
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.Contains(line, "request completed") {
+				completed = line
+			}
+		}
+		require.NotEmpty(completed)
+		assert.Contains(completed, "request_id="+requestID)
+		assert.Contains(completed, "tenant=acme")
+		assert.Contains(completed, "rcode=NXDOMAIN")
+
+		assert.Equal(map[string]string{"transport": "tcp", "rcode": "NXDOMAIN", "tenant": "acme", "region": ""}, metrics.lastLabels(MetricRequestDuration))
+	})
+}
+
+func TestNewHandlerFunc_requestID(t *testing.T) {
+	t.Parallel()
+	const code = dns.EDNS0LOCALSTART + 1
+
+	tests := []struct {
+		name string
+		data []byte
+		code uint16
+		want string
+	}{
+		{
+			name: "printable",
+			data: []byte("upstream-1234"),
+			code: code,
+			want: "upstream-1234",
+		},
+		{
+			name: "binary",
+			data: []byte{0x01, 0x02, 0xff},
+			code: code,
+			want: "0102ff",
+		},
+		{
+			name: "other-code",
+			data: []byte("upstream-1234"),
+			code: code + 1,
+		},
+		{
+			name: "too-long",
+			data: bytes.Repeat([]byte("a"), maxRequestIDLen+1),
+			code: code,
+		},
+		{
+			name: "option-not-configured",
+			data: []byte("upstream-1234"),
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			var got string
+			h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+				got = w.(*RespWriter).RequestID()
+			}, WithRequestIDOption(tc.code))
+			require.NoError(err)
+			r := new(dns.Msg)
+			r.SetQuestion("go.dev.", dns.TypeA)
+			r.SetEdns0(1232, false)
+			r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: code, Data: tc.data})
+			h(new(mockTCPResponseWriter), r)
+			if tc.want != "" {
+				assert.Equal(tc.want, got)
+				return
+			}
+			_, err = hex.DecodeString(got)
+			assert.NoError(err)
+			assert.Len(got, 2*requestIDLen)
+		})
+	}
+	t.Run("err-invalid-code", func(t *testing.T) {
+		_, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {}, WithRequestIDOption(dns.EDNS0COOKIE))
+		assert.ErrorIs(t, err, ErrInvalidParameter)
+	})
+}
+
+func TestNewHandlerFunc_tracer(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	tracer := new(testTracer)
+	h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+		rw := w.(*RespWriter)
+		_, ok := rw.RequestContext().Value(testSpanKey{}).(*testSpan)
+		assert.True(ok, "span isn't in the request context")
+		rw.Annotate("tenant", "acme")
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	}, WithTracer(tracer))
+	require.NoError(err)
+	r := new(dns.Msg)
+	r.SetQuestion("go.dev.", dns.TypeA)
+	h(new(mockTCPResponseWriter), r)
+
+	require.Len(tracer.spans, 1)
+	span := tracer.spans[0]
+	assert.Equal("dns.request", span.name)
+	assert.True(span.ended)
+	assert.Equal("go.dev.", span.attrs["qname"])
+	assert.Equal("A", span.attrs["qtype"])
+	assert.Equal("tcp", span.attrs["transport"])
+	assert.Equal("acme", span.attrs["tenant"])
+	assert.Equal("NOERROR", span.attrs["rcode"])
+	assert.NotEmpty(span.attrs["request_id"])
+}
+
+type testSpanKey struct{}
+
+// testTracer is a Tracer which keeps the spans it starts.
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &testSpan{name: name, attrs: map[string]string{}}
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, testSpanKey{}, s), s
+}
+
+type testSpan struct {
+	name  string
+	attrs map[string]string
+	ended bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...slog.Attr) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value.String()
+	}
+}
+
+func (s *testSpan) End() { s.ended = true }
+
+// syncBuffer is a bytes.Buffer which is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
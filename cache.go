@@ -0,0 +1,373 @@
+package respwriter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultCacheMaxEntries     = 10000
+	defaultCacheMaxTTL         = time.Hour
+	defaultPrefetchThreshold   = 3
+	defaultPrefetchWindow      = 0.1
+	defaultPrefetchConcurrency = 10
+	defaultPrefetchTimeout     = 2 * time.Second
+)
+
+// Cache is a response cache which wraps a dns.HandlerFunc. Responses written
+// by the wrapped handler are cached until their TTL expires and repeat
+// questions are answered from the cache.
+//
+// Popular responses (at least the prefetch threshold of hits) which are hit
+// during the last portion of their TTL are refreshed in the background through
+// the wrapped handler, so clients don't wait on a cold upstream for hot names.
+// A failed prefetch never evicts the existing response, which isn't prefetched
+// again: it's refreshed by a regular lookup once it expires.
+//
+// Cache.ServeDNS is typically wrapped by NewHandlerFunc, so cache misses are
+// bound by the request timeout.
+type Cache struct {
+	handler dns.HandlerFunc
+	logger  *slog.Logger
+	clock   Clock
+
+	maxEntries      int
+	maxTTL          time.Duration
+	prefetchHits    int
+	prefetchWindow  float64
+	prefetchTimeout time.Duration
+
+	// prefetchHandler calls handler for prefetches, the way a request from a
+	// client would be handled (see prefetchWriter).
+	prefetchHandler dns.HandlerFunc
+
+	// prefetchSem bounds the number of in-flight prefetches
+	prefetchSem chan struct{}
+	prefetchWg  sync.WaitGroup
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+type cacheEntry struct {
+	msg    *dns.Msg
+	stored time.Time
+	ttl    time.Duration
+	hits   int
+
+	// prefetching is true once a prefetch of the entry was started. It stays
+	// true when the prefetch fails, so later hits don't start another one
+	// before the entry expires.
+	prefetching bool
+}
+
+func (e *cacheEntry) expires() time.Time {
+	return e.stored.Add(e.ttl)
+}
+
+// NewCache returns a new Cache which wraps the given handler. Options
+// supported: WithLogger, WithCacheMaxEntries, WithCacheMaxTTL,
+// WithPrefetchThreshold, WithPrefetchWindow, WithPrefetchConcurrency,
+// WithPrefetchTimeout, WithClock
+func NewCache(h dns.HandlerFunc, opt ...Option) (*Cache, error) {
+	const op = "respwriter.NewCache"
+	opts := getGeneralOpts(opt...)
+	switch {
+	case isNil(h):
+		return nil, fmt.Errorf("%s: nil handler: %w", op, ErrInvalidParameter)
+	case opts.withCacheMaxEntries <= 0:
+		return nil, fmt.Errorf("%s: invalid max entries: %w", op, ErrInvalidParameter)
+	case opts.withCacheMaxTTL <= 0:
+		return nil, fmt.Errorf("%s: invalid max ttl: %w", op, ErrInvalidParameter)
+	case opts.withPrefetchThreshold < 0:
+		return nil, fmt.Errorf("%s: invalid prefetch threshold: %w", op, ErrInvalidParameter)
+	case opts.withPrefetchWindow <= 0 || opts.withPrefetchWindow >= 1:
+		return nil, fmt.Errorf("%s: invalid prefetch window: %w", op, ErrInvalidParameter)
+	case opts.withPrefetchConcurrency <= 0:
+		return nil, fmt.Errorf("%s: invalid prefetch concurrency: %w", op, ErrInvalidParameter)
+	case opts.withPrefetchTimeout <= 0:
+		return nil, fmt.Errorf("%s: invalid prefetch timeout: %w", op, ErrInvalidParameter)
+	}
+	c := &Cache{
+		handler:         h,
+		logger:          opts.withLogger,
+		clock:           opts.withClock,
+		maxEntries:      opts.withCacheMaxEntries,
+		maxTTL:          opts.withCacheMaxTTL,
+		prefetchHits:    opts.withPrefetchThreshold,
+		prefetchWindow:  opts.withPrefetchWindow,
+		prefetchTimeout: opts.withPrefetchTimeout,
+		prefetchSem:     make(chan struct{}, opts.withPrefetchConcurrency),
+		entries:         make(map[cacheKey]*cacheEntry),
+	}
+	var err error
+	c.prefetchHandler, err = NewHandlerFunc(c.prefetchTimeout, c.servePrefetch, WithLogger(c.logger), WithClock(c.clock))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return c, nil
+}
+
+// ServeDNS answers the request from the cache when possible, otherwise it
+// calls the wrapped handler and caches its response.
+func (c *Cache) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	key, ok := newCacheKey(r)
+	if !ok {
+		c.handler(w, r)
+		return
+	}
+
+	now := c.clock.Now()
+	if resp, ok := c.lookup(key, r, w, now); ok {
+		_ = w.WriteMsg(resp)
+		return
+	}
+
+	// the response is stored when it's written rather than once the handler
+	// returned, so a response written via Detach is cached as well.
+	cw := &captureWriter{onWrite: func(m *dns.Msg) { c.store(key, m, now) }}
+	rw := wrapWrites(w, func(next dns.ResponseWriter) dns.ResponseWriter {
+		cw.ResponseWriter = next
+		return cw
+	}, WithLogger(c.logger), WithClock(c.clock))
+	c.handler(rw, r)
+}
+
+// Len returns the number of responses currently held by the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Wait blocks until all in-flight prefetches have completed.
+func (c *Cache) Wait() {
+	c.prefetchWg.Wait()
+}
+
+// lookup returns a response for r from the cache, rewritten for r. It will
+// start a prefetch when the entry is popular and close to expiring.
+func (c *Cache) lookup(key cacheKey, r *dns.Msg, w dns.ResponseWriter, now time.Time) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	remaining := e.expires().Sub(now)
+	if remaining <= 0 {
+		delete(c.entries, key)
+		return nil, false
+	}
+	e.hits++
+	if c.prefetchHits > 0 && !e.prefetching && e.hits >= c.prefetchHits &&
+		float64(remaining) <= c.prefetchWindow*float64(e.ttl) {
+		e.prefetching = c.prefetch(key, r.Copy(), w.RemoteAddr(), w.LocalAddr())
+	}
+
+	resp := e.msg.Copy()
+	resp.Id = r.Id
+	resp.Question = r.Question
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > age {
+				hdr.Ttl -= age
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return resp, true
+}
+
+// prefetch refreshes the entry for key in the background through the wrapped
+// handler. It returns false when the prefetch concurrency limit has been
+// reached and no prefetch was started. The caller must hold c.mu.
+func (c *Cache) prefetch(key cacheKey, r *dns.Msg, remote, local net.Addr) bool {
+	select {
+	case c.prefetchSem <- struct{}{}:
+	default:
+		return false
+	}
+	c.prefetchWg.Add(1)
+	go func() {
+		defer c.prefetchWg.Done()
+		defer func() { <-c.prefetchSem }()
+
+		started := c.clock.Now()
+		pw := &prefetchWriter{remote: remote, local: local}
+		// the prefetch handler returns once the request is complete, so a
+		// response written via Detach has been captured.
+		c.prefetchHandler(pw, r)
+
+		// on failure, keep the existing entry; it will expire normally.
+		if msg := pw.capture.msg; (msg == nil || !c.store(key, msg, started)) && c.logger != nil {
+			c.logger.Debug("cache prefetch failed", "name", key.name, "qtype", dns.TypeToString[key.qtype], "err", pw.ctx.Err())
+		}
+	}()
+	return true
+}
+
+// servePrefetch calls the wrapped handler for a prefetch, with w being the
+// RespWriter of the prefetch handler, and captures its response.
+func (c *Cache) servePrefetch(w dns.ResponseWriter, r *dns.Msg) {
+	rw := w.(*RespWriter)
+	pw := rw.Underlying().(*prefetchWriter)
+	pw.ctx = rw.RequestContext()
+	rw.wrapWriter(func(next dns.ResponseWriter) dns.ResponseWriter {
+		pw.capture.ResponseWriter = next
+		return &pw.capture
+	})
+	c.handler(rw, r)
+}
+
+// store caches msg for key if it's cacheable and reports whether it did.
+func (c *Cache) store(key cacheKey, msg *dns.Msg, now time.Time) bool {
+	ttl, ok := cacheTTL(msg)
+	if !ok {
+		return false
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = &cacheEntry{msg: msg, stored: now, ttl: ttl}
+	return true
+}
+
+// evict removes expired entries and, if the cache is still full, an arbitrary
+// entry. The caller must hold c.mu.
+func (c *Cache) evict(now time.Time) {
+	for k, e := range c.entries {
+		if !e.expires().After(now) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			return
+		}
+		delete(c.entries, k)
+	}
+}
+
+func newCacheKey(r *dns.Msg) (cacheKey, bool) {
+	if r == nil || r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 {
+		return cacheKey{}, false
+	}
+	q := r.Question[0]
+	key := cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		cd:     r.CheckingDisabled,
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return key, true
+}
+
+// cacheTTL returns how long msg may be cached, which is the lowest TTL of its
+// records. Negative responses use the SOA minimum (RFC 2308).
+func cacheTTL(msg *dns.Msg) (time.Duration, bool) {
+	switch {
+	case msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError:
+		return 0, false
+	case msg.Truncated, len(msg.Question) != 1:
+		return 0, false
+	}
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			rrTTL := hdr.Ttl
+			if soa, ok := rr.(*dns.SOA); ok && len(msg.Answer) == 0 && soa.Minttl < rrTTL {
+				rrTTL = soa.Minttl
+			}
+			if !found || rrTTL < ttl {
+				ttl, found = rrTTL, true
+			}
+		}
+	}
+	if !found || ttl == 0 {
+		return 0, false
+	}
+	return time.Duration(ttl) * time.Second, true
+}
+
+// captureWriter is a dns.ResponseWriter which keeps a copy of the message
+// successfully written through it.
+type captureWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+
+	// onWrite, when set, is called with the copy of every message
+	// successfully written.
+	onWrite func(*dns.Msg)
+}
+
+// WriteMsg writes the message to the wrapped writer and keeps a copy of it.
+func (w *captureWriter) WriteMsg(m *dns.Msg) error {
+	// copy before writing, since the wrapped writer may modify the message
+	// (truncation for example).
+	cp := m.Copy()
+	if err := w.ResponseWriter.WriteMsg(m); err != nil {
+		return err
+	}
+	w.msg = cp
+	if w.onWrite != nil {
+		w.onWrite(cp)
+	}
+	return nil
+}
+
+// prefetchWriter is a dns.ResponseWriter which isn't connected to a client and
+// discards everything written to it. The response of the prefetch is captured
+// on its way to it, along with the context of the prefetch.
+type prefetchWriter struct {
+	remote net.Addr
+	local  net.Addr
+
+	capture captureWriter
+	ctx     context.Context
+}
+
+func (w *prefetchWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (w *prefetchWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *prefetchWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *prefetchWriter) LocalAddr() net.Addr         { return w.local }
+func (w *prefetchWriter) TsigStatus() error           { return nil }
+func (w *prefetchWriter) TsigTimersOnly(bool)         {}
+func (w *prefetchWriter) Hijack()                     {}
+func (w *prefetchWriter) Close() error                { return nil }
@@ -0,0 +1,324 @@
+package respwriter
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCache(t *testing.T) {
+	t.Parallel()
+	testHandler := func(w dns.ResponseWriter, req *dns.Msg) {}
+
+	tests := []struct {
+		name            string
+		handler         dns.HandlerFunc
+		opts            []Option
+		wantErrIs       error
+		wantErrContains string
+	}{
+		{
+			name:    "success",
+			handler: testHandler,
+		},
+		{
+			name:            "err-nil-handler",
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "nil handler",
+		},
+		{
+			name:            "err-max-entries",
+			handler:         testHandler,
+			opts:            []Option{WithCacheMaxEntries(0)},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "invalid max entries",
+		},
+		{
+			name:            "err-max-ttl",
+			handler:         testHandler,
+			opts:            []Option{WithCacheMaxTTL(0)},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "invalid max ttl",
+		},
+		{
+			name:            "err-prefetch-threshold",
+			handler:         testHandler,
+			opts:            []Option{WithPrefetchThreshold(-1)},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "invalid prefetch threshold",
+		},
+		{
+			name:            "err-prefetch-window",
+			handler:         testHandler,
+			opts:            []Option{WithPrefetchWindow(1)},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "invalid prefetch window",
+		},
+		{
+			name:            "err-prefetch-concurrency",
+			handler:         testHandler,
+			opts:            []Option{WithPrefetchConcurrency(0)},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "invalid prefetch concurrency",
+		},
+		{
+			name:            "err-prefetch-timeout",
+			handler:         testHandler,
+			opts:            []Option{WithPrefetchTimeout(0)},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "invalid prefetch timeout",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			got, err := NewCache(tc.handler, tc.opts...)
+			if tc.wantErrContains != "" {
+				require.Error(err)
+				assert.ErrorIs(err, tc.wantErrIs)
+				assert.Contains(err.Error(), tc.wantErrContains)
+				return
+			}
+			require.NoError(err)
+			assert.NotNil(got)
+		})
+	}
+}
+
+func TestCache_ServeDNS(t *testing.T) {
+	t.Parallel()
+	testLogger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{AddSource: true}))
+
+	t.Run("miss-then-hit", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var calls atomic.Int32
+		c, err := NewCache(testTTLHandler(300, &calls), WithLogger(testLogger))
+		require.NoError(err)
+
+		first := serveCache(t, c, testCacheQuestion(1))
+		require.NotNil(first)
+		assert.Equal(uint16(1), first.Id)
+
+		second := serveCache(t, c, testCacheQuestion(2))
+		require.NotNil(second)
+		assert.Equal(uint16(2), second.Id)
+		assert.Equal(first.Answer[0].(*dns.A).A, second.Answer[0].(*dns.A).A)
+		assert.Equal(int32(1), calls.Load())
+		assert.Equal(1, c.Len())
+	})
+	t.Run("case-insensitive", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var calls atomic.Int32
+		c, err := NewCache(testTTLHandler(300, &calls))
+		require.NoError(err)
+
+		serveCache(t, c, testCacheQuestion(1))
+		r := new(dns.Msg)
+		r.SetQuestion("GO.dev.", dns.TypeA)
+		got := serveCache(t, c, r)
+		require.NotNil(got)
+		assert.Equal("GO.dev.", got.Question[0].Name)
+		assert.Equal(int32(1), calls.Load())
+	})
+	t.Run("not-cacheable", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var calls atomic.Int32
+		h := func(w dns.ResponseWriter, r *dns.Msg) {
+			calls.Add(1)
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			_ = w.WriteMsg(m)
+		}
+		c, err := NewCache(h)
+		require.NoError(err)
+
+		serveCache(t, c, testCacheQuestion(1))
+		serveCache(t, c, testCacheQuestion(2))
+		assert.Equal(int32(2), calls.Load())
+		assert.Equal(0, c.Len())
+	})
+	t.Run("max-entries", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var calls atomic.Int32
+		c, err := NewCache(testTTLHandler(300, &calls), WithCacheMaxEntries(1))
+		require.NoError(err)
+
+		serveCache(t, c, testCacheQuestion(1))
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		serveCache(t, c, r)
+		assert.Equal(1, c.Len())
+	})
+	t.Run("detached", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var (
+			calls         atomic.Int32
+			outer         *RespWriter
+			handlerWriter *RespWriter
+		)
+		c, err := NewCache(func(w dns.ResponseWriter, r *dns.Msg) {
+			// the handler gets the writer of NewHandlerFunc.
+			handlerWriter = w.(*RespWriter)
+			assert.NoError(handlerWriter.ExtendDeadline(time.Second))
+			d := handlerWriter.Detach()
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				assert.NoError(d.Respond(testTTLReply(r, 300, &calls)))
+			}()
+		})
+		require.NoError(err)
+		h, err := NewHandlerFunc(50*time.Millisecond, func(w dns.ResponseWriter, r *dns.Msg) {
+			outer = w.(*RespWriter)
+			c.ServeDNS(w, r)
+		}, WithMaxRequestTimeout(time.Minute))
+		require.NoError(err)
+
+		cw := &captureWriter{ResponseWriter: new(mockDNSResponseWriter)}
+		h(cw, testCacheQuestion(1))
+		assert.Same(outer, handlerWriter)
+		require.NotNil(cw.msg)
+		assert.Equal(dns.RcodeSuccess, cw.msg.Rcode)
+
+		// the response written after the handler returned was cached.
+		assert.Equal(1, c.Len())
+		got := serveCache(t, c, testCacheQuestion(2))
+		require.NotNil(got)
+		assert.Equal(int32(1), calls.Load())
+	})
+}
+
+func TestCache_prefetch(t *testing.T) {
+	t.Parallel()
+
+	t.Run("failure-keeps-entry", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var calls atomic.Int32
+		h := func(w dns.ResponseWriter, r *dns.Msg) {
+			if calls.Add(1) > 1 {
+				// simulate an upstream which never answers
+				rw := w.(*RespWriter)
+				<-rw.RequestContext().Done()
+				return
+			}
+			testTTLHandler(1, new(atomic.Int32))(w, r)
+		}
+		c, err := NewCache(h, WithPrefetchThreshold(1), WithPrefetchWindow(0.99), WithPrefetchTimeout(10*time.Millisecond))
+		require.NoError(err)
+
+		serveCache(t, c, testCacheQuestion(1))
+		time.Sleep(20 * time.Millisecond)
+		serveCache(t, c, testCacheQuestion(2))
+		c.Wait()
+		assert.Equal(int32(2), calls.Load())
+		assert.Equal(1, c.Len())
+
+		// later hits are answered from the entry without another prefetch.
+		for i := uint16(3); i < 6; i++ {
+			got := serveCache(t, c, testCacheQuestion(i))
+			require.NotNil(got)
+			require.Len(got.Answer, 1)
+		}
+		c.Wait()
+		assert.Equal(int32(2), calls.Load())
+	})
+	t.Run("detached", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var calls atomic.Int32
+		h := func(w dns.ResponseWriter, r *dns.Msg) {
+			if calls.Load() == 0 {
+				testTTLHandler(1, &calls)(w, r)
+				return
+			}
+			// the prefetch is answered after the handler returned.
+			d := w.(*RespWriter).Detach()
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				assert.NoError(d.Respond(testTTLReply(r, 300, &calls)))
+			}()
+		}
+		c, err := NewCache(h, WithPrefetchThreshold(1), WithPrefetchWindow(0.99))
+		require.NoError(err)
+
+		serveCache(t, c, testCacheQuestion(1))
+		time.Sleep(20 * time.Millisecond)
+		serveCache(t, c, testCacheQuestion(2))
+		c.Wait()
+		assert.Equal(int32(2), calls.Load())
+
+		// the entry was replaced by the prefetched response.
+		got := serveCache(t, c, testCacheQuestion(3))
+		require.NotNil(got)
+		require.Len(got.Answer, 1)
+		assert.Equal([]byte{192, 0, 2, 2}, []byte(got.Answer[0].(*dns.A).A.To4()))
+	})
+	t.Run("bounded-concurrency", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var calls atomic.Int32
+		release := make(chan struct{})
+		var once sync.Once
+		h := func(w dns.ResponseWriter, r *dns.Msg) {
+			if calls.Add(1) > 2 {
+				<-release
+			}
+			testTTLHandler(1, new(atomic.Int32))(w, r)
+		}
+		c, err := NewCache(h, WithPrefetchThreshold(1), WithPrefetchWindow(0.99), WithPrefetchConcurrency(1))
+		require.NoError(err)
+		t.Cleanup(func() { once.Do(func() { close(release) }) })
+
+		other := new(dns.Msg)
+		other.SetQuestion("example.com.", dns.TypeA)
+		serveCache(t, c, testCacheQuestion(1))
+		serveCache(t, c, other.Copy())
+		time.Sleep(20 * time.Millisecond)
+
+		serveCache(t, c, testCacheQuestion(2))
+		serveCache(t, c, other.Copy())
+		once.Do(func() { close(release) })
+		c.Wait()
+		assert.Equal(int32(3), calls.Load())
+	})
+}
+
+func testCacheQuestion(id uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("go.dev.", dns.TypeA)
+	m.Id = id
+	return m
+}
+
+func testTTLHandler(ttl uint32, calls *atomic.Int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		_ = w.WriteMsg(testTTLReply(r, ttl, calls))
+	}
+}
+
+// testTTLReply returns a reply to r with an A record, with the given TTL,
+// whose last byte is the number of calls.
+func testTTLReply(r *dns.Msg, ttl uint32, calls *atomic.Int32) *dns.Msg {
+	n := calls.Add(1)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   []byte{192, 0, 2, byte(n)},
+	})
+	return m
+}
+
+// serveCache serves r through the cache and returns the response written.
+func serveCache(t *testing.T, c *Cache, r *dns.Msg) *dns.Msg {
+	t.Helper()
+	cw := &captureWriter{ResponseWriter: new(mockDNSResponseWriter)}
+	c.ServeDNS(NewRespWriter(context.Background(), cw), r)
+	return cw.msg
+}
@@ -0,0 +1,43 @@
+package respwriter
+
+import "time"
+
+// Clock is the source of time used for request deadlines, latency
+// measurements, caches and cookies. It allows tests to advance time
+// deterministically instead of sleeping (see respwritertest.FakeClock).
+// Implementations must be safe for concurrent use.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc waits for the duration to elapse and then calls f in its own
+	// goroutine, like time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by Clock.AfterFunc, like time.Timer.
+type Timer interface {
+	// Stop prevents the timer from firing. It returns false if the timer
+	// already fired or was stopped.
+	Stop() bool
+
+	// Reset changes the timer to fire after the duration. It returns true if
+	// the timer was active.
+	Reset(d time.Duration) bool
+}
+
+// realClock is the Clock backed by the time package, it's the default.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// wallTime converts t, a time of the clock, to the wall clock. It's used for
+// deadlines of network connections, which always follow the wall clock.
+func wallTime(c Clock, t time.Time) time.Time {
+	if _, ok := c.(realClock); ok {
+		return t
+	}
+	return time.Now().Add(t.Sub(c.Now()))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// outcome is the outcome of a query.
+type outcome int
+
+const (
+	// outcomeAnswered means a response was received within the timeout.
+	outcomeAnswered outcome = iota
+
+	// outcomeTimedOut means no response was received within the timeout.
+	outcomeTimedOut
+
+	// outcomeDropped means the server closed the connection before it
+	// responded.
+	outcomeDropped
+
+	// outcomeFailed means the query couldn't be sent.
+	outcomeFailed
+)
+
+// result is the result of a query.
+type result struct {
+	outcome outcome
+	rcode   int
+	latency time.Duration
+}
+
+// conn is a connection (or UDP socket) to the server, shared by concurrent
+// queries. A reader goroutine matches the responses to the queries by ID, so
+// queries are pipelined over TCP and responses arriving after their query
+// timed out are counted as late. A closed connection is redialed by the next
+// query.
+type conn struct {
+	network string
+	addr    string
+	timeout time.Duration
+	// onLate is called for every late response.
+	onLate func()
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	c       *dns.Conn
+	nextID  uint16
+	pending map[uint16]chan *dns.Msg
+	// expired are the IDs of the queries which timed out, whose responses
+	// are late.
+	expired map[uint16]struct{}
+}
+
+func newConn(network, addr string, timeout time.Duration, onLate func()) *conn {
+	return &conn{
+		network: network,
+		addr:    addr,
+		timeout: timeout,
+		onLate:  onLate,
+		pending: map[uint16]chan *dns.Msg{},
+		expired: map[uint16]struct{}{},
+	}
+}
+
+// exchange sends the query, with a new ID, and waits for its response.
+func (c *conn) exchange(m *dns.Msg) result {
+	ch := make(chan *dns.Msg, 1)
+	dc, id, err := c.register(ch)
+	if err != nil {
+		return result{outcome: outcomeFailed}
+	}
+	m.Id = id
+
+	start := time.Now()
+	c.writeMu.Lock()
+	_ = dc.SetWriteDeadline(start.Add(c.timeout))
+	err = dc.WriteMsg(m)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		c.closeConn(dc)
+		return result{outcome: outcomeFailed}
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case r, ok := <-ch:
+		return c.received(r, ok, start)
+	case <-timer.C:
+		c.mu.Lock()
+		_, stillPending := c.pending[id]
+		if stillPending {
+			delete(c.pending, id)
+			c.expired[id] = struct{}{}
+		}
+		c.mu.Unlock()
+		if !stillPending {
+			// the response (or the connection's close) raced the timer.
+			r, ok := <-ch
+			return c.received(r, ok, start)
+		}
+		return result{outcome: outcomeTimedOut, latency: c.timeout}
+	}
+}
+
+func (c *conn) received(r *dns.Msg, ok bool, start time.Time) result {
+	if !ok {
+		return result{outcome: outcomeDropped, latency: time.Since(start)}
+	}
+	return result{outcome: outcomeAnswered, rcode: r.Rcode, latency: time.Since(start)}
+}
+
+// register dials the connection when needed and registers the channel of a
+// query under a free ID.
+func (c *conn) register(ch chan *dns.Msg) (*dns.Conn, uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c == nil {
+		dc, err := dns.DialTimeout(c.network, c.addr, c.timeout)
+		if err != nil {
+			return nil, 0, err
+		}
+		c.c = dc
+		go c.read(dc)
+	}
+	for i := 0; i <= 0xffff; i++ {
+		c.nextID++
+		if _, ok := c.pending[c.nextID]; ok {
+			continue
+		}
+		delete(c.expired, c.nextID)
+		c.pending[c.nextID] = ch
+		return c.c, c.nextID, nil
+	}
+	return nil, 0, errors.New("no free query ID")
+}
+
+// read delivers the responses read from the connection until it's closed.
+func (c *conn) read(dc *dns.Conn) {
+	defer c.closeConn(dc)
+	for {
+		r, err := dc.ReadMsg()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// a malformed message, skip it.
+			continue
+		}
+		c.mu.Lock()
+		if ch, ok := c.pending[r.Id]; ok {
+			delete(c.pending, r.Id)
+			ch <- r
+		} else if _, ok := c.expired[r.Id]; ok {
+			delete(c.expired, r.Id)
+			if c.onLate != nil {
+				c.onLate()
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// closeConn closes the connection, unless it was already replaced, and drops
+// the queries waiting on it.
+func (c *conn) closeConn(dc *dns.Conn) {
+	_ = dc.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c != dc {
+		return
+	}
+	c.c = nil
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	clear(c.expired)
+}
+
+// close closes the connection.
+func (c *conn) close() {
+	c.mu.Lock()
+	dc := c.c
+	c.mu.Unlock()
+	if dc != nil {
+		c.closeConn(dc)
+	}
+}
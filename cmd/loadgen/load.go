@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// loadConfig is the configuration of the load.
+type loadConfig struct {
+	addr        string
+	network     string
+	qps         float64
+	duration    time.Duration
+	timeout     time.Duration
+	conns       int
+	maxInFlight int
+}
+
+// runLoad sends the queries, in order and repeatedly, at the target rate until
+// the duration elapses or ctx is done, then waits for the queries in flight
+// (and, when queries timed out, for their late responses for another timeout)
+// and reports the results.
+//
+// The load is open loop: queries are sent when they're due whether or not the
+// server keeps up, so a slow server shows up as timeouts rather than as a lower
+// rate. Queries due while max-inflight queries await a response are skipped.
+func runLoad(ctx context.Context, cfg loadConfig, queries []*dns.Msg) (*report, error) {
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no queries to send")
+	}
+	var late atomic.Int64
+	conns := make([]*conn, cfg.conns)
+	for i := range conns {
+		conns[i] = newConn(cfg.network, cfg.addr, cfg.timeout, func() { late.Add(1) })
+	}
+	defer func() {
+		for _, c := range conns {
+			c.close()
+		}
+	}()
+
+	loadCtx, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		inFlight = make(chan struct{}, cfg.maxInFlight)
+		stats    = newStats()
+		start    = time.Now()
+		skipped  int
+		sent     int
+	)
+	for i := 0; ; i++ {
+		due := start.Add(time.Duration(float64(i) * float64(time.Second) / cfg.qps))
+		if !sleepUntil(loadCtx, due) {
+			break
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			skipped++
+			continue
+		}
+		sent++
+		q := queries[i%len(queries)].Copy()
+		c := conns[i%len(conns)]
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			stats.add(c.exchange(q))
+		}()
+	}
+	elapsed := time.Since(start)
+	wg.Wait()
+
+	rep := stats.report()
+	if rep.Timeouts > 0 {
+		sleepUntil(ctx, time.Now().Add(cfg.timeout))
+	}
+	rep.Network = cfg.network
+	rep.Addr = cfg.addr
+	rep.TargetQPS = cfg.qps
+	rep.Elapsed = elapsed
+	rep.Sent = sent
+	rep.Skipped = skipped
+	rep.Late = int(late.Load())
+	if elapsed > 0 {
+		rep.AchievedQPS = float64(sent) / elapsed.Seconds()
+	}
+	return rep, nil
+}
+
+// sleepUntil waits until t, it returns false when the context is done first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return ctx.Err() == nil
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// stats accumulates the results of the queries.
+type stats struct {
+	mu        sync.Mutex
+	latencies latencies
+	rcodes    map[int]int
+	timeouts  int
+	dropped   int
+	failed    int
+}
+
+func newStats() *stats {
+	return &stats{rcodes: map[int]int{}}
+}
+
+func (s *stats) add(r result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.outcome {
+	case outcomeAnswered:
+		s.rcodes[r.rcode]++
+		s.latencies = append(s.latencies, r.latency)
+	case outcomeTimedOut:
+		s.timeouts++
+	case outcomeDropped:
+		s.dropped++
+	case outcomeFailed:
+		s.failed++
+	}
+}
+
+func (s *stats) report() *report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rep := &report{
+		Rcodes:   map[string]int{},
+		Timeouts: s.timeouts,
+		Dropped:  s.dropped,
+		Errors:   s.failed,
+		Latency:  s.latencies.summary(),
+	}
+	for rcode, n := range s.rcodes {
+		rep.Answered += n
+		rep.Rcodes[rcodeString(rcode)] = n
+	}
+	return rep
+}
+
+func rcodeString(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// latencies are latency samples.
+type latencies []time.Duration
+
+// latencySummary summarizes latency samples.
+type latencySummary struct {
+	Count int           `json:"count"`
+	Mean  time.Duration `json:"mean_ns"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	P999  time.Duration `json:"p999_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+// summary returns the summary of the samples, which are sorted in place.
+func (l latencies) summary() latencySummary {
+	if len(l) == 0 {
+		return latencySummary{}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	var total time.Duration
+	for _, d := range l {
+		total += d
+	}
+	return latencySummary{
+		Count: len(l),
+		Mean:  total / time.Duration(len(l)),
+		P50:   l.percentile(50),
+		P90:   l.percentile(90),
+		P99:   l.percentile(99),
+		P999:  l.percentile(99.9),
+		Max:   l[len(l)-1],
+	}
+}
+
+// percentile returns the p-th percentile of the sorted samples, with the
+// nearest-rank method.
+func (l latencies) percentile(p float64) time.Duration {
+	rank := int(p/100*float64(len(l)) + 0.999999)
+	return l[min(max(rank, 1), len(l))-1]
+}
+
+// report is the report of a run.
+type report struct {
+	Network     string        `json:"network"`
+	Addr        string        `json:"addr"`
+	TargetQPS   float64       `json:"target_qps"`
+	AchievedQPS float64       `json:"achieved_qps"`
+	Elapsed     time.Duration `json:"elapsed_ns"`
+
+	// Sent is the number of queries sent, and Skipped the number of queries
+	// not sent because too many were in flight.
+	Sent    int `json:"sent"`
+	Skipped int `json:"skipped"`
+
+	// Answered is the number of queries answered within the timeout, by
+	// rcode in Rcodes.
+	Answered int            `json:"answered"`
+	Rcodes   map[string]int `json:"rcodes"`
+
+	// Timeouts is the number of queries which weren't answered within the
+	// timeout, Late the number of those whose response arrived afterwards.
+	Timeouts int `json:"timeouts"`
+	Late     int `json:"late"`
+
+	// Dropped is the number of queries whose connection was closed by the
+	// server before it responded, and Errors the number of queries which
+	// couldn't be sent.
+	Dropped int `json:"dropped"`
+	Errors  int `json:"errors"`
+
+	// Latency summarizes the latency of the answered queries.
+	Latency latencySummary `json:"latency"`
+
+	// Server is the report of the embedded server, when there's one.
+	Server *serverReport `json:"server,omitempty"`
+}
+
+// ServfailRate returns the portion of the queries sent answered with SERVFAIL.
+func (r *report) ServfailRate() float64 {
+	return rate(r.Rcodes[dns.RcodeToString[dns.RcodeServerFailure]], r.Sent)
+}
+
+// TimeoutRate returns the portion of the queries sent which timed out.
+func (r *report) TimeoutRate() float64 {
+	return rate(r.Timeouts, r.Sent)
+}
+
+// DropRate returns the portion of the queries sent which were never answered:
+// dropped, or timed out without a late response.
+func (r *report) DropRate() float64 {
+	return rate(r.Dropped+r.Timeouts-r.Late, r.Sent)
+}
+
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+func (r *report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		*report
+		ServfailRate float64 `json:"servfail_rate"`
+		TimeoutRate  float64 `json:"timeout_rate"`
+		DropRate     float64 `json:"drop_rate"`
+	}{r, r.ServfailRate(), r.TimeoutRate(), r.DropRate()})
+}
+
+func (r *report) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "target\t%s %s\n", r.Network, r.Addr)
+	fmt.Fprintf(tw, "rate\t%.1f qps (target %.1f) for %s\n", r.AchievedQPS, r.TargetQPS, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(tw, "sent\t%d (%d skipped, %d errors)\n", r.Sent, r.Skipped, r.Errors)
+	fmt.Fprintf(tw, "answered\t%d\n", r.Answered)
+	rcodes := make([]string, 0, len(r.Rcodes))
+	for rcode := range r.Rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Strings(rcodes)
+	for _, rcode := range rcodes {
+		fmt.Fprintf(tw, "  %s\t%d (%.2f%%)\n", rcode, r.Rcodes[rcode], 100*rate(r.Rcodes[rcode], r.Sent))
+	}
+	fmt.Fprintf(tw, "timeouts\t%d (%.2f%%, %d late responses)\n", r.Timeouts, 100*r.TimeoutRate(), r.Late)
+	fmt.Fprintf(tw, "dropped\t%d (%.2f%% never answered)\n", r.Dropped, 100*r.DropRate())
+	writeLatency(tw, "latency", r.Latency)
+	if r.Server != nil {
+		fmt.Fprintf(tw, "server timeouts\t%d (timeout %s, policy %s)\n", r.Server.Timeouts, r.Server.Timeout, r.Server.Policy)
+		writeLatency(tw, "server duration", r.Server.Duration)
+	}
+	return tw.Flush()
+}
+
+func writeLatency(w io.Writer, name string, l latencySummary) {
+	fmt.Fprintf(w, "%s\tmean %s  p50 %s  p90 %s  p99 %s  p99.9 %s  max %s\n", name, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencies_summary(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	var l latencies
+	for i := 1000; i > 0; i-- {
+		l = append(l, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(latencySummary{
+		Count: 1000,
+		Mean:  500500 * time.Microsecond,
+		P50:   500 * time.Millisecond,
+		P90:   900 * time.Millisecond,
+		P99:   990 * time.Millisecond,
+		P999:  999 * time.Millisecond,
+		Max:   time.Second,
+	}, l.summary())
+
+	assert.Equal(latencySummary{}, latencies(nil).summary())
+	one := latencies{time.Millisecond}.summary()
+	assert.Equal(time.Millisecond, one.P50)
+	assert.Equal(time.Millisecond, one.P999)
+}
+
+func TestRunLoad(t *testing.T) {
+	t.Parallel()
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+
+	// closedAddr returns the address of a closed tcp port.
+	closedAddr := func(t *testing.T) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := l.Addr().String()
+		require.NoError(t, l.Close())
+		return addr
+	}
+
+	tests := []struct {
+		name    string
+		network string
+		server  *serverConfig
+		addr    func(t *testing.T) string
+		timeout time.Duration
+		check   func(t *testing.T, rep *report)
+	}{
+		{
+			name:    "udp-answered",
+			network: "udp",
+			server:  &serverConfig{timeout: time.Second, delay: respwriter.FixedDelay(0)},
+			timeout: time.Second,
+			check: func(t *testing.T, rep *report) {
+				assert.Equal(t, rep.Sent, rep.Answered)
+				assert.Equal(t, rep.Sent, rep.Rcodes["NOERROR"])
+				assert.Equal(t, rep.Sent, rep.Latency.Count)
+				assert.Zero(t, rep.Timeouts)
+				assert.Positive(t, rep.Server.Duration.Count)
+			},
+		},
+		{
+			name:    "tcp-servfail",
+			network: "tcp",
+			// the server times out every request and replies with SERVFAIL.
+			server:  &serverConfig{timeout: 10 * time.Millisecond, delay: respwriter.FixedDelay(time.Second), policy: respwriter.TimeoutReplyAndClose},
+			timeout: time.Second,
+			check: func(t *testing.T, rep *report) {
+				assert.Equal(t, rep.Sent, rep.Rcodes["SERVFAIL"])
+				assert.Equal(t, 1.0, rep.ServfailRate())
+				assert.Equal(t, rep.Sent, rep.Server.Timeouts)
+			},
+		},
+		{
+			name:    "udp-late",
+			network: "udp",
+			// the server answers after the client gave up.
+			server:  &serverConfig{timeout: time.Second, delay: respwriter.FixedDelay(150 * time.Millisecond)},
+			timeout: 100 * time.Millisecond,
+			check: func(t *testing.T, rep *report) {
+				assert.Zero(t, rep.Answered)
+				assert.Equal(t, rep.Sent, rep.Timeouts)
+				assert.Equal(t, rep.Sent, rep.Late)
+				assert.Equal(t, 1.0, rep.TimeoutRate())
+				assert.Zero(t, rep.DropRate())
+			},
+		},
+		{
+			name:    "tcp-dropped",
+			network: "tcp",
+			// the server times out every request and closes the connection.
+			server:  &serverConfig{timeout: 10 * time.Millisecond, delay: respwriter.FixedDelay(time.Second), policy: respwriter.TimeoutCloseConn},
+			timeout: time.Second,
+			check: func(t *testing.T, rep *report) {
+				assert.Zero(t, rep.Answered)
+				assert.Zero(t, rep.Timeouts)
+				assert.Equal(t, rep.Sent, rep.Dropped)
+				assert.Equal(t, 1.0, rep.DropRate())
+			},
+		},
+		{
+			name:    "tcp-unreachable",
+			network: "tcp",
+			addr:    closedAddr,
+			timeout: time.Second,
+			check: func(t *testing.T, rep *report) {
+				assert.Equal(t, rep.Sent, rep.Errors)
+				assert.Zero(t, rep.Answered)
+			},
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+			cfg := loadConfig{
+				network:     tc.network,
+				qps:         50,
+				duration:    90 * time.Millisecond,
+				timeout:     tc.timeout,
+				conns:       2,
+				maxInFlight: 100,
+			}
+			var srv *embeddedServer
+			if tc.server != nil {
+				var err error
+				srv, err = startEmbedded(tc.network, *tc.server)
+				require.NoError(err)
+				defer srv.shutdown()
+				cfg.addr = srv.addr
+			} else {
+				cfg.addr = tc.addr(t)
+			}
+			rep, err := runLoad(context.Background(), cfg, []*dns.Msg{query})
+			require.NoError(err)
+			if srv != nil {
+				rep.Server = srv.report()
+			}
+			require.Equal(5, rep.Sent)
+			require.Zero(rep.Skipped)
+			tc.check(t, rep)
+		})
+	}
+	t.Run("skipped", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		srv, err := startEmbedded("udp", serverConfig{timeout: time.Second, delay: respwriter.FixedDelay(time.Second)})
+		require.NoError(err)
+		defer srv.shutdown()
+		// a single query is in flight at a time, the others are skipped.
+		rep, err := runLoad(context.Background(), loadConfig{
+			addr:        srv.addr,
+			network:     "udp",
+			qps:         50,
+			duration:    90 * time.Millisecond,
+			timeout:     200 * time.Millisecond,
+			conns:       1,
+			maxInFlight: 1,
+		}, []*dns.Msg{query})
+		require.NoError(err)
+		assert.Equal(1, rep.Sent)
+		assert.Equal(4, rep.Skipped)
+		assert.Equal(1, rep.Timeouts)
+	})
+}
@@ -0,0 +1,156 @@
+// Command loadgen sends DNS queries to a server at a target rate, over UDP or
+// TCP, and reports the latency percentiles, the rcode (SERVFAIL) and timeout
+// rates and the dropped responses, to measure how a server and its timeouts
+// behave under stress.
+//
+// The queries are read from a qname list (-qnames, a "name [type]" per line)
+// or from recorded traffic (-replay, a JSONL file written by
+// respwriter.NewJSONLSink or a pcap file), and are sent in order, repeatedly,
+// at the target rate regardless of how fast the server answers.
+//
+// With -embedded, loadgen starts a local server whose handler answers after a
+// synthetic delay (-delay) and is wrapped by respwriter.NewHandlerFunc, so the
+// wrapper itself is benchmarked, and reports the server's timeouts and request
+// durations as well.
+//
+// Usage:
+//
+//	loadgen -server 127.0.0.1:53 -net tcp -qnames names.txt -qps 500
+//	loadgen -server 127.0.0.1:53 -replay traffic.pcap -duration 1m
+//	loadgen -embedded -delay exp:20ms -server-timeout 50ms -qps 5000
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "loadgen: %s\n", err)
+		}
+		os.Exit(2)
+	}
+}
+
+// config is the configuration of a run, from the command line.
+type config struct {
+	load loadConfig
+
+	qnames string
+	replay string
+	json   bool
+
+	embedded bool
+	server   serverConfig
+}
+
+// run parses the arguments, runs the load and writes the report to stdout.
+// Interrupting the run (cancelling ctx) stops the load early, and the report
+// covers the queries sent until then.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	cfg, err := parseFlags(args, stderr)
+	if err != nil {
+		return err
+	}
+	queries, err := loadQueries(cfg.qnames, cfg.replay)
+	if err != nil {
+		return err
+	}
+
+	var srv *embeddedServer
+	if cfg.embedded {
+		if srv, err = startEmbedded(cfg.load.network, cfg.server); err != nil {
+			return err
+		}
+		defer srv.shutdown()
+		cfg.load.addr = srv.addr
+	}
+
+	rep, err := runLoad(ctx, cfg.load, queries)
+	if err != nil {
+		return err
+	}
+	if srv != nil {
+		rep.Server = srv.report()
+	}
+	if cfg.json {
+		return rep.writeJSON(stdout)
+	}
+	return rep.writeText(stdout)
+}
+
+func parseFlags(args []string, stderr io.Writer) (config, error) {
+	var (
+		cfg    config
+		delay  string
+		policy string
+	)
+	fs := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&cfg.load.addr, "server", "", "address of the server to load, host:port")
+	fs.StringVar(&cfg.load.network, "net", "udp", "transport of the queries: udp or tcp")
+	fs.Float64Var(&cfg.load.qps, "qps", 100, "target rate of queries per second")
+	fs.DurationVar(&cfg.load.duration, "duration", 10*time.Second, "duration of the load")
+	fs.DurationVar(&cfg.load.timeout, "timeout", 2*time.Second, "how long to wait for a response")
+	fs.IntVar(&cfg.load.conns, "conns", 8, "number of connections (or UDP sockets) the queries are spread over")
+	fs.IntVar(&cfg.load.maxInFlight, "max-inflight", 10000, "maximum number of queries awaiting a response, more are skipped")
+	fs.StringVar(&cfg.qnames, "qnames", "", "file of the queries, a \"name [type]\" per line (default \"example.com. A\")")
+	fs.StringVar(&cfg.replay, "replay", "", "file of recorded traffic whose requests are sent, JSONL or pcap")
+	fs.BoolVar(&cfg.json, "json", false, "write the report as JSON")
+	fs.BoolVar(&cfg.embedded, "embedded", false, "start an embedded server with a synthetic-delay handler and load it")
+	fs.StringVar(&delay, "delay", "fixed:0s", "delay of the embedded handler: fixed:D, uniform:MIN-MAX, normal:MEAN,STDDEV or exp:MEAN")
+	fs.DurationVar(&cfg.server.timeout, "server-timeout", 100*time.Millisecond, "request timeout of the embedded server's NewHandlerFunc")
+	fs.StringVar(&policy, "policy", respwriter.TimeoutKeepConn.String(), "timeout policy of the embedded server over tcp: keep, close or reply-and-close")
+	fs.Int64Var(&cfg.server.seed, "seed", 0, "seed of the embedded handler's delays (default random)")
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+	if fs.NArg() > 0 {
+		return config{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	var err error
+	switch {
+	case cfg.embedded == (cfg.load.addr != ""):
+		return config{}, errors.New("exactly one of -server and -embedded is required")
+	case cfg.qnames != "" && cfg.replay != "":
+		return config{}, errors.New("-qnames and -replay are mutually exclusive")
+	case cfg.load.network != "udp" && cfg.load.network != "tcp":
+		return config{}, fmt.Errorf("invalid -net %q", cfg.load.network)
+	case cfg.load.qps <= 0:
+		return config{}, errors.New("-qps must be positive")
+	case cfg.load.duration <= 0 || cfg.load.timeout <= 0 || cfg.server.timeout <= 0:
+		return config{}, errors.New("-duration, -timeout and -server-timeout must be positive")
+	case cfg.load.conns <= 0 || cfg.load.maxInFlight <= 0:
+		return config{}, errors.New("-conns and -max-inflight must be positive")
+	}
+	if cfg.server.delay, err = parseDelay(delay); err != nil {
+		return config{}, err
+	}
+	if cfg.server.policy, err = parsePolicy(policy); err != nil {
+		return config{}, err
+	}
+	return cfg, nil
+}
+
+func parsePolicy(s string) (respwriter.TimeoutPolicy, error) {
+	for _, p := range []respwriter.TimeoutPolicy{respwriter.TimeoutKeepConn, respwriter.TimeoutCloseConn, respwriter.TimeoutReplyAndClose} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid -policy %q", s)
+}
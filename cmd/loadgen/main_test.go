@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name            string
+		args            []string
+		wantErrContains string
+	}{
+		{name: "no-server", args: nil, wantErrContains: "exactly one of -server and -embedded"},
+		{name: "server-and-embedded", args: []string{"-server", "127.0.0.1:53", "-embedded"}, wantErrContains: "exactly one of"},
+		{name: "qnames-and-replay", args: []string{"-embedded", "-qnames", "a", "-replay", "b"}, wantErrContains: "mutually exclusive"},
+		{name: "invalid-net", args: []string{"-embedded", "-net", "tcp-tls"}, wantErrContains: "invalid -net"},
+		{name: "invalid-qps", args: []string{"-embedded", "-qps", "0"}, wantErrContains: "-qps must be positive"},
+		{name: "invalid-duration", args: []string{"-embedded", "-duration", "-1s"}, wantErrContains: "must be positive"},
+		{name: "invalid-conns", args: []string{"-embedded", "-conns", "0"}, wantErrContains: "must be positive"},
+		{name: "invalid-delay", args: []string{"-embedded", "-delay", "fixed"}, wantErrContains: "invalid -delay"},
+		{name: "invalid-policy", args: []string{"-embedded", "-policy", "drop"}, wantErrContains: "invalid -policy"},
+		{name: "unexpected-args", args: []string{"-embedded", "extra"}, wantErrContains: "unexpected arguments: extra"},
+		{name: "unknown-flag", args: []string{"-bogus"}, wantErrContains: "flag provided but not defined"},
+		{name: "missing-qnames", args: []string{"-embedded", "-qnames", "/nonexistent"}, wantErrContains: "no such file"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			var stdout, stderr bytes.Buffer
+			err := run(context.Background(), tc.args, &stdout, &stderr)
+			require.Error(err)
+			assert.Contains(err.Error(), tc.wantErrContains)
+			assert.Empty(stdout.String())
+		})
+	}
+	t.Run("embedded", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		var stdout, stderr bytes.Buffer
+		err := run(context.Background(), []string{"-embedded", "-net", "tcp", "-qps", "100", "-duration", "100ms", "-delay", "uniform:1ms-5ms", "-seed", "1", "-json"}, &stdout, &stderr)
+		require.NoError(err)
+		var got struct {
+			Network      string         `json:"network"`
+			Sent         int            `json:"sent"`
+			Rcodes       map[string]int `json:"rcodes"`
+			ServfailRate float64        `json:"servfail_rate"`
+			Server       struct {
+				Policy string `json:"policy"`
+			} `json:"server"`
+		}
+		require.NoError(json.Unmarshal(stdout.Bytes(), &got))
+		assert.Equal("tcp", got.Network)
+		assert.Positive(got.Sent)
+		assert.Equal(got.Sent, got.Rcodes["NOERROR"])
+		assert.Zero(got.ServfailRate)
+		assert.Equal("keep", got.Server.Policy)
+	})
+	t.Run("text", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		var stdout, stderr bytes.Buffer
+		err := run(context.Background(), []string{"-embedded", "-qps", "100", "-duration", "50ms"}, &stdout, &stderr)
+		require.NoError(err)
+		for _, want := range []string{"target", "udp 127.0.0.1:", "NOERROR", "timeouts", "dropped", "latency", "server timeouts", "server duration"} {
+			assert.Contains(stdout.String(), want)
+		}
+	})
+}
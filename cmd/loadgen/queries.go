@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/jimlambrt/respwriter/pcap"
+	"github.com/miekg/dns"
+)
+
+// pcapMagics are the first bytes of pcap files, in both byte orders and both
+// resolutions.
+var pcapMagics = [][]byte{
+	{0xd4, 0xc3, 0xb2, 0xa1},
+	{0xa1, 0xb2, 0xc3, 0xd4},
+	{0x4d, 0x3c, 0xb2, 0xa1},
+	{0xa1, 0xb2, 0x3c, 0x4d},
+}
+
+// loadQueries returns the queries of the qname list or of the recorded
+// traffic, or a single "example.com. A" query when neither is given.
+func loadQueries(qnames, replay string) ([]*dns.Msg, error) {
+	var (
+		queries []*dns.Msg
+		err     error
+	)
+	switch {
+	case qnames != "":
+		queries, err = readFile(qnames, parseQnames)
+	case replay != "":
+		queries, err = readFile(replay, parseReplay)
+	default:
+		queries, err = parseQnames(strings.NewReader("example.com. A"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, errors.New("no queries to send")
+	}
+	return queries, nil
+}
+
+func readFile(name string, parse func(io.Reader) ([]*dns.Msg, error)) ([]*dns.Msg, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	queries, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return queries, nil
+}
+
+// parseQnames parses a qname list, a "name [type]" per line. The type defaults
+// to A, and blank lines and lines starting with # are skipped.
+func parseQnames(r io.Reader) ([]*dns.Msg, error) {
+	var queries []*dns.Msg
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected \"name [type]\"", line)
+		}
+		name := dns.Fqdn(fields[0])
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("line %d: invalid name %q", line, fields[0])
+		}
+		qtype := dns.TypeA
+		if len(fields) == 2 {
+			var ok bool
+			if qtype, ok = dns.StringToType[strings.ToUpper(fields[1])]; !ok {
+				return nil, fmt.Errorf("line %d: unknown type %q", line, fields[1])
+			}
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		queries = append(queries, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return queries, nil
+}
+
+// parseReplay returns the requests of recorded traffic, a pcap file or a JSONL
+// file written by respwriter.NewJSONLSink.
+func parseReplay(r io.Reader) ([]*dns.Msg, error) {
+	br := bufio.NewReader(r)
+	var src respwriter.TrafficSource = respwriter.NewJSONLSource(br)
+	if magic, err := br.Peek(4); err == nil && isPcap(magic) {
+		if src, err = pcap.NewSource(br); err != nil {
+			return nil, err
+		}
+	}
+	var queries []*dns.Msg
+	for {
+		rec, err := src.Next()
+		switch {
+		case errors.Is(err, io.EOF):
+			return queries, nil
+		case err != nil:
+			return nil, err
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(rec.Request); err != nil {
+			return nil, fmt.Errorf("record %d: unable to unpack request: %w", len(queries), err)
+		}
+		queries = append(queries, m)
+	}
+}
+
+func isPcap(magic []byte) bool {
+	for _, m := range pcapMagics {
+		if bytes.Equal(magic, m) {
+			return true
+		}
+	}
+	return false
+}
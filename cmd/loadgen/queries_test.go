@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/jimlambrt/respwriter/pcap"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQnames(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name            string
+		input           string
+		wantQuestions   []dns.Question
+		wantErrContains string
+	}{
+		{
+			name:  "valid",
+			input: "# comment\nexample.com\n\nwww.example.com. aaaa\n  mx.example.com. MX  \n",
+			wantQuestions: []dns.Question{
+				{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				{Name: "www.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+				{Name: "mx.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET},
+			},
+		},
+		{
+			name:            "unknown-type",
+			input:           "example.com. BOGUS",
+			wantErrContains: "line 1: unknown type",
+		},
+		{
+			name:            "too-many-fields",
+			input:           "example.com.\nexample.com. A IN",
+			wantErrContains: "line 2: expected",
+		},
+		{
+			name:            "invalid-name",
+			input:           "example..com",
+			wantErrContains: "line 1: invalid name",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			queries, err := parseQnames(strings.NewReader(tc.input))
+			if tc.wantErrContains != "" {
+				require.Error(err)
+				assert.Contains(err.Error(), tc.wantErrContains)
+				return
+			}
+			require.NoError(err)
+			var got []dns.Question
+			for _, q := range queries {
+				got = append(got, q.Question...)
+			}
+			assert.Equal(tc.wantQuestions, got)
+		})
+	}
+}
+
+func TestLoadQueries(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	record := func(sink respwriter.TrafficSink, names ...string) {
+		for i, name := range names {
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeA)
+			b, err := m.Pack()
+			require.NoError(t, err)
+			require.NoError(t, sink.Record(respwriter.TrafficRecord{
+				Time:       time.Now(),
+				RemoteAddr: "192.0.2.7:5300",
+				Transport:  respwriter.TransportUDP,
+				Request:    b,
+				Latency:    time.Duration(i) * time.Millisecond,
+			}))
+		}
+	}
+
+	var jsonl bytes.Buffer
+	record(respwriter.NewJSONLSink(&jsonl), "a.example.", "b.example.")
+	jsonlFile := filepath.Join(dir, "traffic.jsonl")
+	require.NoError(t, os.WriteFile(jsonlFile, jsonl.Bytes(), 0o600))
+
+	var capture bytes.Buffer
+	sink, err := pcap.NewSink(&capture)
+	require.NoError(t, err)
+	record(sink, "c.example.", "d.example.")
+	pcapFile := filepath.Join(dir, "traffic.pcap")
+	require.NoError(t, os.WriteFile(pcapFile, capture.Bytes(), 0o600))
+
+	qnamesFile := filepath.Join(dir, "qnames.txt")
+	require.NoError(t, os.WriteFile(qnamesFile, []byte("e.example.\n"), 0o600))
+	emptyFile := filepath.Join(dir, "empty.txt")
+	require.NoError(t, os.WriteFile(emptyFile, nil, 0o600))
+
+	tests := []struct {
+		name            string
+		qnames          string
+		replay          string
+		wantNames       []string
+		wantErrContains string
+	}{
+		{name: "default", wantNames: []string{"example.com."}},
+		{name: "qnames", qnames: qnamesFile, wantNames: []string{"e.example."}},
+		{name: "jsonl", replay: jsonlFile, wantNames: []string{"a.example.", "b.example."}},
+		{name: "pcap", replay: pcapFile, wantNames: []string{"c.example.", "d.example."}},
+		{name: "empty", qnames: emptyFile, wantErrContains: "no queries"},
+		{name: "missing", replay: filepath.Join(dir, "missing"), wantErrContains: "no such file"},
+		{name: "invalid-replay", replay: qnamesFile, wantErrContains: qnamesFile},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			queries, err := loadQueries(tc.qnames, tc.replay)
+			if tc.wantErrContains != "" {
+				require.Error(err)
+				assert.Contains(err.Error(), tc.wantErrContains)
+				return
+			}
+			require.NoError(err)
+			var got []string
+			for _, q := range queries {
+				got = append(got, q.Question[0].Name)
+			}
+			assert.Equal(tc.wantNames, got)
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+)
+
+// serverConfig is the configuration of the embedded server.
+type serverConfig struct {
+	timeout time.Duration
+	policy  respwriter.TimeoutPolicy
+	delay   respwriter.Delay
+	seed    int64
+}
+
+// embeddedServer is a local server whose synthetic-delay handler is wrapped by
+// respwriter.NewHandlerFunc.
+type embeddedServer struct {
+	addr    string
+	cfg     serverConfig
+	server  *dns.Server
+	fin     chan error
+	metrics *serverMetrics
+}
+
+// startEmbedded starts an embedded server on a loopback port for the network.
+// Its handler answers every query with an A record after a delay sampled from
+// the configured distribution, via a respwriter.FaultInjector, so the delay is
+// bound by the request timeout.
+func startEmbedded(network string, cfg serverConfig) (*embeddedServer, error) {
+	metrics := &serverMetrics{}
+	injector, err := respwriter.NewFaultInjector(answer,
+		respwriter.WithFaultRules(respwriter.FaultRule{Probability: 1, Kind: respwriter.FaultDelay, Delay: cfg.delay}),
+		respwriter.WithFaultSeed(cfg.seed),
+	)
+	if err != nil {
+		return nil, err
+	}
+	handler, err := respwriter.NewHandlerFunc(cfg.timeout, injector.ServeDNS,
+		respwriter.WithTimeoutPolicy(cfg.policy),
+		respwriter.WithMetrics(metrics),
+		// a panicking handler mustn't take the load generator down with it.
+		respwriter.WithRecoverPanics(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &dns.Server{Net: network, Handler: handler}
+	switch network {
+	case "udp":
+		if server.PacketConn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			return nil, err
+		}
+	default:
+		if server.Listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return nil, err
+		}
+	}
+
+	var started sync.WaitGroup
+	started.Add(1)
+	server.NotifyStartedFunc = started.Done
+	s := &embeddedServer{cfg: cfg, server: server, fin: make(chan error, 1), metrics: metrics}
+	go func() {
+		s.fin <- server.ActivateAndServe()
+	}()
+	ready := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(ready)
+	}()
+	select {
+	case <-ready:
+	case err := <-s.fin:
+		return nil, fmt.Errorf("unable to start the embedded server: %w", err)
+	}
+	if server.Listener != nil {
+		s.addr = server.Listener.Addr().String()
+	} else {
+		s.addr = server.PacketConn.LocalAddr().String()
+	}
+	return s, nil
+}
+
+// shutdown shuts the server down and waits until it's done.
+func (s *embeddedServer) shutdown() {
+	_ = s.server.Shutdown()
+	<-s.fin
+}
+
+// report returns the report of the server.
+func (s *embeddedServer) report() *serverReport {
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+	return &serverReport{
+		Timeout:  s.cfg.timeout,
+		Policy:   s.cfg.policy.String(),
+		Timeouts: s.metrics.timeouts,
+		Duration: append(latencies(nil), s.metrics.durations...).summary(),
+	}
+}
+
+// serverReport is the report of the embedded server.
+type serverReport struct {
+	Timeout time.Duration `json:"timeout_ns"`
+	Policy  string        `json:"policy"`
+
+	// Timeouts is the number of requests which timed out before a response
+	// was written.
+	Timeouts int `json:"timeouts"`
+
+	// Duration summarizes how long NewHandlerFunc took to handle the
+	// requests.
+	Duration latencySummary `json:"duration"`
+}
+
+// answer answers the query with an A record.
+func answer(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeA {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	}
+	_ = w.WriteMsg(m)
+}
+
+// serverMetrics collects the timeouts and request durations of the embedded
+// server.
+type serverMetrics struct {
+	mu        sync.Mutex
+	timeouts  int
+	durations latencies
+}
+
+func (m *serverMetrics) IncCounter(name string, _ map[string]string) {
+	if name != respwriter.MetricTimeouts {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeouts++
+}
+
+func (m *serverMetrics) ObserveDuration(name string, d time.Duration, _ map[string]string) {
+	if name != respwriter.MetricRequestDuration {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations = append(m.durations, d)
+}
+
+// parseDelay parses a delay distribution: fixed:D, uniform:MIN-MAX,
+// normal:MEAN,STDDEV or exp:MEAN.
+func parseDelay(s string) (respwriter.Delay, error) {
+	kind, params, _ := strings.Cut(s, ":")
+	durations := func(sep string, n int) ([]time.Duration, error) {
+		parts := strings.Split(params, sep)
+		if len(parts) != n {
+			return nil, fmt.Errorf("invalid -delay %q", s)
+		}
+		ds := make([]time.Duration, n)
+		for i, p := range parts {
+			d, err := time.ParseDuration(strings.TrimSpace(p))
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid -delay %q", s)
+			}
+			ds[i] = d
+		}
+		return ds, nil
+	}
+	switch kind {
+	case "fixed":
+		ds, err := durations(",", 1)
+		if err != nil {
+			return nil, err
+		}
+		return respwriter.FixedDelay(ds[0]), nil
+	case "uniform":
+		ds, err := durations("-", 2)
+		if err != nil {
+			return nil, err
+		}
+		return respwriter.UniformDelay(ds[0], ds[1]), nil
+	case "normal":
+		ds, err := durations(",", 2)
+		if err != nil {
+			return nil, err
+		}
+		return respwriter.NormalDelay(ds[0], ds[1]), nil
+	case "exp":
+		ds, err := durations(",", 1)
+		if err != nil {
+			return nil, err
+		}
+		return respwriter.ExponentialDelay(ds[0]), nil
+	default:
+		return nil, fmt.Errorf("invalid -delay %q", s)
+	}
+}
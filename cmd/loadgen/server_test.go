@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDelay(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		spec    string
+		wantMin time.Duration
+		wantMax time.Duration
+		wantErr bool
+	}{
+		{name: "fixed", spec: "fixed:10ms", wantMin: 10 * time.Millisecond, wantMax: 10 * time.Millisecond},
+		{name: "uniform", spec: "uniform:5ms-20ms", wantMin: 5 * time.Millisecond, wantMax: 20 * time.Millisecond},
+		{name: "normal", spec: "normal:20ms, 0s", wantMin: 20 * time.Millisecond, wantMax: 20 * time.Millisecond},
+		{name: "exp", spec: "exp:1ms", wantMin: 0, wantMax: time.Second},
+		{name: "missing-param", spec: "uniform:5ms", wantErr: true},
+		{name: "negative", spec: "fixed:-1ms", wantErr: true},
+		{name: "invalid-duration", spec: "exp:soon", wantErr: true},
+		{name: "unknown-kind", spec: "pareto:1ms", wantErr: true},
+		{name: "empty", spec: "", wantErr: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			d, err := parseDelay(tc.spec)
+			if tc.wantErr {
+				require.Error(err)
+				assert.Contains(err.Error(), "invalid -delay")
+				return
+			}
+			require.NoError(err)
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 100; i++ {
+				got := d.Sample(r)
+				assert.GreaterOrEqual(got, tc.wantMin)
+				assert.LessOrEqual(got, tc.wantMax)
+			}
+		})
+	}
+}
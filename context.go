@@ -0,0 +1,132 @@
+package respwriter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// requestIDLen is the number of random bytes in a generated request ID.
+	requestIDLen = 8
+
+	// maxRequestIDLen is the max length of a request ID received in an EDNS0
+	// local option.
+	maxRequestIDLen = 64
+)
+
+// respWriterKey is the context key for the RespWriter of a request.
+type respWriterKey struct{}
+
+// FromContext returns the RespWriter stored in the request context by
+// NewHandlerFunc, so code which only has the context can reach the writer.
+func FromContext(ctx context.Context) (*RespWriter, bool) {
+	if isNil(ctx) {
+		return nil, false
+	}
+	rw, ok := ctx.Value(respWriterKey{}).(*RespWriter)
+	return rw, ok && rw != nil
+}
+
+// QuestionFromContext returns the first question of the request for the
+// context.
+func QuestionFromContext(ctx context.Context) (dns.Question, bool) {
+	rw, ok := FromContext(ctx)
+	if !ok {
+		return dns.Question{}, false
+	}
+	r := rw.Request()
+	if r == nil || len(r.Question) == 0 {
+		return dns.Question{}, false
+	}
+	return r.Question[0], true
+}
+
+// ClientAddrFromContext returns the client address of the request for the
+// context.
+func ClientAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	rw, ok := FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	addr := rw.RemoteAddr()
+	return addr, !isNil(addr)
+}
+
+// TransportFromContext returns the transport of the request for the context,
+// which is TransportUnknown when the context doesn't belong to a request.
+func TransportFromContext(ctx context.Context) Transport {
+	rw, ok := FromContext(ctx)
+	if !ok {
+		return TransportUnknown
+	}
+	return rw.Transport()
+}
+
+// RequestIDFromContext returns the request ID of the request for the context.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	rw, ok := FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	id := rw.RequestID()
+	return id, id != ""
+}
+
+// BudgetFromContext returns the time left until the context's deadline, which
+// is zero once it has expired. It returns false when the context has no
+// deadline.
+func BudgetFromContext(ctx context.Context) (time.Duration, bool) {
+	if isNil(ctx) {
+		return 0, false
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	now := time.Now()
+	if rw, ok := FromContext(ctx); ok {
+		now = rw.clock.Now()
+	}
+	budget := deadline.Sub(now)
+	if budget < 0 {
+		budget = 0
+	}
+	return budget, true
+}
+
+// requestIDOf returns the request ID received in the EDNS0 local option with
+// the given code, so requests can be correlated across hops, or an empty
+// string when there's none. IDs which aren't printable ASCII are hex encoded.
+func requestIDOf(r *dns.Msg, code uint16) string {
+	if code == 0 || r == nil || r.IsEdns0() == nil {
+		return ""
+	}
+	for _, o := range r.IsEdns0().Option {
+		l, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || l.Code != code || len(l.Data) == 0 || len(l.Data) > maxRequestIDLen {
+			continue
+		}
+		for _, b := range l.Data {
+			if b < 0x21 || b > 0x7e {
+				return hex.EncodeToString(l.Data)
+			}
+		}
+		return string(l.Data)
+	}
+	return ""
+}
+
+// newRequestID returns a new random request ID, or an empty string if one
+// can't be generated.
+func newRequestID() string {
+	b := make([]byte, requestIDLen)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
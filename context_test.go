@@ -0,0 +1,99 @@
+package respwriter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromContext(t *testing.T) {
+	t.Parallel()
+
+	t.Run("request-context", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		var called bool
+		h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+			called = true
+			ctx := w.(*RespWriter).RequestContext()
+
+			rw, ok := FromContext(ctx)
+			require.True(ok)
+			assert.Same(w, rw)
+
+			q, ok := QuestionFromContext(ctx)
+			require.True(ok)
+			assert.Equal(r.Question[0], q)
+
+			addr, ok := ClientAddrFromContext(ctx)
+			require.True(ok)
+			assert.Equal(w.RemoteAddr(), addr)
+
+			assert.Equal(TransportTCP, TransportFromContext(ctx))
+
+			id, ok := RequestIDFromContext(ctx)
+			require.True(ok)
+			assert.Len(id, 2*requestIDLen)
+			assert.Equal(rw.RequestID(), id)
+
+			budget, ok := BudgetFromContext(ctx)
+			require.True(ok)
+			assert.Greater(budget, time.Duration(0))
+			assert.LessOrEqual(budget, time.Second)
+
+			// derived contexts still carry the values
+			derived, cancel := context.WithCancel(ctx)
+			defer cancel()
+			rw, ok = FromContext(derived)
+			require.True(ok)
+			assert.Same(w, rw)
+		})
+		require.NoError(err)
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		h(new(mockTCPResponseWriter), r)
+		assert.True(called)
+	})
+	t.Run("unique-request-ids", func(t *testing.T) {
+		t.Parallel()
+		ids := map[string]bool{}
+		h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+			ids[w.(*RespWriter).RequestID()] = true
+		})
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			r := new(dns.Msg)
+			r.SetQuestion("go.dev.", dns.TypeA)
+			h(new(mockTCPResponseWriter), r)
+		}
+		assert.Len(t, ids, 10)
+	})
+	t.Run("no-request", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		ctx := context.Background()
+		_, ok := FromContext(ctx)
+		assert.False(ok)
+		_, ok = FromContext(nil)
+		assert.False(ok)
+		_, ok = QuestionFromContext(ctx)
+		assert.False(ok)
+		_, ok = ClientAddrFromContext(ctx)
+		assert.False(ok)
+		assert.Equal(TransportUnknown, TransportFromContext(ctx))
+		_, ok = RequestIDFromContext(ctx)
+		assert.False(ok)
+		_, ok = BudgetFromContext(ctx)
+		assert.False(ok)
+
+		expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+		defer cancel()
+		budget, ok := BudgetFromContext(expired)
+		assert.True(ok)
+		assert.Zero(budget)
+	})
+}
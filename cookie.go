@@ -0,0 +1,337 @@
+package respwriter
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultCookieRotation = 24 * time.Hour
+
+	// cookieSecretLen is the length of the SipHash-2-4 key used to generate
+	// server cookies.
+	cookieSecretLen = 16
+
+	clientCookieLen    = 8
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+
+	// serverCookieVersion and serverCookieLen describe the interoperable
+	// server cookie defined by RFC 9018.
+	serverCookieVersion = 1
+	serverCookieLen     = 16
+
+	// cookieMaxAge, cookieRefreshAge and cookieMaxSkew are the timestamp
+	// limits recommended by RFC 9018 section 4.3.
+	cookieMaxAge     = time.Hour
+	cookieRefreshAge = 30 * time.Minute
+	cookieMaxSkew    = 5 * time.Minute
+)
+
+// CookieStatus is the result of validating the DNS cookies (RFC 7873) of a
+// request.
+type CookieStatus int
+
+const (
+	// CookieNone means the request had no cookies or they weren't checked.
+	CookieNone CookieStatus = iota
+
+	// CookieClientOnly means the request had a client cookie but no server
+	// cookie.
+	CookieClientOnly
+
+	// CookieInvalid means the request's server cookie isn't valid for the
+	// client cookie and address, or it has expired.
+	CookieInvalid
+
+	// CookieValid means the request's server cookie is valid, which means the
+	// client's source address can be trusted.
+	CookieValid
+)
+
+// String returns a string representation of the cookie status.
+func (s CookieStatus) String() string {
+	switch s {
+	case CookieClientOnly:
+		return "client-only"
+	case CookieInvalid:
+		return "invalid"
+	case CookieValid:
+		return "valid"
+	default:
+		return "none"
+	}
+}
+
+// Cookies is a dns.Handler which implements server side DNS cookies (RFC
+// 7873) for the handler it wraps. Server cookies are generated using SipHash-2-4
+// as specified by RFC 9018, with a secret which is rotated periodically.
+//
+// The result of validating the request's cookies is available to the wrapped
+// handler via RespWriter.CookieStatus and the server cookie is attached to the
+// OPT RR of the response written via the RespWriter.
+type Cookies struct {
+	handler  dns.HandlerFunc
+	logger   *slog.Logger
+	require  bool
+	rotation time.Duration
+
+	// now returns the current time, it's the Now of the clock.
+	now func() time.Time
+
+	mu         sync.Mutex
+	secret     [cookieSecretLen]byte
+	prevSecret *[cookieSecretLen]byte
+	rotated    time.Time
+}
+
+// NewCookies returns a new Cookies which wraps the given handler. Options
+// supported: WithLogger, WithCookieSecret, WithCookieRotation,
+// WithRequireCookies, WithClock
+func NewCookies(h dns.HandlerFunc, opt ...Option) (*Cookies, error) {
+	const op = "respwriter.NewCookies"
+	opts := getGeneralOpts(opt...)
+	switch {
+	case isNil(h):
+		return nil, fmt.Errorf("%s: nil handler: %w", op, ErrInvalidParameter)
+	case opts.withCookieSecret != nil && len(opts.withCookieSecret) != cookieSecretLen:
+		return nil, fmt.Errorf("%s: cookie secret must be %d bytes: %w", op, cookieSecretLen, ErrInvalidParameter)
+	case opts.withCookieRotation < 0:
+		return nil, fmt.Errorf("%s: invalid cookie rotation: %w", op, ErrInvalidParameter)
+	}
+	c := &Cookies{
+		handler:  h,
+		logger:   opts.withLogger,
+		require:  opts.withRequireCookies,
+		rotation: opts.withCookieRotation,
+		now:      opts.withClock.Now,
+	}
+	switch {
+	case opts.withCookieSecret != nil:
+		copy(c.secret[:], opts.withCookieSecret)
+	default:
+		if err := randomSecret(&c.secret); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	c.rotated = c.now()
+	return c, nil
+}
+
+// RotateSecret replaces the secret used to generate server cookies. Cookies
+// generated with the previous secret are accepted until the next rotation.
+func (c *Cookies) RotateSecret(secret []byte) error {
+	const op = "respwriter.(Cookies).RotateSecret"
+	if len(secret) != cookieSecretLen {
+		return fmt.Errorf("%s: cookie secret must be %d bytes: %w", op, cookieSecretLen, ErrInvalidParameter)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.secret
+	c.prevSecret = &prev
+	copy(c.secret[:], secret)
+	c.rotated = c.now()
+	return nil
+}
+
+// ServeDNS validates the request's cookies before calling the wrapped handler.
+// Malformed cookies are answered with FORMERR and, when WithRequireCookies is
+// used, requests without a valid server cookie are answered with BADCOOKIE.
+func (c *Cookies) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	rw, ok := w.(*RespWriter)
+	if !ok {
+		rw = NewRespWriter(context.Background(), w, WithLogger(c.logger), WithRequest(r))
+	}
+	rw.setRequest(r)
+
+	cookie, ok := requestCookie(r)
+	if !ok {
+		c.handler(rw, r)
+		return
+	}
+	raw, err := hex.DecodeString(cookie)
+	if err != nil || !validCookieLen(len(raw)) {
+		m := new(dns.Msg)
+		m.SetRcodeFormatError(r)
+		_ = rw.WriteMsg(m)
+		return
+	}
+	client, server := raw[:clientCookieLen], raw[clientCookieLen:]
+
+	now := c.now()
+	ip := addrIP(rw.RemoteAddr())
+	status := CookieClientOnly
+	if len(server) > 0 {
+		status = CookieInvalid
+		if c.valid(client, server, ip, now) {
+			status = CookieValid
+		}
+	}
+	if status != CookieValid || cookieAge(server, now) >= cookieRefreshAge {
+		server = c.generate(client, ip, now)
+	}
+	rw.setCookie(status, hex.EncodeToString(append(append([]byte{}, client...), server...)))
+
+	if status != CookieValid && c.require {
+		if rw.Logger() != nil {
+			rw.Logger().Debug("bad cookie", "remote_addr", rw.RemoteAddr().String(), "cookie_status", status.String())
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeBadCookie)
+		m.Extra = append(m.Extra, newOPT(r.IsEdns0().Do()))
+		_ = rw.WriteMsg(m)
+		return
+	}
+	c.handler(rw, r)
+}
+
+// setRequest sets the request being responded to, unless it's already known.
+func (rw *RespWriter) setRequest(r *dns.Msg) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.request == nil {
+		rw.request = r
+	}
+}
+
+// setCookie sets the result of validating the request's cookies and the
+// cookie attached to responses.
+func (rw *RespWriter) setCookie(status CookieStatus, cookie string) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.cookieStatus = status
+	rw.cookie = cookie
+}
+
+// secrets returns the current and previous (which may be nil) secrets,
+// rotating them first when required.
+func (c *Cookies) secrets(now time.Time) ([cookieSecretLen]byte, *[cookieSecretLen]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rotation > 0 && now.Sub(c.rotated) >= c.rotation {
+		var next [cookieSecretLen]byte
+		if err := randomSecret(&next); err == nil {
+			prev := c.secret
+			c.prevSecret = &prev
+			c.secret = next
+			c.rotated = now
+		} else if c.logger != nil {
+			c.logger.Error("unable to rotate cookie secret", "err", err)
+		}
+	}
+	return c.secret, c.prevSecret
+}
+
+// generate returns a new server cookie for the client cookie and address.
+func (c *Cookies) generate(client []byte, ip net.IP, now time.Time) []byte {
+	secret, _ := c.secrets(now)
+	server := make([]byte, serverCookieLen)
+	server[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(server[4:8], uint32(now.Unix()))
+	binary.LittleEndian.PutUint64(server[8:], cookieHash(secret, client, server[:8], ip))
+	return server
+}
+
+// valid returns true when the server cookie was generated by us for the
+// client cookie and address and it hasn't expired.
+func (c *Cookies) valid(client, server []byte, ip net.IP, now time.Time) bool {
+	if len(server) != serverCookieLen || server[0] != serverCookieVersion {
+		return false
+	}
+	if age := cookieAge(server, now); age > cookieMaxAge || age < -cookieMaxSkew {
+		return false
+	}
+	secret, prev := c.secrets(now)
+	want := make([]byte, 8)
+	binary.LittleEndian.PutUint64(want, cookieHash(secret, client, server[:8], ip))
+	if subtle.ConstantTimeCompare(want, server[8:]) == 1 {
+		return true
+	}
+	if prev != nil {
+		binary.LittleEndian.PutUint64(want, cookieHash(*prev, client, server[:8], ip))
+		return subtle.ConstantTimeCompare(want, server[8:]) == 1
+	}
+	return false
+}
+
+// cookieHash is the hash of an RFC 9018 server cookie, where header is the
+// version, reserved and timestamp fields.
+func cookieHash(secret [cookieSecretLen]byte, client, header []byte, ip net.IP) uint64 {
+	buf := make([]byte, 0, clientCookieLen+8+net.IPv6len)
+	buf = append(buf, client...)
+	buf = append(buf, header...)
+	buf = append(buf, ip...)
+	return siphash24(secret, buf)
+}
+
+// cookieAge returns the age of an RFC 9018 server cookie, using serial number
+// arithmetic for its timestamp. The age is negative for timestamps in the
+// future.
+func cookieAge(server []byte, now time.Time) time.Duration {
+	if len(server) != serverCookieLen {
+		return 0
+	}
+	ts := binary.BigEndian.Uint32(server[4:8])
+	return time.Duration(int32(uint32(now.Unix())-ts)) * time.Second
+}
+
+func validCookieLen(n int) bool {
+	return n == clientCookieLen || (n >= clientCookieLen+minServerCookieLen && n <= clientCookieLen+maxServerCookieLen)
+}
+
+// requestCookie returns the hex encoded cookie option of the request.
+func requestCookie(r *dns.Msg) (string, bool) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return "", false
+	}
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return c.Cookie, true
+		}
+	}
+	return "", false
+}
+
+// addrIP returns the IP of the address, in its 4 byte form for IPv4.
+func addrIP(addr net.Addr) net.IP {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		if isNil(addr) {
+			return nil
+		}
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func randomSecret(secret *[cookieSecretLen]byte) error {
+	if _, err := rand.Read(secret[:]); err != nil {
+		return fmt.Errorf("unable to generate cookie secret: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package respwriter
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCookies(t *testing.T) {
+	t.Parallel()
+	testHandler := func(w dns.ResponseWriter, req *dns.Msg) {}
+
+	tests := []struct {
+		name            string
+		handler         dns.HandlerFunc
+		opts            []Option
+		wantErrIs       error
+		wantErrContains string
+	}{
+		{
+			name:    "success",
+			handler: testHandler,
+		},
+		{
+			name:    "success-with-secret",
+			handler: testHandler,
+			opts:    []Option{WithCookieSecret(make([]byte, 16))},
+		},
+		{
+			name:            "err-nil-handler",
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "nil handler",
+		},
+		{
+			name:            "err-secret-len",
+			handler:         testHandler,
+			opts:            []Option{WithCookieSecret(make([]byte, 8))},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "cookie secret must be 16 bytes",
+		},
+		{
+			name:            "err-rotation",
+			handler:         testHandler,
+			opts:            []Option{WithCookieRotation(-1)},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "invalid cookie rotation",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			got, err := NewCookies(tc.handler, tc.opts...)
+			if tc.wantErrContains != "" {
+				require.Error(err)
+				assert.ErrorIs(err, tc.wantErrIs)
+				assert.Contains(err.Error(), tc.wantErrContains)
+				return
+			}
+			require.NoError(err)
+			assert.NotNil(got)
+		})
+	}
+}
+
+func TestCookies_generate(t *testing.T) {
+	t.Parallel()
+	// test vectors from RFC 9018 appendix A
+	tests := []struct {
+		name   string
+		secret string
+		client string
+		ip     string
+		ts     int64
+		want   string
+	}{
+		{
+			name:   "ipv4",
+			secret: "e5e973e5a6b2a43f48e7dc849e37bfcf",
+			client: "2464c4abcf10c957",
+			ip:     "198.51.100.100",
+			ts:     1559731985,
+			want:   "010000005cf79f111f8130c3eee29480",
+		},
+		{
+			name:   "ipv4-renewed",
+			secret: "e5e973e5a6b2a43f48e7dc849e37bfcf",
+			client: "2464c4abcf10c957",
+			ip:     "198.51.100.100",
+			ts:     1559734385,
+			want:   "010000005cf7a871d4a564a1442aca77",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require := require.New(t)
+			secret, err := hex.DecodeString(tc.secret)
+			require.NoError(err)
+			client, err := hex.DecodeString(tc.client)
+			require.NoError(err)
+			c, err := NewCookies(func(w dns.ResponseWriter, req *dns.Msg) {}, WithCookieSecret(secret), WithCookieRotation(0))
+			require.NoError(err)
+
+			ip := addrIP(&net.UDPAddr{IP: net.ParseIP(tc.ip)})
+			got := c.generate(client, ip, time.Unix(tc.ts, 0))
+			assert.Equal(t, tc.want, hex.EncodeToString(got))
+			assert.True(t, c.valid(client, got, ip, time.Unix(tc.ts, 0)))
+		})
+	}
+}
+
+func TestCookies_ServeDNS(t *testing.T) {
+	t.Parallel()
+	const clientCookie = "2464c4abcf10c957"
+	secret := make([]byte, 16)
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+	start := time.Unix(1700000000, 0)
+
+	// serverCookie returns a server cookie generated at the given time for the
+	// client cookie and the mock writer's address.
+	serverCookie := func(t *testing.T, c *Cookies, at time.Time) string {
+		t.Helper()
+		client, err := hex.DecodeString(clientCookie)
+		require.NoError(t, err)
+		return hex.EncodeToString(c.generate(client, addrIP(new(mockUDPResponseWriter).RemoteAddr()), at))
+	}
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		cookie      func(t *testing.T, c *Cookies) string
+		now         time.Time
+		wantRcode   int
+		wantStatus  CookieStatus
+		wantHandler bool
+		wantCookie  bool
+		wantSame    bool
+	}{
+		{
+			name:        "no-cookie",
+			now:         start,
+			wantRcode:   dns.RcodeSuccess,
+			wantStatus:  CookieNone,
+			wantHandler: true,
+		},
+		{
+			name:      "malformed",
+			cookie:    func(t *testing.T, c *Cookies) string { return "2464c4ab" },
+			now:       start,
+			wantRcode: dns.RcodeFormatError,
+		},
+		{
+			name:        "client-only",
+			cookie:      func(t *testing.T, c *Cookies) string { return clientCookie },
+			now:         start,
+			wantRcode:   dns.RcodeSuccess,
+			wantStatus:  CookieClientOnly,
+			wantHandler: true,
+			wantCookie:  true,
+		},
+		{
+			name: "valid",
+			cookie: func(t *testing.T, c *Cookies) string {
+				return clientCookie + serverCookie(t, c, start)
+			},
+			now:         start.Add(time.Minute),
+			wantRcode:   dns.RcodeSuccess,
+			wantStatus:  CookieValid,
+			wantHandler: true,
+			wantCookie:  true,
+			wantSame:    true,
+		},
+		{
+			name: "valid-refreshed",
+			cookie: func(t *testing.T, c *Cookies) string {
+				return clientCookie + serverCookie(t, c, start)
+			},
+			now:         start.Add(40 * time.Minute),
+			wantRcode:   dns.RcodeSuccess,
+			wantStatus:  CookieValid,
+			wantHandler: true,
+			wantCookie:  true,
+		},
+		{
+			name: "expired",
+			cookie: func(t *testing.T, c *Cookies) string {
+				return clientCookie + serverCookie(t, c, start)
+			},
+			now:         start.Add(2 * time.Hour),
+			wantRcode:   dns.RcodeSuccess,
+			wantStatus:  CookieInvalid,
+			wantHandler: true,
+			wantCookie:  true,
+		},
+		{
+			name: "future",
+			cookie: func(t *testing.T, c *Cookies) string {
+				return clientCookie + serverCookie(t, c, start.Add(time.Hour))
+			},
+			now:         start,
+			wantRcode:   dns.RcodeSuccess,
+			wantStatus:  CookieInvalid,
+			wantHandler: true,
+			wantCookie:  true,
+		},
+		{
+			name: "wrong-client-cookie",
+			cookie: func(t *testing.T, c *Cookies) string {
+				return "0000000000000000" + serverCookie(t, c, start)
+			},
+			now:         start,
+			wantRcode:   dns.RcodeSuccess,
+			wantStatus:  CookieInvalid,
+			wantHandler: true,
+			wantCookie:  true,
+		},
+		{
+			name:       "required-client-only",
+			opts:       []Option{WithRequireCookies(true)},
+			cookie:     func(t *testing.T, c *Cookies) string { return clientCookie },
+			now:        start,
+			wantRcode:  dns.RcodeBadCookie,
+			wantStatus: CookieClientOnly,
+			wantCookie: true,
+		},
+		{
+			name: "required-valid",
+			opts: []Option{WithRequireCookies(true)},
+			cookie: func(t *testing.T, c *Cookies) string {
+				return clientCookie + serverCookie(t, c, start)
+			},
+			now:         start,
+			wantRcode:   dns.RcodeSuccess,
+			wantStatus:  CookieValid,
+			wantHandler: true,
+			wantCookie:  true,
+			wantSame:    true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			var executedHandler bool
+			var gotStatus CookieStatus
+			h := func(w dns.ResponseWriter, r *dns.Msg) {
+				executedHandler = true
+				gotStatus = w.(*RespWriter).CookieStatus()
+				m := new(dns.Msg)
+				m.SetReply(r)
+				_ = w.WriteMsg(m)
+			}
+			opts := append([]Option{WithCookieSecret(secret), WithCookieRotation(0)}, tc.opts...)
+			c, err := NewCookies(h, opts...)
+			require.NoError(err)
+			c.now = func() time.Time { return tc.now }
+
+			r := new(dns.Msg)
+			r.SetQuestion("go.dev.", dns.TypeA)
+			var sent string
+			if tc.cookie != nil {
+				sent = tc.cookie(t, c)
+				r.SetEdns0(4096, false)
+				opt := r.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: sent})
+			}
+			cw := &captureWriter{ResponseWriter: new(mockUDPResponseWriter)}
+			rw := NewRespWriter(context.Background(), cw, WithRequest(r))
+			c.ServeDNS(rw, r)
+
+			require.NotNil(cw.msg)
+			buf, err := cw.msg.Pack()
+			require.NoError(err)
+			got := new(dns.Msg)
+			require.NoError(got.Unpack(buf))
+			assert.Equal(tc.wantRcode, got.Rcode)
+			assert.Equal(tc.wantHandler, executedHandler)
+			assert.Equal(tc.wantStatus, rw.CookieStatus())
+			if tc.wantHandler {
+				assert.Equal(tc.wantStatus, gotStatus)
+			}
+
+			gotCookie, ok := requestCookie(got)
+			assert.Equal(tc.wantCookie, ok)
+			if !tc.wantCookie {
+				return
+			}
+			assert.Len(gotCookie, 2*(clientCookieLen+serverCookieLen))
+			assert.Equal(sent[:2*clientCookieLen], gotCookie[:2*clientCookieLen])
+			if tc.wantSame {
+				assert.Equal(sent, gotCookie)
+			} else {
+				assert.NotEqual(sent, gotCookie)
+			}
+		})
+	}
+}
+
+func TestCookies_rotation(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	c, err := NewCookies(func(w dns.ResponseWriter, req *dns.Msg) {}, WithCookieRotation(10*time.Minute))
+	require.NoError(err)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	c.rotated = now
+
+	client, err := hex.DecodeString("2464c4abcf10c957")
+	require.NoError(err)
+	ip := net.IPv4(192, 0, 2, 1).To4()
+	server := c.generate(client, ip, now)
+	assert.True(c.valid(client, server, ip, now))
+
+	// accepted after one rotation
+	now = now.Add(11 * time.Minute)
+	assert.True(c.valid(client, server, ip, now))
+
+	// rejected after two rotations
+	now = now.Add(11 * time.Minute)
+	assert.False(c.valid(client, server, ip, now))
+
+	// manual rotation
+	server = c.generate(client, ip, now)
+	require.NoError(c.RotateSecret(make([]byte, 16)))
+	assert.True(c.valid(client, server, ip, now))
+	require.NoError(c.RotateSecret(make([]byte, 16)))
+	assert.False(c.valid(client, server, ip, now))
+
+	err = c.RotateSecret(make([]byte, 8))
+	assert.ErrorIs(err, ErrInvalidParameter)
+}
+
+func TestCookieStatus_String(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "none", CookieNone.String())
+	assert.Equal(t, "client-only", CookieClientOnly.String())
+	assert.Equal(t, "invalid", CookieInvalid.String())
+	assert.Equal(t, "valid", CookieValid.String())
+}
@@ -0,0 +1,300 @@
+package respwriter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// deadlineContext is a context.Context whose deadline can be moved after it's
+// created, which isn't supported by context.WithDeadline. It's used for the
+// request context created by NewHandlerFunc, so the deadline can follow the
+// progress of streamed responses.
+//
+// It's designed to be cheap to create for every request: its done channel is
+// only created when Done is called, it doesn't register with a parent which
+// is never done (such as context.Background) and it can be restarted (see
+// start), which reuses its timer. Each context has its own timer, rather than
+// sharing a timer wheel, since runtime timers are cheap to reset and the
+// deadlines must be exact and follow the Clock.
+type deadlineContext struct {
+	parent context.Context
+	clock  Clock
+
+	// rw is the writer of the request when the context is the request
+	// context of NewHandlerFunc. It's returned by Value for respWriterKey{}
+	// and its timeout policy is applied once the deadline expires.
+	rw *RespWriter
+
+	// expiring tracks the application of the timeout policy, so finish can
+	// wait for it.
+	expiring sync.WaitGroup
+
+	mu         sync.Mutex
+	done       chan struct{}
+	deadline   time.Time
+	timer      Timer
+	stopParent func() bool
+	afterFuncs map[uint64]func()
+	nextFunc   uint64
+	err        error
+
+	// calledFuncs is true once funcs registered via AfterFunc have been
+	// called. They may still be using the context (contexts derived from it
+	// read its Err when they're canceled), so it can't be restarted.
+	calledFuncs bool
+}
+
+// closedChan is the done channel of the contexts which were done before Done
+// was called.
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// newDeadlineContext returns a new deadlineContext which is done when the
+// deadline expires, the parent is done or the returned cancel func is called.
+// The deadline follows the given clock.
+func newDeadlineContext(parent context.Context, deadline time.Time, clock Clock) (*deadlineContext, context.CancelFunc) {
+	c := new(deadlineContext)
+	c.start(parent, deadline, clock)
+	return c, func() { c.cancel(context.Canceled) }
+}
+
+// start starts the context with the given parent and deadline, or restarts
+// it once it's done (see finish). Restarting a context reuses its timer, which
+// must have been created by the same clock.
+func (c *deadlineContext) start(parent context.Context, deadline time.Time, clock Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.parent = parent
+	c.clock = clock
+	c.done = nil
+	c.deadline = deadline
+	c.err = nil
+	c.calledFuncs = false
+	switch d := deadline.Sub(clock.Now()); {
+	case c.timer == nil:
+		c.timer = clock.AfterFunc(d, c.expire)
+	default:
+		c.timer.Reset(d)
+	}
+	c.stopParent = nil
+	if parent.Done() != nil {
+		c.stopParent = context.AfterFunc(parent, c.parentDone)
+	}
+}
+
+// Deadline returns the current deadline, which is the earliest of the
+// context's and its parent's.
+func (c *deadlineContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	if parent, ok := c.parent.Deadline(); ok && parent.Before(deadline) {
+		return parent, true
+	}
+	return deadline, true
+}
+
+// Done returns a channel that's closed when the context is done.
+func (c *deadlineContext) Done() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.done != nil:
+	case c.err != nil:
+		c.done = closedChan
+	default:
+		c.done = make(chan struct{})
+	}
+	return c.done
+}
+
+// Err returns nil until the context is done and then the reason it's done.
+func (c *deadlineContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Value returns the writer of the request for respWriterKey{}, when there's
+// one, and the parent's value for other keys.
+func (c *deadlineContext) Value(key any) any {
+	if _, ok := key.(respWriterKey); ok && c.rw != nil {
+		return c.rw
+	}
+	return c.parent.Value(key)
+}
+
+// AfterFunc arranges to call f in its own goroutine once the context is done.
+// It's used by context.AfterFunc, so it doesn't need a goroutine per context
+// to wait for it to be done.
+func (c *deadlineContext) AfterFunc(f func()) func() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		c.calledFuncs = true
+		go f()
+		return func() bool { return false }
+	}
+	if c.afterFuncs == nil {
+		c.afterFuncs = make(map[uint64]func())
+	}
+	// nextFunc isn't reset when the context is restarted, so a stale stop
+	// func can't remove the func of a later use of the context.
+	id := c.nextFunc
+	c.nextFunc++
+	c.afterFuncs[id] = f
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		_, ok := c.afterFuncs[id]
+		delete(c.afterFuncs, id)
+		return ok
+	}
+}
+
+// setDeadline moves the deadline. It returns false when the context is
+// already done.
+func (c *deadlineContext) setDeadline(deadline time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return false
+	}
+	c.deadline = deadline
+	c.timer.Reset(deadline.Sub(c.clock.Now()))
+	return true
+}
+
+// expire is called by the timer when the deadline may have expired.
+func (c *deadlineContext) expire() {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	if d := c.deadline.Sub(c.clock.Now()); d > 0 {
+		// the deadline was moved while the timer was firing (or the
+		// context was restarted).
+		c.timer.Reset(d)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	c.cancel(context.DeadlineExceeded)
+}
+
+// parentDone cancels the context once its parent is done.
+func (c *deadlineContext) parentDone() {
+	c.cancel(c.parent.Err())
+}
+
+func (c *deadlineContext) cancel(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	c.timer.Stop()
+	switch c.done {
+	case nil:
+		c.done = closedChan
+	default:
+		close(c.done)
+	}
+	stopParent := c.stopParent
+	afterFuncs := c.afterFuncs
+	c.afterFuncs = nil
+	c.calledFuncs = len(afterFuncs) > 0
+	rw := c.rw
+	if err == context.DeadlineExceeded && rw != nil {
+		c.expiring.Add(1)
+	}
+	c.mu.Unlock()
+	if stopParent != nil {
+		stopParent()
+	}
+	for _, f := range afterFuncs {
+		go f()
+	}
+	if err == context.DeadlineExceeded && rw != nil {
+		// apply the timeout policy as soon as the deadline expires, rather
+		// than waiting for the handler to return.
+		go func() {
+			defer c.expiring.Done()
+			rw.handleTimeout(rw.timeoutPolicy)
+		}()
+	}
+}
+
+// finish cancels the context once the request is done and waits until the
+// timeout policy has been applied, when the deadline expired first. It
+// reports whether the context can be restarted.
+func (c *deadlineContext) finish() bool {
+	c.cancel(context.Canceled)
+	c.expiring.Wait()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.calledFuncs
+}
+
+// ExtendDeadline pushes the request context's deadline out by d, for handlers
+// which know they need more time. The deadline can't be extended beyond the
+// max request timeout (see WithMaxRequestTimeout) and a *DeadlineExtensionError
+// is returned when the extension would exceed it, a response has already been
+// written or the request context is done. Only a RespWriter created by
+// NewHandlerFunc supports extending its deadline.
+func (rw *RespWriter) ExtendDeadline(d time.Duration) error {
+	const op = "respwriter.(RespWriter).ExtendDeadline"
+	switch {
+	case d <= 0:
+		return fmt.Errorf("%s: invalid extension: %w", op, ErrInvalidParameter)
+	case rw.deadlineCtx == nil:
+		return fmt.Errorf("%s: deadline isn't extendable: %w", op, ErrInvalidParameter)
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.hijacked {
+		return ErrHijacked
+	}
+	current, _ := rw.deadlineCtx.Deadline()
+	extErr := &DeadlineExtensionError{Requested: current.Add(d), Ceiling: rw.maxDeadline}
+	switch {
+	case rw.written && !rw.streaming:
+		extErr.Err = ErrAlreadyWritten
+	case extErr.Requested.After(rw.maxDeadline):
+		extErr.Err = ErrDeadlineCeiling
+	case !rw.deadlineCtx.setDeadline(extErr.Requested):
+		extErr.Err = rw.deadlineCtx.Err()
+	}
+	rw.reportExtension(d, extErr)
+	if extErr.Err != nil {
+		return fmt.Errorf("%s: %w", op, extErr)
+	}
+	return nil
+}
+
+// reportExtension logs the deadline extension and records it in the metrics.
+func (rw *RespWriter) reportExtension(d time.Duration, extErr *DeadlineExtensionError) {
+	result := "extended"
+	if extErr.Err != nil {
+		result = "refused"
+	}
+	if logger := rw.Logger(); logger != nil {
+		args := []any{"remote_addr", rw.RemoteAddr().String(), "extension", d, "deadline", extErr.Requested}
+		switch {
+		case extErr.Err != nil:
+			logger.Debug("request deadline extension refused", append(args, "err", extErr.Err)...)
+		default:
+			logger.Debug("request deadline extended", args...)
+		}
+	}
+	if rw.metrics != nil {
+		rw.metrics.IncCounter(MetricDeadlineExtensions, rw.labels(map[string]string{"transport": rw.Transport().String(), "result": result}))
+	}
+}
@@ -0,0 +1,142 @@
+package respwriter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_deadlineContext(t *testing.T) {
+	t.Parallel()
+
+	t.Run("canceled", func(t *testing.T) {
+		assert := assert.New(t)
+		ctx, cancel := newDeadlineContext(context.Background(), time.Now().Add(time.Hour), realClock{})
+		cancel()
+		<-ctx.Done()
+		assert.Equal(context.Canceled, ctx.Err())
+		// cancel is idempotent
+		cancel()
+		assert.False(ctx.setDeadline(time.Now().Add(time.Hour)))
+	})
+	t.Run("parent-canceled", func(t *testing.T) {
+		assert := assert.New(t)
+		parent, parentCancel := context.WithCancel(context.Background())
+		ctx, cancel := newDeadlineContext(parent, time.Now().Add(time.Hour), realClock{})
+		t.Cleanup(cancel)
+		parentCancel()
+		<-ctx.Done()
+		assert.Equal(context.Canceled, ctx.Err())
+	})
+	t.Run("parent-deadline", func(t *testing.T) {
+		assert := assert.New(t)
+		parentDeadline := time.Now().Add(time.Minute)
+		parent, parentCancel := context.WithDeadline(context.Background(), parentDeadline)
+		t.Cleanup(parentCancel)
+		ctx, cancel := newDeadlineContext(parent, time.Now().Add(time.Hour), realClock{})
+		t.Cleanup(cancel)
+		got, _ := ctx.Deadline()
+		assert.Equal(parentDeadline, got)
+	})
+	t.Run("values", func(t *testing.T) {
+		type key struct{}
+		parent := context.WithValue(context.Background(), key{}, "value")
+		ctx, cancel := newDeadlineContext(parent, time.Now().Add(time.Hour), realClock{})
+		t.Cleanup(cancel)
+		assert.Equal(t, "value", ctx.Value(key{}))
+	})
+	t.Run("after-func", func(t *testing.T) {
+		assert := assert.New(t)
+		ctx, cancel := newDeadlineContext(context.Background(), time.Now().Add(time.Hour), realClock{})
+		called := make(chan struct{})
+		context.AfterFunc(ctx, func() { close(called) })
+		stopped := context.AfterFunc(ctx, func() { t.Error("stopped func was called") })
+		assert.True(stopped())
+		assert.False(stopped())
+		cancel()
+		select {
+		case <-called:
+		case <-time.After(time.Second):
+			assert.Fail("after func wasn't called")
+		}
+
+		// registered once done
+		late := make(chan struct{})
+		stop := context.AfterFunc(ctx, func() { close(late) })
+		<-late
+		assert.False(stop())
+	})
+	t.Run("done-lazily", func(t *testing.T) {
+		assert := assert.New(t)
+		ctx, cancel := newDeadlineContext(context.Background(), time.Now().Add(time.Hour), realClock{})
+		cancel()
+		// Done wasn't called before the context was done.
+		<-ctx.Done()
+		assert.Equal(context.Canceled, ctx.Err())
+	})
+}
+
+func TestRespWriter_ExtendDeadline(t *testing.T) {
+	t.Parallel()
+	const requestTimeout = 100 * time.Millisecond
+
+	// serve calls the handler created by NewHandlerFunc with fn as the wrapped
+	// handler and returns when it's done.
+	serve := func(t *testing.T, fn func(rw *RespWriter, r *dns.Msg), opt ...Option) {
+		t.Helper()
+		h, err := NewHandlerFunc(requestTimeout, func(w dns.ResponseWriter, r *dns.Msg) {
+			fn(w.(*RespWriter), r)
+		}, opt...)
+		require.NoError(t, err)
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		h(new(mockTCPResponseWriter), r)
+	}
+
+	t.Run("ceiling", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		metrics := newTestMetrics()
+		serve(t, func(rw *RespWriter, r *dns.Msg) {
+			before, _ := rw.RequestContext().Deadline()
+			err := rw.ExtendDeadline(time.Second)
+			require.Error(err)
+			assert.ErrorIs(err, ErrDeadlineCeiling)
+			var extErr *DeadlineExtensionError
+			require.ErrorAs(err, &extErr)
+			assert.Equal(before.Add(time.Second), extErr.Requested)
+			assert.False(extErr.Ceiling.After(before.Add(200 * time.Millisecond)))
+
+			after, _ := rw.RequestContext().Deadline()
+			assert.Equal(before, after)
+		}, WithMaxRequestTimeout(2*requestTimeout), WithMetrics(metrics))
+		assert.Equal(map[string]string{"transport": "tcp", "result": "refused"}, metrics.lastLabels(MetricDeadlineExtensions))
+	})
+	t.Run("default-ceiling", func(t *testing.T) {
+		t.Parallel()
+		serve(t, func(rw *RespWriter, r *dns.Msg) {
+			assert.ErrorIs(t, rw.ExtendDeadline(time.Millisecond), ErrDeadlineCeiling)
+		})
+	})
+	t.Run("already-written", func(t *testing.T) {
+		t.Parallel()
+		serve(t, func(rw *RespWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			require.NoError(t, rw.WriteMsg(m))
+			assert.ErrorIs(t, rw.ExtendDeadline(time.Millisecond), ErrAlreadyWritten)
+		}, WithMaxRequestTimeout(time.Second))
+	})
+	t.Run("invalid-parameters", func(t *testing.T) {
+		t.Parallel()
+		serve(t, func(rw *RespWriter, r *dns.Msg) {
+			assert.ErrorIs(t, rw.ExtendDeadline(0), ErrInvalidParameter)
+		})
+		rw := NewRespWriter(context.Background(), new(mockTCPResponseWriter))
+		assert.ErrorIs(t, rw.ExtendDeadline(time.Millisecond), ErrInvalidParameter)
+	})
+}
@@ -0,0 +1,98 @@
+package respwriter
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Detached is a handle for answering a request from another goroutine, after
+// the handler has returned. It's returned by RespWriter.Detach.
+//
+// Respond and Fail obey the request's deadline, like RespWriter.WriteMsg, and
+// only one response may be written through the handle.
+type Detached struct {
+	rw *RespWriter
+
+	once sync.Once
+	done chan struct{}
+}
+
+// Detach returns a handle which is used to answer the request asynchronously.
+// Once detached, the handler created by NewHandlerFunc doesn't consider the
+// request done when the wrapped handler returns, but waits until the handle is
+// used or the request's deadline expires. Calling Detach more than once
+// returns the same handle.
+func (rw *RespWriter) Detach() *Detached {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.detached == nil {
+		rw.detached = &Detached{rw: rw, done: make(chan struct{})}
+	}
+	return rw.detached
+}
+
+// Respond writes msg to the client. It returns ErrAlreadyWritten when a
+// response has already been written for the request, either through the
+// handle or the RespWriter. Otherwise, it returns the same errors as
+// RespWriter.WriteMsg.
+func (d *Detached) Respond(msg *dns.Msg) error {
+	const op = "respwriter.(Detached).Respond"
+	if msg == nil {
+		return fmt.Errorf("%s: missing message: %w", op, ErrInvalidParameter)
+	}
+	return d.finish(func() error { return d.rw.writeMsg(msg) })
+}
+
+// Fail answers the request with the given rcode. It returns the same errors
+// as Respond.
+func (d *Detached) Fail(rcode int) error {
+	const op = "respwriter.(Detached).Fail"
+	return d.finish(func() error {
+		if d.rw.request == nil {
+			return fmt.Errorf("%s: missing request: %w", op, ErrInvalidParameter)
+		}
+		m := new(dns.Msg)
+		m.SetRcode(d.rw.request, rcode)
+		return d.rw.writeMsg(m)
+	})
+}
+
+// Done returns a channel which is closed once the handle has been used to
+// answer the request, whether the write succeeded or not.
+func (d *Detached) Done() <-chan struct{} {
+	return d.done
+}
+
+// finish writes the response via write, enforcing that it's only written
+// once, and then marks the handle done.
+func (d *Detached) finish(write func() error) error {
+	d.rw.mu.Lock()
+	defer d.rw.mu.Unlock()
+	select {
+	case <-d.done:
+		return ErrAlreadyWritten
+	default:
+	}
+	defer d.once.Do(func() { close(d.done) })
+	if d.rw.written && !d.rw.streaming {
+		return ErrAlreadyWritten
+	}
+	return write()
+}
+
+// waitDetached blocks until the detached handle, if any, has been used or the
+// request context is done.
+func (rw *RespWriter) waitDetached() {
+	rw.mu.Lock()
+	d := rw.detached
+	rw.mu.Unlock()
+	if d == nil {
+		return
+	}
+	select {
+	case <-d.done:
+	case <-rw.requestCtx.Done():
+	}
+}
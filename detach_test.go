@@ -0,0 +1,93 @@
+package respwriter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRespWriter_Detach(t *testing.T) {
+	t.Parallel()
+
+	t.Run("respond", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		respondErr := make(chan error, 1)
+		h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+			d := w.(*RespWriter).Detach()
+			assert.Same(d, w.(*RespWriter).Detach())
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				m := new(dns.Msg)
+				m.SetReply(r)
+				respondErr <- d.Respond(m)
+			}()
+		})
+		require.NoError(err)
+		_, c, addr := runTestDnsServer(t, ".", h)
+
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		got, _, err := c.Exchange(r, addr)
+		require.NoError(err)
+		assert.Equal(r.Id, got.Id)
+		assert.Equal(dns.RcodeSuccess, got.Rcode)
+		assert.NoError(<-respondErr)
+	})
+	t.Run("fail", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+			d := w.(*RespWriter).Detach()
+			go func() { _ = d.Fail(dns.RcodeRefused) }()
+		})
+		require.NoError(err)
+		_, c, addr := runTestDnsServer(t, ".", h)
+
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		got, _, err := c.Exchange(r, addr)
+		require.NoError(err)
+		assert.Equal(dns.RcodeRefused, got.Rcode)
+	})
+	t.Run("write-once", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		rw := NewRespWriter(context.Background(), new(mockTCPResponseWriter), WithRequest(r))
+		d := rw.Detach()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		require.NoError(d.Respond(m))
+		select {
+		case <-d.Done():
+		default:
+			assert.Fail("handle isn't done")
+		}
+		assert.ErrorIs(d.Respond(m), ErrAlreadyWritten)
+		assert.ErrorIs(d.Fail(dns.RcodeServerFailure), ErrAlreadyWritten)
+	})
+	t.Run("already-written", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		rw := NewRespWriter(context.Background(), new(mockTCPResponseWriter), WithRequest(r))
+		m := new(dns.Msg)
+		m.SetReply(r)
+		require.NoError(rw.WriteMsg(m))
+		assert.ErrorIs(rw.Detach().Respond(m), ErrAlreadyWritten)
+	})
+	t.Run("invalid-parameters", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		rw := NewRespWriter(context.Background(), new(mockTCPResponseWriter))
+		assert.ErrorIs(rw.Detach().Respond(nil), ErrInvalidParameter)
+		assert.ErrorIs(rw.Detach().Fail(dns.RcodeRefused), ErrInvalidParameter)
+	})
+}
@@ -0,0 +1,158 @@
+package respwriter
+
+import (
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultEDNSUDPSize is the UDP payload size advertised in responses,
+	// as recommended by DNS flag day 2020.
+	defaultEDNSUDPSize = 1232
+
+	// defaultPaddingBlockSize is the block size recommended for responses by
+	// RFC 8467.
+	defaultPaddingBlockSize = 468
+
+	// supportedEDNSVersion is the highest EDNS version supported.
+	supportedEDNSVersion = 0
+)
+
+// badVersion returns true when the request's EDNS version isn't supported.
+func badVersion(r *dns.Msg) bool {
+	if r == nil {
+		return false
+	}
+	opt := r.IsEdns0()
+	return opt != nil && opt.Version() > supportedEDNSVersion
+}
+
+// badVersionReply returns a BADVERS reply to r (RFC 6891 section 6.1.3).
+func badVersionReply(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeBadVers)
+	m.Extra = append(m.Extra, newOPT(r.IsEdns0().Do()))
+	return m
+}
+
+func newOPT(do bool) *dns.OPT {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(defaultEDNSUDPSize)
+	opt.SetVersion(supportedEDNSVersion)
+	opt.SetDo(do)
+	return opt
+}
+
+// setEDNS ensures the msg has an OPT RR which is consistent with the
+// request's: it's added when the request had one and removed when it didn't.
+// The NSID is attached when the request asked for it. The server cookie set by
+// Cookies is attached even when EDNS handling isn't enabled.
+func (rw *RespWriter) setEDNS(msg *dns.Msg) {
+	if (!rw.edns && rw.cookie == "") || msg == nil || rw.request == nil {
+		return
+	}
+	reqOPT := rw.request.IsEdns0()
+	if reqOPT == nil {
+		if rw.edns {
+			removeOPT(msg)
+		}
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		opt = newOPT(reqOPT.Do())
+		addOPT(msg, opt)
+	}
+	if rw.cookie != "" {
+		removeOption(opt, dns.EDNS0COOKIE)
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: rw.cookie})
+	}
+	if !rw.edns {
+		return
+	}
+
+	opt.Hdr.Name = "."
+	opt.SetVersion(supportedEDNSVersion)
+	opt.SetDo(reqOPT.Do())
+	if opt.UDPSize() < dns.MinMsgSize {
+		size := uint16(defaultEDNSUDPSize)
+		if rw.maxUDPSize > 0 && rw.maxUDPSize < int(size) {
+			size = uint16(rw.maxUDPSize)
+		}
+		opt.SetUDPSize(size)
+	}
+
+	if rw.nsid != "" && hasOption(reqOPT, dns.EDNS0NSID) && !hasOption(opt, dns.EDNS0NSID) {
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: rw.nsid})
+	}
+}
+
+// pad adds an RFC 7830 padding option to msg, so its length is a multiple of
+// the padding block size, when the response is sent over an encrypted
+// transport and the request was padded (RFC 8467).
+func (rw *RespWriter) pad(msg *dns.Msg) {
+	switch {
+	case !rw.edns, rw.paddingBlockSize <= 0, msg == nil, rw.request == nil:
+		return
+	case rw.Transport() != TransportTLS:
+		return
+	}
+	reqOPT := rw.request.IsEdns0()
+	if reqOPT == nil || !hasOption(reqOPT, dns.EDNS0PADDING) {
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	removeOption(opt, dns.EDNS0PADDING)
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	// the length includes the padding option's (empty) header.
+	l := msg.Len()
+	n := (rw.paddingBlockSize - l%rw.paddingBlockSize) % rw.paddingBlockSize
+	if l+n > dns.MaxMsgSize {
+		removeOption(opt, dns.EDNS0PADDING)
+		return
+	}
+	padding.Padding = make([]byte, n)
+}
+
+func hasOption(opt *dns.OPT, code uint16) bool {
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+func removeOption(opt *dns.OPT, code uint16) {
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != code {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// addOPT adds opt to the additional section of msg, before its TSIG if it
+// has one: the TSIG must be the last record, otherwise the message isn't
+// signed (see dns.Msg.IsTsig).
+func addOPT(msg *dns.Msg, opt *dns.OPT) {
+	if sig := msg.IsTsig(); sig != nil {
+		msg.Extra = append(msg.Extra[:len(msg.Extra)-1], opt, sig)
+		return
+	}
+	msg.Extra = append(msg.Extra, opt)
+}
+
+func removeOPT(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
@@ -0,0 +1,224 @@
+package respwriter
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRespWriter_WriteMsg_edns(t *testing.T) {
+	t.Parallel()
+
+	newReq := func(edns bool, options ...dns.EDNS0) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		if edns {
+			r.SetEdns0(4096, true)
+			opt := r.IsEdns0()
+			opt.Option = append(opt.Option, options...)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name        string
+		w           dns.ResponseWriter
+		req         *dns.Msg
+		resp        func(r *dns.Msg) *dns.Msg
+		opts        []Option
+		wantOPT     bool
+		wantNSID    string
+		wantPadding bool
+	}{
+		{
+			name:    "disabled",
+			w:       new(mockUDPResponseWriter),
+			req:     newReq(true),
+			opts:    []Option{WithEDNS(false)},
+			wantOPT: false,
+		},
+		{
+			name:    "opt-added",
+			w:       new(mockUDPResponseWriter),
+			req:     newReq(true),
+			opts:    []Option{WithEDNS(true)},
+			wantOPT: true,
+		},
+		{
+			name: "opt-removed",
+			w:    new(mockUDPResponseWriter),
+			req:  newReq(false),
+			resp: func(r *dns.Msg) *dns.Msg {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				m.SetEdns0(4096, false)
+				return m
+			},
+			opts:    []Option{WithEDNS(true)},
+			wantOPT: false,
+		},
+		{
+			name: "opt-fixed",
+			w:    new(mockUDPResponseWriter),
+			req:  newReq(true),
+			resp: func(r *dns.Msg) *dns.Msg {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				m.SetEdns0(0, false)
+				m.IsEdns0().SetVersion(1)
+				return m
+			},
+			opts:    []Option{WithEDNS(true)},
+			wantOPT: true,
+		},
+		{
+			name:     "nsid",
+			w:        new(mockUDPResponseWriter),
+			req:      newReq(true, &dns.EDNS0_NSID{Code: dns.EDNS0NSID}),
+			opts:     []Option{WithEDNS(true), WithNSID("ns1")},
+			wantOPT:  true,
+			wantNSID: hex.EncodeToString([]byte("ns1")),
+		},
+		{
+			name:    "nsid-not-requested",
+			w:       new(mockUDPResponseWriter),
+			req:     newReq(true),
+			opts:    []Option{WithEDNS(true), WithNSID("ns1")},
+			wantOPT: true,
+		},
+		{
+			name:        "padding-tls",
+			w:           &mockConnResponseWriter{conn: &tls.Conn{}},
+			req:         newReq(true, &dns.EDNS0_PADDING{}),
+			opts:        []Option{WithEDNS(true)},
+			wantOPT:     true,
+			wantPadding: true,
+		},
+		{
+			name:    "padding-disabled",
+			w:       &mockConnResponseWriter{conn: &tls.Conn{}},
+			req:     newReq(true, &dns.EDNS0_PADDING{}),
+			opts:    []Option{WithEDNS(true), WithPaddingBlockSize(0)},
+			wantOPT: true,
+		},
+		{
+			name:    "padding-not-encrypted",
+			w:       new(mockTCPResponseWriter),
+			req:     newReq(true, &dns.EDNS0_PADDING{}),
+			opts:    []Option{WithEDNS(true)},
+			wantOPT: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			rw := NewRespWriter(context.Background(), tc.w, append(tc.opts, WithRequest(tc.req))...)
+			var msg *dns.Msg
+			switch {
+			case tc.resp != nil:
+				msg = tc.resp(tc.req)
+			default:
+				msg = new(dns.Msg)
+				msg.SetReply(tc.req)
+			}
+			require.NoError(rw.WriteMsg(msg))
+			_, err := msg.Pack()
+			require.NoError(err)
+
+			opt := msg.IsEdns0()
+			if !tc.wantOPT {
+				assert.Nil(opt)
+				return
+			}
+			require.NotNil(opt)
+			assert.Equal(uint8(0), opt.Version())
+			assert.Equal(tc.req.IsEdns0().Do(), opt.Do())
+			assert.GreaterOrEqual(opt.UDPSize(), uint16(dns.MinMsgSize))
+
+			var gotNSID string
+			var gotPadding bool
+			for _, o := range opt.Option {
+				switch o := o.(type) {
+				case *dns.EDNS0_NSID:
+					gotNSID = o.Nsid
+				case *dns.EDNS0_PADDING:
+					gotPadding = true
+				}
+			}
+			assert.Equal(tc.wantNSID, gotNSID)
+			assert.Equal(tc.wantPadding, gotPadding)
+			if tc.wantPadding {
+				assert.Zero(msg.Len() % defaultPaddingBlockSize)
+			}
+		})
+	}
+}
+
+func TestNewHandlerFunc_badVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		version     uint8
+		opts        []Option
+		wantRcode   int
+		wantHandler bool
+	}{
+		{
+			name:        "supported",
+			version:     0,
+			opts:        []Option{WithEDNS(true)},
+			wantRcode:   dns.RcodeSuccess,
+			wantHandler: true,
+		},
+		{
+			name:      "unsupported",
+			version:   1,
+			opts:      []Option{WithEDNS(true)},
+			wantRcode: dns.RcodeBadVers,
+		},
+		{
+			name:        "disabled",
+			version:     1,
+			wantRcode:   dns.RcodeSuccess,
+			wantHandler: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			var executedHandler bool
+			h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+				executedHandler = true
+				m := new(dns.Msg)
+				m.SetReply(r)
+				_ = w.WriteMsg(m)
+			}, tc.opts...)
+			require.NoError(err)
+
+			r := new(dns.Msg)
+			r.SetQuestion("go.dev.", dns.TypeA)
+			r.SetEdns0(4096, false)
+			r.IsEdns0().SetVersion(tc.version)
+			cw := &captureWriter{ResponseWriter: new(mockUDPResponseWriter)}
+			h(cw, r)
+
+			require.NotNil(cw.msg)
+			assert.Equal(tc.wantHandler, executedHandler)
+			// round trip the message to check the extended rcode is packed
+			buf, err := cw.msg.Pack()
+			require.NoError(err)
+			got := new(dns.Msg)
+			require.NoError(got.Unpack(buf))
+			assert.Equal(tc.wantRcode, got.Rcode)
+		})
+	}
+}
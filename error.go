@@ -1,5 +1,89 @@
 package respwriter
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
-var ErrInvalidParameter = errors.New("invalid parameter")
+var (
+	ErrInvalidParameter = errors.New("invalid parameter")
+
+	// ErrUnsupportedTransport is returned when an operation isn't supported
+	// by the transport the request was received over.
+	ErrUnsupportedTransport = errors.New("unsupported transport")
+
+	// ErrHijacked is returned when the RespWriter is used after its
+	// connection has been hijacked.
+	ErrHijacked = errors.New("connection hijacked")
+
+	// ErrAlreadyWritten is returned when a response is written for a request
+	// which has already been answered.
+	ErrAlreadyWritten = errors.New("response already written")
+
+	// ErrDeadlineCeiling is returned when extending a request's deadline
+	// would exceed its max request timeout.
+	ErrDeadlineCeiling = errors.New("deadline ceiling exceeded")
+
+	// ErrNotFound is returned by a ContextHandlerFunc when the name doesn't
+	// exist, and it's mapped to NXDOMAIN by DefaultErrorMapper.
+	ErrNotFound = errors.New("not found")
+
+	// ErrRefused is returned by a ContextHandlerFunc when it refuses to
+	// answer, and it's mapped to REFUSED by DefaultErrorMapper.
+	ErrRefused = errors.New("refused")
+)
+
+// WriteTimeoutError is returned when a write to the client isn't complete
+// before the write deadline derived from the request context.
+type WriteTimeoutError struct {
+	// Deadline is the write deadline which was exceeded.
+	Deadline time.Time
+
+	// Err is the error returned by the underlying connection.
+	Err error
+}
+
+// Error returns the error message.
+func (e *WriteTimeoutError) Error() string {
+	return fmt.Sprintf("write timeout (deadline %s): %s", e.Deadline.Format(time.RFC3339Nano), e.Err)
+}
+
+// Unwrap returns the error returned by the underlying connection.
+func (e *WriteTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout returns true, so the error satisfies net.Error.
+func (e *WriteTimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary returns false, so the error satisfies net.Error.
+func (e *WriteTimeoutError) Temporary() bool {
+	return false
+}
+
+// DeadlineExtensionError is returned when RespWriter.ExtendDeadline refuses to
+// extend the request's deadline.
+type DeadlineExtensionError struct {
+	// Requested is the deadline which was requested.
+	Requested time.Time
+
+	// Ceiling is the latest deadline allowed for the request.
+	Ceiling time.Time
+
+	// Err is the reason the extension was refused: ErrDeadlineCeiling,
+	// ErrAlreadyWritten or the request context's error.
+	Err error
+}
+
+// Error returns the error message.
+func (e *DeadlineExtensionError) Error() string {
+	return fmt.Sprintf("unable to extend deadline to %s (ceiling %s): %s", e.Requested.Format(time.RFC3339Nano), e.Ceiling.Format(time.RFC3339Nano), e.Err)
+}
+
+// Unwrap returns the reason the extension was refused.
+func (e *DeadlineExtensionError) Unwrap() error {
+	return e.Err
+}
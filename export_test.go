@@ -0,0 +1,44 @@
+package respwriter
+
+import (
+	"context"
+	"time"
+)
+
+// This file exports internals to the tests of package respwriter_test, which
+// can import respwritertest (its FakeClock for example).
+
+const (
+	TestTsigKey    = testTsigKey
+	TestTsigSecret = testTsigSecret
+)
+
+var (
+	RunServer         = runServer
+	NewTestMetrics    = newTestMetrics
+	TestCacheQuestion = testCacheQuestion
+	TestTTLHandler    = testTTLHandler
+	ServeCache        = serveCache
+)
+
+func (m *testMetrics) Counter(name string) int                  { return m.counter(name) }
+func (m *testMetrics) LastLabels(name string) map[string]string { return m.lastLabels(name) }
+
+// DeadlineContext is a deadlineContext, with the methods used by the tests
+// exported.
+type DeadlineContext struct {
+	*deadlineContext
+}
+
+func NewDeadlineContext(parent context.Context, deadline time.Time, clock Clock) (DeadlineContext, context.CancelFunc) {
+	ctx, cancel := newDeadlineContext(parent, deadline, clock)
+	return DeadlineContext{ctx}, cancel
+}
+
+func (c DeadlineContext) SetDeadline(deadline time.Time) bool { return c.setDeadline(deadline) }
+func (c DeadlineContext) Finish() bool                        { return c.finish() }
+func (c DeadlineContext) Timer() Timer                        { return c.timer }
+
+func (c DeadlineContext) Start(parent context.Context, deadline time.Time, clock Clock) {
+	c.start(parent, deadline, clock)
+}
@@ -0,0 +1,408 @@
+package respwriter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// FaultKind identifies the fault injected by a FaultRule.
+type FaultKind int
+
+const (
+	// FaultDelay delays the request by the rule's Delay before it's passed
+	// to the wrapped handler.
+	FaultDelay FaultKind = iota + 1
+
+	// FaultDrop drops the request, nothing is written and the request times
+	// out.
+	FaultDrop
+
+	// FaultWrongID changes the message ID of the responses written by the
+	// wrapped handler, so they don't match the request.
+	FaultWrongID
+
+	// FaultTruncate sets the TC bit of the responses written by the wrapped
+	// handler and strips their records.
+	FaultTruncate
+
+	// FaultRcode answers the request with the rule's Rcode (SERVFAIL or
+	// REFUSED for example) without calling the wrapped handler.
+	FaultRcode
+
+	// FaultPanic panics rather than answering the request. The panic crashes
+	// the process, since the dns.Server doesn't recover the panics of its
+	// handlers, unless the injector is wrapped by NewHandlerFunc with
+	// WithRecoverPanics(true), which answers it with SERVFAIL.
+	FaultPanic
+)
+
+// String returns a string representation of the fault kind.
+func (k FaultKind) String() string {
+	switch k {
+	case FaultDelay:
+		return "delay"
+	case FaultDrop:
+		return "drop"
+	case FaultWrongID:
+		return "wrong-id"
+	case FaultTruncate:
+		return "truncate"
+	case FaultRcode:
+		return "rcode"
+	case FaultPanic:
+		return "panic"
+	default:
+		return "unknown"
+	}
+}
+
+// FaultRule injects a fault into the requests it matches, with a probability.
+type FaultRule struct {
+	// Name matches the question name, case-insensitively. A "*." prefix
+	// matches the subdomains of the name, and "" matches every name.
+	Name string
+
+	// Qtype matches the question type, 0 matches every type.
+	Qtype uint16
+
+	// Probability is the probability of injecting the fault into a matching
+	// request, from 0 to 1.
+	Probability float64
+
+	// Kind is the fault injected.
+	Kind FaultKind
+
+	// Delay is the distribution of the delays injected by FaultDelay.
+	Delay Delay
+
+	// Rcode is the rcode answered by FaultRcode.
+	Rcode int
+}
+
+// matches returns true when the rule matches the question.
+func (r FaultRule) matches(q dns.Question) bool {
+	if r.Qtype != 0 && r.Qtype != q.Qtype {
+		return false
+	}
+	name := dns.CanonicalName(q.Name)
+	switch {
+	case r.Name == "":
+		return true
+	case strings.HasPrefix(r.Name, "*."):
+		parent := dns.CanonicalName(strings.TrimPrefix(r.Name, "*."))
+		return name != parent && dns.IsSubDomain(parent, name)
+	default:
+		return name == dns.CanonicalName(r.Name)
+	}
+}
+
+func (r FaultRule) validate() error {
+	switch {
+	case r.Probability < 0 || r.Probability > 1 || math.IsNaN(r.Probability):
+		return fmt.Errorf("invalid probability %v", r.Probability)
+	case r.Name != "" && r.Name != "*." && !dnsNameValid(strings.TrimPrefix(r.Name, "*.")):
+		return fmt.Errorf("invalid name %q", r.Name)
+	}
+	switch r.Kind {
+	case FaultDelay:
+		if isNil(r.Delay) {
+			return fmt.Errorf("missing delay")
+		}
+	case FaultRcode:
+		if _, ok := dns.RcodeToString[r.Rcode]; !ok || r.Rcode == dns.RcodeSuccess {
+			return fmt.Errorf("invalid rcode %d", r.Rcode)
+		}
+	case FaultDrop, FaultWrongID, FaultTruncate, FaultPanic:
+	default:
+		return fmt.Errorf("unknown fault kind %d", r.Kind)
+	}
+	return nil
+}
+
+func dnsNameValid(name string) bool {
+	_, ok := dns.IsDomainName(name)
+	return ok
+}
+
+// Delay is a distribution of the delays injected by FaultDelay.
+type Delay interface {
+	// Sample returns a delay, using r as the source of randomness.
+	Sample(r *rand.Rand) time.Duration
+}
+
+// FixedDelay returns a Delay which always delays by d.
+func FixedDelay(d time.Duration) Delay {
+	return fixedDelay(d)
+}
+
+type fixedDelay time.Duration
+
+func (d fixedDelay) Sample(*rand.Rand) time.Duration { return time.Duration(d) }
+
+// UniformDelay returns a Delay which is uniformly distributed between min and
+// max.
+func UniformDelay(min, max time.Duration) Delay {
+	if max < min {
+		min, max = max, min
+	}
+	return uniformDelay{min: min, max: max}
+}
+
+type uniformDelay struct{ min, max time.Duration }
+
+func (d uniformDelay) Sample(r *rand.Rand) time.Duration {
+	if d.max == d.min {
+		return d.min
+	}
+	return d.min + time.Duration(r.Int63n(int64(d.max-d.min)+1))
+}
+
+// NormalDelay returns a Delay which is normally distributed with the mean and
+// standard deviation. Negative samples are clamped to zero.
+func NormalDelay(mean, stddev time.Duration) Delay {
+	return normalDelay{mean: mean, stddev: stddev}
+}
+
+type normalDelay struct{ mean, stddev time.Duration }
+
+func (d normalDelay) Sample(r *rand.Rand) time.Duration {
+	return max(0, d.mean+time.Duration(r.NormFloat64()*float64(d.stddev)))
+}
+
+// ExponentialDelay returns a Delay which is exponentially distributed with the
+// mean, which models the long tail of a browned out upstream.
+func ExponentialDelay(mean time.Duration) Delay {
+	return exponentialDelay(mean)
+}
+
+type exponentialDelay time.Duration
+
+func (d exponentialDelay) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(d))
+}
+
+// FaultInjector is a middleware which wraps a dns.HandlerFunc and injects
+// faults (delays, drops, wrong IDs, truncated responses, error rcodes and
+// panics) into the requests matched by its rules, to test how clients and
+// the RespWriter's timeouts behave when an upstream browns out.
+//
+// Every matching rule injects its fault with its probability, in order, so a
+// delay followed by SERVFAIL is expressed with two rules. The randomness is
+// seeded (see WithFaultSeed) so runs are reproducible, and the rules can be
+// replaced at runtime via SetRules.
+//
+// FaultInjector.ServeDNS is typically wrapped by NewHandlerFunc, so injected
+// delays are bound by the request timeout.
+type FaultInjector struct {
+	handler dns.HandlerFunc
+	logger  *slog.Logger
+	metrics Metrics
+	clock   Clock
+
+	mu      sync.Mutex
+	rules   []FaultRule
+	enabled bool
+	rand    *rand.Rand
+}
+
+// NewFaultInjector returns a new FaultInjector which wraps the given handler.
+// Options supported: WithFaultRules, WithFaultSeed, WithLogger, WithMetrics,
+// WithClock
+func NewFaultInjector(h dns.HandlerFunc, opt ...Option) (*FaultInjector, error) {
+	const op = "respwriter.NewFaultInjector"
+	if isNil(h) {
+		return nil, fmt.Errorf("%s: nil handler: %w", op, ErrInvalidParameter)
+	}
+	opts := getGeneralOpts(opt...)
+	seed := opts.withFaultSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	f := &FaultInjector{
+		handler: h,
+		logger:  opts.withLogger,
+		metrics: opts.withMetrics,
+		clock:   opts.withClock,
+		enabled: true,
+		rand:    rand.New(rand.NewSource(seed)),
+	}
+	if err := f.SetRules(opts.withFaultRules...); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return f, nil
+}
+
+// SetRules replaces the rules of the injector. The rules are validated, and
+// the existing rules are kept when any of them is invalid.
+func (f *FaultInjector) SetRules(rules ...FaultRule) error {
+	const op = "respwriter.(FaultInjector).SetRules"
+	for i, r := range rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("%s: rule %d: %s: %w", op, i, err, ErrInvalidParameter)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append([]FaultRule(nil), rules...)
+	return nil
+}
+
+// Rules returns the current rules of the injector.
+func (f *FaultInjector) Rules() []FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FaultRule(nil), f.rules...)
+}
+
+// SetEnabled enables or disables the injector at runtime, a disabled injector
+// passes every request to the wrapped handler. It's enabled by default.
+func (f *FaultInjector) SetEnabled(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.enabled = enabled
+}
+
+// Enabled returns true when the injector is enabled.
+func (f *FaultInjector) Enabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enabled
+}
+
+// ServeDNS injects the faults of the rules matching the request, and unless a
+// fault answered (or dropped) the request, it calls the wrapped handler.
+func (f *FaultInjector) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	faults := f.sample(r)
+	if len(faults) == 0 {
+		f.handler(w, r)
+		return
+	}
+
+	ctx := context.Background()
+	if rw, ok := w.(*RespWriter); ok {
+		ctx = rw.RequestContext()
+	}
+	var fw *faultWriter
+	for _, fault := range faults {
+		f.report(r, fault.kind)
+		switch fault.kind {
+		case FaultDelay:
+			if !f.sleep(ctx, fault.delay) {
+				// the request timed out while delayed.
+				return
+			}
+		case FaultDrop:
+			return
+		case FaultRcode:
+			m := new(dns.Msg)
+			m.SetRcode(r, fault.rcode)
+			_ = w.WriteMsg(m)
+			return
+		case FaultPanic:
+			panic(fmt.Sprintf("respwriter: injected panic for %s", r.Question[0].Name))
+		case FaultWrongID, FaultTruncate:
+			if fw == nil {
+				fw = &faultWriter{}
+			}
+			fw.wrongID = fw.wrongID || fault.kind == FaultWrongID
+			fw.truncate = fw.truncate || fault.kind == FaultTruncate
+		}
+	}
+	if fw == nil {
+		f.handler(w, r)
+		return
+	}
+	f.handler(wrapWrites(w, func(next dns.ResponseWriter) dns.ResponseWriter {
+		fw.ResponseWriter = next
+		return fw
+	}, WithLogger(f.logger), WithClock(f.clock)), r)
+}
+
+// injectedFault is a fault to inject into a request, sampled from a rule.
+type injectedFault struct {
+	kind  FaultKind
+	delay time.Duration
+	rcode int
+}
+
+// sample returns the faults to inject into the request.
+func (f *FaultInjector) sample(r *dns.Msg) []injectedFault {
+	if len(r.Question) == 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.enabled {
+		return nil
+	}
+	var faults []injectedFault
+	for _, rule := range f.rules {
+		if !rule.matches(r.Question[0]) || f.rand.Float64() >= rule.Probability {
+			continue
+		}
+		fault := injectedFault{kind: rule.Kind, rcode: rule.Rcode}
+		if rule.Kind == FaultDelay {
+			fault.delay = rule.Delay.Sample(f.rand)
+		}
+		faults = append(faults, fault)
+	}
+	return faults
+}
+
+// sleep waits for d, it returns false when the context is done first.
+func (f *FaultInjector) sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	elapsed := make(chan struct{})
+	timer := f.clock.AfterFunc(d, func() { close(elapsed) })
+	defer timer.Stop()
+	select {
+	case <-elapsed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (f *FaultInjector) report(r *dns.Msg, kind FaultKind) {
+	if f.logger != nil {
+		f.logger.Debug("injected fault", "fault", kind.String(), "qname", r.Question[0].Name, "qtype", dns.TypeToString[r.Question[0].Qtype])
+	}
+	if f.metrics != nil {
+		f.metrics.IncCounter(MetricFaults, map[string]string{"fault": kind.String()})
+	}
+}
+
+// faultWriter mangles the responses written by the wrapped handler.
+type faultWriter struct {
+	dns.ResponseWriter
+	wrongID  bool
+	truncate bool
+}
+
+// WriteMsg writes a mangled copy of the message.
+func (w *faultWriter) WriteMsg(m *dns.Msg) error {
+	m = m.Copy()
+	if w.wrongID {
+		m.Id++
+	}
+	if w.truncate {
+		m.Truncated = true
+		m.Answer, m.Ns = nil, nil
+		var extra []dns.RR
+		if opt := m.IsEdns0(); opt != nil {
+			extra = append(extra, opt)
+		}
+		m.Extra = extra
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
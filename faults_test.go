@@ -0,0 +1,454 @@
+package respwriter
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFaultInjector(t *testing.T) {
+	t.Parallel()
+	testHandler := func(w dns.ResponseWriter, req *dns.Msg) {}
+
+	tests := []struct {
+		name            string
+		handler         dns.HandlerFunc
+		opts            []Option
+		wantErrIs       error
+		wantErrContains string
+	}{
+		{
+			name:    "success",
+			handler: testHandler,
+		},
+		{
+			name:    "success-rules",
+			handler: testHandler,
+			opts: []Option{WithFaultSeed(1), WithFaultRules(
+				FaultRule{Name: "*.example.", Probability: 0.5, Kind: FaultDelay, Delay: FixedDelay(time.Millisecond)},
+				FaultRule{Qtype: dns.TypeAAAA, Probability: 1, Kind: FaultRcode, Rcode: dns.RcodeRefused},
+			)},
+		},
+		{
+			name:            "err-nil-handler",
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "nil handler",
+		},
+		{
+			name:            "err-probability",
+			handler:         testHandler,
+			opts:            []Option{WithFaultRules(FaultRule{Probability: 1.5, Kind: FaultDrop})},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "rule 0: invalid probability 1.5",
+		},
+		{
+			name:            "err-name",
+			handler:         testHandler,
+			opts:            []Option{WithFaultRules(FaultRule{Name: "bad..name.", Probability: 1, Kind: FaultDrop})},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: `rule 0: invalid name "bad..name."`,
+		},
+		{
+			name:            "err-missing-delay",
+			handler:         testHandler,
+			opts:            []Option{WithFaultRules(FaultRule{Probability: 1, Kind: FaultDrop}, FaultRule{Probability: 1, Kind: FaultDelay})},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "rule 1: missing delay",
+		},
+		{
+			name:            "err-rcode",
+			handler:         testHandler,
+			opts:            []Option{WithFaultRules(FaultRule{Probability: 1, Kind: FaultRcode})},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "rule 0: invalid rcode 0",
+		},
+		{
+			name:            "err-kind",
+			handler:         testHandler,
+			opts:            []Option{WithFaultRules(FaultRule{Probability: 1})},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "rule 0: unknown fault kind 0",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			got, err := NewFaultInjector(tc.handler, tc.opts...)
+			if tc.wantErrContains != "" {
+				require.Error(err)
+				assert.ErrorIs(err, tc.wantErrIs)
+				assert.Contains(err.Error(), tc.wantErrContains)
+				return
+			}
+			require.NoError(err)
+			assert.NotNil(got)
+			assert.True(got.Enabled())
+		})
+	}
+}
+
+func TestFaultInjector_ServeDNS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		rules       []FaultRule
+		qname       string
+		qtype       uint16
+		ctxTimeout  time.Duration
+		wantCalled  bool
+		wantWritten bool
+		wantRcode   int
+		wantWrongID bool
+		wantTC      bool
+		wantMinTime time.Duration
+		wantPanic   bool
+		wantFaults  int
+	}{
+		{
+			name:        "no-rules",
+			wantCalled:  true,
+			wantWritten: true,
+		},
+		{
+			name:        "name-mismatch",
+			rules:       []FaultRule{{Name: "example.", Probability: 1, Kind: FaultDrop}},
+			wantCalled:  true,
+			wantWritten: true,
+		},
+		{
+			name:        "qtype-mismatch",
+			rules:       []FaultRule{{Qtype: dns.TypeAAAA, Probability: 1, Kind: FaultDrop}},
+			wantCalled:  true,
+			wantWritten: true,
+		},
+		{
+			name:        "zero-probability",
+			rules:       []FaultRule{{Probability: 0, Kind: FaultDrop}},
+			wantCalled:  true,
+			wantWritten: true,
+		},
+		{
+			name:       "drop",
+			rules:      []FaultRule{{Name: "GO.dev", Qtype: dns.TypeA, Probability: 1, Kind: FaultDrop}},
+			wantFaults: 1,
+		},
+		{
+			name:       "wildcard",
+			rules:      []FaultRule{{Name: "*.example.", Probability: 1, Kind: FaultDrop}},
+			qname:      "www.example.",
+			wantFaults: 1,
+		},
+		{
+			name:        "wildcard-apex",
+			rules:       []FaultRule{{Name: "*.example.", Probability: 1, Kind: FaultDrop}},
+			qname:       "example.",
+			wantCalled:  true,
+			wantWritten: true,
+		},
+		{
+			name:        "rcode",
+			rules:       []FaultRule{{Probability: 1, Kind: FaultRcode, Rcode: dns.RcodeServerFailure}},
+			wantWritten: true,
+			wantRcode:   dns.RcodeServerFailure,
+			wantFaults:  1,
+		},
+		{
+			name:        "wrong-id",
+			rules:       []FaultRule{{Probability: 1, Kind: FaultWrongID}},
+			wantCalled:  true,
+			wantWritten: true,
+			wantWrongID: true,
+			wantFaults:  1,
+		},
+		{
+			name:        "truncate",
+			rules:       []FaultRule{{Probability: 1, Kind: FaultTruncate}},
+			wantCalled:  true,
+			wantWritten: true,
+			wantTC:      true,
+			wantFaults:  1,
+		},
+		{
+			name: "delay-then-refused",
+			rules: []FaultRule{
+				{Probability: 1, Kind: FaultDelay, Delay: FixedDelay(20 * time.Millisecond)},
+				{Probability: 1, Kind: FaultRcode, Rcode: dns.RcodeRefused},
+			},
+			wantWritten: true,
+			wantRcode:   dns.RcodeRefused,
+			wantMinTime: 20 * time.Millisecond,
+			wantFaults:  2,
+		},
+		{
+			name:        "delay",
+			rules:       []FaultRule{{Probability: 1, Kind: FaultDelay, Delay: FixedDelay(20 * time.Millisecond)}},
+			wantCalled:  true,
+			wantWritten: true,
+			wantMinTime: 20 * time.Millisecond,
+			wantFaults:  1,
+		},
+		{
+			name:        "delay-past-timeout",
+			rules:       []FaultRule{{Probability: 1, Kind: FaultDelay, Delay: FixedDelay(time.Minute)}},
+			ctxTimeout:  20 * time.Millisecond,
+			wantMinTime: 20 * time.Millisecond,
+			wantFaults:  1,
+		},
+		{
+			name:       "panic",
+			rules:      []FaultRule{{Probability: 1, Kind: FaultPanic}},
+			wantPanic:  true,
+			wantFaults: 1,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			var called atomic.Bool
+			metrics := newTestMetrics()
+			f, err := NewFaultInjector(func(w dns.ResponseWriter, r *dns.Msg) {
+				called.Store(true)
+				_, ok := w.(*RespWriter)
+				assert.True(ok, "handler must be passed a *RespWriter")
+				m := new(dns.Msg)
+				m.SetReply(r)
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   []byte{192, 0, 2, 1},
+				})
+				_ = w.WriteMsg(m)
+			}, WithFaultRules(tc.rules...), WithMetrics(metrics))
+			require.NoError(err)
+
+			r := new(dns.Msg)
+			qname, qtype := tc.qname, tc.qtype
+			if qname == "" {
+				qname = "go.dev."
+			}
+			if qtype == 0 {
+				qtype = dns.TypeA
+			}
+			r.SetQuestion(qname, qtype)
+
+			ctx := context.Background()
+			if tc.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.ctxTimeout)
+				defer cancel()
+			}
+			cw := &captureWriter{ResponseWriter: new(mockDNSResponseWriter)}
+			start := time.Now()
+			if tc.wantPanic {
+				assert.Panics(func() { f.ServeDNS(NewRespWriter(ctx, cw), r) })
+				assert.Equal(tc.wantFaults, metrics.counter(MetricFaults))
+				return
+			}
+			f.ServeDNS(NewRespWriter(ctx, cw), r)
+			assert.GreaterOrEqual(time.Since(start), tc.wantMinTime)
+			assert.Equal(tc.wantCalled, called.Load())
+			assert.Equal(tc.wantFaults, metrics.counter(MetricFaults))
+			if !tc.wantWritten {
+				assert.Nil(cw.msg)
+				return
+			}
+			require.NotNil(cw.msg)
+			assert.Equal(tc.wantRcode, cw.msg.Rcode)
+			assert.Equal(tc.wantWrongID, cw.msg.Id != r.Id)
+			assert.Equal(tc.wantTC, cw.msg.Truncated)
+			if tc.wantTC {
+				assert.Empty(cw.msg.Answer)
+			}
+		})
+	}
+}
+
+func TestFaultInjector_NewHandlerFunc(t *testing.T) {
+	t.Parallel()
+	testLogger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Run("panic", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		metrics := newTestMetrics()
+		f, err := NewFaultInjector(func(w dns.ResponseWriter, r *dns.Msg) {},
+			WithFaultRules(FaultRule{Probability: 1, Kind: FaultPanic}), WithMetrics(metrics))
+		require.NoError(err)
+		h, err := NewHandlerFunc(time.Second, f.ServeDNS, WithLogger(testLogger), WithMetrics(metrics), WithRecoverPanics(true))
+		require.NoError(err)
+
+		// the injected panic is answered rather than crashing the process,
+		// since the handler recovers panics.
+		cw := &captureWriter{ResponseWriter: new(mockDNSResponseWriter)}
+		assert.NotPanics(func() { h(cw, testCacheQuestion(1)) })
+		require.NotNil(cw.msg)
+		assert.Equal(dns.RcodeServerFailure, cw.msg.Rcode)
+		assert.Equal(1, metrics.counter(MetricFaults))
+		assert.Equal(1, metrics.counter(MetricPanics))
+	})
+	t.Run("wrong-id-detached", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		var handlerWriter *RespWriter
+		f, err := NewFaultInjector(func(w dns.ResponseWriter, r *dns.Msg) {
+			// the handler gets the writer of NewHandlerFunc.
+			handlerWriter = w.(*RespWriter)
+			assert.NoError(handlerWriter.ExtendDeadline(time.Second))
+			d := handlerWriter.Detach()
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				m := new(dns.Msg)
+				m.SetReply(r)
+				assert.NoError(d.Respond(m))
+			}()
+		}, WithFaultRules(FaultRule{Probability: 1, Kind: FaultWrongID}))
+		require.NoError(err)
+		var outer *RespWriter
+		h, err := NewHandlerFunc(50*time.Millisecond, func(w dns.ResponseWriter, r *dns.Msg) {
+			outer = w.(*RespWriter)
+			f.ServeDNS(w, r)
+		}, WithMaxRequestTimeout(time.Minute), WithLogger(testLogger))
+		require.NoError(err)
+
+		r := testCacheQuestion(1)
+		cw := &captureWriter{ResponseWriter: new(mockDNSResponseWriter)}
+		h(cw, r)
+		assert.Same(outer, handlerWriter)
+		// the response written after the handler returned is mangled.
+		require.NotNil(cw.msg)
+		assert.Equal(dns.RcodeSuccess, cw.msg.Rcode)
+		assert.NotEqual(r.Id, cw.msg.Id)
+	})
+}
+
+func TestFaultInjector_seed(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	}
+	// drops returns which of n requests are dropped.
+	drops := func(seed int64, n int) []bool {
+		f, err := NewFaultInjector(handler, WithFaultSeed(seed), WithFaultRules(FaultRule{Probability: 0.5, Kind: FaultDrop}))
+		require.NoError(err)
+		var got []bool
+		for i := 0; i < n; i++ {
+			cw := &captureWriter{ResponseWriter: new(mockDNSResponseWriter)}
+			f.ServeDNS(NewRespWriter(context.Background(), cw), testCacheQuestion(uint16(i)))
+			got = append(got, cw.msg == nil)
+		}
+		return got
+	}
+	first := drops(42, 100)
+	assert.Equal(first, drops(42, 100))
+	assert.NotEqual(first, drops(43, 100))
+	assert.Contains(first, true)
+	assert.Contains(first, false)
+}
+
+func TestFaultInjector_runtimeControl(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	var calls atomic.Int32
+	f, err := NewFaultInjector(testTTLHandler(60, &calls))
+	require.NoError(err)
+	serve := func() *dns.Msg {
+		cw := &captureWriter{ResponseWriter: new(mockDNSResponseWriter)}
+		f.ServeDNS(NewRespWriter(context.Background(), cw), testCacheQuestion(1))
+		return cw.msg
+	}
+
+	assert.NotNil(serve())
+	assert.Empty(f.Rules())
+
+	// a brownout starts
+	brownout := []FaultRule{{Probability: 1, Kind: FaultRcode, Rcode: dns.RcodeServerFailure}}
+	require.NoError(f.SetRules(brownout...))
+	assert.Equal(brownout, f.Rules())
+	got := serve()
+	require.NotNil(got)
+	assert.Equal(dns.RcodeServerFailure, got.Rcode)
+
+	// invalid rules don't replace the existing ones
+	err = f.SetRules(FaultRule{Probability: -1, Kind: FaultDrop})
+	assert.ErrorIs(err, ErrInvalidParameter)
+	assert.Equal(brownout, f.Rules())
+
+	// disabled, requests pass through
+	f.SetEnabled(false)
+	assert.False(f.Enabled())
+	got = serve()
+	require.NotNil(got)
+	assert.Equal(dns.RcodeSuccess, got.Rcode)
+
+	// the brownout is over
+	f.SetEnabled(true)
+	require.NoError(f.SetRules())
+	got = serve()
+	require.NotNil(got)
+	assert.Equal(dns.RcodeSuccess, got.Rcode)
+	assert.Equal(int32(3), calls.Load())
+}
+
+func TestDelay(t *testing.T) {
+	t.Parallel()
+	const samples = 10000
+	r := rand.New(rand.NewSource(1))
+	mean := func(d Delay) time.Duration {
+		var sum time.Duration
+		for i := 0; i < samples; i++ {
+			s := d.Sample(r)
+			assert.GreaterOrEqual(t, s, time.Duration(0))
+			sum += s
+		}
+		return sum / samples
+	}
+
+	t.Run("fixed", func(t *testing.T) {
+		assert.Equal(t, 5*time.Millisecond, FixedDelay(5*time.Millisecond).Sample(r))
+	})
+	t.Run("uniform", func(t *testing.T) {
+		assert := assert.New(t)
+		d := UniformDelay(20*time.Millisecond, 10*time.Millisecond)
+		for i := 0; i < samples; i++ {
+			s := d.Sample(r)
+			assert.GreaterOrEqual(s, 10*time.Millisecond)
+			assert.LessOrEqual(s, 20*time.Millisecond)
+		}
+		assert.Equal(time.Millisecond, UniformDelay(time.Millisecond, time.Millisecond).Sample(r))
+	})
+	t.Run("normal", func(t *testing.T) {
+		assert.InDelta(t, float64(100*time.Millisecond), float64(mean(NormalDelay(100*time.Millisecond, 10*time.Millisecond))), float64(time.Millisecond))
+		// negative samples are clamped
+		mean(NormalDelay(0, 10*time.Millisecond))
+	})
+	t.Run("exponential", func(t *testing.T) {
+		assert.InDelta(t, float64(100*time.Millisecond), float64(mean(ExponentialDelay(100*time.Millisecond))), float64(5*time.Millisecond))
+	})
+}
+
+func TestFaultKind_String(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	assert.Equal("delay", FaultDelay.String())
+	assert.Equal("drop", FaultDrop.String())
+	assert.Equal("wrong-id", FaultWrongID.String())
+	assert.Equal("truncate", FaultTruncate.String())
+	assert.Equal("rcode", FaultRcode.String())
+	assert.Equal("panic", FaultPanic.String())
+	assert.Equal("unknown", FaultKind(0).String())
+}
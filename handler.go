@@ -0,0 +1,80 @@
+package respwriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ContextHandlerFunc is a handler which receives the request context and
+// returns an error instead of writing an error response itself. See
+// NewContextHandlerFunc.
+type ContextHandlerFunc func(ctx context.Context, w *RespWriter, r *dns.Msg) error
+
+// ErrorMapper maps an error returned by a ContextHandlerFunc to the rcode of
+// the response.
+type ErrorMapper func(err error) int
+
+// DefaultErrorMapper maps errors to rcodes as follows: ErrInvalidParameter to
+// FORMERR, ErrNotFound to NXDOMAIN, ErrRefused to REFUSED and everything else,
+// including deadline and cancellation errors, to SERVFAIL.
+func DefaultErrorMapper(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidParameter):
+		return dns.RcodeFormatError
+	case errors.Is(err, ErrNotFound):
+		return dns.RcodeNameError
+	case errors.Is(err, ErrRefused):
+		return dns.RcodeRefused
+	default:
+		return dns.RcodeServerFailure
+	}
+}
+
+// NewContextHandlerFunc returns a new dns.HandlerFunc which wraps the given
+// ContextHandlerFunc like NewHandlerFunc does. The handler is passed the
+// RespWriter's RequestContext and, when it returns an error without having
+// written a response, the error is mapped to an rcode (see WithErrorMapper)
+// and the response is written, even if the request context is done. Options
+// supported: the options of NewHandlerFunc and WithErrorMapper
+func NewContextHandlerFunc(requestTimeout time.Duration, h ContextHandlerFunc, opt ...Option) (dns.HandlerFunc, error) {
+	const op = "respwriter.NewContextHandlerFunc"
+	if isNil(h) {
+		return nil, fmt.Errorf("%s: nil handler: %w", op, ErrInvalidParameter)
+	}
+	opts := getGeneralOpts(opt...)
+	handler, err := NewHandlerFunc(requestTimeout, func(w dns.ResponseWriter, r *dns.Msg) {
+		rw := w.(*RespWriter)
+		if err := h(rw.RequestContext(), rw, r); err != nil {
+			rw.handleError(err, opts.withErrorMapper)
+		}
+	}, opt...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return handler, nil
+}
+
+// handleError writes the response for the error returned by a handler, unless
+// a response has already been written. Like the timeout reply, it's written via
+// writeFallback, so it goes through the writers installed by middlewares.
+func (rw *RespWriter) handleError(err error, mapper ErrorMapper) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rcode := mapper(err)
+	logger := rw.Logger()
+	if logger != nil {
+		logger.Debug("handler error", "remote_addr", rw.RemoteAddr().String(), "rcode", dns.RcodeToString[rcode], "err", err)
+	}
+	if rw.written || rw.hijacked || rw.request == nil {
+		return
+	}
+	m := new(dns.Msg)
+	m.SetRcode(rw.request, rcode)
+	if err := rw.writeFallback(m); err != nil && logger != nil {
+		logger.Debug("unable to write error response", "err", err)
+	}
+}
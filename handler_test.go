@@ -0,0 +1,183 @@
+package respwriter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewContextHandlerFunc(t *testing.T) {
+	t.Parallel()
+	errBackend := errors.New("backend unavailable")
+
+	tests := []struct {
+		name            string
+		handler         ContextHandlerFunc
+		timeout         time.Duration
+		opts            []Option
+		wantRcode       int
+		wantAnswer      bool
+		wantErrIs       error
+		wantErrContains string
+	}{
+		{
+			name: "success",
+			handler: func(ctx context.Context, w *RespWriter, r *dns.Msg) error {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   []byte{192, 0, 2, 1},
+				})
+				return w.WriteMsg(m)
+			},
+			wantRcode:  dns.RcodeSuccess,
+			wantAnswer: true,
+		},
+		{
+			name: "not-found",
+			handler: func(ctx context.Context, w *RespWriter, r *dns.Msg) error {
+				return fmt.Errorf("lookup: %w", ErrNotFound)
+			},
+			wantRcode: dns.RcodeNameError,
+		},
+		{
+			name: "invalid-parameter",
+			handler: func(ctx context.Context, w *RespWriter, r *dns.Msg) error {
+				return ErrInvalidParameter
+			},
+			wantRcode: dns.RcodeFormatError,
+		},
+		{
+			name: "refused",
+			handler: func(ctx context.Context, w *RespWriter, r *dns.Msg) error {
+				return ErrRefused
+			},
+			wantRcode: dns.RcodeRefused,
+		},
+		{
+			name: "other-error",
+			handler: func(ctx context.Context, w *RespWriter, r *dns.Msg) error {
+				return errBackend
+			},
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name:    "deadline",
+			timeout: 50 * time.Millisecond,
+			handler: func(ctx context.Context, w *RespWriter, r *dns.Msg) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name: "custom-mapper",
+			handler: func(ctx context.Context, w *RespWriter, r *dns.Msg) error {
+				return errBackend
+			},
+			opts: []Option{WithErrorMapper(func(err error) int {
+				if errors.Is(err, errBackend) {
+					return dns.RcodeNotImplemented
+				}
+				return DefaultErrorMapper(err)
+			})},
+			wantRcode: dns.RcodeNotImplemented,
+		},
+		{
+			name: "error-after-write",
+			handler: func(ctx context.Context, w *RespWriter, r *dns.Msg) error {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				if err := w.WriteMsg(m); err != nil {
+					return err
+				}
+				return errBackend
+			},
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:            "err-nil-handler",
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "nil handler",
+		},
+		{
+			name: "err-invalid-request-timeout",
+			handler: func(ctx context.Context, w *RespWriter, r *dns.Msg) error {
+				return nil
+			},
+			timeout:         -1,
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "invalid request timeout",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			timeout := tc.timeout
+			if timeout == 0 {
+				timeout = time.Second
+			}
+			h, err := NewContextHandlerFunc(timeout, tc.handler, tc.opts...)
+			if tc.wantErrContains != "" {
+				require.Error(err)
+				assert.ErrorIs(err, tc.wantErrIs)
+				assert.Contains(err.Error(), tc.wantErrContains)
+				return
+			}
+			require.NoError(err)
+			_, c, addr := runTestDnsServer(t, ".", h)
+
+			r := new(dns.Msg)
+			r.SetQuestion("go.dev.", dns.TypeA)
+			got, _, err := c.Exchange(r, addr)
+			require.NoError(err)
+			assert.Equal(r.Id, got.Id)
+			assert.Equal(tc.wantRcode, got.Rcode)
+			assert.Equal(tc.wantAnswer, len(got.Answer) > 0)
+		})
+	}
+	t.Run("error-reply-recorded", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		sink := &testTrafficSink{}
+		tr, err := NewTrafficRecorder(func(dns.ResponseWriter, *dns.Msg) {}, sink)
+		require.NoError(err)
+		h, err := NewContextHandlerFunc(time.Second, func(ctx context.Context, w *RespWriter, r *dns.Msg) error {
+			tr.ServeDNS(w, r)
+			return errBackend
+		})
+		require.NoError(err)
+
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		h(new(mockUDPResponseWriter), r)
+
+		// the error reply goes through the writers installed by middlewares.
+		records := sink.all()
+		require.Len(records, 1)
+		resp := new(dns.Msg)
+		require.NoError(resp.Unpack(records[0].Response))
+		assert.Equal(r.Id, resp.Id)
+		assert.Equal(dns.RcodeServerFailure, resp.Rcode)
+	})
+}
+
+func TestDefaultErrorMapper(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	assert.Equal(dns.RcodeServerFailure, DefaultErrorMapper(context.DeadlineExceeded))
+	assert.Equal(dns.RcodeServerFailure, DefaultErrorMapper(context.Canceled))
+	assert.Equal(dns.RcodeFormatError, DefaultErrorMapper(fmt.Errorf("op: %w", ErrInvalidParameter)))
+	assert.Equal(dns.RcodeNameError, DefaultErrorMapper(ErrNotFound))
+	assert.Equal(dns.RcodeRefused, DefaultErrorMapper(ErrRefused))
+	assert.Equal(dns.RcodeServerFailure, DefaultErrorMapper(errors.New("other")))
+}
@@ -0,0 +1,61 @@
+package respwriter
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// HijackConn hijacks the underlying stream connection and returns it, along
+// with a new context which is detached from the request context: it keeps
+// the request context's values, but it's not canceled when the request times
+// out. The new context has no deadline unless WithHijackTimeout is used and
+// the returned cancel func must be called to release its resources.
+//
+// Once hijacked, the handler owns the connection (including closing it) and
+// the writer's WriteMsg, Write and Close return ErrHijacked. The underlying
+// writer must implement ExposesUnderlyingConns and the request must have been
+// received over a stream transport, otherwise ErrUnsupportedTransport is
+// returned.
+//
+// When the writer doesn't expose its connection (see ExposesUnderlyingConns),
+// use Hijack to take over the connection from the server without getting it.
+// Options supported: WithHijackTimeout
+func (rw *RespWriter) HijackConn(opt ...Option) (net.Conn, context.Context, context.CancelFunc, error) {
+	const op = "respwriter.(RespWriter).HijackConn"
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.hijacked {
+		return nil, nil, nil, fmt.Errorf("%s: %w", op, ErrHijacked)
+	}
+	conn := rw.streamConn()
+	if conn == nil {
+		return nil, nil, nil, fmt.Errorf("%s: hijacking requires an exposed stream connection: %w", op, ErrUnsupportedTransport)
+	}
+	opts := getGeneralOpts(opt...)
+
+	detached := context.WithoutCancel(rw.requestCtx)
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	switch {
+	case opts.withHijackTimeout > 0:
+		ctx, cancel = newDeadlineContext(detached, rw.clock.Now().Add(opts.withHijackTimeout), rw.clock)
+	default:
+		ctx, cancel = context.WithCancel(detached)
+	}
+	rw.hijack()
+	return conn, ctx, cancel, nil
+}
+
+// reportHijack logs the hijack and increments the hijack counter.
+func (rw *RespWriter) reportHijack() {
+	transport := rw.Transport()
+	if logger := rw.Logger(); logger != nil {
+		logger.Debug("connection hijacked", "remote_addr", rw.RemoteAddr().String(), "transport", transport.String())
+	}
+	if rw.metrics != nil {
+		rw.metrics.IncCounter(MetricHijacks, rw.labels(map[string]string{"transport": transport.String()}))
+	}
+}
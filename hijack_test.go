@@ -0,0 +1,110 @@
+package respwriter
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRespWriter_HijackConn(t *testing.T) {
+	t.Parallel()
+	testLogger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{AddSource: true}))
+
+	t.Run("success", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		type key struct{}
+		server, client := net.Pipe()
+		t.Cleanup(func() { server.Close(); client.Close() })
+		reqCtx, reqCancel := context.WithTimeout(context.WithValue(context.Background(), key{}, "value"), time.Minute)
+		metrics := newTestMetrics()
+		rw := NewRespWriter(reqCtx, &mockPipeResponseWriter{conn: server}, WithLogger(testLogger), WithMetrics(metrics))
+
+		conn, ctx, cancel, err := rw.HijackConn()
+		require.NoError(err)
+		t.Cleanup(cancel)
+		assert.Equal(server, conn)
+		assert.Equal(1, metrics.counter(MetricHijacks))
+		assert.Equal(map[string]string{"transport": "tcp"}, metrics.lastLabels(MetricHijacks))
+
+		// the context is detached from the request context
+		reqCancel()
+		assert.NoError(ctx.Err())
+		_, ok := ctx.Deadline()
+		assert.False(ok)
+		assert.Equal("value", ctx.Value(key{}))
+
+		// the writer can't be used anymore
+		assert.ErrorIs(rw.WriteMsg(new(dns.Msg)), ErrHijacked)
+		_, err = rw.Write([]byte("hello"))
+		assert.ErrorIs(err, ErrHijacked)
+		assert.ErrorIs(rw.Close(), ErrHijacked)
+		_, _, _, err = rw.HijackConn()
+		assert.ErrorIs(err, ErrHijacked)
+		assert.Equal(1, metrics.counter(MetricHijacks))
+	})
+	t.Run("with-timeout", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		server, client := net.Pipe()
+		t.Cleanup(func() { server.Close(); client.Close() })
+		rw := NewRespWriter(context.Background(), &mockPipeResponseWriter{conn: server}, WithLogger(testLogger))
+
+		_, ctx, cancel, err := rw.HijackConn(WithHijackTimeout(10 * time.Millisecond))
+		require.NoError(err)
+		t.Cleanup(cancel)
+		_, ok := ctx.Deadline()
+		assert.True(ok)
+		<-ctx.Done()
+		assert.Equal(context.DeadlineExceeded, ctx.Err())
+	})
+	t.Run("udp", func(t *testing.T) {
+		rw := NewRespWriter(context.Background(), new(mockUDPResponseWriter), WithLogger(testLogger))
+		_, _, _, err := rw.HijackConn()
+		assert.ErrorIs(t, err, ErrUnsupportedTransport)
+		assert.NoError(t, rw.WriteMsg(new(dns.Msg)))
+	})
+	t.Run("not-exposed", func(t *testing.T) {
+		rw := NewRespWriter(context.Background(), &mockAddrResponseWriter{remote: &net.TCPAddr{}}, WithLogger(testLogger))
+		_, _, _, err := rw.HijackConn()
+		assert.ErrorIs(t, err, ErrUnsupportedTransport)
+	})
+	t.Run("stock-server", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		hijackErr := make(chan error, 1)
+		h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+			// the writer of a stock dns.Server doesn't expose its connection,
+			// even over TCP.
+			_, _, _, err := w.(*RespWriter).HijackConn()
+			hijackErr <- err
+			m := new(dns.Msg)
+			m.SetReply(r)
+			_ = w.WriteMsg(m)
+		}, WithLogger(testLogger))
+		require.NoError(err)
+		_, c, addr := runTestDnsServer(t, ".", h)
+
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		got, _, err := c.Exchange(r, addr)
+		assert.ErrorIs(<-hijackErr, ErrUnsupportedTransport)
+		// the connection stays with the server, which answers.
+		require.NoError(err)
+		assert.Equal(r.Id, got.Id)
+	})
+	t.Run("hijack", func(t *testing.T) {
+		assert := assert.New(t)
+		metrics := newTestMetrics()
+		rw := NewRespWriter(context.Background(), new(mockTCPResponseWriter), WithLogger(testLogger), WithMetrics(metrics))
+		rw.Hijack()
+		rw.Hijack()
+		assert.Equal(1, metrics.counter(MetricHijacks))
+		assert.ErrorIs(rw.WriteMsg(new(dns.Msg)), ErrHijacked)
+		assert.ErrorIs(rw.Close(), ErrHijacked)
+	})
+}
@@ -0,0 +1,40 @@
+package respwriter
+
+import "time"
+
+const (
+	// MetricHijacks counts the connections hijacked via RespWriter.Hijack
+	// or RespWriter.HijackConn.
+	MetricHijacks = "respwriter_hijacks_total"
+
+	// MetricTimeouts counts the requests which timed out before a response
+	// was written.
+	MetricTimeouts = "respwriter_timeouts_total"
+
+	// MetricDeadlineExtensions counts the calls to RespWriter.ExtendDeadline,
+	// labeled by whether the extension was granted or refused.
+	MetricDeadlineExtensions = "respwriter_deadline_extensions_total"
+
+	// MetricRequestDuration records the duration of the requests handled by
+	// NewHandlerFunc, labeled by transport and rcode.
+	MetricRequestDuration = "respwriter_request_duration_seconds"
+
+	// MetricFaults counts the faults injected by a FaultInjector, labeled by
+	// fault.
+	MetricFaults = "respwriter_faults_total"
+
+	// MetricPanics counts the panics of handlers recovered by NewHandlerFunc
+	// (see WithRecoverPanics), labeled by transport.
+	MetricPanics = "respwriter_panics_total"
+)
+
+// Metrics receives the metrics of the RespWriter, so they can be exported with
+// the metrics library of your choice. Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	// IncCounter increments the named counter.
+	IncCounter(name string, labels map[string]string)
+
+	// ObserveDuration records a duration for the named histogram.
+	ObserveDuration(name string, d time.Duration, labels map[string]string)
+}
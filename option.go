@@ -2,6 +2,9 @@ package respwriter
 
 import (
 	"log/slog"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 // Option defines a common functional options type which can be used in a
@@ -20,11 +23,58 @@ func applyOpts(opts interface{}, opt ...Option) {
 }
 
 type generalOptions struct {
-	withLogger *slog.Logger
+	withLogger              *slog.Logger
+	withRequest             *dns.Msg
+	withMaxUDPSize          int
+	withEDNS                bool
+	withNSID                string
+	withPaddingBlockSize    int
+	withCookieSecret        []byte
+	withCookieRotation      time.Duration
+	withRequireCookies      bool
+	withTsigOpcodes         []int
+	withTsigQtypes          []uint16
+	withTsigZones           []string
+	withEnvelopeTimeout     time.Duration
+	withIdleTimeout         time.Duration
+	withMetrics             Metrics
+	withHijackTimeout       time.Duration
+	withTimeoutPolicy       TimeoutPolicy
+	withMaxRequestTimeout   time.Duration
+	withRequestIDOption     uint16
+	withMetricLabels        []string
+	withTracer              Tracer
+	withErrorMapper         ErrorMapper
+	withClock               Clock
+	withCacheMaxEntries     int
+	withCacheMaxTTL         time.Duration
+	withPrefetchThreshold   int
+	withPrefetchWindow      float64
+	withPrefetchConcurrency int
+	withPrefetchTimeout     time.Duration
+	withFaultRules          []FaultRule
+	withFaultSeed           int64
+	withPooling             bool
+	withRecoverPanics       bool
 }
 
 func generalDefaults() generalOptions {
-	return generalOptions{}
+	return generalOptions{
+		withCacheMaxEntries:     defaultCacheMaxEntries,
+		withCacheMaxTTL:         defaultCacheMaxTTL,
+		withPrefetchThreshold:   defaultPrefetchThreshold,
+		withPrefetchWindow:      defaultPrefetchWindow,
+		withPrefetchConcurrency: defaultPrefetchConcurrency,
+		withPrefetchTimeout:     defaultPrefetchTimeout,
+		withPaddingBlockSize:    defaultPaddingBlockSize,
+		withCookieRotation:      defaultCookieRotation,
+		withTsigOpcodes:         []int{dns.OpcodeUpdate},
+		withTsigQtypes:          []uint16{dns.TypeAXFR, dns.TypeIXFR},
+		withEnvelopeTimeout:     defaultEnvelopeTimeout,
+		withIdleTimeout:         defaultIdleTimeout,
+		withErrorMapper:         DefaultErrorMapper,
+		withClock:               realClock{},
+	}
 }
 
 func getGeneralOpts(opt ...Option) generalOptions {
@@ -43,3 +93,355 @@ func WithLogger(l *slog.Logger) Option {
 		}
 	}
 }
+
+// WithCacheMaxEntries allows you to specify the maximum number of responses a
+// Cache will hold.
+func WithCacheMaxEntries(n int) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withCacheMaxEntries = n
+		}
+	}
+}
+
+// WithCacheMaxTTL allows you to specify the maximum amount of time a Cache
+// will hold a response, regardless of the TTLs of its records.
+func WithCacheMaxTTL(d time.Duration) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withCacheMaxTTL = d
+		}
+	}
+}
+
+// WithPrefetchThreshold allows you to specify the number of hits a cached
+// response must receive before it's considered popular enough to prefetch. A
+// threshold of zero disables prefetching.
+func WithPrefetchThreshold(hits int) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withPrefetchThreshold = hits
+		}
+	}
+}
+
+// WithPrefetchWindow allows you to specify the portion of a cached response's
+// TTL (between 0 and 1) during which a hit on a popular response will trigger
+// a prefetch. For example, 0.1 means the last 10% of the TTL.
+func WithPrefetchWindow(portion float64) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withPrefetchWindow = portion
+		}
+	}
+}
+
+// WithPrefetchConcurrency allows you to specify the maximum number of
+// prefetches which may be in-flight at once.
+func WithPrefetchConcurrency(n int) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withPrefetchConcurrency = n
+		}
+	}
+}
+
+// WithPrefetchTimeout allows you to specify the request timeout used when
+// prefetching a response through the wrapped handler.
+func WithPrefetchTimeout(d time.Duration) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withPrefetchTimeout = d
+		}
+	}
+}
+
+// WithRequest allows you to specify the request a RespWriter is responding to,
+// which is required for features that depend on the request such as
+// truncation. NewHandlerFunc sets this for you.
+func WithRequest(r *dns.Msg) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withRequest = r
+		}
+	}
+}
+
+// WithMaxUDPSize allows you to cap the size of UDP responses below the size
+// advertised by the client, which limits the amplification factor of your
+// server. Sizes less than dns.MinMsgSize (512) are treated as 512.
+func WithMaxUDPSize(size int) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withMaxUDPSize = size
+		}
+	}
+}
+
+// WithEDNS allows you to enable server-side EDNS0 handling: responses will
+// carry a correct OPT RR whenever the request had one, requests with an
+// unsupported EDNS version are answered with BADVERS before calling the
+// handler, responses sent over encrypted transports are padded (RFC 7830) and
+// the NSID from WithNSID is attached when requested (RFC 5001).
+func WithEDNS(enabled bool) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withEDNS = enabled
+		}
+	}
+}
+
+// WithNSID allows you to specify the name server identifier (RFC 5001)
+// attached to responses when the request asks for it. It requires
+// WithEDNS(true).
+func WithNSID(nsid string) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withNSID = nsid
+		}
+	}
+}
+
+// WithPaddingBlockSize allows you to specify the block size responses sent
+// over encrypted transports are padded to (RFC 8467). It requires
+// WithEDNS(true). The default is 468 and zero disables padding.
+func WithPaddingBlockSize(size int) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withPaddingBlockSize = size
+		}
+	}
+}
+
+// WithCookieSecret allows you to specify the 16 byte secret used to generate
+// server cookies, which is required when several servers (anycast for
+// example) must accept each other's cookies. A random secret is generated
+// when it's not specified.
+func WithCookieSecret(secret []byte) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withCookieSecret = secret
+		}
+	}
+}
+
+// WithCookieRotation allows you to specify how often the server cookie secret
+// is replaced with a new random secret. Cookies generated with the previous
+// secret are accepted until the next rotation. Zero disables rotation.
+func WithCookieRotation(interval time.Duration) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withCookieRotation = interval
+		}
+	}
+}
+
+// WithRequireCookies allows you to specify that requests with a client cookie
+// but without a valid server cookie are answered with BADCOOKIE, rather than
+// passed to the handler.
+func WithRequireCookies(required bool) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withRequireCookies = required
+		}
+	}
+}
+
+// WithTsigOpcodes allows you to specify the opcodes of requests which require
+// a valid TSIG. The default is UPDATE.
+func WithTsigOpcodes(opcodes ...int) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withTsigOpcodes = opcodes
+		}
+	}
+}
+
+// WithTsigQtypes allows you to specify the question types of requests which
+// require a valid TSIG. The default is AXFR and IXFR.
+func WithTsigQtypes(qtypes ...uint16) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withTsigQtypes = qtypes
+		}
+	}
+}
+
+// WithTsigZones allows you to limit the requests which require a valid TSIG to
+// the ones for names in the given zones. By default, all zones are included.
+func WithTsigZones(zones ...string) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withTsigZones = zones
+		}
+	}
+}
+
+// WithEnvelopeTimeout allows you to specify how long each message of a
+// streamed response (see RespWriter.StartStream) may take to be written.
+// Zero disables the per-message write deadline.
+//
+// The deadline is set on the connection, so it only applies when the
+// underlying writer implements ExposesUnderlyingConns.
+func WithEnvelopeTimeout(d time.Duration) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withEnvelopeTimeout = d
+		}
+	}
+}
+
+// WithIdleTimeout allows you to specify how long a streamed response (see
+// RespWriter.StartStream) may go without writing a message. It replaces the
+// request timeout of NewHandlerFunc once streaming starts.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withIdleTimeout = d
+		}
+	}
+}
+
+// WithMetrics allows you to specify an optional Metrics which receives the
+// metrics of the RespWriter.
+func WithMetrics(m Metrics) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			if !isNil(m) {
+				o.withMetrics = m
+			}
+		}
+	}
+}
+
+// WithHijackTimeout allows you to specify the timeout of the context returned
+// by RespWriter.HijackConn. By default the context has no deadline.
+func WithHijackTimeout(d time.Duration) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withHijackTimeout = d
+		}
+	}
+}
+
+// WithTimeoutPolicy allows you to specify what NewHandlerFunc does with the
+// connection when a request received over a stream transport times out before
+// a response is written. The default is TimeoutKeepConn.
+func WithTimeoutPolicy(p TimeoutPolicy) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withTimeoutPolicy = p
+		}
+	}
+}
+
+// WithMaxRequestTimeout allows you to specify the ceiling for
+// RespWriter.ExtendDeadline, measured from when the request is received. By
+// default, a request's deadline can't be extended beyond its request timeout.
+func WithMaxRequestTimeout(d time.Duration) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withMaxRequestTimeout = d
+		}
+	}
+}
+
+// WithRequestIDOption allows you to specify the code of an EDNS0 local option
+// (65001-65534) which carries the request ID, so requests can be correlated
+// across hops. Requests without the option are assigned a new request ID.
+func WithRequestIDOption(code uint16) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withRequestIDOption = code
+		}
+	}
+}
+
+// WithMetricLabels allows you to specify the annotation keys (see
+// RespWriter.Annotate) which are added as labels to the metrics. Only
+// allow-listed keys are used, to keep the cardinality of the metrics bounded.
+func WithMetricLabels(keys ...string) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withMetricLabels = keys
+		}
+	}
+}
+
+// WithTracer allows you to specify a Tracer which is used to create a span for
+// every request.
+func WithTracer(t Tracer) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok && !isNil(t) {
+			o.withTracer = t
+		}
+	}
+}
+
+// WithErrorMapper allows you to specify how NewContextHandlerFunc maps the
+// errors returned by handlers to rcodes. The default is DefaultErrorMapper.
+func WithErrorMapper(m ErrorMapper) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok && m != nil {
+			o.withErrorMapper = m
+		}
+	}
+}
+
+// WithClock allows you to specify the Clock used for request deadlines,
+// latency measurements, caches and cookies. The default is the wall clock.
+func WithClock(c Clock) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok && !isNil(c) {
+			o.withClock = c
+		}
+	}
+}
+
+// WithFaultRules allows you to specify the initial rules of a FaultInjector.
+func WithFaultRules(rules ...FaultRule) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withFaultRules = rules
+		}
+	}
+}
+
+// WithFaultSeed allows you to specify the seed of a FaultInjector's
+// randomness, so the faults injected are reproducible. The default (zero) is
+// seeded from the current time.
+func WithFaultSeed(seed int64) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withFaultSeed = seed
+		}
+	}
+}
+
+// WithPooling allows you to specify that the handler returned by
+// NewHandlerFunc reuses its RespWriters, along with their request contexts and
+// deadline timers, across requests rather than allocating them for every
+// request. With pooling, handlers must not use the RespWriter, its request
+// context or the contexts derived from it once they return; use
+// RespWriter.Detach to answer a request asynchronously. Writers which were
+// detached or hijacked aren't reused.
+func WithPooling(enabled bool) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withPooling = enabled
+		}
+	}
+}
+
+// WithRecoverPanics allows you to specify that the handler returned by
+// NewHandlerFunc recovers the panics of the wrapped handler: they're logged,
+// counted (see MetricPanics) and answered with SERVFAIL, unless a response
+// was already written. By default panics aren't recovered, and since the
+// dns.Server doesn't recover them either, a panic crashes the process.
+func WithRecoverPanics(enabled bool) Option {
+	return func(o interface{}) {
+		if o, ok := o.(*generalOptions); ok {
+			o.withRecoverPanics = enabled
+		}
+	}
+}
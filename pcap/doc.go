@@ -0,0 +1,9 @@
+// Package pcap reads and writes pcap capture files of DNS traffic, without
+// libpcap, so traffic seen by a RespWriter can be analyzed offline and
+// captures of DNS queries can be replayed against a handler.
+//
+// A Sink is a respwriter.TrafficSink which exports the traffic recorded by a
+// respwriter.TrafficRecorder as synthesized UDP and TCP frames, and a Source
+// is a respwriter.TrafficSource which imports the queries (and their
+// responses) of a capture, for respwritertest.Replay.
+package pcap
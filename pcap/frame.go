@@ -0,0 +1,324 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	tcpHeaderLen  = 20
+
+	// maxUDPPayload is the largest UDP payload which fits in an IPv4 packet.
+	maxUDPPayload = 65535 - ipv4HeaderLen - udpHeaderLen
+
+	// maxTCPSegment is the largest TCP payload written in a single segment.
+	maxTCPSegment = 65000
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// flow is one direction of a connection.
+type flow struct {
+	src netip.AddrPort
+	dst netip.AddrPort
+}
+
+func (f flow) reverse() flow {
+	return flow{src: f.dst, dst: f.src}
+}
+
+// WriteMessage writes a DNS message sent from src to dst at t, as a
+// synthesized UDP datagram or, for stream transports, as TCP segments
+// carrying the length-prefixed message. The sequence numbers of TCP segments
+// continue those previously written for the connection. Messages over TLS are
+// written in the clear, as TCP.
+func (w *Writer) WriteMessage(t time.Time, src, dst netip.AddrPort, transport respwriter.Transport, msg []byte) error {
+	const op = "pcap.(Writer).WriteMessage"
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	switch {
+	case !src.IsValid() || !dst.IsValid():
+		return fmt.Errorf("%s: invalid address: %w", op, respwriter.ErrInvalidParameter)
+	case src.Addr().Is4() != dst.Addr().Is4():
+		return fmt.Errorf("%s: mixed address families: %w", op, respwriter.ErrInvalidParameter)
+	case len(msg) > 0xffff:
+		return fmt.Errorf("%s: message too large: %w", op, respwriter.ErrInvalidParameter)
+	}
+
+	f := flow{src: src, dst: dst}
+	if !transport.IsStream() {
+		if len(msg) > maxUDPPayload {
+			return fmt.Errorf("%s: message too large for udp: %w", op, respwriter.ErrInvalidParameter)
+		}
+		if err := w.WritePacket(t, udpPacket(f, msg)); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		return nil
+	}
+
+	payload := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(payload, uint16(len(msg)))
+	copy(payload[2:], msg)
+	for len(payload) > 0 {
+		n := min(len(payload), maxTCPSegment)
+		seq := w.seqs[f]
+		if err := w.WritePacket(t, tcpPacket(f, seq, w.seqs[f.reverse()], payload[:n])); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		w.seqs[f] = seq + uint32(n)
+		payload = payload[n:]
+	}
+	return nil
+}
+
+// udpPacket returns an IP packet carrying a UDP datagram with the payload.
+func udpPacket(f flow, payload []byte) []byte {
+	seg := make([]byte, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(seg[0:2], f.src.Port())
+	binary.BigEndian.PutUint16(seg[2:4], f.dst.Port())
+	binary.BigEndian.PutUint16(seg[4:6], uint16(len(seg)))
+	copy(seg[udpHeaderLen:], payload)
+	csum := transportChecksum(f, protoUDP, seg)
+	if csum == 0 {
+		// zero means no checksum for UDP.
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(seg[6:8], csum)
+	return ipPacket(f, protoUDP, seg)
+}
+
+// tcpPacket returns an IP packet carrying a TCP segment with the payload.
+func tcpPacket(f flow, seq, ack uint32, payload []byte) []byte {
+	seg := make([]byte, tcpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(seg[0:2], f.src.Port())
+	binary.BigEndian.PutUint16(seg[2:4], f.dst.Port())
+	binary.BigEndian.PutUint32(seg[4:8], seq)
+	binary.BigEndian.PutUint32(seg[8:12], ack)
+	seg[12] = (tcpHeaderLen / 4) << 4
+	seg[13] = tcpFlagPSH | tcpFlagACK
+	binary.BigEndian.PutUint16(seg[14:16], 0xffff)
+	copy(seg[tcpHeaderLen:], payload)
+	binary.BigEndian.PutUint16(seg[16:18], transportChecksum(f, protoTCP, seg))
+	return ipPacket(f, protoTCP, seg)
+}
+
+// ipPacket returns an IPv4 or IPv6 packet carrying the transport segment.
+func ipPacket(f flow, proto byte, seg []byte) []byte {
+	src, dst := f.src.Addr(), f.dst.Addr()
+	if src.Is4() {
+		p := make([]byte, ipv4HeaderLen+len(seg))
+		p[0] = 4<<4 | ipv4HeaderLen/4
+		binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+		// don't fragment
+		binary.BigEndian.PutUint16(p[6:8], 0x4000)
+		p[8] = 64
+		p[9] = proto
+		s, d := src.As4(), dst.As4()
+		copy(p[12:16], s[:])
+		copy(p[16:20], d[:])
+		binary.BigEndian.PutUint16(p[10:12], checksum(0, p[:ipv4HeaderLen]))
+		copy(p[ipv4HeaderLen:], seg)
+		return p
+	}
+	p := make([]byte, ipv6HeaderLen+len(seg))
+	p[0] = 6 << 4
+	binary.BigEndian.PutUint16(p[4:6], uint16(len(seg)))
+	p[6] = proto
+	p[7] = 64
+	s, d := src.As16(), dst.As16()
+	copy(p[8:24], s[:])
+	copy(p[24:40], d[:])
+	copy(p[ipv6HeaderLen:], seg)
+	return p
+}
+
+// transportChecksum returns the UDP or TCP checksum of the segment, whose
+// checksum field must be zero.
+func transportChecksum(f flow, proto byte, seg []byte) uint16 {
+	var pseudo []byte
+	if f.src.Addr().Is4() {
+		s, d := f.src.Addr().As4(), f.dst.Addr().As4()
+		pseudo = append(append(pseudo, s[:]...), d[:]...)
+		pseudo = append(pseudo, 0, proto, byte(len(seg)>>8), byte(len(seg)))
+	} else {
+		s, d := f.src.Addr().As16(), f.dst.Addr().As16()
+		pseudo = append(append(pseudo, s[:]...), d[:]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(seg)))
+		pseudo = append(pseudo, 0, 0, 0, proto)
+	}
+	return checksum(sum(0, pseudo), seg)
+}
+
+// checksum returns the internet checksum (RFC 1071) of b, continuing the
+// partial sum.
+func checksum(partial uint32, b []byte) uint16 {
+	s := sum(partial, b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		s += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		s += uint32(b[0]) << 8
+	}
+	return s
+}
+
+// segment is the transport-layer payload of a decoded packet.
+type segment struct {
+	flow      flow
+	transport respwriter.Transport
+	payload   []byte
+	// seq and flags are the TCP sequence number and flags of the segment.
+	seq   uint32
+	flags byte
+}
+
+// decodePacket decodes a captured packet of the link type. It returns false
+// for packets which aren't unfragmented UDP or TCP over IPv4 or IPv6.
+func decodePacket(lt LinkType, data []byte) (segment, bool) {
+	var etherType uint16
+	switch lt {
+	case LinkTypeNull:
+		if len(data) < 4 {
+			return segment{}, false
+		}
+		return decodeIP(data[4:])
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		return decodeIP(data)
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return segment{}, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		// skip VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= 4 {
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return segment{}, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case LinkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return segment{}, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[0:2]), data[20:]
+	default:
+		return segment{}, false
+	}
+	if etherType != 0x0800 && etherType != 0x86dd {
+		return segment{}, false
+	}
+	return decodeIP(data)
+}
+
+// decodeIP decodes an IPv4 or IPv6 packet.
+func decodeIP(data []byte) (segment, bool) {
+	if len(data) < 1 {
+		return segment{}, false
+	}
+	var (
+		src, dst netip.Addr
+		proto    byte
+	)
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < ipv4HeaderLen {
+			return segment{}, false
+		}
+		hdrLen := int(data[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+		// skip fragments, they can't be decoded on their own.
+		if fragment := binary.BigEndian.Uint16(data[6:8]); fragment&0x2000 != 0 || fragment&0x1fff != 0 {
+			return segment{}, false
+		}
+		if hdrLen < ipv4HeaderLen || totalLen < hdrLen || len(data) < hdrLen {
+			return segment{}, false
+		}
+		proto = data[9]
+		src, dst = netip.AddrFrom4([4]byte(data[12:16])), netip.AddrFrom4([4]byte(data[16:20]))
+		data = data[hdrLen:min(totalLen, len(data))]
+	case 6:
+		if len(data) < ipv6HeaderLen {
+			return segment{}, false
+		}
+		payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+		proto = data[6]
+		src, dst = netip.AddrFrom16([16]byte(data[8:24])), netip.AddrFrom16([16]byte(data[24:40]))
+		data = data[ipv6HeaderLen:min(ipv6HeaderLen+payloadLen, len(data))]
+		// skip the hop-by-hop, routing and destination options headers.
+		for (proto == 0 || proto == 43 || proto == 60) && len(data) >= 8 {
+			n := (int(data[1]) + 1) * 8
+			if len(data) < n {
+				return segment{}, false
+			}
+			proto, data = data[0], data[n:]
+		}
+	default:
+		return segment{}, false
+	}
+
+	switch proto {
+	case protoUDP:
+		if len(data) < udpHeaderLen {
+			return segment{}, false
+		}
+		n := int(binary.BigEndian.Uint16(data[4:6]))
+		if n < udpHeaderLen || n > len(data) {
+			n = len(data)
+		}
+		return segment{
+			flow:      newFlow(src, dst, data),
+			transport: respwriter.TransportUDP,
+			payload:   data[udpHeaderLen:n],
+		}, true
+	case protoTCP:
+		if len(data) < tcpHeaderLen {
+			return segment{}, false
+		}
+		hdrLen := int(data[12]>>4) * 4
+		if hdrLen < tcpHeaderLen || hdrLen > len(data) {
+			return segment{}, false
+		}
+		return segment{
+			flow:      newFlow(src, dst, data),
+			transport: respwriter.TransportTCP,
+			payload:   data[hdrLen:],
+			seq:       binary.BigEndian.Uint32(data[4:8]),
+			flags:     data[13],
+		}, true
+	default:
+		return segment{}, false
+	}
+}
+
+// newFlow returns the flow of a UDP or TCP segment, both start with the
+// source and destination ports.
+func newFlow(src, dst netip.Addr, seg []byte) flow {
+	return flow{
+		src: netip.AddrPortFrom(src, binary.BigEndian.Uint16(seg[0:2])),
+		dst: netip.AddrPortFrom(dst, binary.BigEndian.Uint16(seg[2:4])),
+	}
+}
@@ -0,0 +1,286 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testClient4 = netip.MustParseAddrPort("192.0.2.7:5300")
+	testServer4 = netip.MustParseAddrPort("192.0.2.53:53")
+	testClient6 = netip.MustParseAddrPort("[2001:db8::7]:5300")
+	testServer6 = netip.MustParseAddrPort("[2001:db8::53]:53")
+)
+
+func TestWriter_WriteMessage(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		src         netip.AddrPort
+		dst         netip.AddrPort
+		transport   respwriter.Transport
+		msgLen      int
+		wantPackets int
+		wantErr     error
+	}{
+		{
+			name:        "udp-ipv4",
+			src:         testClient4,
+			dst:         testServer4,
+			transport:   respwriter.TransportUDP,
+			msgLen:      40,
+			wantPackets: 1,
+		},
+		{
+			name:        "udp-ipv4-mapped",
+			src:         netip.MustParseAddrPort("[::ffff:192.0.2.7]:5300"),
+			dst:         testServer4,
+			transport:   respwriter.TransportUDP,
+			msgLen:      40,
+			wantPackets: 1,
+		},
+		{
+			name:        "udp-ipv6",
+			src:         testClient6,
+			dst:         testServer6,
+			transport:   respwriter.TransportUDP,
+			msgLen:      40,
+			wantPackets: 1,
+		},
+		{
+			name:        "tcp-ipv4",
+			src:         testClient4,
+			dst:         testServer4,
+			transport:   respwriter.TransportTCP,
+			msgLen:      40,
+			wantPackets: 1,
+		},
+		{
+			name:        "tls-ipv6",
+			src:         testClient6,
+			dst:         testServer6,
+			transport:   respwriter.TransportTLS,
+			msgLen:      40,
+			wantPackets: 1,
+		},
+		{
+			name:        "tcp-segmented",
+			src:         testClient4,
+			dst:         testServer4,
+			transport:   respwriter.TransportTCP,
+			msgLen:      0xffff,
+			wantPackets: 2,
+		},
+		{
+			name:      "udp-too-large",
+			src:       testClient4,
+			dst:       testServer4,
+			transport: respwriter.TransportUDP,
+			msgLen:    maxUDPPayload + 1,
+			wantErr:   respwriter.ErrInvalidParameter,
+		},
+		{
+			name:      "mixed-families",
+			src:       testClient4,
+			dst:       testServer6,
+			transport: respwriter.TransportUDP,
+			msgLen:    40,
+			wantErr:   respwriter.ErrInvalidParameter,
+		},
+		{
+			name:      "invalid-address",
+			dst:       testServer4,
+			transport: respwriter.TransportUDP,
+			msgLen:    40,
+			wantErr:   respwriter.ErrInvalidParameter,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf)
+			require.NoError(err)
+			msg := make([]byte, tc.msgLen)
+			for i := range msg {
+				msg[i] = byte(i)
+			}
+			now := time.Now()
+			err = w.WriteMessage(now, tc.src, tc.dst, tc.transport, msg)
+			if tc.wantErr != nil {
+				require.Error(err)
+				assert.ErrorIs(err, tc.wantErr)
+				return
+			}
+			require.NoError(err)
+
+			r, err := NewReader(&buf)
+			require.NoError(err)
+			var payload []byte
+			for i := 0; i < tc.wantPackets; i++ {
+				p, err := r.Next()
+				require.NoError(err)
+				assert.True(p.Time.Equal(now))
+				assertChecksums(t, p.Data)
+				seg, ok := decodePacket(r.LinkType(), p.Data)
+				require.True(ok)
+				assert.Equal(tc.src.Addr().Unmap(), seg.flow.src.Addr())
+				assert.Equal(tc.src.Port(), seg.flow.src.Port())
+				assert.Equal(tc.dst, seg.flow.dst)
+				if tc.transport.IsStream() {
+					assert.Equal(respwriter.TransportTCP, seg.transport)
+					assert.Equal(uint32(len(payload)), seg.seq)
+				} else {
+					assert.Equal(respwriter.TransportUDP, seg.transport)
+				}
+				payload = append(payload, seg.payload...)
+			}
+			_, err = r.Next()
+			require.Error(err)
+			if tc.transport.IsStream() {
+				require.Len(payload, 2+len(msg))
+				assert.Equal(uint16(len(msg)), binary.BigEndian.Uint16(payload))
+				payload = payload[2:]
+			}
+			assert.Equal(msg, payload)
+		})
+	}
+	t.Run("tcp-sequence", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf)
+		require.NoError(err)
+		require.NoError(w.WriteMessage(time.Now(), testClient4, testServer4, respwriter.TransportTCP, make([]byte, 10)))
+		require.NoError(w.WriteMessage(time.Now(), testServer4, testClient4, respwriter.TransportTCP, make([]byte, 20)))
+		require.NoError(w.WriteMessage(time.Now(), testClient4, testServer4, respwriter.TransportTCP, make([]byte, 10)))
+
+		r, err := NewReader(&buf)
+		require.NoError(err)
+		var got [][2]uint32
+		for i := 0; i < 3; i++ {
+			p, err := r.Next()
+			require.NoError(err)
+			seg, ok := decodePacket(r.LinkType(), p.Data)
+			require.True(ok)
+			got = append(got, [2]uint32{seg.seq, binary.BigEndian.Uint32(p.Data[ipv4HeaderLen+8:])})
+		}
+		// the sequence numbers continue per direction, and acknowledge the
+		// other direction.
+		assert.Equal([][2]uint32{{0, 0}, {0, 12}, {12, 22}}, got)
+	})
+}
+
+// assertChecksums asserts the checksums of an IP packet written by a Writer
+// are valid, the checksum of data including a valid checksum is zero.
+func assertChecksums(t *testing.T, p []byte) {
+	t.Helper()
+	seg, ok := decodeIP(p)
+	require.True(t, ok)
+	var (
+		proto  byte
+		header []byte
+	)
+	if p[0]>>4 == 4 {
+		header, proto = p[:ipv4HeaderLen], p[9]
+		assert.Zero(t, checksum(0, header), "ipv4 header checksum")
+	} else {
+		header, proto = p[:ipv6HeaderLen], p[6]
+	}
+	data := p[len(header):]
+	f := flow{src: seg.flow.src, dst: seg.flow.dst}
+	assert.Zero(t, transportChecksum(f, proto, data), "transport checksum")
+}
+
+func TestChecksum(t *testing.T) {
+	t.Parallel()
+	// the example of RFC 1071
+	assert.Equal(t, ^uint16(0xddf2), checksum(0, []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}))
+	// odd lengths are padded with zero
+	assert.Equal(t, checksum(0, []byte{1, 2, 3, 0}), checksum(0, []byte{1, 2, 3}))
+}
+
+func TestDecodePacket(t *testing.T) {
+	t.Parallel()
+	f := flow{src: testClient4, dst: testServer4}
+	udp4 := udpPacket(f, []byte("payload"))
+	udp6 := udpPacket(flow{src: testClient6, dst: testServer6}, []byte("payload"))
+
+	ethernet := func(etherType uint16, ip []byte, vlans ...uint16) []byte {
+		b := make([]byte, 12)
+		for _, tag := range vlans {
+			b = binary.BigEndian.AppendUint16(b, 0x8100)
+			b = binary.BigEndian.AppendUint16(b, tag)
+		}
+		b = binary.BigEndian.AppendUint16(b, etherType)
+		return append(b, ip...)
+	}
+	sll := func(ip []byte) []byte {
+		b := make([]byte, 14)
+		b = binary.BigEndian.AppendUint16(b, 0x0800)
+		return append(b, ip...)
+	}
+	sll2 := func(ip []byte) []byte {
+		b := binary.BigEndian.AppendUint16(nil, 0x86dd)
+		b = append(b, make([]byte, 18)...)
+		return append(b, ip...)
+	}
+	null := func(ip []byte) []byte {
+		return append(binary.LittleEndian.AppendUint32(nil, 2), ip...)
+	}
+	fragment := append([]byte(nil), udp4...)
+	fragment[6] |= 0x20
+	ipv6HopByHop := func(ip []byte) []byte {
+		b := append([]byte(nil), ip[:ipv6HeaderLen]...)
+		b[6] = 0
+		binary.BigEndian.PutUint16(b[4:6], uint16(len(ip)-ipv6HeaderLen+8))
+		b = append(b, protoUDP, 0, 0, 0, 0, 0, 0, 0)
+		return append(b, ip[ipv6HeaderLen:]...)
+	}
+
+	tests := []struct {
+		name      string
+		linkType  LinkType
+		data      []byte
+		wantFlow  flow
+		wantNotOk bool
+	}{
+		{name: "raw-ipv4", linkType: LinkTypeRaw, data: udp4, wantFlow: f},
+		{name: "raw-ipv6", linkType: LinkTypeIPv6, data: udp6, wantFlow: flow{src: testClient6, dst: testServer6}},
+		{name: "ethernet", linkType: LinkTypeEthernet, data: ethernet(0x0800, udp4), wantFlow: f},
+		{name: "ethernet-vlan", linkType: LinkTypeEthernet, data: ethernet(0x0800, udp4, 10, 20), wantFlow: f},
+		{name: "ethernet-arp", linkType: LinkTypeEthernet, data: ethernet(0x0806, udp4), wantNotOk: true},
+		{name: "linux-sll", linkType: LinkTypeLinuxSLL, data: sll(udp4), wantFlow: f},
+		{name: "linux-sll2", linkType: LinkTypeLinuxSLL2, data: sll2(udp6), wantFlow: flow{src: testClient6, dst: testServer6}},
+		{name: "null", linkType: LinkTypeNull, data: null(udp4), wantFlow: f},
+		{name: "ipv6-extension-header", linkType: LinkTypeRaw, data: ipv6HopByHop(udp6), wantFlow: flow{src: testClient6, dst: testServer6}},
+		{name: "ipv4-fragment", linkType: LinkTypeRaw, data: fragment, wantNotOk: true},
+		{name: "truncated", linkType: LinkTypeRaw, data: udp4[:ipv4HeaderLen+4], wantNotOk: true},
+		{name: "unsupported-link-type", linkType: 105, data: udp4, wantNotOk: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert := assert.New(t)
+			seg, ok := decodePacket(tc.linkType, tc.data)
+			if tc.wantNotOk {
+				assert.False(ok)
+				return
+			}
+			assert.True(ok)
+			assert.Equal(tc.wantFlow, seg.flow)
+			assert.Equal(respwriter.TransportUDP, seg.transport)
+			assert.Equal([]byte("payload"), seg.payload)
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package pcap
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+)
+
+// defaultResponseWindow is how long a Source waits for the response to a
+// query, in capture time.
+const defaultResponseWindow = 5 * time.Second
+
+// options are the options of the pcap package. They're set via
+// respwriter.Option, so they follow the same functional options pattern.
+type options struct {
+	withResponseWindow time.Duration
+	withServerAddr     netip.AddrPort
+}
+
+func getDefaultOptions() options {
+	return options{
+		withResponseWindow: defaultResponseWindow,
+	}
+}
+
+func getOpts(opt ...respwriter.Option) options {
+	opts := getDefaultOptions()
+	for _, o := range opt {
+		if o == nil {
+			continue
+		}
+		o(&opts)
+	}
+	return opts
+}
+
+// WithResponseWindow allows you to specify how long, in capture time, a Source
+// waits for the response to a query before the query is considered timed
+// out. The default is 5s.
+func WithResponseWindow(d time.Duration) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withResponseWindow = d
+		}
+	}
+}
+
+// WithServerAddr allows you to specify the server address a Sink writes for
+// records without a LocalAddr (or whose LocalAddr isn't an ip:port address).
+// The default is 192.0.2.53:53 (or [2001:db8::53]:53 for IPv6 clients).
+func WithServerAddr(addr netip.AddrPort) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withServerAddr = addr
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+)
+
+var (
+	// ErrInvalidFormat is returned when a file isn't a valid pcap file.
+	ErrInvalidFormat = errors.New("invalid pcap format")
+
+	// ErrUnsupportedLinkType is returned when the link type of a capture
+	// isn't supported.
+	ErrUnsupportedLinkType = errors.New("unsupported link type")
+)
+
+const (
+	magicMicroseconds = 0xa1b2c3d4
+	magicNanoseconds  = 0xa1b23c4d
+	magicPcapng       = 0x0a0d0d0a
+
+	versionMajor = 2
+	versionMinor = 4
+
+	fileHeaderLen   = 24
+	recordHeaderLen = 16
+
+	// defaultSnapLen is the snapshot length of written captures, which fits
+	// the largest DNS message over TCP.
+	defaultSnapLen = 262144
+)
+
+// LinkType is the link-layer header type of a capture.
+type LinkType uint32
+
+// The link types supported by the Reader. The Writer writes LinkTypeRaw.
+const (
+	LinkTypeNull      LinkType = 0
+	LinkTypeEthernet  LinkType = 1
+	LinkTypeRaw       LinkType = 101
+	LinkTypeLinuxSLL  LinkType = 113
+	LinkTypeIPv4      LinkType = 228
+	LinkTypeIPv6      LinkType = 229
+	LinkTypeLinuxSLL2 LinkType = 276
+)
+
+// Packet is a packet of a capture.
+type Packet struct {
+	// Time is when the packet was captured.
+	Time time.Time
+
+	// Data is the captured bytes of the packet, starting with its link-layer
+	// header.
+	Data []byte
+
+	// Length is the original length of the packet, which is more than
+	// len(Data) when the packet was truncated by the snapshot length.
+	Length int
+}
+
+// Reader reads the packets of a pcap file. Both byte orders and both
+// microsecond and nanosecond resolutions are supported, pcapng isn't.
+type Reader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	snapLen  uint32
+	linkType LinkType
+	buf      [recordHeaderLen]byte
+}
+
+// NewReader returns a new Reader which reads the file header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	const op = "pcap.NewReader"
+	if r == nil {
+		return nil, fmt.Errorf("%s: nil reader: %w", op, respwriter.ErrInvalidParameter)
+	}
+	var hdr [fileHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%s: unable to read file header: %w", op, err)
+	}
+	pr := &Reader{r: r}
+	switch magic := binary.LittleEndian.Uint32(hdr[0:4]); {
+	case magic == magicMicroseconds || magic == magicNanoseconds:
+		pr.order, pr.nanos = binary.LittleEndian, magic == magicNanoseconds
+	case binary.BigEndian.Uint32(hdr[0:4]) == magicMicroseconds || binary.BigEndian.Uint32(hdr[0:4]) == magicNanoseconds:
+		pr.order, pr.nanos = binary.BigEndian, binary.BigEndian.Uint32(hdr[0:4]) == magicNanoseconds
+	case magic == magicPcapng:
+		return nil, fmt.Errorf("%s: pcapng isn't supported: %w", op, ErrInvalidFormat)
+	default:
+		return nil, fmt.Errorf("%s: unknown magic number %#x: %w", op, magic, ErrInvalidFormat)
+	}
+	if major := pr.order.Uint16(hdr[4:6]); major != versionMajor {
+		return nil, fmt.Errorf("%s: unsupported version %d: %w", op, major, ErrInvalidFormat)
+	}
+	pr.snapLen = pr.order.Uint32(hdr[16:20])
+	// the upper bits of the link type field hold the FCS length.
+	pr.linkType = LinkType(pr.order.Uint32(hdr[20:24]) & 0x0fffffff)
+	return pr, nil
+}
+
+// LinkType returns the link type of the capture.
+func (r *Reader) LinkType() LinkType {
+	return r.linkType
+}
+
+// Next returns the next packet, or io.EOF when there are no more packets.
+func (r *Reader) Next() (Packet, error) {
+	const op = "pcap.(Reader).Next"
+	if _, err := io.ReadFull(r.r, r.buf[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Packet{}, io.EOF
+		}
+		return Packet{}, fmt.Errorf("%s: unable to read record header: %w", op, err)
+	}
+	sec := r.order.Uint32(r.buf[0:4])
+	frac := r.order.Uint32(r.buf[4:8])
+	capLen := r.order.Uint32(r.buf[8:12])
+	origLen := r.order.Uint32(r.buf[12:16])
+	if limit := max(r.snapLen, defaultSnapLen); capLen > limit {
+		return Packet{}, fmt.Errorf("%s: captured length %d exceeds the snapshot length: %w", op, capLen, ErrInvalidFormat)
+	}
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Packet{}, fmt.Errorf("%s: unable to read packet: %w", op, err)
+	}
+	nsec := int64(frac)
+	if !r.nanos {
+		nsec *= int64(time.Microsecond)
+	}
+	return Packet{
+		Time:   time.Unix(int64(sec), nsec).UTC(),
+		Data:   data,
+		Length: int(origLen),
+	}, nil
+}
+
+// Writer writes packets to a pcap file, with nanosecond resolution and
+// LinkTypeRaw (packets start with their IPv4 or IPv6 header). It isn't safe
+// for concurrent use.
+type Writer struct {
+	w   io.Writer
+	buf [recordHeaderLen]byte
+
+	// seqs are the next TCP sequence numbers of the flows written via
+	// WriteMessage.
+	seqs map[flow]uint32
+}
+
+// NewWriter returns a new Writer which writes the file header to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	const op = "pcap.NewWriter"
+	if w == nil {
+		return nil, fmt.Errorf("%s: nil writer: %w", op, respwriter.ErrInvalidParameter)
+	}
+	var hdr [fileHeaderLen]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], magicNanoseconds)
+	binary.LittleEndian.PutUint16(hdr[4:6], versionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], versionMinor)
+	binary.LittleEndian.PutUint32(hdr[16:20], defaultSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], uint32(LinkTypeRaw))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, fmt.Errorf("%s: unable to write file header: %w", op, err)
+	}
+	return &Writer{w: w, seqs: map[flow]uint32{}}, nil
+}
+
+// WritePacket writes a packet captured at t, data must start with an IPv4 or
+// IPv6 header.
+func (w *Writer) WritePacket(t time.Time, data []byte) error {
+	const op = "pcap.(Writer).WritePacket"
+	if len(data) > defaultSnapLen {
+		return fmt.Errorf("%s: packet exceeds the snapshot length: %w", op, respwriter.ErrInvalidParameter)
+	}
+	nsec := t.UnixNano()
+	binary.LittleEndian.PutUint32(w.buf[0:4], uint32(nsec/int64(time.Second)))
+	binary.LittleEndian.PutUint32(w.buf[4:8], uint32(nsec%int64(time.Second)))
+	binary.LittleEndian.PutUint32(w.buf[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(w.buf[12:16], uint32(len(data)))
+	if _, err := w.w.Write(w.buf[:]); err != nil {
+		return fmt.Errorf("%s: unable to write record header: %w", op, err)
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return fmt.Errorf("%s: unable to write packet: %w", op, err)
+	}
+	return nil
+}
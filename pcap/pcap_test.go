@@ -0,0 +1,155 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFile returns a pcap file with the header fields and a single packet.
+func testFile(order binary.AppendByteOrder, magic uint32, linkType LinkType, sec, frac uint32, data []byte) []byte {
+	var b []byte
+	b = order.AppendUint32(b, magic)
+	b = order.AppendUint16(b, versionMajor)
+	b = order.AppendUint16(b, versionMinor)
+	b = order.AppendUint32(b, 0)
+	b = order.AppendUint32(b, 0)
+	b = order.AppendUint32(b, 65535)
+	b = order.AppendUint32(b, uint32(linkType))
+	b = order.AppendUint32(b, sec)
+	b = order.AppendUint32(b, frac)
+	b = order.AppendUint32(b, uint32(len(data)))
+	b = order.AppendUint32(b, uint32(len(data))+10)
+	return append(b, data...)
+}
+
+func TestReader(t *testing.T) {
+	t.Parallel()
+	data := []byte{1, 2, 3, 4}
+	tests := []struct {
+		name         string
+		file         []byte
+		wantLinkType LinkType
+		wantTime     time.Time
+		wantErr      error
+	}{
+		{
+			name:         "little-endian-microseconds",
+			file:         testFile(binary.LittleEndian, magicMicroseconds, LinkTypeEthernet, 1700000000, 250, data),
+			wantLinkType: LinkTypeEthernet,
+			wantTime:     time.Unix(1700000000, 250*int64(time.Microsecond)).UTC(),
+		},
+		{
+			name:         "big-endian-microseconds",
+			file:         testFile(binary.BigEndian, magicMicroseconds, LinkTypeLinuxSLL, 1700000000, 250, data),
+			wantLinkType: LinkTypeLinuxSLL,
+			wantTime:     time.Unix(1700000000, 250*int64(time.Microsecond)).UTC(),
+		},
+		{
+			name:         "big-endian-nanoseconds",
+			file:         testFile(binary.BigEndian, magicNanoseconds, LinkTypeRaw, 1700000000, 250, data),
+			wantLinkType: LinkTypeRaw,
+			wantTime:     time.Unix(1700000000, 250).UTC(),
+		},
+		{
+			name:         "fcs-length",
+			file:         testFile(binary.LittleEndian, magicNanoseconds, LinkTypeEthernet|0x10000000, 1, 0, data),
+			wantLinkType: LinkTypeEthernet,
+			wantTime:     time.Unix(1, 0).UTC(),
+		},
+		{
+			name:    "pcapng",
+			file:    testFile(binary.LittleEndian, magicPcapng, LinkTypeEthernet, 0, 0, data),
+			wantErr: ErrInvalidFormat,
+		},
+		{
+			name:    "unknown-magic",
+			file:    testFile(binary.LittleEndian, 0xdeadbeef, LinkTypeEthernet, 0, 0, data),
+			wantErr: ErrInvalidFormat,
+		},
+		{
+			name:    "short-header",
+			file:    []byte{0xd4, 0xc3, 0xb2, 0xa1},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			r, err := NewReader(bytes.NewReader(tc.file))
+			if tc.wantErr != nil {
+				require.Error(err)
+				assert.ErrorIs(err, tc.wantErr)
+				return
+			}
+			require.NoError(err)
+			assert.Equal(tc.wantLinkType, r.LinkType())
+			p, err := r.Next()
+			require.NoError(err)
+			assert.Equal(tc.wantTime, p.Time)
+			assert.Equal(data, p.Data)
+			assert.Equal(len(data)+10, p.Length)
+			_, err = r.Next()
+			assert.Equal(io.EOF, err)
+		})
+	}
+	t.Run("truncated-packet", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		file := testFile(binary.LittleEndian, magicNanoseconds, LinkTypeRaw, 0, 0, data)
+		r, err := NewReader(bytes.NewReader(file[:len(file)-1]))
+		require.NoError(err)
+		_, err = r.Next()
+		require.Error(err)
+		assert.ErrorIs(err, io.ErrUnexpectedEOF)
+	})
+	t.Run("nil-reader", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewReader(nil)
+		assert.ErrorIs(t, err, respwriter.ErrInvalidParameter)
+	})
+}
+
+func TestWriter(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	require.NoError(err)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	require.NoError(w.WritePacket(now, []byte{0x45, 0}))
+	require.NoError(w.WritePacket(now.Add(time.Second), []byte{0x60}))
+	assert.ErrorIs(w.WritePacket(now, make([]byte, defaultSnapLen+1)), respwriter.ErrInvalidParameter)
+
+	r, err := NewReader(&buf)
+	require.NoError(err)
+	assert.Equal(LinkTypeRaw, r.LinkType())
+	p, err := r.Next()
+	require.NoError(err)
+	assert.Equal(Packet{Time: now, Data: []byte{0x45, 0}, Length: 2}, p)
+	p, err = r.Next()
+	require.NoError(err)
+	assert.Equal(Packet{Time: now.Add(time.Second), Data: []byte{0x60}, Length: 1}, p)
+	_, err = r.Next()
+	assert.Equal(io.EOF, err)
+
+	_, err = NewWriter(nil)
+	assert.ErrorIs(err, respwriter.ErrInvalidParameter)
+	_, err = NewWriter(errWriter{})
+	assert.ErrorIs(err, errWrite)
+}
+
+var errWrite = errors.New("write error")
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, errWrite }
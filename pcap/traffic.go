@@ -0,0 +1,284 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+)
+
+var (
+	defaultServerAddr4 = netip.MustParseAddrPort("192.0.2.53:53")
+	defaultServerAddr6 = netip.MustParseAddrPort("[2001:db8::53]:53")
+)
+
+// Sink is a respwriter.TrafficSink which writes the records of a
+// respwriter.TrafficRecorder to a pcap file: the request as a packet from the
+// client (RemoteAddr) to the server (LocalAddr) at the record's Time, and the
+// response as a packet back to the client at Time plus Latency.
+//
+// Records are written as they're received, when their requests are done, so
+// the packets of concurrent requests aren't necessarily in time order; most
+// tools sort them (wireshark, or "reordercap" for others).
+type Sink struct {
+	mu         sync.Mutex
+	w          *Writer
+	serverAddr netip.AddrPort
+}
+
+// NewSink returns a new Sink which writes the file header to w. Options
+// supported: WithServerAddr
+func NewSink(w io.Writer, opt ...respwriter.Option) (*Sink, error) {
+	const op = "pcap.NewSink"
+	opts := getOpts(opt...)
+	pw, err := NewWriter(w)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return &Sink{w: pw, serverAddr: opts.withServerAddr}, nil
+}
+
+// Record writes the request and response of the record. Records whose
+// RemoteAddr isn't an ip:port address can't be written.
+func (s *Sink) Record(rec respwriter.TrafficRecord) error {
+	const op = "pcap.(Sink).Record"
+	client, err := netip.ParseAddrPort(rec.RemoteAddr)
+	if err != nil {
+		return fmt.Errorf("%s: invalid remote address %q: %w", op, rec.RemoteAddr, respwriter.ErrInvalidParameter)
+	}
+	client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+	server := s.server(client, rec.LocalAddr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.WriteMessage(rec.Time, client, server, rec.Transport, rec.Request); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if len(rec.Response) > 0 {
+		if err := s.w.WriteMessage(rec.Time.Add(rec.Latency), server, client, rec.Transport, rec.Response); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// server returns the server address of a record, of the same family as the
+// client's address.
+func (s *Sink) server(client netip.AddrPort, local string) netip.AddrPort {
+	for _, addr := range []string{local, s.serverAddr.String()} {
+		server, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			continue
+		}
+		server = netip.AddrPortFrom(server.Addr().Unmap(), server.Port())
+		if server.Addr().Is4() == client.Addr().Is4() {
+			return server
+		}
+	}
+	if client.Addr().Is4() {
+		return defaultServerAddr4
+	}
+	return defaultServerAddr6
+}
+
+// Source is a respwriter.TrafficSource which reads the DNS queries of a pcap
+// file, along with their responses, for replaying them against a handler
+// (see respwritertest.Replay).
+//
+// Queries are paired with the first response from the server they were sent
+// to, with the same ID and question, seen within the response window (see
+// WithResponseWindow). A query without a response within the window is
+// recorded as timed out, unless the capture ends first. TCP streams are
+// reassembled, but IP fragments are skipped, out-of-order segments aren't
+// reordered and a connection is skipped once a segment of it was lost.
+type Source struct {
+	r      *Reader
+	window time.Duration
+
+	// pending are the queries read, in capture order, waiting for their
+	// responses.
+	pending []*pendingQuery
+	streams map[flow]*stream
+	// last is the time of the last packet read.
+	last time.Time
+	eof  bool
+}
+
+// pendingQuery is a query waiting for its response.
+type pendingQuery struct {
+	key      queryKey
+	rec      respwriter.TrafficRecord
+	answered bool
+}
+
+// queryKey pairs a query with its response.
+type queryKey struct {
+	client   netip.AddrPort
+	server   netip.AddrPort
+	id       uint16
+	question dns.Question
+}
+
+// stream is the reassembly buffer of a TCP flow.
+type stream struct {
+	next uint32
+	buf  []byte
+	// lost is true once a segment was lost, the messages can't be delimited
+	// after that.
+	lost bool
+}
+
+// NewSource returns a new Source which reads the capture from r. Options
+// supported: WithResponseWindow
+func NewSource(r io.Reader, opt ...respwriter.Option) (*Source, error) {
+	const op = "pcap.NewSource"
+	opts := getOpts(opt...)
+	if opts.withResponseWindow <= 0 {
+		return nil, fmt.Errorf("%s: invalid response window: %w", op, respwriter.ErrInvalidParameter)
+	}
+	pr, err := NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	switch pr.LinkType() {
+	case LinkTypeNull, LinkTypeEthernet, LinkTypeRaw, LinkTypeLinuxSLL, LinkTypeIPv4, LinkTypeIPv6, LinkTypeLinuxSLL2:
+	default:
+		return nil, fmt.Errorf("%s: link type %d: %w", op, pr.LinkType(), ErrUnsupportedLinkType)
+	}
+	return &Source{
+		r:       pr,
+		window:  opts.withResponseWindow,
+		streams: map[flow]*stream{},
+	}, nil
+}
+
+// Next returns the next query, in capture order, or io.EOF when there are no
+// more queries.
+func (s *Source) Next() (respwriter.TrafficRecord, error) {
+	const op = "pcap.(Source).Next"
+	for {
+		if len(s.pending) > 0 {
+			q := s.pending[0]
+			expired := s.last.Sub(q.rec.Time) > s.window
+			if q.answered || expired || s.eof {
+				s.pending = s.pending[1:]
+				q.rec.TimedOut = !q.answered && expired
+				return q.rec, nil
+			}
+		}
+		if s.eof {
+			return respwriter.TrafficRecord{}, io.EOF
+		}
+		p, err := s.r.Next()
+		switch {
+		case errors.Is(err, io.EOF):
+			s.eof = true
+			continue
+		case err != nil:
+			return respwriter.TrafficRecord{}, fmt.Errorf("%s: %w", op, err)
+		}
+		s.last = p.Time
+		seg, ok := decodePacket(s.r.LinkType(), p.Data)
+		if !ok {
+			continue
+		}
+		for _, msg := range s.messages(seg) {
+			s.add(p.Time, seg, msg)
+		}
+	}
+}
+
+// messages returns the DNS messages carried by the segment.
+func (s *Source) messages(seg segment) [][]byte {
+	if seg.transport == respwriter.TransportUDP {
+		return [][]byte{seg.payload}
+	}
+
+	st := s.streams[seg.flow]
+	if seg.flags&(tcpFlagSYN|tcpFlagRST) != 0 {
+		// a new connection, or the end of one.
+		delete(s.streams, seg.flow)
+		st = nil
+	}
+	if seg.flags&tcpFlagRST != 0 {
+		return nil
+	}
+	payload := seg.payload
+	switch {
+	case st == nil:
+		st = &stream{next: seg.seq}
+		s.streams[seg.flow] = st
+	case int32(seg.seq-st.next) < 0:
+		// a retransmission, skip what was already seen.
+		seen := int(st.next - seg.seq)
+		if seen >= len(payload) {
+			return nil
+		}
+		payload = payload[seen:]
+	case seg.seq != st.next:
+		// segments were lost, the rest of the connection is skipped.
+		st.lost, st.buf = true, nil
+	}
+	if st.lost {
+		return nil
+	}
+	st.buf = append(st.buf, payload...)
+	st.next = seg.seq + uint32(len(seg.payload))
+	if seg.flags&tcpFlagSYN != 0 {
+		// the SYN consumes a sequence number.
+		st.next++
+	}
+
+	var msgs [][]byte
+	for len(st.buf) >= 2 {
+		n := int(binary.BigEndian.Uint16(st.buf))
+		if len(st.buf) < 2+n {
+			break
+		}
+		msgs = append(msgs, append([]byte(nil), st.buf[2:2+n]...))
+		st.buf = st.buf[2+n:]
+	}
+	if seg.flags&tcpFlagFIN != 0 {
+		delete(s.streams, seg.flow)
+	}
+	return msgs
+}
+
+// add adds a query to the pending queries, or pairs a response with its
+// pending query. Payloads which aren't DNS messages with one question are
+// ignored.
+func (s *Source) add(t time.Time, seg segment, payload []byte) {
+	m := new(dns.Msg)
+	if err := m.Unpack(payload); err != nil || len(m.Question) != 1 {
+		return
+	}
+	if !m.Response {
+		s.pending = append(s.pending, &pendingQuery{
+			key: queryKey{client: seg.flow.src, server: seg.flow.dst, id: m.Id, question: m.Question[0]},
+			rec: respwriter.TrafficRecord{
+				Time:       t,
+				RemoteAddr: seg.flow.src.String(),
+				LocalAddr:  seg.flow.dst.String(),
+				Transport:  seg.transport,
+				Request:    append([]byte(nil), payload...),
+			},
+		})
+		return
+	}
+	key := queryKey{client: seg.flow.dst, server: seg.flow.src, id: m.Id, question: m.Question[0]}
+	for _, q := range s.pending {
+		if q.answered || q.key != key || q.rec.Transport != seg.transport || t.Sub(q.rec.Time) > s.window {
+			continue
+		}
+		q.answered = true
+		q.rec.Response = append([]byte(nil), payload...)
+		q.rec.Latency = t.Sub(q.rec.Time)
+		return
+	}
+}
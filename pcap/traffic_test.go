@@ -0,0 +1,320 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/jimlambrt/respwriter/respwritertest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testQuery returns a packed query, and its packed response with the address
+// in ip.
+func testQuery(t *testing.T, id uint16, name string, ip net.IP) ([]byte, []byte) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	q.Id = id
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   ip,
+	})
+	query, err := q.Pack()
+	require.NoError(t, err)
+	response, err := r.Pack()
+	require.NoError(t, err)
+	return query, response
+}
+
+// readAll returns every record of the source.
+func readAll(t *testing.T, src *Source) []respwriter.TrafficRecord {
+	t.Helper()
+	var recs []respwriter.TrafficRecord
+	for {
+		rec, err := src.Next()
+		if err == io.EOF {
+			return recs
+		}
+		require.NoError(t, err)
+		recs = append(recs, rec)
+	}
+}
+
+func TestSink(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	q1, r1 := testQuery(t, 1, "a.example.", net.IPv4(192, 0, 2, 1))
+	q2, r2 := testQuery(t, 2, "b.example.", net.IPv4(192, 0, 2, 2))
+	q3, _ := testQuery(t, 3, "slow.example.", net.IPv4(192, 0, 2, 3))
+	records := []respwriter.TrafficRecord{
+		{
+			Time:       start,
+			RemoteAddr: "192.0.2.7:5300",
+			LocalAddr:  "192.0.2.53:53",
+			Transport:  respwriter.TransportUDP,
+			Request:    q1,
+			Response:   r1,
+			Latency:    2 * time.Millisecond,
+		},
+		{
+			Time:       start.Add(time.Millisecond),
+			RemoteAddr: "[2001:db8::7]:5301",
+			LocalAddr:  "[2001:db8::53]:53",
+			Transport:  respwriter.TransportTCP,
+			Request:    q2,
+			Response:   r2,
+			Latency:    3 * time.Millisecond,
+		},
+		{
+			Time:       start.Add(2 * time.Millisecond),
+			RemoteAddr: "192.0.2.7:5302",
+			Transport:  respwriter.TransportUDP,
+			Request:    q3,
+			Latency:    time.Second,
+			TimedOut:   true,
+		},
+	}
+
+	assert, require := assert.New(t), require.New(t)
+	var buf bytes.Buffer
+	sink, err := NewSink(&buf, WithServerAddr(netip.MustParseAddrPort("192.0.2.54:5353")))
+	require.NoError(err)
+	for _, rec := range records {
+		require.NoError(sink.Record(rec))
+	}
+	err = sink.Record(respwriter.TrafficRecord{RemoteAddr: "mem-client-1:53000", Request: q1})
+	assert.ErrorIs(err, respwriter.ErrInvalidParameter)
+
+	// the records are read back, and the default server address is used
+	// for the record without a LocalAddr.
+	src, err := NewSource(bytes.NewReader(buf.Bytes()), WithResponseWindow(500*time.Millisecond))
+	require.NoError(err)
+	got := readAll(t, src)
+	require.Len(got, len(records))
+	for i, want := range records {
+		if want.LocalAddr == "" {
+			want.LocalAddr = "192.0.2.54:5353"
+			// the capture ends before the response window, so the
+			// timeout isn't known.
+			want.Latency, want.TimedOut = 0, false
+		}
+		assert.Equal(want, got[i], "record %d", i)
+	}
+}
+
+func TestSink_defaultServerAddr(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	q, _ := testQuery(t, 1, "a.example.", net.IPv4(192, 0, 2, 1))
+	var buf bytes.Buffer
+	sink, err := NewSink(&buf)
+	require.NoError(err)
+	require.NoError(sink.Record(respwriter.TrafficRecord{RemoteAddr: "192.0.2.7:5300", Request: q}))
+	require.NoError(sink.Record(respwriter.TrafficRecord{RemoteAddr: "[2001:db8::7]:5300", LocalAddr: "192.0.2.53:53", Request: q}))
+
+	src, err := NewSource(&buf)
+	require.NoError(err)
+	got := readAll(t, src)
+	require.Len(got, 2)
+	assert.Equal("192.0.2.53:53", got[0].LocalAddr)
+	// the server's address must be of the client's family.
+	assert.Equal("[2001:db8::53]:53", got[1].LocalAddr)
+}
+
+func TestSource(t *testing.T) {
+	t.Parallel()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	client, server := netip.MustParseAddrPort("192.0.2.7:5300"), netip.MustParseAddrPort("192.0.2.53:53")
+	f := flow{src: client, dst: server}
+	q1, r1 := testQuery(t, 1, "a.example.", net.IPv4(192, 0, 2, 1))
+	q2, r2 := testQuery(t, 2, "b.example.", net.IPv4(192, 0, 2, 2))
+
+	// capture writes the packets, a packet every millisecond.
+	capture := func(t *testing.T, packets ...[]byte) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf)
+		require.NoError(t, err)
+		for i, p := range packets {
+			require.NoError(t, w.WritePacket(start.Add(time.Duration(i)*time.Millisecond), p))
+		}
+		return buf.Bytes()
+	}
+	prefixed := func(msgs ...[]byte) []byte {
+		var b []byte
+		for _, m := range msgs {
+			b = binary.BigEndian.AppendUint16(b, uint16(len(m)))
+			b = append(b, m...)
+		}
+		return b
+	}
+	tcp := func(f flow, seq uint32, flags byte, payload []byte) []byte {
+		p := tcpPacket(f, seq, 0, payload)
+		p[ipv4HeaderLen+13] = flags
+		return p
+	}
+
+	t.Run("pairs-responses", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		// the responses are out of order, and a response from another
+		// server and a non-DNS packet are ignored.
+		other := flow{src: netip.MustParseAddrPort("192.0.2.99:53"), dst: client}
+		src, err := NewSource(bytes.NewReader(capture(t,
+			udpPacket(f, q1),
+			udpPacket(f, q2),
+			udpPacket(other, r1),
+			udpPacket(f, []byte("not dns")),
+			udpPacket(f.reverse(), r2),
+			udpPacket(f.reverse(), r1),
+		)))
+		require.NoError(err)
+		got := readAll(t, src)
+		require.Len(got, 2)
+		assert.Equal(q1, got[0].Request)
+		assert.Equal(r1, got[0].Response)
+		assert.Equal(5*time.Millisecond, got[0].Latency)
+		assert.Equal(q2, got[1].Request)
+		assert.Equal(r2, got[1].Response)
+		assert.Equal(3*time.Millisecond, got[1].Latency)
+		for _, rec := range got {
+			assert.Equal(respwriter.TransportUDP, rec.Transport)
+			assert.Equal(client.String(), rec.RemoteAddr)
+			assert.Equal(server.String(), rec.LocalAddr)
+			assert.False(rec.TimedOut)
+		}
+	})
+	t.Run("response-window", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		// the response to q1 arrives after the window, and q2 isn't answered
+		// before the end of the capture.
+		src, err := NewSource(bytes.NewReader(capture(t,
+			udpPacket(f, q1),
+			udpPacket(f, q2),
+			udpPacket(f, []byte("filler")),
+			udpPacket(f.reverse(), r1),
+		)), WithResponseWindow(2*time.Millisecond))
+		require.NoError(err)
+		got := readAll(t, src)
+		require.Len(got, 2)
+		assert.True(got[0].TimedOut)
+		assert.Empty(got[0].Response)
+		assert.False(got[1].TimedOut)
+		assert.Empty(got[1].Response)
+	})
+	t.Run("tcp-reassembly", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		// both queries are pipelined on a connection, split across segments
+		// with a retransmission, and answered in a single segment.
+		stream := prefixed(q1, q2)
+		src, err := NewSource(bytes.NewReader(capture(t,
+			tcp(f, 99, tcpFlagSYN, nil),
+			tcp(f, 100, tcpFlagACK, stream[:5]),
+			tcp(f, 100, tcpFlagACK, stream[:5]),
+			tcp(f, 105, tcpFlagACK|tcpFlagPSH, stream[5:]),
+			tcp(f.reverse(), 500, tcpFlagACK|tcpFlagPSH, prefixed(r1, r2)),
+			tcp(f, 100+uint32(len(stream)), tcpFlagFIN|tcpFlagACK, nil),
+		)))
+		require.NoError(err)
+		got := readAll(t, src)
+		require.Len(got, 2)
+		assert.Equal(q1, got[0].Request)
+		assert.Equal(r1, got[0].Response)
+		assert.Equal(q2, got[1].Request)
+		assert.Equal(r2, got[1].Response)
+		assert.Equal(respwriter.TransportTCP, got[0].Transport)
+	})
+	t.Run("tcp-lost-segment", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		// a segment of the first connection was lost, so only the query of
+		// the second connection is read.
+		lost := prefixed(q1, q1)
+		next := flow{src: netip.MustParseAddrPort("192.0.2.7:5301"), dst: server}
+		src, err := NewSource(bytes.NewReader(capture(t,
+			tcp(f, 100, tcpFlagACK, lost[:5]),
+			tcp(f, 110, tcpFlagACK, lost[10:]),
+			tcp(next, 99, tcpFlagSYN, nil),
+			tcp(next, 100, tcpFlagACK|tcpFlagPSH, prefixed(q2)),
+		)))
+		require.NoError(err)
+		got := readAll(t, src)
+		require.Len(got, 1)
+		assert.Equal(q2, got[0].Request)
+	})
+	t.Run("link-types", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		file := testFile(binary.BigEndian, magicMicroseconds, LinkTypeLinuxSLL, 1, 0, append(make([]byte, 14), append([]byte{0x08, 0x00}, udpPacket(f, q1)...)...))
+		src, err := NewSource(bytes.NewReader(file))
+		require.NoError(err)
+		got := readAll(t, src)
+		require.Len(got, 1)
+		assert.Equal(q1, got[0].Request)
+
+		_, err = NewSource(bytes.NewReader(testFile(binary.LittleEndian, magicMicroseconds, 105, 1, 0, nil)))
+		assert.ErrorIs(err, ErrUnsupportedLinkType)
+		_, err = NewSource(bytes.NewReader(file), WithResponseWindow(0))
+		assert.ErrorIs(err, respwriter.ErrInvalidParameter)
+	})
+}
+
+func TestSource_replay(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	handler := func(ip net.IP) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   ip,
+			})
+			_ = w.WriteMsg(m)
+		}
+	}
+
+	// record traffic as a pcap, through a TrafficRecorder.
+	var buf bytes.Buffer
+	sink, err := NewSink(&buf)
+	require.NoError(err)
+	tr, err := respwriter.NewTrafficRecorder(handler(net.IPv4(192, 0, 2, 1)), sink)
+	require.NoError(err)
+	recorded, err := respwriter.NewHandlerFunc(time.Second, tr.ServeDNS)
+	require.NoError(err)
+	for _, name := range []string{"a.example.", "b.example."} {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		recorded(respwritertest.NewRecorder(respwritertest.WithTransport(respwriter.TransportTCP)), r)
+	}
+
+	// replaying against the same handler doesn't differ, a changed handler
+	// does.
+	src, err := NewSource(bytes.NewReader(buf.Bytes()))
+	require.NoError(err)
+	report, err := respwritertest.Replay(context.Background(), src, handler(net.IPv4(192, 0, 2, 1)), respwritertest.WithReplaySpeed(0))
+	require.NoError(err)
+	assert.Equal(2, report.Requests)
+	assert.Empty(report.Diffs)
+
+	src, err = NewSource(bytes.NewReader(buf.Bytes()))
+	require.NoError(err)
+	report, err = respwritertest.Replay(context.Background(), src, handler(net.IPv4(192, 0, 2, 2)), respwritertest.WithReplaySpeed(0))
+	require.NoError(err)
+	assert.Equal(2, report.Requests)
+	require.Len(report.Diffs, 2)
+	assert.Contains(report.Diffs[0].Diff, "+ answer: a.example.\t60\tIN\tA\t192.0.2.2")
+}
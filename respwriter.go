@@ -2,9 +2,13 @@ package respwriter
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"runtime/debug"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -12,7 +16,11 @@ import (
 
 // NewHandlerFunc returns a new dns.HandlerFunc that wraps the given
 // handler with a RespWriter. The returned handler will use the given logger
-// and requestTimeout to create the RespWriter. Options supported: WithLogger
+// and requestTimeout to create the RespWriter. Options supported: WithLogger,
+// WithMaxUDPSize, WithEDNS, WithNSID, WithPaddingBlockSize,
+// WithEnvelopeTimeout, WithIdleTimeout, WithMetrics, WithTimeoutPolicy,
+// WithMaxRequestTimeout, WithRequestIDOption, WithMetricLabels, WithTracer,
+// WithClock, WithPooling, WithRecoverPanics
 func NewHandlerFunc(requestTimeout time.Duration, h dns.HandlerFunc, opt ...Option) (dns.HandlerFunc, error) {
 	const op = "handlers.NewRespWriterHandler"
 	switch {
@@ -21,34 +29,283 @@ func NewHandlerFunc(requestTimeout time.Duration, h dns.HandlerFunc, opt ...Opti
 	case isNil(h):
 		return nil, fmt.Errorf("%s: nil handler: %w", op, ErrInvalidParameter)
 	}
+	opts := getGeneralOpts(opt...)
+	maxRequestTimeout := requestTimeout
+	switch {
+	case opts.withMaxRequestTimeout < 0:
+		return nil, fmt.Errorf("%s: invalid max request timeout: %w", op, ErrInvalidParameter)
+	case opts.withMaxRequestTimeout > 0 && opts.withMaxRequestTimeout < requestTimeout:
+		return nil, fmt.Errorf("%s: max request timeout is less than the request timeout: %w", op, ErrInvalidParameter)
+	case opts.withMaxRequestTimeout > 0:
+		maxRequestTimeout = opts.withMaxRequestTimeout
+	}
+	if c := opts.withRequestIDOption; c != 0 && (c < dns.EDNS0LOCALSTART || c > dns.EDNS0LOCALEND) {
+		return nil, fmt.Errorf("%s: request id option %d isn't a local option code: %w", op, c, ErrInvalidParameter)
+	}
+	cfg := newWriterConfig(opts)
+	var pool *sync.Pool
+	if opts.withPooling {
+		pool = &sync.Pool{New: func() any { return newRequestState() }}
+	}
 	return func(w dns.ResponseWriter, r *dns.Msg) {
-		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
-		defer cancel()
-		wrappedWriter := NewRespWriter(ctx, w, opt...)
-		h(wrappedWriter, r)
+		start := cfg.clock.Now()
+		requestID := requestIDOf(r, opts.withRequestIDOption)
+		s := getRequestState(pool)
+		s.rw = RespWriter{
+			writerConfig: cfg,
+			underlying:   w,
+			request:      r,
+			requestCtx:   &s.ctx,
+			deadlineCtx:  &s.ctx,
+			maxDeadline:  start.Add(maxRequestTimeout),
+			requestID:    requestID,
+			// a random request ID is only generated when it's used.
+			generateRequestID: requestID == "",
+			rcode:             -1,
+		}
+		s.ctx.start(context.Background(), start.Add(requestTimeout), cfg.clock)
+		rw := &s.rw
+		if opts.withTracer != nil {
+			rw.startSpan(opts.withTracer)
+		}
+		defer s.finish(start, pool)
+		if rw.edns && badVersion(r) {
+			_ = rw.WriteMsg(badVersionReply(r))
+			return
+		}
+		if opts.withRecoverPanics {
+			defer rw.recoverPanic()
+		}
+		h(rw, r)
+		rw.waitDetached()
 	}, nil
 }
 
+// recoverPanic recovers a panic of the handler, reports it to the logger and
+// metrics, and answers the request with SERVFAIL unless a response was
+// already written. It must be deferred.
+func (rw *RespWriter) recoverPanic() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	transport := rw.Transport().String()
+	if logger := rw.Logger(); logger != nil {
+		logger.Error("handler panicked", "remote_addr", rw.RemoteAddr().String(), "transport", transport, "panic", v, "stack", string(debug.Stack()))
+	}
+	if rw.metrics != nil {
+		rw.metrics.IncCounter(MetricPanics, rw.labels(map[string]string{"transport": transport}))
+	}
+	// answering via the detached handle is a no-op when a response was
+	// already written, and it prevents a late response from a goroutine
+	// the handler detached before panicking.
+	_ = rw.Detach().Fail(dns.RcodeServerFailure)
+}
+
+// requestState is the state of a request handled by the handler returned by
+// NewHandlerFunc: the writer and its request context, which are allocated
+// together and, with WithPooling, reused across requests along with the
+// context's timer.
+type requestState struct {
+	rw  RespWriter
+	ctx deadlineContext
+}
+
+func newRequestState() *requestState {
+	s := new(requestState)
+	s.ctx.rw = &s.rw
+	return s
+}
+
+// getRequestState returns a request state from the pool, or a new one when
+// pooling is disabled.
+func getRequestState(pool *sync.Pool) *requestState {
+	if pool == nil {
+		return newRequestState()
+	}
+	return pool.Get().(*requestState)
+}
+
+// finish completes the request, which started at start, and returns the state
+// to the pool unless the writer or its request context may still be used:
+// once the writer has been detached or hijacked, or funcs registered with the
+// context (such as the cancellation of contexts derived from it) were called.
+func (s *requestState) finish(start time.Time, pool *sync.Pool) {
+	restartable := s.ctx.finish()
+	s.rw.complete(start)
+	if pool == nil || !restartable {
+		return
+	}
+	s.rw.mu.Lock()
+	reusable := s.rw.detached == nil && !s.rw.hijacked
+	s.rw.mu.Unlock()
+	if reusable {
+		pool.Put(s)
+	}
+}
+
 // RespWriter is a wrapper around dns.ResponseWriter that provides "base"
 // capabilities for the wrapped writer. Among other things, this is useful for
 // ensuring that the wrapped writer is not used after the context is canceled.
 type RespWriter struct {
+	// writerConfig is the configuration of the writer.
+	writerConfig
+
 	// underlying is the wrapped dns.ResponseWriter.  We need an explicit field
 	// here for the underlying wrapped writer so we can perform type assertions
 	// on the underlying writer to access the underlying connections via the
-	// dns.ExposesUnderlyingConns interface.
+	// ExposesUnderlyingConns interface.
 	underlying dns.ResponseWriter
 
+	// writer is the writer the messages are written to when middlewares
+	// have wrapped it (see wrapWriter), otherwise they're written to the
+	// underlying writer. It's protected by mu.
+	writer dns.ResponseWriter
+
 	// requestCtx is the context for the request and will have a timeout set.
 	// It's important to only use this context for the duration of the request
 	// and not for things which may outlive the request.
 	requestCtx context.Context
 
-	// logger is the logger to use for logging during the request.
+	// request is the request being responded to.  It may be nil when the
+	// RespWriter wasn't created via NewHandlerFunc or WithRequest. It's
+	// protected by mu.
+	request *dns.Msg
+
+	// cookie is the hex encoded client and server cookie attached to
+	// responses, which is set by Cookies. It's protected by mu.
+	cookie string
+
+	// cookieStatus is the result of validating the request's cookies, which
+	// is set by Cookies. It's protected by mu.
+	cookieStatus CookieStatus
+
+	// deadlineCtx is the request context when it was created by
+	// NewHandlerFunc, which allows its deadline to be moved.
+	deadlineCtx *deadlineContext
+
+	// streaming is true once StartStream has been called. It's protected by
+	// mu.
+	streaming bool
+
+	// maxDeadline is the latest deadline ExtendDeadline may move the request
+	// context's deadline to.
+	maxDeadline time.Time
+
+	// requestID identifies the request in logs. It's empty when the
+	// RespWriter wasn't created via NewHandlerFunc. It's protected by
+	// attrsMu.
+	requestID string
+
+	// generateRequestID is true until the random request ID of a request
+	// which didn't carry one is generated, on first use. It's protected by
+	// attrsMu.
+	generateRequestID bool
+
+	// span is the trace span of the request, it may be nil.
+	span Span
+
+	// mu serializes the use of the underlying writer, since the timeout
+	// policy may be applied while the handler is still running, and protects
+	// the fields below.
+	mu sync.Mutex
+
+	// hijacked is true once the connection has been hijacked.
+	hijacked bool
+
+	// fallback is true while a fallback response is written (see
+	// writeFallback), which isn't bound by the request context's deadline.
+	fallback bool
+
+	// written is true once a message has been written successfully.
+	written bool
+
+	// rcode is the rcode of the last message written, or -1.
+	rcode int
+
+	// detached is the handle returned by Detach, if it was called.
+	detached *Detached
+
+	// completeFuncs are called once the request is complete (see
+	// onComplete).
+	completeFuncs []func()
+
+	// attrsMu protects the logger, the request ID and the request's
+	// annotations.
+	attrsMu sync.Mutex
+
+	// attrs are the annotations added via Annotate.
+	attrs []slog.Attr
+
+	// boundLogger is the logger with the request ID and annotations bound to
+	// it, it's reset whenever they change.
+	boundLogger *slog.Logger
+}
+
+// writerConfig is the configuration of a RespWriter, which NewHandlerFunc
+// computes once from the options rather than for every request.
+type writerConfig struct {
+	// logger is the logger to use for logging during the request. It's
+	// protected by attrsMu.
 	logger *slog.Logger
+
+	// maxUDPSize caps the size of UDP responses when greater than zero.
+	maxUDPSize int
+
+	// edns enables server-side EDNS0 handling of responses.
+	edns bool
+
+	// nsid is the hex encoded name server identifier attached to responses
+	// when requested.
+	nsid string
+
+	// paddingBlockSize is the block size responses over encrypted transports
+	// are padded to.
+	paddingBlockSize int
+
+	// envelopeTimeout is the write deadline of each message in streaming
+	// mode.
+	envelopeTimeout time.Duration
+
+	// idleTimeout replaces the request timeout in streaming mode and it's
+	// reset every time a message is written.
+	idleTimeout time.Duration
+
+	// metrics receives the metrics of the writer, it may be nil.
+	metrics Metrics
+
+	// metricLabels are the annotation keys which are added as labels to the
+	// writer's metrics.
+	metricLabels []string
+
+	// timeoutPolicy is applied when the deadline of a request created by
+	// NewHandlerFunc expires before a response is written.
+	timeoutPolicy TimeoutPolicy
+
+	// clock is the source of time for the request's deadlines.
+	clock Clock
+}
+
+func newWriterConfig(opts generalOptions) writerConfig {
+	return writerConfig{
+		logger:           opts.withLogger,
+		maxUDPSize:       opts.withMaxUDPSize,
+		edns:             opts.withEDNS,
+		nsid:             hex.EncodeToString([]byte(opts.withNSID)),
+		paddingBlockSize: opts.withPaddingBlockSize,
+		envelopeTimeout:  opts.withEnvelopeTimeout,
+		idleTimeout:      opts.withIdleTimeout,
+		metrics:          opts.withMetrics,
+		metricLabels:     opts.withMetricLabels,
+		timeoutPolicy:    opts.withTimeoutPolicy,
+		clock:            opts.withClock,
+	}
 }
 
 // NewRespWriter returns a new RespWriter that wraps the given dns.ResponseWriter.
+// Options supported: WithLogger, WithRequest, WithMaxUDPSize, WithEDNS,
+// WithNSID, WithPaddingBlockSize, WithEnvelopeTimeout, WithIdleTimeout,
+// WithMetrics
 func NewRespWriter(ctx context.Context, w dns.ResponseWriter, opt ...Option) *RespWriter {
 	switch {
 	case isNil(ctx):
@@ -58,32 +315,178 @@ func NewRespWriter(ctx context.Context, w dns.ResponseWriter, opt ...Option) *Re
 	}
 	opts := getGeneralOpts(opt...)
 	return &RespWriter{
-		requestCtx: ctx,
-		logger:     opts.withLogger,
-		underlying: w,
+		writerConfig: newWriterConfig(opts),
+		requestCtx:   ctx,
+		underlying:   w,
+		request:      opts.withRequest,
+		rcode:        -1,
 	}
 }
 
 // WriteMsg writes a DNS message to the client. If the ctx is done, it returns
-// the ctx error.
+// the ctx error and ErrHijacked once the connection has been hijacked.
+//
+// When the request is known and it was received over UDP, the message is
+// truncated (setting the TC bit) to fit the size advertised by the client's
+// EDNS0 OPT record or 512 bytes without one, capped by WithMaxUDPSize.
+// Responses sent over TCP are left untouched.
+//
+// When WithEDNS(true) is used, the message's OPT RR is made consistent with
+// the request's before it's written.
+//
+// The write is bound by the request context's deadline (see
+// withWriteDeadline) and a *WriteTimeoutError is returned when it isn't
+// complete in time. In streaming mode (see StartStream), each message must
+// also be written within the envelope timeout and writing it resets the idle
+// timeout. These deadlines are set on the connection, and cleared once the
+// write is done, so they only apply when the underlying writer implements
+// ExposesUnderlyingConns.
 func (rw *RespWriter) WriteMsg(msg *dns.Msg) error {
-	select {
-	case <-rw.requestCtx.Done():
-		return rw.requestCtx.Err()
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.writeMsg(msg)
+}
+
+// writeMsg writes msg to the client. The caller must hold rw.mu.
+func (rw *RespWriter) writeMsg(msg *dns.Msg) error {
+	if rw.hijacked {
+		return ErrHijacked
+	}
+	if err := rw.requestCtx.Err(); err != nil {
+		return err
+	}
+	if rw.writer != nil {
+		return rw.writer.WriteMsg(msg)
+	}
+	return rw.writeUnderlying(msg)
+}
+
+// writeUnderlying writes msg to the underlying writer, once it's been made
+// consistent with the request. The caller must hold rw.mu.
+func (rw *RespWriter) writeUnderlying(msg *dns.Msg) error {
+	rw.setEDNS(msg)
+	rw.truncate(msg)
+	rw.pad(msg)
+	write := func() error { return rw.underlying.WriteMsg(msg) }
+	var err error
+	switch {
+	case rw.fallback:
+		err = rw.withDeadline(rw.clock.Now().Add(fallbackWriteTimeout), write)
 	default:
-		return rw.underlying.WriteMsg(msg)
+		err = rw.withWriteDeadline(write)
+	}
+	if err == nil {
+		rw.written = true
+		rw.rcode = msg.Rcode
+		rw.progress()
+	}
+	return err
+}
+
+// truncate truncates msg to fit the UDP payload size the client can accept.
+func (rw *RespWriter) truncate(msg *dns.Msg) {
+	if msg == nil || rw.request == nil || rw.Transport() != TransportUDP {
+		return
+	}
+	size := dns.MinMsgSize
+	if opt := rw.request.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if rw.maxUDPSize > 0 && rw.maxUDPSize < size {
+		size = rw.maxUDPSize
+	}
+	if msg.Len() > size {
+		msg.Truncate(size)
 	}
 }
 
 // Write writes a raw buffer to the client. If the ctx is done, it returns
-// the ctx error.
-func (rw *RespWriter) Write([]byte) (int, error) {
-	select {
-	case <-rw.requestCtx.Done():
-		return 0, rw.requestCtx.Err()
-	default:
-		return rw.underlying.Write([]byte{})
+// the ctx error and ErrHijacked once the connection has been hijacked. Like
+// WriteMsg, the write is bound by the request context's deadline.
+func (rw *RespWriter) Write(b []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.hijacked {
+		return 0, ErrHijacked
+	}
+	if err := rw.requestCtx.Err(); err != nil {
+		return 0, err
+	}
+	if rw.writer != nil {
+		return rw.writer.Write(b)
+	}
+	return rw.writeRawUnderlying(b)
+}
+
+// writeRawUnderlying writes b to the underlying writer. The caller must hold
+// rw.mu.
+func (rw *RespWriter) writeRawUnderlying(b []byte) (int, error) {
+	var n int
+	err := rw.withWriteDeadline(func() error {
+		var err error
+		n, err = rw.underlying.Write(b)
+		return err
+	})
+	if err == nil {
+		rw.written = true
+		rw.progress()
+	}
+	return n, err
+}
+
+// withWriteDeadline calls write with the write deadline of the underlying
+// stream connection set to the request context's deadline (or the envelope
+// deadline in streaming mode, whichever is earlier), so a blocked write can't
+// outlive the request. Packet connections are shared by every request, so
+// their deadline is left alone.
+//
+// Afterward, the connection is left without a write deadline rather than with
+// the one it had before: net.Conn can't report its current deadline, so it
+// can't be restored. A writer which sets its own write deadlines must set them
+// before each write.
+//
+// The connection is only available when the underlying writer implements
+// ExposesUnderlyingConns, otherwise write is called without a deadline.
+func (rw *RespWriter) withWriteDeadline(write func() error) error {
+	deadline, ok := rw.requestCtx.Deadline()
+	if rw.streaming && rw.envelopeTimeout > 0 {
+		if envelope := rw.clock.Now().Add(rw.envelopeTimeout); !ok || envelope.Before(deadline) {
+			deadline, ok = envelope, true
+		}
+	}
+	if !ok {
+		return write()
 	}
+	return rw.withDeadline(deadline, write)
+}
+
+// withDeadline calls write with the write deadline of the underlying stream
+// connection set to deadline, a time of rw's clock (see withWriteDeadline).
+func (rw *RespWriter) withDeadline(deadline time.Time, write func() error) error {
+	conn := rw.streamConn()
+	if conn == nil || conn.SetWriteDeadline(wallTime(rw.clock, deadline)) != nil {
+		return write()
+	}
+	defer conn.SetWriteDeadline(time.Time{})
+
+	err := write()
+	var netErr net.Error
+	if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		return &WriteTimeoutError{Deadline: deadline, Err: err}
+	}
+	return err
+}
+
+// streamConn returns the underlying stream connection, if it's exposed.
+func (rw *RespWriter) streamConn() net.Conn {
+	e, ok := rw.underlying.(ExposesUnderlyingConns)
+	if !ok {
+		return nil
+	}
+	if c := e.IncomingConn(); !isNil(c) {
+		return c
+	}
+	return nil
 }
 
 // RemoteAddr returns the remote address of the client.
@@ -91,6 +494,47 @@ func (rw *RespWriter) RemoteAddr() net.Addr {
 	return rw.underlying.RemoteAddr()
 }
 
+// Transport returns the transport the request was received over.
+func (rw *RespWriter) Transport() Transport {
+	return transportOf(rw.underlying)
+}
+
+// CookieStatus returns the result of validating the request's DNS cookies.
+// It's CookieNone unless the handler is wrapped by Cookies. Layers such as
+// rate limiting or ACLs can use CookieValid to trust a client's source
+// address.
+func (rw *RespWriter) CookieStatus() CookieStatus {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.cookieStatus
+}
+
+// Request returns the request being responded to, which may be nil when the
+// RespWriter wasn't created via NewHandlerFunc or WithRequest.
+func (rw *RespWriter) Request() *dns.Msg {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.request
+}
+
+// RequestID returns the ID which identifies the request in logs. It's empty
+// when the RespWriter wasn't created via NewHandlerFunc.
+func (rw *RespWriter) RequestID() string {
+	rw.attrsMu.Lock()
+	defer rw.attrsMu.Unlock()
+	return rw.requestIDLocked()
+}
+
+// requestIDLocked returns the request ID, generating it on first use. The
+// caller must hold rw.attrsMu.
+func (rw *RespWriter) requestIDLocked() string {
+	if rw.generateRequestID {
+		rw.requestID = newRequestID()
+		rw.generateRequestID = false
+	}
+	return rw.requestID
+}
+
 // LocalAddr returns the local address of the server.
 func (rw *RespWriter) LocalAddr() net.Addr {
 	return rw.underlying.LocalAddr()
@@ -98,12 +542,10 @@ func (rw *RespWriter) LocalAddr() net.Addr {
 
 // TsigStatus returns the Tsig status of the message.
 func (rw *RespWriter) TsigStatus() error {
-	select {
-	case <-rw.requestCtx.Done():
-		return rw.requestCtx.Err()
-	default:
-		return rw.underlying.TsigStatus()
+	if err := rw.requestCtx.Err(); err != nil {
+		return err
 	}
+	return rw.underlying.TsigStatus()
 }
 
 // TsigTimersOnly sets the Tsig timers only flag on the message.
@@ -111,13 +553,33 @@ func (rw *RespWriter) TsigTimersOnly(b bool) {
 	rw.underlying.TsigTimersOnly(b)
 }
 
-// Hijack hijacks the underlying connection.
+// Hijack hijacks the underlying connection. Once hijacked, the handler owns
+// the connection and the writer's WriteMsg, Write and Close return
+// ErrHijacked. See HijackConn to retrieve the connection.
 func (rw *RespWriter) Hijack() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.hijack()
+}
+
+// hijack hijacks the underlying connection. The caller must hold rw.mu.
+func (rw *RespWriter) hijack() {
+	if rw.hijacked {
+		return
+	}
+	rw.hijacked = true
 	rw.underlying.Hijack()
+	rw.reportHijack()
 }
 
-// Close closes the underlying connection.
+// Close closes the underlying connection. It returns ErrHijacked once the
+// connection has been hijacked, since it's owned by the handler.
 func (rw *RespWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.hijacked {
+		return ErrHijacked
+	}
 	return rw.underlying.Close()
 }
 
@@ -131,13 +593,34 @@ func (rw *RespWriter) RequestContext() context.Context {
 	return rw.requestCtx
 }
 
-// Logger returns the logger to use for logging during the request.
+// Logger returns the logger to use for logging during the request. The
+// request ID and the annotations added via Annotate are bound to it.
 func (rw *RespWriter) Logger() *slog.Logger {
-	return rw.logger
+	rw.attrsMu.Lock()
+	defer rw.attrsMu.Unlock()
+	switch {
+	case rw.logger == nil:
+		return nil
+	case rw.requestIDLocked() == "" && len(rw.attrs) == 0:
+		return rw.logger
+	case rw.boundLogger == nil:
+		args := make([]any, 0, len(rw.attrs)+1)
+		if rw.requestID != "" {
+			args = append(args, slog.String("request_id", rw.requestID))
+		}
+		for _, a := range rw.attrs {
+			args = append(args, a)
+		}
+		rw.boundLogger = rw.logger.With(args...)
+	}
+	return rw.boundLogger
 }
 
 // SetLogger sets the logger to use for logging during the request which allows
 // you to override the logger passed to NewRespWriter(...)
 func (rw *RespWriter) SetLogger(logger *slog.Logger) {
+	rw.attrsMu.Lock()
+	defer rw.attrsMu.Unlock()
 	rw.logger = logger
+	rw.boundLogger = nil
 }
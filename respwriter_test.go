@@ -2,9 +2,13 @@ package respwriter
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -43,6 +47,7 @@ func TestNewRespWriterHandler(t *testing.T) {
 		logger                  *slog.Logger
 		timeout                 time.Duration
 		handler                 dns.HandlerFunc
+		opts                    []Option
 		wantErrContains         string
 		wantErrIs               error
 		wantErrExchangeContains string
@@ -54,15 +59,6 @@ func TestNewRespWriterHandler(t *testing.T) {
 			handler: func(w dns.ResponseWriter, req *dns.Msg) {
 			},
 		},
-		{
-			name:    "success-req-timeout",
-			logger:  testLogger,
-			timeout: requestTimeout,
-			handler: func(w dns.ResponseWriter, req *dns.Msg) {
-				time.Sleep(200 * time.Millisecond)
-			},
-			wantErrExchangeContains: "i/o timeout",
-		},
 		{
 			name:    "err-nil-logger",
 			logger:  nil,
@@ -84,6 +80,24 @@ func TestNewRespWriterHandler(t *testing.T) {
 			wantErrIs:       ErrInvalidParameter,
 			wantErrContains: "nil handler",
 		},
+		{
+			name:            "err-invalid-max-request-timeout",
+			logger:          testLogger,
+			timeout:         requestTimeout,
+			handler:         func(w dns.ResponseWriter, req *dns.Msg) {},
+			opts:            []Option{WithMaxRequestTimeout(-1)},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "invalid max request timeout",
+		},
+		{
+			name:            "err-max-request-timeout-too-small",
+			logger:          testLogger,
+			timeout:         requestTimeout,
+			handler:         func(w dns.ResponseWriter, req *dns.Msg) {},
+			opts:            []Option{WithMaxRequestTimeout(requestTimeout / 2)},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "max request timeout is less than the request timeout",
+		},
 	}
 
 	for _, tc := range tests {
@@ -91,12 +105,13 @@ func TestNewRespWriterHandler(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			assert, require := assert.New(t), require.New(t)
 			var executedHandler bool
+			opts := append([]Option{WithLogger(tc.logger)}, tc.opts...)
 
 			var got dns.HandlerFunc
 			var err error
 			switch {
 			case tc.handler == nil:
-				got, err = NewHandlerFunc(tc.timeout, tc.handler, WithLogger(tc.logger))
+				got, err = NewHandlerFunc(tc.timeout, tc.handler, opts...)
 			default:
 				testMockHandler := func(w dns.ResponseWriter, req *dns.Msg) {
 					t.Helper()
@@ -109,7 +124,7 @@ func TestNewRespWriterHandler(t *testing.T) {
 					m.Extra[0] = &dns.TXT{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: []string{"Hello world"}}
 					_ = w.WriteMsg(m)
 				}
-				got, err = NewHandlerFunc(tc.timeout, testMockHandler, WithLogger(tc.logger))
+				got, err = NewHandlerFunc(tc.timeout, testMockHandler, opts...)
 			}
 			if tc.wantErrContains != "" {
 				require.Error(err)
@@ -155,10 +170,9 @@ func TestRespWriter_WriteMsg(t *testing.T) {
 		assert.Equal(t, context.Canceled, err)
 	})
 	t.Run("context-timeout", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
 		t.Cleanup(cancel)
 		respWriter := NewRespWriter(ctx, w, WithLogger(testLogger))
-		time.Sleep(200 * time.Millisecond)
 		msg := new(dns.Msg)
 		err := respWriter.WriteMsg(msg)
 		assert.Equal(t, context.DeadlineExceeded, err)
@@ -169,6 +183,134 @@ func TestRespWriter_WriteMsg(t *testing.T) {
 		err := respWriter.WriteMsg(msg)
 		assert.NoError(t, err)
 	})
+	t.Run("write-timeout", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		server, client := net.Pipe()
+		t.Cleanup(func() { server.Close(); client.Close() })
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		t.Cleanup(cancel)
+		respWriter := NewRespWriter(ctx, &mockPipeResponseWriter{conn: server}, WithLogger(testLogger))
+
+		// nothing reads from the client side of the pipe, so the write blocks
+		// until the request deadline.
+		start := time.Now()
+		err := respWriter.WriteMsg(new(dns.Msg))
+		require.Error(err)
+		var timeoutErr *WriteTimeoutError
+		require.ErrorAs(err, &timeoutErr)
+		wantDeadline, _ := ctx.Deadline()
+		assert.Equal(wantDeadline, timeoutErr.Deadline)
+		assert.Less(time.Since(start), time.Second)
+
+		// the write deadline is cleared afterward
+		go func() {
+			buf := make([]byte, 512)
+			_, _ = client.Read(buf)
+		}()
+		_, err = server.Write([]byte{0})
+		assert.NoError(err)
+	})
+}
+
+func TestRespWriter_WriteMsg_truncate(t *testing.T) {
+	t.Parallel()
+	testLogger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{AddSource: true}))
+
+	bigReply := func(r *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for i := 0; i < 100; i++ {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{fmt.Sprintf("record %d is long enough to take some space", i)},
+			})
+		}
+		return m
+	}
+	withEDNS := func(size uint16) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeTXT)
+		if size > 0 {
+			r.SetEdns0(size, false)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name          string
+		w             dns.ResponseWriter
+		req           *dns.Msg
+		opts          []Option
+		wantTruncated bool
+		wantMaxLen    int
+	}{
+		{
+			name:          "udp-no-edns",
+			w:             new(mockUDPResponseWriter),
+			req:           withEDNS(0),
+			wantTruncated: true,
+			wantMaxLen:    dns.MinMsgSize,
+		},
+		{
+			name:          "udp-edns",
+			w:             new(mockUDPResponseWriter),
+			req:           withEDNS(1232),
+			wantTruncated: true,
+			wantMaxLen:    1232,
+		},
+		{
+			name:          "udp-edns-capped",
+			w:             new(mockUDPResponseWriter),
+			req:           withEDNS(4096),
+			opts:          []Option{WithMaxUDPSize(1000)},
+			wantTruncated: true,
+			wantMaxLen:    1000,
+		},
+		{
+			name:          "udp-edns-below-min",
+			w:             new(mockUDPResponseWriter),
+			req:           withEDNS(100),
+			wantTruncated: true,
+			wantMaxLen:    dns.MinMsgSize,
+		},
+		{
+			name:       "udp-edns-fits",
+			w:          new(mockUDPResponseWriter),
+			req:        withEDNS(dns.MaxMsgSize),
+			wantMaxLen: dns.MaxMsgSize,
+		},
+		{
+			name:       "tcp-untouched",
+			w:          new(mockTCPResponseWriter),
+			req:        withEDNS(0),
+			wantMaxLen: dns.MaxMsgSize,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			opts := append([]Option{WithLogger(testLogger), WithRequest(tc.req)}, tc.opts...)
+			rw := NewRespWriter(context.Background(), tc.w, opts...)
+			msg := bigReply(tc.req)
+			want := len(msg.Answer)
+			require.NoError(rw.WriteMsg(msg))
+
+			assert.Equal(tc.wantTruncated, msg.Truncated)
+			assert.LessOrEqual(msg.Len(), tc.wantMaxLen)
+			if tc.wantTruncated {
+				assert.Less(len(msg.Answer), want)
+				return
+			}
+			assert.Len(msg.Answer, want)
+		})
+	}
+	t.Run("no-request", func(t *testing.T) {
+		rw := NewRespWriter(context.Background(), new(mockUDPResponseWriter), WithLogger(testLogger))
+		msg := bigReply(withEDNS(0))
+		require.NoError(t, rw.WriteMsg(msg))
+		assert.False(t, msg.Truncated)
+	})
 }
 
 func TestRespWriter_Write(t *testing.T) {
@@ -184,10 +326,9 @@ func TestRespWriter_Write(t *testing.T) {
 		assert.Equal(t, context.Canceled, err)
 	})
 	t.Run("context-timeout", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
 		t.Cleanup(cancel)
 		respWriter := NewRespWriter(ctx, w, WithLogger(testLogger))
-		time.Sleep(200 * time.Millisecond)
 		n, err := respWriter.Write([]byte{})
 		assert.Equal(t, 0, n)
 		assert.Equal(t, context.DeadlineExceeded, err)
@@ -198,6 +339,38 @@ func TestRespWriter_Write(t *testing.T) {
 		assert.Equal(t, 0, n)
 		assert.NoError(t, err)
 	})
+	t.Run("write-timeout", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		server, client := net.Pipe()
+		t.Cleanup(func() { server.Close(); client.Close() })
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		t.Cleanup(cancel)
+		respWriter := NewRespWriter(ctx, &mockPipeResponseWriter{conn: server}, WithLogger(testLogger))
+
+		n, err := respWriter.Write([]byte("hello"))
+		assert.Equal(0, n)
+		var timeoutErr *WriteTimeoutError
+		require.ErrorAs(err, &timeoutErr)
+	})
+	t.Run("writes-buffer", func(t *testing.T) {
+		assert := assert.New(t)
+		server, client := net.Pipe()
+		t.Cleanup(func() { server.Close(); client.Close() })
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		t.Cleanup(cancel)
+		respWriter := NewRespWriter(ctx, &mockPipeResponseWriter{conn: server}, WithLogger(testLogger))
+
+		got := make(chan string, 1)
+		go func() {
+			buf := make([]byte, 512)
+			n, _ := client.Read(buf)
+			got <- string(buf[:n])
+		}()
+		n, err := respWriter.Write([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal(5, n)
+		assert.Equal("hello", <-got)
+	})
 }
 
 func TestRespWriter_RemoteAddr(t *testing.T) {
@@ -212,10 +385,9 @@ func TestRespWriter_RemoteAddr(t *testing.T) {
 		assert.NotNil(t, addr)
 	})
 	t.Run("context-timeout", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
 		t.Cleanup(cancel)
 		respWriter := NewRespWriter(ctx, w, WithLogger(testLogger))
-		time.Sleep(200 * time.Millisecond)
 		addr := respWriter.RemoteAddr()
 		assert.NotNil(t, addr)
 	})
@@ -238,10 +410,9 @@ func TestRespWriter_LocalAdrr(t *testing.T) {
 		assert.NotNil(t, addr)
 	})
 	t.Run("context-timeout", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
 		t.Cleanup(cancel)
 		respWriter := NewRespWriter(ctx, w, WithLogger(testLogger))
-		time.Sleep(200 * time.Millisecond)
 		addr := respWriter.LocalAddr()
 		assert.NotNil(t, addr)
 	})
@@ -264,10 +435,9 @@ func TestRespWriter_TigStatus(t *testing.T) {
 		assert.Equal(t, context.Canceled, err)
 	})
 	t.Run("context-timeout", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
 		t.Cleanup(cancel)
 		respWriter := NewRespWriter(ctx, w, WithLogger(testLogger))
-		time.Sleep(200 * time.Millisecond)
 		err := respWriter.TsigStatus()
 		assert.Equal(t, context.DeadlineExceeded, err)
 	})
@@ -289,10 +459,9 @@ func TestRespWriter_TsigTimersOnly(t *testing.T) {
 		respWriter.TsigTimersOnly(true)
 	})
 	t.Run("context-timeout", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
 		t.Cleanup(cancel)
 		respWriter := NewRespWriter(ctx, w, WithLogger(testLogger))
-		time.Sleep(200 * time.Millisecond)
 		respWriter.TsigTimersOnly(true)
 	})
 	t.Run("success", func(t *testing.T) {
@@ -312,10 +481,9 @@ func TestRespWriter_Hijack(t *testing.T) {
 		respWriter.Hijack()
 	})
 	t.Run("context-timeout", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
 		t.Cleanup(cancel)
 		respWriter := NewRespWriter(ctx, w, WithLogger(testLogger))
-		time.Sleep(200 * time.Millisecond)
 		respWriter.Hijack()
 	})
 	t.Run("success", func(t *testing.T) {
@@ -335,10 +503,9 @@ func TestRespWriter_Close(t *testing.T) {
 		assert.NoError(t, respWriter.Close())
 	})
 	t.Run("context-timeout", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
 		t.Cleanup(cancel)
 		respWriter := NewRespWriter(ctx, w, WithLogger(testLogger))
-		time.Sleep(200 * time.Millisecond)
 		assert.NoError(t, respWriter.Close())
 	})
 	t.Run("success", func(t *testing.T) {
@@ -383,6 +550,322 @@ func TestRespWriter_Underlying(t *testing.T) {
 	assert.Equal(t, w, respWriter.Underlying())
 }
 
+func TestRespWriter_concurrentUse(t *testing.T) {
+	t.Parallel()
+	testLogger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// useConcurrently uses rw from several goroutines until its context is
+	// done and returns the number of messages written.
+	useConcurrently := func(t *testing.T, rw *RespWriter, r *dns.Msg) int {
+		t.Helper()
+		var (
+			wg      sync.WaitGroup
+			written atomic.Int32
+		)
+		for i := 0; i < 8; i++ {
+			i := i
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					m := new(dns.Msg)
+					m.SetReply(r)
+					err := rw.WriteMsg(m)
+					switch {
+					case err == nil:
+						written.Add(1)
+					case rw.RequestContext().Err() == nil:
+						assert.NoError(t, err)
+					}
+					rw.SetLogger(testLogger)
+					rw.Annotate(fmt.Sprintf("worker-%d", i), i)
+					rw.Logger().Debug("write", "err", err)
+					_ = rw.CookieStatus()
+					_ = rw.Request()
+					_ = rw.RequestID()
+					_ = rw.ExtendDeadline(time.Millisecond)
+					if rw.RequestContext().Err() != nil {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		return int(written.Load())
+	}
+
+	t.Run("mock", func(t *testing.T) {
+		t.Parallel()
+		require := require.New(t)
+		var written int
+		h, err := NewHandlerFunc(20*time.Millisecond, func(w dns.ResponseWriter, r *dns.Msg) {
+			written = useConcurrently(t, w.(*RespWriter), r)
+		}, WithLogger(testLogger), WithTimeoutPolicy(TimeoutReplyAndClose), WithMaxRequestTimeout(50*time.Millisecond))
+		require.NoError(err)
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		h(new(mockTCPResponseWriter), r)
+		assert.Greater(t, written, 0)
+	})
+	t.Run("server", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		h, err := NewHandlerFunc(20*time.Millisecond, func(w dns.ResponseWriter, r *dns.Msg) {
+			useConcurrently(t, w.(*RespWriter), r)
+		}, WithLogger(testLogger))
+		require.NoError(err)
+		_, c, addr := runTestDnsServer(t, ".", h)
+
+		conn, err := c.Dial(addr)
+		require.NoError(err)
+		defer conn.Close()
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		require.NoError(conn.WriteMsg(r))
+
+		// every message read is intact, since writes are serialized
+		var read int
+		for {
+			require.NoError(conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond)))
+			got, err := conn.ReadMsg()
+			if err != nil {
+				break
+			}
+			assert.Equal(r.Id, got.Id)
+			read++
+		}
+		assert.Greater(read, 0)
+	})
+	t.Run("detached", func(t *testing.T) {
+		t.Parallel()
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		rw := NewRespWriter(context.Background(), new(mockTCPResponseWriter), WithRequest(r))
+		var (
+			wg        sync.WaitGroup
+			responded atomic.Int32
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m := new(dns.Msg)
+				m.SetReply(r)
+				switch err := rw.Detach().Respond(m); {
+				case err == nil:
+					responded.Add(1)
+				default:
+					assert.ErrorIs(t, err, ErrAlreadyWritten)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), responded.Load())
+	})
+}
+
+func TestNewHandlerFunc_panic(t *testing.T) {
+	t.Parallel()
+	testLogger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	r := new(dns.Msg)
+	r.SetQuestion("go.dev.", dns.TypeA)
+
+	tests := []struct {
+		name      string
+		handler   func(rw *RespWriter, r *dns.Msg)
+		wantRcode int
+	}{
+		{
+			name:      "servfail",
+			handler:   func(rw *RespWriter, r *dns.Msg) { panic("boom") },
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name: "already-written",
+			handler: func(rw *RespWriter, r *dns.Msg) {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				_ = rw.WriteMsg(m)
+				panic("boom")
+			},
+			wantRcode: dns.RcodeSuccess,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			metrics := newTestMetrics()
+			h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+				tc.handler(w.(*RespWriter), r)
+			}, WithLogger(testLogger), WithMetrics(metrics), WithRecoverPanics(true))
+			require.NoError(err)
+
+			cw := &captureWriter{ResponseWriter: new(mockUDPResponseWriter)}
+			assert.NotPanics(func() { h(cw, r.Copy()) })
+			require.NotNil(cw.msg)
+			assert.Equal(tc.wantRcode, cw.msg.Rcode)
+			assert.Equal(1, metrics.counter(MetricPanics))
+			assert.Contains(metrics.lastLabels(MetricPanics), "transport")
+		})
+	}
+	t.Run("detached", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		var d *Detached
+		h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+			d = w.(*RespWriter).Detach()
+			panic("boom")
+		}, WithLogger(testLogger), WithRecoverPanics(true))
+		require.NoError(err)
+
+		cw := &captureWriter{ResponseWriter: new(mockUDPResponseWriter)}
+		assert.NotPanics(func() { h(cw, r.Copy()) })
+		require.NotNil(cw.msg)
+		assert.Equal(dns.RcodeServerFailure, cw.msg.Rcode)
+		// the detached handle was used to answer, so a late response is
+		// refused.
+		m := new(dns.Msg)
+		m.SetReply(r)
+		assert.ErrorIs(d.Respond(m), ErrAlreadyWritten)
+	})
+	t.Run("not-recovered", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		metrics := newTestMetrics()
+		h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+			panic("boom")
+		}, WithLogger(testLogger), WithMetrics(metrics))
+		require.NoError(err)
+
+		// panics aren't recovered by default.
+		cw := &captureWriter{ResponseWriter: new(mockUDPResponseWriter)}
+		assert.PanicsWithValue("boom", func() { h(cw, r.Copy()) })
+		assert.Nil(cw.msg)
+		assert.Equal(0, metrics.counter(MetricPanics))
+	})
+}
+
+func TestNewHandlerFunc_pooling(t *testing.T) {
+	t.Parallel()
+	const requestTimeout = time.Second
+	testLogger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// serve calls h, wrapped by a pooling NewHandlerFunc, for n requests and
+	// returns the writers they were given.
+	serve := func(t *testing.T, n int, h func(rw *RespWriter, r *dns.Msg), opt ...Option) []*RespWriter {
+		t.Helper()
+		var writers []*RespWriter
+		handler, err := NewHandlerFunc(requestTimeout, func(w dns.ResponseWriter, r *dns.Msg) {
+			writers = append(writers, w.(*RespWriter))
+			h(w.(*RespWriter), r)
+		}, append([]Option{WithPooling(true), WithMaxRequestTimeout(time.Hour), WithLogger(testLogger)}, opt...)...)
+		require.NoError(t, err)
+		for i := 0; i < n; i++ {
+			r := new(dns.Msg)
+			r.SetQuestion(fmt.Sprintf("%d.go.dev.", i), dns.TypeA)
+			handler(new(mockTCPResponseWriter), r)
+		}
+		return writers
+	}
+	// reused returns the number of requests given a writer which was already
+	// used by an earlier request.
+	reused := func(writers []*RespWriter) int {
+		seen := map[*RespWriter]bool{}
+		n := 0
+		for _, rw := range writers {
+			if seen[rw] {
+				n++
+			}
+			seen[rw] = true
+		}
+		return n
+	}
+
+	t.Run("reset", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		ids := map[string]bool{}
+		writers := serve(t, 50, func(rw *RespWriter, r *dns.Msg) {
+			// every request gets a writer in its initial state.
+			assert.Equal(r, rw.Request())
+			assert.False(ids[rw.RequestID()])
+			ids[rw.RequestID()] = true
+			ctx := rw.RequestContext()
+			assert.NoError(ctx.Err())
+			got, ok := FromContext(ctx)
+			assert.True(ok)
+			assert.Same(rw, got)
+			deadline, _ := ctx.Deadline()
+			assert.WithinDuration(time.Now().Add(requestTimeout), deadline, 100*time.Millisecond)
+			require.NoError(rw.ExtendDeadline(time.Second))
+
+			rw.Annotate("name", r.Question[0].Name)
+			rw.Logger().Debug("handling")
+			// a derived context which is canceled before the handler
+			// returns doesn't prevent the writer's reuse.
+			derived, cancel := context.WithCancel(ctx)
+			cancel()
+			<-derived.Done()
+			m := new(dns.Msg)
+			m.SetReply(r)
+			assert.NoError(rw.WriteMsg(m))
+		})
+		assert.Len(ids, 50)
+		assert.Positive(reused(writers))
+	})
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		metrics := newTestMetrics()
+		n := 0
+		writers := serve(t, 10, func(rw *RespWriter, r *dns.Msg) {
+			// every other request times out.
+			if n++; n%2 == 1 {
+				require.True(t, rw.deadlineCtx.setDeadline(time.Now()))
+				<-rw.RequestContext().Done()
+				return
+			}
+			m := new(dns.Msg)
+			m.SetReply(r)
+			assert.NoError(rw.WriteMsg(m))
+		}, WithMetrics(metrics))
+		assert.Equal(5, metrics.counter(MetricTimeouts))
+		assert.Positive(reused(writers))
+	})
+	t.Run("not-reused", func(t *testing.T) {
+		t.Parallel()
+		tests := []struct {
+			name string
+			h    func(rw *RespWriter, r *dns.Msg)
+		}{
+			{
+				name: "detached",
+				h:    func(rw *RespWriter, r *dns.Msg) { _ = rw.Detach().Fail(dns.RcodeSuccess) },
+			},
+			{
+				name: "hijacked",
+				h:    func(rw *RespWriter, r *dns.Msg) { rw.Hijack() },
+			},
+			{
+				name: "after-func",
+				h: func(rw *RespWriter, r *dns.Msg) {
+					// the func is called once the request is done.
+					context.AfterFunc(rw.RequestContext(), func() {})
+				},
+			},
+		}
+		for _, tc := range tests {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				t.Parallel()
+				assert.Zero(t, reused(serve(t, 20, tc.h)))
+			})
+		}
+	})
+}
+
 type mockDNSResponseWriter struct {
 	dns.ResponseWriter
 }
@@ -424,3 +907,95 @@ func (w *mockDNSResponseWriter) IncomingPacketConn() net.PacketConn {
 func (w *mockDNSResponseWriter) IncomingConn() net.Conn {
 	return &net.TCPConn{}
 }
+
+// mockUDPResponseWriter is a mockDNSResponseWriter which only exposes a
+// packet conn, so its transport is UDP.
+type mockUDPResponseWriter struct {
+	mockDNSResponseWriter
+}
+
+func (w *mockUDPResponseWriter) IncomingConn() net.Conn {
+	return nil
+}
+
+// mockTCPResponseWriter is a mockDNSResponseWriter which only exposes a
+// stream conn, so its transport is TCP.
+type mockTCPResponseWriter struct {
+	mockDNSResponseWriter
+}
+
+func (w *mockTCPResponseWriter) IncomingPacketConn() net.PacketConn {
+	return nil
+}
+
+// benchResponseWriter is a UDP dns.ResponseWriter which discards what's
+// written and doesn't allocate, so benchmarks only measure the RespWriter.
+type benchResponseWriter struct {
+	mockUDPResponseWriter
+	addr net.Addr
+	pc   net.PacketConn
+
+	// reply is the reply written by the benchmarked handler. WriteMsg
+	// modifies it, so it mustn't be shared by concurrent requests.
+	reply *dns.Msg
+}
+
+func newBenchResponseWriter(reply *dns.Msg) *benchResponseWriter {
+	return &benchResponseWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, pc: &net.UDPConn{}, reply: reply}
+}
+
+func (w *benchResponseWriter) RemoteAddr() net.Addr               { return w.addr }
+func (w *benchResponseWriter) LocalAddr() net.Addr                { return w.addr }
+func (w *benchResponseWriter) IncomingPacketConn() net.PacketConn { return w.pc }
+
+func BenchmarkNewHandlerFunc(b *testing.B) {
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(r)
+	h := func(w dns.ResponseWriter, _ *dns.Msg) {
+		_ = w.WriteMsg(w.(*RespWriter).Underlying().(*benchResponseWriter).reply)
+	}
+
+	tests := []struct {
+		name string
+		opt  []Option
+	}{
+		{name: "default"},
+		{name: "edns", opt: []Option{WithEDNS(true), WithNSID("ns1")}},
+		{name: "metrics", opt: []Option{WithMetrics(nopMetrics{})}},
+		{name: "pooled", opt: []Option{WithPooling(true)}},
+		{name: "pooled-metrics", opt: []Option{WithPooling(true), WithMetrics(nopMetrics{})}},
+	}
+	for _, tc := range tests {
+		b.Run(tc.name, func(b *testing.B) {
+			handler, err := NewHandlerFunc(time.Second, h, tc.opt...)
+			require.NoError(b, err)
+			w := newBenchResponseWriter(reply)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler(w, r)
+			}
+		})
+		b.Run(tc.name+"-parallel", func(b *testing.B) {
+			handler, err := NewHandlerFunc(time.Second, h, tc.opt...)
+			require.NoError(b, err)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				w := newBenchResponseWriter(reply.Copy())
+				r := r.Copy()
+				for pb.Next() {
+					handler(w, r)
+				}
+			})
+		})
+	}
+}
+
+// nopMetrics is a Metrics which discards everything.
+type nopMetrics struct{}
+
+func (nopMetrics) IncCounter(string, map[string]string)                     {}
+func (nopMetrics) ObserveDuration(string, time.Duration, map[string]string) {}
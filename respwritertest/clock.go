@@ -0,0 +1,143 @@
+package respwritertest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+)
+
+var _ respwriter.Clock = (*FakeClock)(nil)
+
+// FakeClock is a respwriter.Clock which only moves when it's advanced, so
+// timeouts can be tested deterministically. Pass it to respwriter.WithClock.
+// A FakeClock is safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a new FakeClock set to start. If start is zero, it's
+// set to the current time.
+func NewFakeClock(start time.Time) *FakeClock {
+	if start.IsZero() {
+		start = time.Now()
+	}
+	c := &FakeClock{now: start}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc returns a timer which calls f once the clock has been advanced by
+// at least d. Unlike time.AfterFunc, f is called synchronously by Advance, so
+// its effects are visible when Advance returns.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) respwriter.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, f: f}
+	c.schedule(t, d)
+	return t
+}
+
+// Advance moves the clock forward by d, calling the functions of the timers
+// which expire, in order of expiry.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		if len(c.timers) == 0 || c.timers[0].when.After(target) {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		c.mu.Unlock()
+		t.f()
+	}
+}
+
+// Timers returns the number of active timers.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// WaitForTimers blocks until the clock has at least n active timers, which
+// allows a test to advance the clock once the code under test is waiting on
+// it.
+func (c *FakeClock) WaitForTimers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// schedule (re)schedules t to fire after d. Like time.AfterFunc, it fires
+// right away in its own goroutine when d isn't positive. The caller must hold
+// c.mu.
+func (c *FakeClock) schedule(t *fakeTimer, d time.Duration) {
+	c.unschedule(t)
+	if d <= 0 {
+		go t.f()
+		return
+	}
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+	c.cond.Broadcast()
+}
+
+// unschedule removes t and reports whether it was active. The caller must
+// hold c.mu.
+func (c *FakeClock) unschedule(t *fakeTimer) bool {
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTimer is a timer created by FakeClock.AfterFunc.
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	f     func()
+}
+
+// Stop prevents the timer from firing. It returns false if the timer already
+// fired or was stopped.
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.unschedule(t)
+}
+
+// Reset changes the timer to fire once the clock has been advanced by d. It
+// returns true if the timer was active.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.clock.unschedule(t)
+	t.clock.schedule(t, d)
+	return active
+}
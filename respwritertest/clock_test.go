@@ -0,0 +1,194 @@
+package respwritertest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	t.Parallel()
+
+	t.Run("advance", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		start := time.Unix(1700000000, 0)
+		c := NewFakeClock(start)
+		assert.Equal(start, c.Now())
+
+		var fired []string
+		c.AfterFunc(2*time.Second, func() { fired = append(fired, "second") })
+		c.AfterFunc(time.Second, func() { fired = append(fired, "first") })
+		stopped := c.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+		assert.Equal(3, c.Timers())
+		assert.True(stopped.Stop())
+		assert.False(stopped.Stop())
+
+		c.Advance(500 * time.Millisecond)
+		assert.Empty(fired)
+		c.Advance(2 * time.Second)
+		assert.Equal([]string{"first", "second"}, fired)
+		assert.Equal(start.Add(2500*time.Millisecond), c.Now())
+		assert.Zero(c.Timers())
+	})
+	t.Run("reset", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		c := NewFakeClock(time.Time{})
+		var fired atomic.Int32
+		timer := c.AfterFunc(time.Second, func() { fired.Add(1) })
+		assert.True(timer.Reset(3 * time.Second))
+		c.Advance(2 * time.Second)
+		assert.Zero(fired.Load())
+		c.Advance(time.Second)
+		assert.Equal(int32(1), fired.Load())
+		assert.False(timer.Reset(time.Second))
+		c.Advance(time.Second)
+		assert.Equal(int32(2), fired.Load())
+	})
+	t.Run("not-positive", func(t *testing.T) {
+		t.Parallel()
+		c := NewFakeClock(time.Time{})
+		fired := make(chan struct{})
+		c.AfterFunc(0, func() { close(fired) })
+		select {
+		case <-fired:
+		case <-time.After(time.Second):
+			assert.Fail(t, "timer didn't fire")
+		}
+	})
+	t.Run("wait-for-timers", func(t *testing.T) {
+		t.Parallel()
+		c := NewFakeClock(time.Time{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.WaitForTimers(1)
+		}()
+		c.AfterFunc(time.Second, func() {})
+		wg.Wait()
+	})
+}
+
+func TestFakeClock_NewHandlerFunc(t *testing.T) {
+	t.Parallel()
+	r := new(dns.Msg)
+	r.SetQuestion("go.dev.", dns.TypeA)
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		c := NewFakeClock(time.Time{})
+		var writeErr error
+		h, err := respwriter.NewHandlerFunc(100*time.Millisecond, func(w dns.ResponseWriter, r *dns.Msg) {
+			rw := w.(*respwriter.RespWriter)
+			budget, ok := respwriter.BudgetFromContext(rw.RequestContext())
+			assert.True(ok)
+			assert.Equal(100*time.Millisecond, budget)
+
+			c.Advance(99 * time.Millisecond)
+			assert.NoError(rw.RequestContext().Err())
+			c.Advance(time.Millisecond)
+			<-rw.RequestContext().Done()
+
+			m := new(dns.Msg)
+			m.SetReply(r)
+			writeErr = w.WriteMsg(m)
+		}, respwriter.WithClock(c))
+		require.NoError(err)
+		rec := NewRecorder()
+		h(rec, r)
+		assert.ErrorIs(writeErr, context.DeadlineExceeded)
+		assert.Empty(rec.Records())
+	})
+	t.Run("extend-deadline", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		c := NewFakeClock(time.Time{})
+		metrics := new(testMetrics)
+		h, err := respwriter.NewHandlerFunc(100*time.Millisecond, func(w dns.ResponseWriter, r *dns.Msg) {
+			rw := w.(*respwriter.RespWriter)
+			require.NoError(rw.ExtendDeadline(time.Second))
+			c.Advance(time.Second)
+			assert.NoError(rw.RequestContext().Err())
+
+			m := new(dns.Msg)
+			m.SetReply(r)
+			assert.NoError(w.WriteMsg(m))
+		}, respwriter.WithClock(c), respwriter.WithMaxRequestTimeout(2*time.Second), respwriter.WithMetrics(metrics))
+		require.NoError(err)
+		rec := NewRecorder(WithTransport(respwriter.TransportTCP))
+		h(rec, r)
+		require.Len(rec.Records(), 1)
+
+		// the request's latency is measured with the clock
+		assert.Equal([]time.Duration{time.Second}, metrics.durations(respwriter.MetricRequestDuration))
+	})
+}
+
+func TestFakeClock_Cache(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	c := NewFakeClock(time.Time{})
+	var calls atomic.Int32
+	cache, err := respwriter.NewCache(func(w dns.ResponseWriter, r *dns.Msg) {
+		calls.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   []byte{192, 0, 2, 1},
+		})
+		_ = w.WriteMsg(m)
+	}, respwriter.WithClock(c), respwriter.WithPrefetchThreshold(0))
+	require.NoError(err)
+
+	serve := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		rec := NewRecorder()
+		cache.ServeDNS(respwriter.NewRespWriter(context.Background(), rec), r)
+		return rec.LastMsg()
+	}
+	serve()
+	c.Advance(59 * time.Second)
+	got := serve()
+	require.NotNil(got)
+	assert.Equal(uint32(1), got.Answer[0].Header().Ttl)
+	assert.Equal(int32(1), calls.Load())
+
+	c.Advance(time.Second)
+	serve()
+	assert.Equal(int32(2), calls.Load())
+}
+
+// testMetrics is a respwriter.Metrics which keeps the durations it receives.
+type testMetrics struct {
+	mu     sync.Mutex
+	values map[string][]time.Duration
+}
+
+func (m *testMetrics) IncCounter(string, map[string]string) {}
+
+func (m *testMetrics) ObserveDuration(name string, d time.Duration, _ map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values == nil {
+		m.values = map[string][]time.Duration{}
+	}
+	m.values[name] = append(m.values[name], d)
+}
+
+func (m *testMetrics) durations(name string) []time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[name]
+}
@@ -0,0 +1,3 @@
+// Package respwritertest provides utilities for testing dns handlers which use
+// the respwriter package, in the spirit of net/http/httptest.
+package respwritertest
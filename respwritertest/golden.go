@@ -0,0 +1,563 @@
+package respwritertest
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+)
+
+// goldenQueryID is the message ID of every golden query, so responses are
+// deterministic.
+const goldenQueryID = 1
+
+// RunGolden runs the cases of the golden file at path as subtests. Each case's
+// query is passed to h, wrapped by respwriter.NewHandlerFunc and written to a
+// Recorder, and the responses are diffed with the case's expectations. With
+// WithUpdate, the expectations are rewritten from the actual responses
+// instead.
+//
+// A golden file is a list of cases, each one starting with a "=== <name>" line
+// followed by "key: value" lines describing the query:
+//
+//	question: <name> [class] <type>      (required)
+//	transport: udp | tcp | tcp-tls       (default WithTransport)
+//	flags: [rd] [cd] [ad]                (default rd)
+//	edns: <udp size> [do]
+//	option: nsid | cookie <hex> | padding <len> | <code> <hex>
+//	timeout: <duration>                  (default WithRequestTimeout)
+//	max-latency: <duration>
+//
+// The query is followed by the expectations, which are either "--- times out",
+// "--- no response" or a "--- response" section for every message written:
+//
+//	rcode: <rcode>
+//	flags: [qr] [aa] [tc] [rd] [ra] [ad] [cd]
+//	edns: <udp size> [do]
+//	option: ...                          (see above)
+//	answer: <rr>                         (zone file presentation format)
+//	authority: <rr>
+//	additional: <rr>
+//
+// Lines starting with # and blank lines are ignored, and are kept by updates
+// except within expectations. Options supported: WithRequestTimeout,
+// WithTransport, WithUpdate, and the options of respwriter.NewHandlerFunc.
+func RunGolden(t *testing.T, path string, h dns.HandlerFunc, opt ...respwriter.Option) {
+	t.Helper()
+	opts := getOpts(opt...)
+	f, err := readGoldenFile(path)
+	if err != nil {
+		t.Fatalf("respwritertest.RunGolden: %s", err)
+	}
+	for _, c := range f.cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			got, elapsed, err := c.run(h, opts, opt...)
+			if err != nil {
+				t.Fatalf("%s:%d: %s", path, c.line, err)
+			}
+			if c.maxLatency > 0 && elapsed > c.maxLatency {
+				t.Errorf("%s:%d: took %s, want at most %s", path, c.line, elapsed, c.maxLatency)
+			}
+			if opts.withUpdate {
+				c.want = got
+				return
+			}
+			diff, err := diffGolden(c.want, got)
+			if err != nil {
+				t.Fatalf("%s:%d: %s", path, c.line, err)
+			}
+			if diff != "" {
+				t.Errorf("%s:%d: response mismatch (-want +got):\n%s", path, c.line, diff)
+			}
+		})
+	}
+	if opts.withUpdate {
+		if err := os.WriteFile(path, f.bytes(), 0o644); err != nil {
+			t.Fatalf("respwritertest.RunGolden: unable to update %s: %s", path, err)
+		}
+	}
+}
+
+// goldenFile is a parsed golden file.
+type goldenFile struct {
+	// preamble is the lines before the first case.
+	preamble []string
+	cases    []*goldenCase
+}
+
+// goldenCase is a case of a golden file.
+type goldenCase struct {
+	name string
+	// line is the line number of the case's "===" line.
+	line int
+	// query is the lines describing the query, verbatim.
+	query []string
+	// want is the expectation lines, verbatim.
+	want []string
+
+	msg        *dns.Msg
+	transport  respwriter.Transport
+	timeout    time.Duration
+	maxLatency time.Duration
+}
+
+func readGoldenFile(path string) (*goldenFile, error) {
+	const op = "respwritertest.readGoldenFile"
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	f, err := parseGolden(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", op, path, err)
+	}
+	return f, nil
+}
+
+// parseGolden parses the contents of a golden file. Errors are prefixed with
+// the line number.
+func parseGolden(s string) (*goldenFile, error) {
+	f := &goldenFile{}
+	names := map[string]bool{}
+	var c *goldenCase
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "==="):
+			if err := c.parseQuery(); err != nil {
+				return nil, err
+			}
+			name := strings.TrimSpace(strings.TrimPrefix(trimmed, "==="))
+			switch {
+			case name == "":
+				return nil, fmt.Errorf("%d: missing case name: %w", n, respwriter.ErrInvalidParameter)
+			case names[name]:
+				return nil, fmt.Errorf("%d: duplicate case %q: %w", n, name, respwriter.ErrInvalidParameter)
+			}
+			names[name] = true
+			c = &goldenCase{name: name, line: n}
+			f.cases = append(f.cases, c)
+		case c == nil:
+			f.preamble = append(f.preamble, line)
+		case strings.HasPrefix(trimmed, "---") || len(c.want) > 0:
+			c.want = append(c.want, line)
+		default:
+			c.query = append(c.query, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.parseQuery(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseQuery parses the query lines of the case, it's a no-op for a nil case.
+func (c *goldenCase) parseQuery() error {
+	if c == nil {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.Id = goldenQueryID
+	m.RecursionDesired = true
+	var (
+		opt     *dns.OPT
+		options []dns.EDNS0
+	)
+	for i, line := range c.query {
+		n := c.line + i + 1
+		key, value, ok := goldenKeyValue(line)
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		var err error
+		switch key {
+		case "question":
+			err = parseGoldenQuestion(m, fields)
+		case "transport":
+			switch t := respwriter.Transport(value); t {
+			case respwriter.TransportUDP, respwriter.TransportTCP, respwriter.TransportTLS:
+				c.transport = t
+			default:
+				err = fmt.Errorf("unknown transport %q", value)
+			}
+		case "flags":
+			m.RecursionDesired, m.CheckingDisabled, m.AuthenticatedData = false, false, false
+			for _, flag := range fields {
+				switch flag {
+				case "rd":
+					m.RecursionDesired = true
+				case "cd":
+					m.CheckingDisabled = true
+				case "ad":
+					m.AuthenticatedData = true
+				default:
+					err = fmt.Errorf("unknown query flag %q", flag)
+				}
+			}
+		case "edns":
+			opt, err = parseGoldenEDNS(fields)
+		case "option":
+			var o dns.EDNS0
+			o, err = parseGoldenOption(fields)
+			options = append(options, o)
+		case "timeout":
+			c.timeout, err = parseGoldenDuration(value)
+		case "max-latency":
+			c.maxLatency, err = parseGoldenDuration(value)
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("%d: %s: %w", n, err, respwriter.ErrInvalidParameter)
+		}
+	}
+	switch {
+	case len(m.Question) == 0:
+		return fmt.Errorf("%d: case %q has no question: %w", c.line, c.name, respwriter.ErrInvalidParameter)
+	case len(options) > 0 && opt == nil:
+		return fmt.Errorf("%d: case %q has options without edns: %w", c.line, c.name, respwriter.ErrInvalidParameter)
+	case opt != nil:
+		opt.Option = options
+		m.Extra = append(m.Extra, opt)
+	}
+	c.msg = m
+	return nil
+}
+
+// run passes the case's query to h, wrapped by respwriter.NewHandlerFunc, and
+// returns the rendered responses and how long the handler took.
+func (c *goldenCase) run(h dns.HandlerFunc, opts options, opt ...respwriter.Option) ([]string, time.Duration, error) {
+	timeout := opts.withRequestTimeout
+	if c.timeout > 0 {
+		timeout = c.timeout
+	}
+	handler, err := respwriter.NewHandlerFunc(timeout, h, opt...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.transport != respwriter.TransportUnknown {
+		opt = append(opt, WithTransport(c.transport))
+	}
+	rec := NewRecorder(opt...)
+	start := time.Now()
+	handler(rec, c.msg.Copy())
+	elapsed := time.Since(start)
+
+	records := rec.Records()
+	switch {
+	case len(records) == 0 && elapsed >= timeout:
+		return []string{"--- times out"}, elapsed, nil
+	case len(records) == 0:
+		return []string{"--- no response"}, elapsed, nil
+	}
+	var lines []string
+	for _, r := range records {
+		m := new(dns.Msg)
+		if err := m.Unpack(r.Bytes); err != nil {
+			return nil, 0, fmt.Errorf("unable to unpack response: %w", err)
+		}
+		lines = append(lines, renderGoldenResponse(m)...)
+	}
+	return lines, elapsed, nil
+}
+
+// bytes returns the contents of the golden file.
+func (f *goldenFile) bytes() []byte {
+	var b strings.Builder
+	for _, line := range f.preamble {
+		b.WriteString(line + "\n")
+	}
+	for i, c := range f.cases {
+		b.WriteString("=== " + c.name + "\n")
+		for _, line := range trimBlankLines(c.query) {
+			b.WriteString(line + "\n")
+		}
+		for _, line := range trimBlankLines(c.want) {
+			b.WriteString(line + "\n")
+		}
+		if i < len(f.cases)-1 {
+			b.WriteString("\n")
+		}
+	}
+	return []byte(b.String())
+}
+
+// trimBlankLines drops trailing blank lines, so updates keep a single blank
+// line between cases.
+func trimBlankLines(lines []string) []string {
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// renderGoldenResponse renders a response in the golden format.
+func renderGoldenResponse(m *dns.Msg) []string {
+	rcode, ok := dns.RcodeToString[m.Rcode]
+	if !ok {
+		rcode = strconv.Itoa(m.Rcode)
+	}
+	var flags []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", m.Response},
+		{"aa", m.Authoritative},
+		{"tc", m.Truncated},
+		{"rd", m.RecursionDesired},
+		{"ra", m.RecursionAvailable},
+		{"ad", m.AuthenticatedData},
+		{"cd", m.CheckingDisabled},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	lines := []string{
+		"--- response",
+		"rcode: " + rcode,
+		strings.TrimSpace("flags: " + strings.Join(flags, " ")),
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		edns := "edns: " + strconv.Itoa(int(opt.UDPSize()))
+		if opt.Do() {
+			edns += " do"
+		}
+		lines = append(lines, edns)
+		for _, o := range opt.Option {
+			lines = append(lines, "option: "+renderGoldenOption(o))
+		}
+	}
+	for _, section := range []struct {
+		name string
+		rrs  []dns.RR
+	}{
+		{"answer", m.Answer},
+		{"authority", m.Ns},
+		{"additional", m.Extra},
+	} {
+		for _, rr := range section.rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			lines = append(lines, section.name+": "+rr.String())
+		}
+	}
+	return lines
+}
+
+func renderGoldenOption(o dns.EDNS0) string {
+	switch o := o.(type) {
+	case *dns.EDNS0_NSID:
+		return "nsid " + o.Nsid
+	case *dns.EDNS0_COOKIE:
+		return "cookie " + o.Cookie
+	case *dns.EDNS0_PADDING:
+		return "padding " + strconv.Itoa(len(o.Padding))
+	case *dns.EDNS0_LOCAL:
+		return strconv.Itoa(int(o.Code)) + " " + hex.EncodeToString(o.Data)
+	default:
+		return strconv.Itoa(int(o.Option())) + " " + o.String()
+	}
+}
+
+// diffGolden diffs the expectations with the rendered responses, after
+// normalizing both. It returns "" when they match.
+func diffGolden(want, got []string) (string, error) {
+	normWant, err := normalizeGolden(want)
+	if err != nil {
+		return "", err
+	}
+	normGot, err := normalizeGolden(got)
+	if err != nil {
+		return "", err
+	}
+	return diffLines(normWant, normGot), nil
+}
+
+// normalizeGolden drops blank lines and comments from expectations, collapses
+// whitespace and renders records in their canonical presentation format.
+func normalizeGolden(lines []string) ([]string, error) {
+	var norm []string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "---") {
+			norm = append(norm, strings.Join(strings.Fields(trimmed), " "))
+			continue
+		}
+		key, value, ok := goldenKeyValue(line)
+		if !ok {
+			continue
+		}
+		switch key {
+		case "answer", "authority", "additional":
+			rr, err := dns.NewRR(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s record %q: %w", key, value, err)
+			}
+			if rr == nil {
+				return nil, fmt.Errorf("empty %s record: %w", key, respwriter.ErrInvalidParameter)
+			}
+			value = rr.String()
+		default:
+			value = strings.Join(strings.Fields(value), " ")
+		}
+		norm = append(norm, strings.TrimSpace(key+": "+value))
+	}
+	return norm, nil
+}
+
+// goldenKeyValue splits a "key: value" line, it returns false for blank lines
+// and comments.
+func goldenKeyValue(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	key, value, _ := strings.Cut(line, ":")
+	return strings.TrimSpace(key), strings.TrimSpace(value), true
+}
+
+func parseGoldenQuestion(m *dns.Msg, fields []string) error {
+	if len(fields) < 2 || len(fields) > 3 {
+		return fmt.Errorf("question must be <name> [class] <type>")
+	}
+	class := uint16(dns.ClassINET)
+	if len(fields) == 3 {
+		c, ok := dns.StringToClass[strings.ToUpper(fields[1])]
+		if !ok {
+			return fmt.Errorf("unknown class %q", fields[1])
+		}
+		class = c
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(fields[len(fields)-1])]
+	if !ok {
+		return fmt.Errorf("unknown type %q", fields[len(fields)-1])
+	}
+	m.Question = []dns.Question{{Name: dns.Fqdn(fields[0]), Qtype: qtype, Qclass: class}}
+	return nil
+}
+
+func parseGoldenEDNS(fields []string) (*dns.OPT, error) {
+	if len(fields) < 1 || len(fields) > 2 || (len(fields) == 2 && fields[1] != "do") {
+		return nil, fmt.Errorf("edns must be <udp size> [do]")
+	}
+	size, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid udp size %q", fields[0])
+	}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(uint16(size))
+	opt.SetDo(len(fields) == 2)
+	return opt, nil
+}
+
+func parseGoldenOption(fields []string) (dns.EDNS0, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing option")
+	}
+	switch {
+	case fields[0] == "nsid" && len(fields) <= 2:
+		o := &dns.EDNS0_NSID{Code: dns.EDNS0NSID}
+		if len(fields) == 2 {
+			o.Nsid = fields[1]
+		}
+		return o, nil
+	case fields[0] == "cookie" && len(fields) == 2:
+		if _, err := hex.DecodeString(fields[1]); err != nil {
+			return nil, fmt.Errorf("invalid cookie %q", fields[1])
+		}
+		return &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: fields[1]}, nil
+	case fields[0] == "padding" && len(fields) == 2:
+		n, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid padding length %q", fields[1])
+		}
+		return &dns.EDNS0_PADDING{Padding: make([]byte, n)}, nil
+	case len(fields) <= 2:
+		code, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unknown option %q", fields[0])
+		}
+		o := &dns.EDNS0_LOCAL{Code: uint16(code)}
+		if len(fields) == 2 {
+			if o.Data, err = hex.DecodeString(fields[1]); err != nil {
+				return nil, fmt.Errorf("invalid option data %q", fields[1])
+			}
+		}
+		return o, nil
+	default:
+		return nil, fmt.Errorf("invalid option %q", strings.Join(fields, " "))
+	}
+}
+
+func parseGoldenDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// diffLines returns a line diff of want and got, with removed lines prefixed
+// by "-" and added lines by "+". It returns "" when they're equal.
+func diffLines(want, got []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of want[i:]
+	// and got[j:].
+	lcs := make([][]int, len(want)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(got)+1)
+	}
+	for i := len(want) - 1; i >= 0; i-- {
+		for j := len(got) - 1; j >= 0; j-- {
+			switch {
+			case want[i] == got[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var (
+		b       strings.Builder
+		changed bool
+		i, j    int
+	)
+	for i < len(want) || j < len(got) {
+		switch {
+		case i < len(want) && j < len(got) && want[i] == got[j]:
+			b.WriteString("  " + want[i] + "\n")
+			i++
+			j++
+		case j == len(got) || (i < len(want) && lcs[i+1][j] >= lcs[i][j+1]):
+			b.WriteString("- " + want[i] + "\n")
+			changed = true
+			i++
+		default:
+			b.WriteString("+ " + got[j] + "\n")
+			changed = true
+			j++
+		}
+	}
+	if !changed {
+		return ""
+	}
+	return b.String()
+}
@@ -0,0 +1,261 @@
+package respwritertest
+
+import (
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenHandler answers the queries of testdata/handler.golden.
+func goldenHandler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	q := r.Question[0]
+	switch q.Name {
+	case "go.dev.":
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	case "big.example.":
+		for i := 0; i < 3; i++ {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{strings.Repeat(strconv.Itoa(i), 200)},
+			})
+		}
+	case "slow.example.":
+		<-w.(*respwriter.RespWriter).RequestContext().Done()
+		return
+	case "drop.example.":
+		return
+	default:
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Ns = append(m.Ns, &dns.SOA{
+			Hdr:     dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:      "ns1.example.",
+			Mbox:    "hostmaster.example.",
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  300,
+		})
+	}
+	_ = w.WriteMsg(m)
+}
+
+func TestRunGolden(t *testing.T) {
+	t.Parallel()
+	RunGolden(t, "testdata/handler.golden", goldenHandler,
+		WithUpdate(*update),
+		WithRequestTimeout(time.Second),
+		respwriter.WithEDNS(true),
+		respwriter.WithNSID("ns1"),
+	)
+}
+
+func TestRunGolden_update(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	path := filepath.Join(t.TempDir(), "update.golden")
+	require.NoError(os.WriteFile(path, []byte(`# preamble
+
+=== answer
+# the expectation is stale
+question: go.dev.   A
+--- response
+rcode: SERVFAIL
+=== no-response
+question: drop.example. A
+
+
+`), 0o644))
+
+	RunGolden(t, path, goldenHandler, WithUpdate(true))
+	got, err := os.ReadFile(path)
+	require.NoError(err)
+	assert.Equal(`# preamble
+
+=== answer
+# the expectation is stale
+question: go.dev.   A
+--- response
+rcode: NOERROR
+flags: qr aa rd
+answer: go.dev.	300	IN	A	192.0.2.1
+
+=== no-response
+question: drop.example. A
+--- no response
+`, string(got))
+
+	// the updated file passes
+	RunGolden(t, path, goldenHandler)
+}
+
+func TestParseGolden(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name            string
+		golden          string
+		wantErrContains string
+		wantCases       int
+	}{
+		{
+			name:      "empty",
+			golden:    "# nothing here\n",
+			wantCases: 0,
+		},
+		{
+			name: "valid",
+			golden: `=== one
+question: go.dev. CH TXT
+transport: tcp-tls
+flags: ad
+edns: 4096
+option: cookie 0102030405060708
+option: padding 10
+option: 65001 6162
+timeout: 10ms
+max-latency: 20ms
+--- times out
+
+=== two
+question: go.dev. A
+`,
+			wantCases: 2,
+		},
+		{
+			name:            "missing-name",
+			golden:          "===\nquestion: go.dev. A\n",
+			wantErrContains: "1: missing case name",
+		},
+		{
+			name:            "duplicate",
+			golden:          "=== one\nquestion: go.dev. A\n=== one\nquestion: go.dev. A\n",
+			wantErrContains: `3: duplicate case "one"`,
+		},
+		{
+			name:            "missing-question",
+			golden:          "=== one\nflags: rd\n",
+			wantErrContains: `1: case "one" has no question`,
+		},
+		{
+			name:            "unknown-key",
+			golden:          "=== one\nquestion: go.dev. A\nqname: go.dev.\n",
+			wantErrContains: `3: unknown key "qname"`,
+		},
+		{
+			name:            "unknown-type",
+			golden:          "=== one\nquestion: go.dev. BOGUS\n",
+			wantErrContains: `2: unknown type "BOGUS"`,
+		},
+		{
+			name:            "unknown-transport",
+			golden:          "=== one\nquestion: go.dev. A\ntransport: quic\n",
+			wantErrContains: `3: unknown transport "quic"`,
+		},
+		{
+			name:            "unknown-flag",
+			golden:          "=== one\nquestion: go.dev. A\nflags: qr\n",
+			wantErrContains: `3: unknown query flag "qr"`,
+		},
+		{
+			name:            "invalid-edns",
+			golden:          "=== one\nquestion: go.dev. A\nedns: big\n",
+			wantErrContains: `3: invalid udp size "big"`,
+		},
+		{
+			name:            "option-without-edns",
+			golden:          "=== one\nquestion: go.dev. A\noption: nsid\n",
+			wantErrContains: `1: case "one" has options without edns`,
+		},
+		{
+			name:            "invalid-option",
+			golden:          "=== one\nquestion: go.dev. A\nedns: 1232\noption: cookie xyz\n",
+			wantErrContains: `4: invalid cookie "xyz"`,
+		},
+		{
+			name:            "invalid-timeout",
+			golden:          "=== one\nquestion: go.dev. A\ntimeout: -1s\n",
+			wantErrContains: `3: invalid duration "-1s"`,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			f, err := parseGolden(tc.golden)
+			if tc.wantErrContains != "" {
+				require.Error(err)
+				assert.ErrorIs(err, respwriter.ErrInvalidParameter)
+				assert.Contains(err.Error(), tc.wantErrContains)
+				return
+			}
+			require.NoError(err)
+			assert.Len(f.cases, tc.wantCases)
+			assert.Equal(tc.golden, string(f.bytes()))
+		})
+	}
+	t.Run("query", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		f, err := parseGolden("=== one\nquestion: go.dev. CH TXT\ntransport: tcp\nflags: cd\nedns: 4096 do\noption: 65001 6162\ntimeout: 10ms\nmax-latency: 20ms\n")
+		require.NoError(err)
+		require.Len(f.cases, 1)
+		c := f.cases[0]
+		assert.Equal(respwriter.TransportTCP, c.transport)
+		assert.Equal(10*time.Millisecond, c.timeout)
+		assert.Equal(20*time.Millisecond, c.maxLatency)
+		assert.Equal([]dns.Question{{Name: "go.dev.", Qtype: dns.TypeTXT, Qclass: dns.ClassCHAOS}}, c.msg.Question)
+		assert.False(c.msg.RecursionDesired)
+		assert.True(c.msg.CheckingDisabled)
+		opt := c.msg.IsEdns0()
+		require.NotNil(opt)
+		assert.Equal(uint16(4096), opt.UDPSize())
+		assert.True(opt.Do())
+		assert.Equal([]dns.EDNS0{&dns.EDNS0_LOCAL{Code: 65001, Data: []byte("ab")}}, opt.Option)
+	})
+}
+
+func TestDiffGolden(t *testing.T) {
+	t.Parallel()
+	t.Run("normalized", func(t *testing.T) {
+		t.Parallel()
+		diff, err := diffGolden(
+			[]string{"--- response", "# comment", "rcode:   NOERROR", "", "answer: go.dev. 300 A 192.0.2.1"},
+			[]string{"--- response", "rcode: NOERROR", "answer: go.dev.\t300\tIN\tA\t192.0.2.1"},
+		)
+		require.NoError(t, err)
+		assert.Empty(t, diff)
+	})
+	t.Run("mismatch", func(t *testing.T) {
+		t.Parallel()
+		diff, err := diffGolden(
+			[]string{"--- response", "rcode: NOERROR", "flags: qr"},
+			[]string{"--- response", "rcode: SERVFAIL", "flags: qr"},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, "  --- response\n- rcode: NOERROR\n+ rcode: SERVFAIL\n  flags: qr\n", diff)
+	})
+	t.Run("invalid-record", func(t *testing.T) {
+		t.Parallel()
+		_, err := diffGolden([]string{"answer: go.dev. A bogus"}, nil)
+		assert.ErrorContains(t, err, "invalid answer record")
+	})
+}
@@ -0,0 +1,290 @@
+package respwritertest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// memPacketQueueLen is the number of datagrams a MemPacketConn buffers, like
+// a socket's receive buffer, further datagrams are dropped.
+const memPacketQueueLen = 64
+
+// memAddr is the address of an in-memory connection. Its network is "udp" or
+// "tcp", so the RespWriter detects the transport of the connection.
+type memAddr struct {
+	network string
+	addr    string
+}
+
+func (a memAddr) Network() string { return a.network }
+func (a memAddr) String() string  { return a.addr }
+
+// MemNetwork is an in-memory network, which allows a dns.Server to serve on a
+// MemPacketConn and a MemListener without binding sockets. Clients dial the
+// server via DialUDP and DialTCP.
+type MemNetwork struct {
+	serverPacket *MemPacketConn
+	listener     *MemListener
+
+	mu      sync.Mutex
+	packets map[string]*MemPacketConn
+	next    int
+}
+
+// NewMemNetwork returns a new MemNetwork.
+func NewMemNetwork() *MemNetwork {
+	n := &MemNetwork{packets: map[string]*MemPacketConn{}}
+	n.serverPacket = n.newPacketConn("mem-server:53")
+	n.listener = &MemListener{
+		addr:   memAddr{network: "tcp", addr: "mem-server:53"},
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	return n
+}
+
+// PacketConn returns the server's packet connection, which is served by
+// setting dns.Server.PacketConn.
+func (n *MemNetwork) PacketConn() *MemPacketConn {
+	return n.serverPacket
+}
+
+// Listener returns the server's stream listener, which is served by setting
+// dns.Server.Listener.
+func (n *MemNetwork) Listener() *MemListener {
+	return n.listener
+}
+
+// DialUDP returns a client packet connection to the server. It implements
+// net.PacketConn, so a dns.Conn wrapping it uses UDP semantics.
+func (n *MemNetwork) DialUDP() (net.Conn, error) {
+	n.mu.Lock()
+	n.next++
+	addr := fmt.Sprintf("mem-client-%d:53000", n.next)
+	n.mu.Unlock()
+	c := n.newPacketConn(addr)
+	return &memUDPConn{MemPacketConn: c, remote: n.serverPacket.addr}, nil
+}
+
+// DialTCP returns a client stream connection to the server.
+func (n *MemNetwork) DialTCP() (net.Conn, error) {
+	const op = "respwritertest.(MemNetwork).DialTCP"
+	n.mu.Lock()
+	n.next++
+	clientAddr := memAddr{network: "tcp", addr: fmt.Sprintf("mem-client-%d:53000", n.next)}
+	n.mu.Unlock()
+
+	client, server := net.Pipe()
+	select {
+	case n.listener.conns <- &memStreamConn{Conn: server, local: n.listener.addr, remote: clientAddr}:
+	case <-n.listener.closed:
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("%s: %w", op, net.ErrClosed)
+	}
+	return &memStreamConn{Conn: client, local: clientAddr, remote: n.listener.addr}, nil
+}
+
+func (n *MemNetwork) newPacketConn(addr string) *MemPacketConn {
+	c := &MemPacketConn{
+		network:     n,
+		addr:        memAddr{network: "udp", addr: addr},
+		in:          make(chan memPacket, memPacketQueueLen),
+		closed:      make(chan struct{}),
+		deadlineSet: make(chan struct{}),
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.packets[addr] = c
+	return c
+}
+
+// deliver queues a copy of the datagram for the connection with the address.
+// Datagrams for unknown addresses or full queues are dropped, like UDP.
+func (n *MemNetwork) deliver(to net.Addr, p memPacket) {
+	n.mu.Lock()
+	c, ok := n.packets[to.String()]
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case c.in <- p:
+	case <-c.closed:
+	default:
+	}
+}
+
+func (n *MemNetwork) remove(c *MemPacketConn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.packets, c.addr.String())
+}
+
+type memPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// MemPacketConn is an in-memory net.PacketConn of a MemNetwork.
+type MemPacketConn struct {
+	network *MemNetwork
+	addr    memAddr
+	in      chan memPacket
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	// deadlineSet is closed and replaced whenever the read deadline changes,
+	// so a blocked read picks up the new deadline.
+	deadlineSet chan struct{}
+}
+
+// ReadFrom reads the next datagram, it blocks until one arrives, the read
+// deadline expires or the connection is closed.
+func (c *MemPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		default:
+		}
+		c.mu.Lock()
+		deadline, deadlineSet := c.readDeadline, c.deadlineSet
+		c.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case p := <-c.in:
+			stopTimer(timer)
+			return copy(b, p.data), p.from, nil
+		case <-c.closed:
+			stopTimer(timer)
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-deadlineSet:
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// WriteTo sends a datagram to the address.
+func (c *MemPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.network.deliver(addr, memPacket{data: append([]byte(nil), b...), from: c.addr})
+	return len(b), nil
+}
+
+// Close closes the connection, blocked reads return net.ErrClosed.
+func (c *MemPacketConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.network.remove(c)
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr returns the address of the connection, its network is "udp".
+func (c *MemPacketConn) LocalAddr() net.Addr { return c.addr }
+
+// SetDeadline sets the read deadline, writes never block.
+func (c *MemPacketConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+// SetReadDeadline sets the deadline of subsequent reads.
+func (c *MemPacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is a no-op, since writes never block.
+func (c *MemPacketConn) SetWriteDeadline(time.Time) error { return nil }
+
+// memUDPConn is a MemPacketConn connected to the server.
+type memUDPConn struct {
+	*MemPacketConn
+	remote net.Addr
+}
+
+func (c *memUDPConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *memUDPConn) Write(b []byte) (int, error) { return c.WriteTo(b, c.remote) }
+
+func (c *memUDPConn) RemoteAddr() net.Addr { return c.remote }
+
+// MemListener is an in-memory net.Listener of a MemNetwork, whose connections
+// are created by MemNetwork.DialTCP.
+type MemListener struct {
+	addr      memAddr
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Accept waits for the next connection.
+func (l *MemListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener.
+func (l *MemListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = nil
+	})
+	return err
+}
+
+// Addr returns the address of the listener, its network is "tcp".
+func (l *MemListener) Addr() net.Addr { return l.addr }
+
+// memStreamConn is one end of a net.Pipe with "tcp" addresses.
+type memStreamConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *memStreamConn) LocalAddr() net.Addr  { return c.local }
+func (c *memStreamConn) RemoteAddr() net.Addr { return c.remote }
+
+var (
+	_ net.PacketConn = (*MemPacketConn)(nil)
+	_ net.PacketConn = (*memUDPConn)(nil)
+	_ net.Conn       = (*memUDPConn)(nil)
+	_ net.Listener   = (*MemListener)(nil)
+)
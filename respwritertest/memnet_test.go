@@ -0,0 +1,139 @@
+package respwritertest
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewServer_inMemory(t *testing.T) {
+	t.Parallel()
+	// bigHandler answers with more records than fit in 512 bytes, along with
+	// the transport the request was received over.
+	bigHandler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{w.(*respwriter.RespWriter).Transport().String()},
+		})
+		for i := 0; i < 50; i++ {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, byte(i)),
+			})
+		}
+		_ = w.WriteMsg(m)
+	}
+	s := NewServer(t, bigHandler, WithInMemory(true))
+
+	t.Run("udp-truncated", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		m := new(dns.Msg)
+		m.SetQuestion("go.dev.", dns.TypeA)
+		got, err := s.Exchange(respwriter.TransportUDP, m)
+		require.NoError(err)
+		assert.True(got.Truncated)
+		assert.Less(len(got.Answer), 51)
+		require.NotEmpty(got.Answer)
+		assert.Equal([]string{"udp"}, got.Answer[0].(*dns.TXT).Txt)
+	})
+	t.Run("tcp-framing", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		conn, err := s.Dial(respwriter.TransportTCP)
+		require.NoError(err)
+		defer conn.Close()
+
+		// several queries over the same connection
+		for i := 0; i < 3; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion("go.dev.", dns.TypeA)
+			got, _, err := s.Client(respwriter.TransportTCP).ExchangeWithConn(m, conn)
+			require.NoError(err)
+			assert.Equal(m.Id, got.Id)
+			assert.False(got.Truncated)
+			assert.Len(got.Answer, 51)
+			assert.Equal([]string{"tcp"}, got.Answer[0].(*dns.TXT).Txt)
+		}
+	})
+	t.Run("err-tls", func(t *testing.T) {
+		t.Parallel()
+		_, err := s.Dial(respwriter.TransportTLS)
+		assert.ErrorIs(t, err, respwriter.ErrUnsupportedTransport)
+	})
+}
+
+func TestMemNetwork(t *testing.T) {
+	t.Parallel()
+
+	t.Run("packet", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		n := NewMemNetwork()
+		client, err := n.DialUDP()
+		require.NoError(err)
+		assert.Equal("udp", client.LocalAddr().Network())
+
+		_, err = client.Write([]byte("ping"))
+		require.NoError(err)
+		buf := make([]byte, 16)
+		nr, from, err := n.PacketConn().ReadFrom(buf)
+		require.NoError(err)
+		assert.Equal("ping", string(buf[:nr]))
+		assert.Equal(client.LocalAddr(), from)
+
+		_, err = n.PacketConn().WriteTo([]byte("pong"), from)
+		require.NoError(err)
+		nr, err = client.Read(buf)
+		require.NoError(err)
+		assert.Equal("pong", string(buf[:nr]))
+
+		// read deadline
+		require.NoError(client.SetReadDeadline(time.Now().Add(10 * time.Millisecond)))
+		_, err = client.Read(buf)
+		assert.ErrorIs(err, os.ErrDeadlineExceeded)
+
+		// closed
+		require.NoError(client.Close())
+		_, err = client.Read(buf)
+		assert.ErrorIs(err, net.ErrClosed)
+		assert.ErrorIs(client.Close(), net.ErrClosed)
+	})
+	t.Run("stream", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		n := NewMemNetwork()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, err := n.Listener().Accept()
+			assert.NoError(err)
+			accepted <- c
+		}()
+		client, err := n.DialTCP()
+		require.NoError(err)
+		server := <-accepted
+		assert.Equal("tcp", server.RemoteAddr().Network())
+		assert.Equal(client.LocalAddr(), server.RemoteAddr())
+
+		go func() { _, _ = client.Write([]byte("ping")) }()
+		buf := make([]byte, 4)
+		_, err = server.Read(buf)
+		require.NoError(err)
+		assert.Equal("ping", string(buf))
+
+		require.NoError(n.Listener().Close())
+		_, err = n.Listener().Accept()
+		assert.True(errors.Is(err, net.ErrClosed))
+		_, err = n.DialTCP()
+		assert.ErrorIs(err, net.ErrClosed)
+	})
+}
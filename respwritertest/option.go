@@ -0,0 +1,155 @@
+package respwritertest
+
+import (
+	"net"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+)
+
+// options are the options of the respwritertest package. They're set via
+// respwriter.Option, so they follow the same functional options pattern.
+type options struct {
+	withRemoteAddr   net.Addr
+	withLocalAddr    net.Addr
+	withTransport    respwriter.Transport
+	withTsigStatus   error
+	withWriteError   error
+	withWriteLatency time.Duration
+
+	withRequestTimeout time.Duration
+	withTLS            bool
+	withInMemory       bool
+
+	withUpdate bool
+
+	withReplaySpeed float64
+}
+
+func getDefaultOptions() options {
+	return options{
+		withTransport:      respwriter.TransportUDP,
+		withRequestTimeout: defaultRequestTimeout,
+		withReplaySpeed:    1,
+	}
+}
+
+func getOpts(opt ...respwriter.Option) options {
+	opts := getDefaultOptions()
+	for _, o := range opt {
+		if o == nil {
+			continue
+		}
+		o(&opts)
+	}
+	return opts
+}
+
+// WithRemoteAddr allows you to specify the client address of a Recorder.
+func WithRemoteAddr(addr net.Addr) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withRemoteAddr = addr
+		}
+	}
+}
+
+// WithLocalAddr allows you to specify the server address of a Recorder.
+func WithLocalAddr(addr net.Addr) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withLocalAddr = addr
+		}
+	}
+}
+
+// WithTransport allows you to specify the transport of a Recorder. The
+// default is UDP.
+func WithTransport(t respwriter.Transport) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withTransport = t
+		}
+	}
+}
+
+// WithTsigStatus allows you to specify the TSIG status of a Recorder.
+func WithTsigStatus(err error) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withTsigStatus = err
+		}
+	}
+}
+
+// WithWriteError allows you to specify an error returned by every write to a
+// Recorder.
+func WithWriteError(err error) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withWriteError = err
+		}
+	}
+}
+
+// WithWriteLatency allows you to specify how long every write to a Recorder
+// takes.
+func WithWriteLatency(d time.Duration) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withWriteLatency = d
+		}
+	}
+}
+
+// WithRequestTimeout allows you to specify the request timeout of a Server's
+// handler. The default is 2s.
+func WithRequestTimeout(d time.Duration) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withRequestTimeout = d
+		}
+	}
+}
+
+// WithTLS allows you to specify that a Server also listens for TLS (DoT),
+// with a self-signed certificate trusted by its TLS client.
+func WithTLS(enabled bool) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withTLS = enabled
+		}
+	}
+}
+
+// WithInMemory allows you to specify that a Server serves UDP and TCP on a
+// MemNetwork, for environments which forbid binding sockets.
+func WithInMemory(enabled bool) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withInMemory = enabled
+		}
+	}
+}
+
+// WithUpdate allows you to specify that RunGolden rewrites the expectations of
+// a golden file from the actual responses, rather than diffing them. It's
+// typically set from a test's -update flag.
+func WithUpdate(enabled bool) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withUpdate = enabled
+		}
+	}
+}
+
+// WithReplaySpeed allows you to specify the pace of Replay, relative to the
+// recorded pace: 2 replays twice as fast and 0 replays as fast as possible.
+// The default is 1, the recorded pace.
+func WithReplaySpeed(speed float64) respwriter.Option {
+	return func(o interface{}) {
+		if o, ok := o.(*options); ok {
+			o.withReplaySpeed = speed
+		}
+	}
+}
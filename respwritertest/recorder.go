@@ -0,0 +1,304 @@
+package respwritertest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+)
+
+var (
+	_ dns.ResponseWriter                = (*Recorder)(nil)
+	_ respwriter.ExposesUnderlyingConns = (*Recorder)(nil)
+	_ net.Conn                          = (*recorderConn)(nil)
+	_ net.PacketConn                    = (*recorderConn)(nil)
+)
+
+// Record is a message or buffer written to a Recorder.
+type Record struct {
+	// Msg is the message written via WriteMsg, it's nil for Write.
+	Msg *dns.Msg
+
+	// Bytes is the packed message written via WriteMsg or the buffer written
+	// via Write.
+	Bytes []byte
+
+	// At is when the write completed.
+	At time.Time
+
+	// WriteDeadline is the write deadline of the connection at the time of
+	// the write, it's zero when none was set.
+	WriteDeadline time.Time
+}
+
+// Recorder is a dns.ResponseWriter which records what's written to it, for
+// use in tests. It implements respwriter.ExposesUnderlyingConns, so the
+// RespWriter wrapping it sees the configured transport, and write errors and
+// latencies can be injected. A Recorder is safe for concurrent use.
+type Recorder struct {
+	remote    net.Addr
+	local     net.Addr
+	transport respwriter.Transport
+	conn      *recorderConn
+
+	mu             sync.Mutex
+	records        []Record
+	writeErr       error
+	writeLatency   time.Duration
+	tsigStatus     error
+	tsigTimersOnly bool
+	hijackedAt     time.Time
+	closedAt       time.Time
+}
+
+// NewRecorder returns a new Recorder. Options supported: WithRemoteAddr,
+// WithLocalAddr, WithTransport, WithTsigStatus, WithWriteError,
+// WithWriteLatency
+func NewRecorder(opt ...respwriter.Option) *Recorder {
+	opts := getOpts(opt...)
+	r := &Recorder{
+		remote:       opts.withRemoteAddr,
+		local:        opts.withLocalAddr,
+		transport:    opts.withTransport,
+		writeErr:     opts.withWriteError,
+		writeLatency: opts.withWriteLatency,
+		tsigStatus:   opts.withTsigStatus,
+	}
+	if r.remote == nil {
+		r.remote = defaultAddr(r.transport, net.IPv4(192, 0, 2, 1), 53000)
+	}
+	if r.local == nil {
+		r.local = defaultAddr(r.transport, net.IPv4(127, 0, 0, 1), 53)
+	}
+	r.conn = &recorderConn{recorder: r}
+	return r
+}
+
+// WriteMsg records the message after the write latency, unless a write error
+// was injected or the Recorder is closed.
+func (r *Recorder) WriteMsg(m *dns.Msg) error {
+	const op = "respwritertest.(Recorder).WriteMsg"
+	b, err := m.Pack()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return r.record(m.Copy(), b)
+}
+
+// Write records the buffer after the write latency, unless a write error was
+// injected or the Recorder is closed.
+func (r *Recorder) Write(b []byte) (int, error) {
+	if err := r.record(nil, append([]byte(nil), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (r *Recorder) record(m *dns.Msg, b []byte) error {
+	r.mu.Lock()
+	latency, writeErr, closed := r.writeLatency, r.writeErr, !r.closedAt.IsZero()
+	r.mu.Unlock()
+	deadline := r.conn.writeDeadline()
+
+	switch {
+	case closed:
+		return net.ErrClosed
+	case latency > 0 && !deadline.IsZero() && time.Until(deadline) < latency:
+		time.Sleep(time.Until(deadline))
+		return os.ErrDeadlineExceeded
+	case latency > 0:
+		time.Sleep(latency)
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, Record{Msg: m, Bytes: b, At: time.Now(), WriteDeadline: deadline})
+	return nil
+}
+
+// LocalAddr returns the configured local address.
+func (r *Recorder) LocalAddr() net.Addr { return r.local }
+
+// RemoteAddr returns the configured remote address.
+func (r *Recorder) RemoteAddr() net.Addr { return r.remote }
+
+// TsigStatus returns the configured TSIG status.
+func (r *Recorder) TsigStatus() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tsigStatus
+}
+
+// TsigTimersOnly records the setting, see TimersOnly.
+func (r *Recorder) TsigTimersOnly(b bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tsigTimersOnly = b
+}
+
+// Hijack records the time of the call, see HijackedAt.
+func (r *Recorder) Hijack() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hijackedAt.IsZero() {
+		r.hijackedAt = time.Now()
+	}
+}
+
+// Close records the time of the call, see ClosedAt. Writes fail once the
+// Recorder is closed.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closedAt.IsZero() {
+		return net.ErrClosed
+	}
+	r.closedAt = time.Now()
+	return nil
+}
+
+// IncomingPacketConn returns a connection for UDP and nil otherwise.
+func (r *Recorder) IncomingPacketConn() net.PacketConn {
+	if r.transport.IsStream() {
+		return nil
+	}
+	return r.conn
+}
+
+// IncomingConn returns a connection for stream transports and nil otherwise.
+func (r *Recorder) IncomingConn() net.Conn {
+	if !r.transport.IsStream() {
+		return nil
+	}
+	return r.conn
+}
+
+// ConnectionState returns a TLS connection state when the transport is TLS
+// and nil otherwise.
+func (r *Recorder) ConnectionState() *tls.ConnectionState {
+	if r.transport != respwriter.TransportTLS {
+		return nil
+	}
+	return &tls.ConnectionState{HandshakeComplete: true, Version: tls.VersionTLS13}
+}
+
+// Records returns the messages and buffers written, in order.
+func (r *Recorder) Records() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Record(nil), r.records...)
+}
+
+// Msgs returns the messages written via WriteMsg, in order.
+func (r *Recorder) Msgs() []*dns.Msg {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var msgs []*dns.Msg
+	for _, rec := range r.records {
+		if rec.Msg != nil {
+			msgs = append(msgs, rec.Msg)
+		}
+	}
+	return msgs
+}
+
+// LastMsg returns the last message written via WriteMsg, or nil.
+func (r *Recorder) LastMsg() *dns.Msg {
+	msgs := r.Msgs()
+	if len(msgs) == 0 {
+		return nil
+	}
+	return msgs[len(msgs)-1]
+}
+
+// TimersOnly returns the last value passed to TsigTimersOnly.
+func (r *Recorder) TimersOnly() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tsigTimersOnly
+}
+
+// HijackedAt returns when Hijack was first called and false if it wasn't.
+func (r *Recorder) HijackedAt() (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hijackedAt, !r.hijackedAt.IsZero()
+}
+
+// ClosedAt returns when Close was first called and false if it wasn't.
+func (r *Recorder) ClosedAt() (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closedAt, !r.closedAt.IsZero()
+}
+
+// SetWriteError injects an error returned by all subsequent writes, nil
+// clears it.
+func (r *Recorder) SetWriteError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeErr = err
+}
+
+// SetWriteLatency sets how long subsequent writes take. A write whose latency
+// exceeds the connection's write deadline fails with os.ErrDeadlineExceeded
+// when the deadline expires.
+func (r *Recorder) SetWriteLatency(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLatency = d
+}
+
+// SetTsigStatus sets the status returned by TsigStatus.
+func (r *Recorder) SetTsigStatus(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tsigStatus = err
+}
+
+func defaultAddr(t respwriter.Transport, ip net.IP, port int) net.Addr {
+	if t.IsStream() {
+		return &net.TCPAddr{IP: ip, Port: port}
+	}
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+// recorderConn is the connection exposed by a Recorder. It only keeps track of
+// the write deadline, reads fail and writes are discarded.
+type recorderConn struct {
+	recorder *Recorder
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *recorderConn) writeDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline
+}
+
+func (c *recorderConn) Read([]byte) (int, error)                  { return 0, net.ErrClosed }
+func (c *recorderConn) ReadFrom([]byte) (int, net.Addr, error)    { return 0, nil, net.ErrClosed }
+func (c *recorderConn) Write(b []byte) (int, error)               { return len(b), nil }
+func (c *recorderConn) WriteTo(b []byte, _ net.Addr) (int, error) { return len(b), nil }
+func (c *recorderConn) Close() error                              { return c.recorder.Close() }
+func (c *recorderConn) LocalAddr() net.Addr                       { return c.recorder.local }
+func (c *recorderConn) RemoteAddr() net.Addr                      { return c.recorder.remote }
+func (c *recorderConn) SetReadDeadline(time.Time) error           { return nil }
+func (c *recorderConn) SetDeadline(t time.Time) error             { return c.SetWriteDeadline(t) }
+
+func (c *recorderConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
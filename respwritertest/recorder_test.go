@@ -0,0 +1,191 @@
+package respwritertest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRecorder(t *testing.T) {
+	t.Parallel()
+	remote := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 4242}
+
+	tests := []struct {
+		name          string
+		opts          []respwriter.Option
+		wantTransport respwriter.Transport
+		wantRemote    string
+	}{
+		{
+			name:          "default",
+			wantTransport: respwriter.TransportUDP,
+			wantRemote:    "192.0.2.1:53000",
+		},
+		{
+			name:          "tcp",
+			opts:          []respwriter.Option{WithTransport(respwriter.TransportTCP), WithRemoteAddr(remote)},
+			wantTransport: respwriter.TransportTCP,
+			wantRemote:    remote.String(),
+		},
+		{
+			name:          "tls",
+			opts:          []respwriter.Option{WithTransport(respwriter.TransportTLS)},
+			wantTransport: respwriter.TransportTLS,
+			wantRemote:    "192.0.2.1:53000",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+			rec := NewRecorder(tc.opts...)
+			rw := respwriter.NewRespWriter(context.Background(), rec)
+			assert.Equal(tc.wantTransport, rw.Transport())
+			assert.Equal(tc.wantRemote, rw.RemoteAddr().String())
+			assert.Equal(tc.wantTransport.IsStream(), rw.RemoteAddr().Network() == "tcp")
+		})
+	}
+}
+
+func TestRecorder_WriteMsg(t *testing.T) {
+	t.Parallel()
+	r := new(dns.Msg)
+	r.SetQuestion("go.dev.", dns.TypeA)
+
+	t.Run("records", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		rec := NewRecorder(WithTransport(respwriter.TransportTCP))
+		rw := respwriter.NewRespWriter(context.Background(), rec)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		start := time.Now()
+		require.NoError(rw.WriteMsg(m))
+		_, err := rw.Write([]byte{1, 2, 3})
+		require.NoError(err)
+
+		records := rec.Records()
+		require.Len(records, 2)
+		assert.Equal(r.Id, records[0].Msg.Id)
+		want, err := m.Pack()
+		require.NoError(err)
+		assert.Equal(want, records[0].Bytes)
+		assert.False(records[0].At.Before(start))
+		assert.Nil(records[1].Msg)
+		assert.Equal([]byte{1, 2, 3}, records[1].Bytes)
+		assert.Len(rec.Msgs(), 1)
+		assert.Equal(r.Id, rec.LastMsg().Id)
+	})
+	t.Run("write-deadline", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		rec := NewRecorder(WithTransport(respwriter.TransportTCP))
+		deadline := time.Now().Add(time.Hour)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		rw := respwriter.NewRespWriter(ctx, rec)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		require.NoError(rw.WriteMsg(m))
+		require.Len(rec.Records(), 1)
+		assert.True(deadline.Equal(rec.Records()[0].WriteDeadline))
+	})
+	t.Run("write-error", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		errWrite := errors.New("write failed")
+		rec := NewRecorder(WithWriteError(errWrite))
+		m := new(dns.Msg)
+		m.SetReply(r)
+		assert.ErrorIs(rec.WriteMsg(m), errWrite)
+
+		rec.SetWriteError(nil)
+		assert.NoError(rec.WriteMsg(m))
+		assert.Len(rec.Msgs(), 1)
+	})
+	t.Run("write-latency", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		rec := NewRecorder(WithWriteLatency(50 * time.Millisecond))
+		m := new(dns.Msg)
+		m.SetReply(r)
+		start := time.Now()
+		assert.NoError(rec.WriteMsg(m))
+		assert.GreaterOrEqual(time.Since(start), 50*time.Millisecond)
+	})
+	t.Run("write-latency-exceeds-deadline", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		rec := NewRecorder(WithTransport(respwriter.TransportTCP))
+		rec.SetWriteLatency(time.Hour)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		rw := respwriter.NewRespWriter(ctx, rec)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		err := rw.WriteMsg(m)
+		var timeoutErr *respwriter.WriteTimeoutError
+		assert.ErrorAs(err, &timeoutErr)
+		assert.Empty(rec.Records())
+	})
+	t.Run("closed", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		rec := NewRecorder()
+		_, ok := rec.ClosedAt()
+		assert.False(ok)
+		assert.NoError(rec.Close())
+		_, ok = rec.ClosedAt()
+		assert.True(ok)
+		assert.ErrorIs(rec.Close(), net.ErrClosed)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		assert.ErrorIs(rec.WriteMsg(m), net.ErrClosed)
+	})
+	t.Run("concurrent", func(t *testing.T) {
+		t.Parallel()
+		rec := NewRecorder()
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m := new(dns.Msg)
+				m.SetReply(r)
+				assert.NoError(t, rec.WriteMsg(m))
+			}()
+		}
+		wg.Wait()
+		assert.Len(t, rec.Records(), 10)
+	})
+}
+
+func TestRecorder_hijackAndTsig(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	rec := NewRecorder(WithTransport(respwriter.TransportTCP), WithTsigStatus(dns.ErrSig))
+	rw := respwriter.NewRespWriter(context.Background(), rec)
+
+	assert.ErrorIs(rw.TsigStatus(), dns.ErrSig)
+	rec.SetTsigStatus(nil)
+	assert.NoError(rw.TsigStatus())
+
+	assert.False(rec.TimersOnly())
+	rw.TsigTimersOnly(true)
+	assert.True(rec.TimersOnly())
+
+	_, ok := rec.HijackedAt()
+	assert.False(ok)
+	rw.Hijack()
+	_, ok = rec.HijackedAt()
+	assert.True(ok)
+	assert.ErrorIs(rw.Close(), respwriter.ErrHijacked)
+}
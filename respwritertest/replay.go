@@ -0,0 +1,251 @@
+package respwritertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+)
+
+// maxReplayInFlight bounds the number of requests a replay has in flight.
+const maxReplayInFlight = 256
+
+// ReplayReport is the result of a replay.
+type ReplayReport struct {
+	// Requests is the number of requests replayed.
+	Requests int
+
+	// RecordedTimeouts is the number of requests which timed out when they
+	// were recorded.
+	RecordedTimeouts int
+
+	// ReplayedTimeouts is the number of requests which timed out when they
+	// were replayed.
+	ReplayedTimeouts int
+
+	// Diffs are the requests whose replayed response differs from the
+	// recorded one, in the order they were recorded.
+	Diffs []ReplayDiff
+}
+
+// RecordedTimeoutRate returns the portion of the requests which timed out when
+// they were recorded.
+func (r *ReplayReport) RecordedTimeoutRate() float64 {
+	return rate(r.RecordedTimeouts, r.Requests)
+}
+
+// ReplayedTimeoutRate returns the portion of the requests which timed out when
+// they were replayed.
+func (r *ReplayReport) ReplayedTimeoutRate() float64 {
+	return rate(r.ReplayedTimeouts, r.Requests)
+}
+
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// ReplayDiff is a request whose replayed response differs from the recorded
+// one.
+type ReplayDiff struct {
+	// Record is the recorded request.
+	Record respwriter.TrafficRecord
+
+	// Latency is how long the replayed handler took.
+	Latency time.Duration
+
+	// Diff is a line diff of the recorded (-) and replayed (+) responses, in
+	// the format of golden files (see RunGolden).
+	Diff string
+}
+
+// Replay feeds the traffic recorded by a respwriter.TrafficRecorder into h,
+// wrapped by respwriter.NewHandlerFunc and writing to a Recorder with the
+// recorded client's address and transport, and reports the responses which
+// differ from the recorded ones and the change of the timeout rate.
+//
+// Requests are replayed at their recorded pace, divided by the speed (see
+// WithReplaySpeed), and concurrently, so a slow handler doesn't hold back the
+// requests recorded after it. Replay returns early with the context's error
+// when it's done. Options supported: WithRequestTimeout, WithReplaySpeed, and
+// the options of respwriter.NewHandlerFunc.
+func Replay(ctx context.Context, src respwriter.TrafficSource, h dns.HandlerFunc, opt ...respwriter.Option) (*ReplayReport, error) {
+	const op = "respwritertest.Replay"
+	switch {
+	case src == nil:
+		return nil, fmt.Errorf("%s: nil source: %w", op, respwriter.ErrInvalidParameter)
+	case h == nil:
+		return nil, fmt.Errorf("%s: nil handler: %w", op, respwriter.ErrInvalidParameter)
+	}
+	opts := getOpts(opt...)
+	if opts.withReplaySpeed < 0 {
+		return nil, fmt.Errorf("%s: invalid replay speed: %w", op, respwriter.ErrInvalidParameter)
+	}
+	handler, err := respwriter.NewHandlerFunc(opts.withRequestTimeout, h, opt...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		inFlight = make(chan struct{}, maxReplayInFlight)
+		results  []*replayResult
+		first    time.Time
+		started  = time.Now()
+	)
+	defer wg.Wait()
+	for i := 0; ; i++ {
+		rec, err := src.Next()
+		switch {
+		case errors.Is(err, io.EOF):
+			wg.Wait()
+			return newReplayReport(results), nil
+		case err != nil:
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(rec.Request); err != nil {
+			return nil, fmt.Errorf("%s: record %d: unable to unpack request: %w", op, i, err)
+		}
+
+		// wait until the request is due, at the replay's pace.
+		if i == 0 {
+			first = rec.Time
+		}
+		if opts.withReplaySpeed > 0 {
+			due := started.Add(time.Duration(float64(rec.Time.Sub(first)) / opts.withReplaySpeed))
+			if err := sleepUntil(ctx, due); err != nil {
+				return nil, fmt.Errorf("%s: %w", op, err)
+			}
+		}
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s: %w", op, ctx.Err())
+		}
+
+		result := &replayResult{record: rec}
+		results = append(results, result)
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			result.replay(handler, req, opts.withRequestTimeout)
+		}()
+	}
+}
+
+// replayResult is a replayed request.
+type replayResult struct {
+	record   respwriter.TrafficRecord
+	latency  time.Duration
+	timedOut bool
+	diff     string
+}
+
+// replay passes the request to the handler and diffs its response with the
+// recorded one.
+func (r *replayResult) replay(handler dns.HandlerFunc, req *dns.Msg, timeout time.Duration) {
+	transport := r.record.Transport
+	if transport == respwriter.TransportUnknown {
+		transport = respwriter.TransportUDP
+	}
+	opt := []respwriter.Option{WithTransport(transport)}
+	if addr := replayAddr(transport, r.record.RemoteAddr); addr != nil {
+		opt = append(opt, WithRemoteAddr(addr))
+	}
+	if addr := replayAddr(transport, r.record.LocalAddr); addr != nil {
+		opt = append(opt, WithLocalAddr(addr))
+	}
+	rec := NewRecorder(opt...)
+	start := time.Now()
+	handler(rec, req)
+	r.latency = time.Since(start)
+
+	var got []string
+	switch records := rec.Records(); {
+	case len(records) > 0:
+		got = renderReplayResponse(records[len(records)-1].Bytes)
+	case r.latency >= timeout:
+		r.timedOut = true
+		got = []string{"--- times out"}
+	default:
+		got = []string{"--- no response"}
+	}
+	var want []string
+	switch {
+	case len(r.record.Response) > 0:
+		want = renderReplayResponse(r.record.Response)
+	case r.record.TimedOut:
+		want = []string{"--- times out"}
+	default:
+		want = []string{"--- no response"}
+	}
+	r.diff = diffLines(want, got)
+}
+
+// renderReplayResponse renders a packed response in the golden format.
+func renderReplayResponse(b []byte) []string {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return []string{"--- invalid response: " + err.Error()}
+	}
+	return renderGoldenResponse(m)
+}
+
+func newReplayReport(results []*replayResult) *ReplayReport {
+	report := &ReplayReport{Requests: len(results)}
+	for _, r := range results {
+		if r.record.TimedOut {
+			report.RecordedTimeouts++
+		}
+		if r.timedOut {
+			report.ReplayedTimeouts++
+		}
+		if r.diff != "" {
+			report.Diffs = append(report.Diffs, ReplayDiff{Record: r.record, Latency: r.latency, Diff: r.diff})
+		}
+	}
+	return report
+}
+
+// replayAddr returns the recorded address for the transport, or nil when it
+// isn't an ip:port address.
+func replayAddr(transport respwriter.Transport, s string) net.Addr {
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil
+	}
+	if transport.IsStream() {
+		return net.TCPAddrFromAddrPort(addrPort)
+	}
+	return net.UDPAddrFromAddrPort(addrPort)
+}
+
+// sleepUntil waits until t, it returns the context's error when it's done
+// first.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
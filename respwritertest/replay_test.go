@@ -0,0 +1,205 @@
+package respwritertest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replayHandler answers with the address in ip, unless the name is slow.
+func replayHandler(ip net.IP) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if strings.HasPrefix(r.Question[0].Name, "slow.") {
+			<-w.(*respwriter.RespWriter).RequestContext().Done()
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   ip,
+		})
+		_ = w.WriteMsg(m)
+	}
+}
+
+// recordTraffic records the queries for the names through the handler, as a
+// JSONL file.
+func recordTraffic(t *testing.T, h dns.HandlerFunc, names ...string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tr, err := respwriter.NewTrafficRecorder(h, respwriter.NewJSONLSink(&buf))
+	require.NoError(t, err)
+	handler, err := respwriter.NewHandlerFunc(50*time.Millisecond, tr.ServeDNS)
+	require.NoError(t, err)
+	for _, name := range names {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		handler(NewRecorder(WithRemoteAddr(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 5300})), r)
+	}
+	return &buf
+}
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+	recorded := recordTraffic(t, replayHandler(net.IPv4(192, 0, 2, 1)), "a.example.", "slow.example.", "b.example.")
+
+	t.Run("unchanged", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		var remote net.Addr
+		h := replayHandler(net.IPv4(192, 0, 2, 1))
+		report, err := Replay(context.Background(), respwriter.NewJSONLSource(bytes.NewReader(recorded.Bytes())), func(w dns.ResponseWriter, r *dns.Msg) {
+			if r.Question[0].Name == "a.example." {
+				remote = w.RemoteAddr()
+			}
+			h(w, r)
+		}, WithReplaySpeed(0), WithRequestTimeout(50*time.Millisecond))
+		require.NoError(err)
+		assert.Equal(3, report.Requests)
+		assert.Empty(report.Diffs)
+		assert.Equal(1, report.RecordedTimeouts)
+		assert.Equal(1, report.ReplayedTimeouts)
+		assert.InDelta(1.0/3, report.RecordedTimeoutRate(), 0.001)
+		assert.InDelta(1.0/3, report.ReplayedTimeoutRate(), 0.001)
+		// the recorded client's address is replayed
+		assert.Equal("192.0.2.7:5300", remote.String())
+	})
+	t.Run("changed", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		// the changed handler answers differently and no longer times out.
+		changed := func(w dns.ResponseWriter, r *dns.Msg) {
+			r.Question[0].Name = strings.TrimPrefix(r.Question[0].Name, "slow.")
+			replayHandler(net.IPv4(192, 0, 2, 2))(w, r)
+		}
+		report, err := Replay(context.Background(), respwriter.NewJSONLSource(bytes.NewReader(recorded.Bytes())), changed, WithReplaySpeed(0), WithRequestTimeout(50*time.Millisecond))
+		require.NoError(err)
+		assert.Equal(3, report.Requests)
+		assert.Equal(1, report.RecordedTimeouts)
+		assert.Equal(0, report.ReplayedTimeouts)
+		assert.Zero(report.ReplayedTimeoutRate())
+		require.Len(report.Diffs, 3)
+		assert.Contains(report.Diffs[0].Diff, "- answer: a.example.\t60\tIN\tA\t192.0.2.1\n+ answer: a.example.\t60\tIN\tA\t192.0.2.2\n")
+		assert.Contains(report.Diffs[1].Diff, "- --- times out\n+ --- response\n")
+		assert.Equal("192.0.2.7:5300", report.Diffs[2].Record.RemoteAddr)
+	})
+	t.Run("pace", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		var buf bytes.Buffer
+		sink := respwriter.NewJSONLSink(&buf)
+		r := new(dns.Msg)
+		r.SetQuestion("a.example.", dns.TypeA)
+		req, err := r.Pack()
+		require.NoError(err)
+		start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		for _, offset := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond} {
+			require.NoError(sink.Record(respwriter.TrafficRecord{Time: start.Add(offset), Request: req}))
+		}
+
+		for _, tc := range []struct {
+			speed   float64
+			wantMin time.Duration
+			wantMax time.Duration
+		}{
+			{speed: 1, wantMin: 200 * time.Millisecond, wantMax: time.Second},
+			{speed: 4, wantMin: 50 * time.Millisecond, wantMax: 150 * time.Millisecond},
+		} {
+			began := time.Now()
+			report, err := Replay(context.Background(), respwriter.NewJSONLSource(bytes.NewReader(buf.Bytes())), replayHandler(net.IPv4(192, 0, 2, 1)), WithReplaySpeed(tc.speed))
+			require.NoError(err)
+			assert.Equal(3, report.Requests)
+			// nothing was recorded for the requests
+			assert.Len(report.Diffs, 3)
+			assert.WithinRange(time.Now(), began.Add(tc.wantMin), began.Add(tc.wantMax), "speed %v", tc.speed)
+		}
+	})
+}
+
+func TestReplay_errors(t *testing.T) {
+	t.Parallel()
+	h := replayHandler(net.IPv4(192, 0, 2, 1))
+	src := func(s string) respwriter.TrafficSource {
+		return respwriter.NewJSONLSource(strings.NewReader(s))
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name            string
+		ctx             context.Context
+		src             respwriter.TrafficSource
+		h               dns.HandlerFunc
+		opts            []respwriter.Option
+		wantErrIs       error
+		wantErrContains string
+	}{
+		{
+			name:            "nil-source",
+			h:               h,
+			wantErrIs:       respwriter.ErrInvalidParameter,
+			wantErrContains: "nil source",
+		},
+		{
+			name:            "nil-handler",
+			src:             src(""),
+			wantErrIs:       respwriter.ErrInvalidParameter,
+			wantErrContains: "nil handler",
+		},
+		{
+			name:            "invalid-speed",
+			src:             src(""),
+			h:               h,
+			opts:            []respwriter.Option{WithReplaySpeed(-1)},
+			wantErrIs:       respwriter.ErrInvalidParameter,
+			wantErrContains: "invalid replay speed",
+		},
+		{
+			name:            "invalid-source",
+			src:             src("{bogus}\n"),
+			h:               h,
+			wantErrContains: "line 1",
+		},
+		{
+			name:            "invalid-request",
+			src:             src(`{"request":"AQID"}` + "\n"),
+			h:               h,
+			wantErrContains: "record 0: unable to unpack request",
+		},
+		{
+			name:            "canceled",
+			ctx:             canceled,
+			src:             src(`{"time":"2024-01-02T03:04:05Z","request":"AAEBAAABAAAAAAAAAWEAAAEAAQ=="}` + "\n" + `{"time":"2024-01-02T03:05:05Z","request":"AAEBAAABAAAAAAAAAWEAAAEAAQ=="}` + "\n"),
+			h:               h,
+			wantErrIs:       context.Canceled,
+			wantErrContains: "context canceled",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			ctx := tc.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			_, err := Replay(ctx, tc.src, tc.h, tc.opts...)
+			require.Error(err)
+			if tc.wantErrIs != nil {
+				assert.True(errors.Is(err, tc.wantErrIs), err)
+			}
+			assert.Contains(err.Error(), tc.wantErrContains)
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package respwritertest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+)
+
+const defaultRequestTimeout = 2 * time.Second
+
+// Server is an in-process DNS server for tests, listening on ephemeral
+// loopback ports for UDP, TCP and, optionally, TLS. With WithInMemory, it
+// serves UDP and TCP on a MemNetwork instead, without binding sockets.
+type Server struct {
+	addrs     map[respwriter.Transport]string
+	clientTLS *tls.Config
+	mem       *MemNetwork
+}
+
+// NewServer starts a Server whose handler is h wrapped by
+// respwriter.NewHandlerFunc. It returns once the server is ready and shuts it
+// down via t.Cleanup. The options are passed to respwriter.NewHandlerFunc as
+// well, so respwriter options (WithLogger for example) can be mixed in.
+// Options supported: WithRequestTimeout, WithTLS, WithInMemory
+func NewServer(t testing.TB, h dns.HandlerFunc, opt ...respwriter.Option) *Server {
+	t.Helper()
+	opts := getOpts(opt...)
+	handler, err := respwriter.NewHandlerFunc(opts.withRequestTimeout, h, opt...)
+	if err != nil {
+		t.Fatalf("respwritertest.NewServer: %s", err)
+	}
+
+	s := &Server{addrs: map[respwriter.Transport]string{}}
+	if opts.withInMemory {
+		if opts.withTLS {
+			t.Fatalf("respwritertest.NewServer: tls isn't supported in memory")
+		}
+		s.mem = NewMemNetwork()
+		s.addrs[respwriter.TransportUDP] = startServer(t, &dns.Server{PacketConn: s.mem.PacketConn(), Handler: handler})
+		s.addrs[respwriter.TransportTCP] = startServer(t, &dns.Server{Listener: s.mem.Listener(), Handler: handler})
+		return s
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("respwritertest.NewServer: unable to listen on udp: %s", err)
+	}
+	s.addrs[respwriter.TransportUDP] = startServer(t, &dns.Server{PacketConn: pc, Handler: handler})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("respwritertest.NewServer: unable to listen on tcp: %s", err)
+	}
+	s.addrs[respwriter.TransportTCP] = startServer(t, &dns.Server{Listener: l, Handler: handler})
+
+	if opts.withTLS {
+		serverTLS, clientTLS, err := selfSignedTLS()
+		if err != nil {
+			t.Fatalf("respwritertest.NewServer: %s", err)
+		}
+		l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+		if err != nil {
+			t.Fatalf("respwritertest.NewServer: unable to listen on tls: %s", err)
+		}
+		s.addrs[respwriter.TransportTLS] = startServer(t, &dns.Server{Listener: l, Net: "tcp-tls", Handler: handler})
+		s.clientTLS = clientTLS
+	}
+	return s
+}
+
+// Addr returns the address the server listens on for the transport, or an
+// empty string when it doesn't.
+func (s *Server) Addr(transport respwriter.Transport) string {
+	return s.addrs[transport]
+}
+
+// Client returns a dns.Client for the transport, which trusts the server's
+// certificate for TLS. It returns nil when the server doesn't listen on the
+// transport. In memory, the client must be used with a connection returned by
+// Dial, via dns.Client.ExchangeWithConn.
+func (s *Server) Client(transport respwriter.Transport) *dns.Client {
+	if _, ok := s.addrs[transport]; !ok {
+		return nil
+	}
+	c := &dns.Client{Net: transport.String(), Timeout: 5 * time.Second}
+	if transport == respwriter.TransportTLS {
+		c.TLSConfig = s.clientTLS.Clone()
+	}
+	return c
+}
+
+// Dial returns a connection to the server over the transport.
+func (s *Server) Dial(transport respwriter.Transport) (*dns.Conn, error) {
+	const op = "respwritertest.(Server).Dial"
+	c := s.Client(transport)
+	if c == nil {
+		return nil, fmt.Errorf("%s: not listening on %s: %w", op, transport, respwriter.ErrUnsupportedTransport)
+	}
+	if s.mem == nil {
+		conn, err := c.Dial(s.addrs[transport])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		return conn, nil
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch transport {
+	case respwriter.TransportUDP:
+		conn, err = s.mem.DialUDP()
+	default:
+		conn, err = s.mem.DialTCP()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// Exchange sends m to the server over the transport and returns the response.
+func (s *Server) Exchange(transport respwriter.Transport, m *dns.Msg) (*dns.Msg, error) {
+	const op = "respwritertest.(Server).Exchange"
+	conn, err := s.Dial(transport)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer conn.Close()
+	r, _, err := s.Client(transport).ExchangeWithConn(m, conn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return r, nil
+}
+
+// startServer starts the server, waits until it's ready and returns its
+// address. The server is shut down via t.Cleanup.
+func startServer(t testing.TB, server *dns.Server) string {
+	t.Helper()
+	server.ReadTimeout = time.Hour
+	server.WriteTimeout = time.Hour
+
+	var started sync.WaitGroup
+	started.Add(1)
+	server.NotifyStartedFunc = started.Done
+
+	fin := make(chan error, 1)
+	go func() {
+		fin <- server.ActivateAndServe()
+	}()
+	ready := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(ready)
+	}()
+	select {
+	case <-ready:
+	case err := <-fin:
+		t.Fatalf("respwritertest.NewServer: unable to start server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+		<-fin
+	})
+	switch {
+	case server.Listener != nil:
+		return server.Listener.Addr().String()
+	default:
+		return server.PacketConn.LocalAddr().String()
+	}
+}
+
+// selfSignedTLS returns a server config with a self-signed certificate for
+// 127.0.0.1 and a client config which trusts it.
+func selfSignedTLS() (*tls.Config, *tls.Config, error) {
+	const op = "respwritertest.selfSignedTLS"
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: unable to generate key: %w", op, err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "respwritertest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: unable to create certificate: %w", op, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: unable to parse certificate: %w", op, err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	clientTLS := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1", MinVersion: tls.VersionTLS12}
+	return serverTLS, clientTLS, nil
+}
@@ -0,0 +1,71 @@
+package respwritertest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewServer(t *testing.T) {
+	t.Parallel()
+	// transportHandler answers with the transport the request was received
+	// over.
+	transportHandler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{w.(*respwriter.RespWriter).Transport().String()},
+		})
+		_ = w.WriteMsg(m)
+	}
+	s := NewServer(t, transportHandler, WithTLS(true))
+
+	for _, transport := range []respwriter.Transport{respwriter.TransportUDP, respwriter.TransportTCP, respwriter.TransportTLS} {
+		transport := transport
+		t.Run(transport.String(), func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			require.NotEmpty(s.Addr(transport))
+			require.NotNil(s.Client(transport))
+
+			m := new(dns.Msg)
+			m.SetQuestion("go.dev.", dns.TypeTXT)
+			got, err := s.Exchange(transport, m)
+			require.NoError(err)
+			require.Len(got.Answer, 1)
+			assert.Equal([]string{transport.String()}, got.Answer[0].(*dns.TXT).Txt)
+		})
+	}
+}
+
+func TestNewServer_options(t *testing.T) {
+	t.Parallel()
+
+	t.Run("without-tls", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+		s := NewServer(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+		assert.Empty(s.Addr(respwriter.TransportTLS))
+		assert.Nil(s.Client(respwriter.TransportTLS))
+		_, err := s.Exchange(respwriter.TransportTLS, new(dns.Msg))
+		assert.ErrorIs(err, respwriter.ErrUnsupportedTransport)
+	})
+	t.Run("respwriter-options", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		s := NewServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			<-w.(*respwriter.RespWriter).RequestContext().Done()
+		}, WithRequestTimeout(50*time.Millisecond), respwriter.WithTimeoutPolicy(respwriter.TimeoutReplyAndClose))
+
+		m := new(dns.Msg)
+		m.SetQuestion("go.dev.", dns.TypeA)
+		got, err := s.Exchange(respwriter.TransportTCP, m)
+		require.NoError(err)
+		assert.Equal(dns.RcodeServerFailure, got.Rcode)
+	})
+}
@@ -0,0 +1,37 @@
+package respwriter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_siphash24(t *testing.T) {
+	t.Parallel()
+	// test vectors from the SipHash reference implementation
+	var key [16]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	msg := make([]byte, 16)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want uint64
+	}{
+		{name: "empty", msg: msg[:0], want: 0x726fdb47dd0e0e31},
+		{name: "1-byte", msg: msg[:1], want: 0x74f839c593dc67fd},
+		{name: "8-bytes", msg: msg[:8], want: 0x93f5f5799a932462},
+		{name: "15-bytes", msg: msg[:15], want: 0xa129ca6149be45e5},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, siphash24(key, tc.msg))
+		})
+	}
+}
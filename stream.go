@@ -0,0 +1,100 @@
+package respwriter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultEnvelopeTimeout = 10 * time.Second
+	defaultIdleTimeout     = time.Minute
+)
+
+// StartStream switches the writer to streaming mode, which is meant for
+// multi-message responses over stream transports such as zone transfers. In
+// streaming mode:
+//
+//   - each message written must be sent within the envelope timeout (see
+//     WithEnvelopeTimeout), which is applied to the connection's write
+//     deadline when the underlying writer implements ExposesUnderlyingConns.
+//   - the request timeout of NewHandlerFunc is replaced by the idle timeout
+//     (see WithIdleTimeout), which is reset every time a message is written.
+//
+// It returns ErrUnsupportedTransport for packet transports.
+func (rw *RespWriter) StartStream() error {
+	const op = "respwriter.(RespWriter).StartStream"
+	if !rw.Transport().IsStream() {
+		return fmt.Errorf("%s: streaming requires a stream transport: %w", op, ErrUnsupportedTransport)
+	}
+	if err := rw.requestCtx.Err(); err != nil {
+		return err
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.streaming = true
+	rw.progress()
+	return nil
+}
+
+// progress resets the idle timeout in streaming mode. The caller must hold
+// rw.mu.
+func (rw *RespWriter) progress() {
+	if !rw.streaming || rw.deadlineCtx == nil || rw.idleTimeout <= 0 {
+		return
+	}
+	rw.deadlineCtx.setDeadline(rw.clock.Now().Add(rw.idleTimeout))
+}
+
+// StreamZone streams the zone transfer (AXFR or IXFR) response to r, using
+// the records received from ch, one message per envelope. It switches rw to
+// streaming mode (see StartStream), so each message gets its own write
+// deadline and the transfer can outlast the request timeout as long as it
+// makes progress. When r is signed, each message is signed with the request's
+// TSIG key.
+//
+// StreamZone returns when ch is closed, an envelope has an error, a message
+// can't be written or the request context is done. It doesn't close the
+// connection.
+func StreamZone(rw *RespWriter, r *dns.Msg, ch <-chan *dns.Envelope) error {
+	const op = "respwriter.StreamZone"
+	switch {
+	case rw == nil:
+		return fmt.Errorf("%s: missing writer: %w", op, ErrInvalidParameter)
+	case r == nil:
+		return fmt.Errorf("%s: missing request: %w", op, ErrInvalidParameter)
+	case ch == nil:
+		return fmt.Errorf("%s: missing channel: %w", op, ErrInvalidParameter)
+	}
+	if err := rw.StartStream(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	sig := r.IsTsig()
+	for {
+		var env *dns.Envelope
+		select {
+		case <-rw.requestCtx.Done():
+			return fmt.Errorf("%s: %w", op, rw.requestCtx.Err())
+		case e, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			env = e
+		}
+		if env.Error != nil {
+			return fmt.Errorf("%s: %w", op, env.Error)
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = append(m.Answer, env.RR...)
+		if sig != nil && rw.TsigStatus() == nil {
+			m.SetTsig(sig.Hdr.Name, sig.Algorithm, sig.Fudge, rw.clock.Now().Unix())
+		}
+		if err := rw.WriteMsg(m); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		rw.TsigTimersOnly(true)
+	}
+}
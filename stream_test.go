@@ -0,0 +1,105 @@
+package respwriter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRespWriter_StartStream(t *testing.T) {
+	t.Parallel()
+
+	t.Run("udp", func(t *testing.T) {
+		rw := NewRespWriter(context.Background(), new(mockUDPResponseWriter))
+		err := rw.StartStream()
+		assert.ErrorIs(t, err, ErrUnsupportedTransport)
+	})
+	t.Run("context-done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		rw := NewRespWriter(ctx, new(mockTCPResponseWriter))
+		err := rw.StartStream()
+		assert.Equal(t, context.Canceled, err)
+	})
+	t.Run("envelope-timeout", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		server, client := net.Pipe()
+		t.Cleanup(func() { server.Close(); client.Close() })
+		w := &mockPipeResponseWriter{conn: server}
+		rw := NewRespWriter(context.Background(), w, WithEnvelopeTimeout(50*time.Millisecond))
+		require.NoError(rw.StartStream())
+
+		// nothing reads from the client side of the pipe, so the write blocks
+		// until the envelope deadline.
+		m := new(dns.Msg)
+		m.SetQuestion("go.dev.", dns.TypeAXFR)
+		start := time.Now()
+		err := rw.WriteMsg(m)
+		require.Error(err)
+		var timeoutErr *WriteTimeoutError
+		require.True(errors.As(err, &timeoutErr))
+		assert.True(timeoutErr.Timeout())
+		assert.Less(time.Since(start), time.Second)
+
+		// the write deadline is cleared afterward
+		go func() {
+			buf := make([]byte, 512)
+			_, _ = client.Read(buf)
+		}()
+		assert.NoError(rw.WriteMsg(m))
+	})
+}
+
+func TestStreamZone(t *testing.T) {
+	t.Parallel()
+	t.Run("invalid-parameters", func(t *testing.T) {
+		assert := assert.New(t)
+		rw := NewRespWriter(context.Background(), new(mockTCPResponseWriter))
+		r := new(dns.Msg)
+		assert.ErrorIs(StreamZone(nil, r, make(chan *dns.Envelope)), ErrInvalidParameter)
+		assert.ErrorIs(StreamZone(rw, nil, make(chan *dns.Envelope)), ErrInvalidParameter)
+		assert.ErrorIs(StreamZone(rw, r, nil), ErrInvalidParameter)
+	})
+	t.Run("envelope-error", func(t *testing.T) {
+		rw := NewRespWriter(context.Background(), new(mockTCPResponseWriter))
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeAXFR)
+		ch := make(chan *dns.Envelope, 1)
+		testErr := errors.New("zone error")
+		ch <- &dns.Envelope{Error: testErr}
+		assert.ErrorIs(t, StreamZone(rw, r, ch), testErr)
+	})
+}
+
+// mockPipeResponseWriter writes messages to the given conn.
+type mockPipeResponseWriter struct {
+	mockDNSResponseWriter
+	conn net.Conn
+}
+
+func (w *mockPipeResponseWriter) WriteMsg(m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.conn.Write(buf)
+	return err
+}
+
+func (w *mockPipeResponseWriter) Write(b []byte) (int, error) {
+	return w.conn.Write(b)
+}
+
+func (w *mockPipeResponseWriter) IncomingConn() net.Conn {
+	return w.conn
+}
+
+func (w *mockPipeResponseWriter) IncomingPacketConn() net.PacketConn {
+	return nil
+}
@@ -71,3 +71,48 @@ func runServer(t testing.TB, pc net.PacketConn, l net.Listener, opts ...func(*dn
 	})
 	return server, addr, fin
 }
+
+// testMetrics is a Metrics which keeps the counters and durations it receives.
+type testMetrics struct {
+	mu        sync.Mutex
+	counters  map[string]int
+	labels    map[string][]map[string]string
+	durations map[string][]time.Duration
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		counters:  map[string]int{},
+		labels:    map[string][]map[string]string{},
+		durations: map[string][]time.Duration{},
+	}
+}
+
+func (m *testMetrics) IncCounter(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name]++
+	m.labels[name] = append(m.labels[name], labels)
+}
+
+func (m *testMetrics) ObserveDuration(name string, d time.Duration, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations[name] = append(m.durations[name], d)
+	m.labels[name] = append(m.labels[name], labels)
+}
+
+func (m *testMetrics) counter(name string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name]
+}
+
+func (m *testMetrics) lastLabels(name string) map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l := m.labels[name]; len(l) > 0 {
+		return l[len(l)-1]
+	}
+	return nil
+}
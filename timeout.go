@@ -0,0 +1,100 @@
+package respwriter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fallbackWriteTimeout bounds writing a response after the request context is
+// done.
+const fallbackWriteTimeout = time.Second
+
+// TimeoutPolicy defines what happens to the connection of a request received
+// over a stream transport (TCP or TLS) when it times out before a response is
+// written. Requests received over UDP are never answered or closed on timeout.
+type TimeoutPolicy int
+
+const (
+	// TimeoutKeepConn keeps the connection open, so the client may send more
+	// queries on it once the handler returns.
+	TimeoutKeepConn TimeoutPolicy = iota
+
+	// TimeoutCloseConn closes the connection, so the client (and any queries
+	// it pipelined behind the request) doesn't wait on it.
+	TimeoutCloseConn
+
+	// TimeoutReplyAndClose sends a SERVFAIL reply and then closes the
+	// connection.
+	TimeoutReplyAndClose
+)
+
+// String returns a string representation of the policy.
+func (p TimeoutPolicy) String() string {
+	switch p {
+	case TimeoutKeepConn:
+		return "keep"
+	case TimeoutCloseConn:
+		return "close"
+	case TimeoutReplyAndClose:
+		return "reply-and-close"
+	default:
+		return "unknown"
+	}
+}
+
+// handleTimeout applies the policy, via Close, when the request context's
+// deadline expired before a response was written. It reports the timeout to
+// the logger and metrics.
+func (rw *RespWriter) handleTimeout(policy TimeoutPolicy) {
+	if !errors.Is(rw.requestCtx.Err(), context.DeadlineExceeded) {
+		return
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.written || rw.hijacked {
+		return
+	}
+	transport := rw.Transport()
+	if !transport.IsStream() {
+		policy = TimeoutKeepConn
+	}
+	logger := rw.Logger()
+	if logger != nil {
+		logger.Warn("request timed out", "remote_addr", rw.RemoteAddr().String(), "transport", transport.String(), "timeout_policy", policy.String())
+	}
+	if rw.metrics != nil {
+		rw.metrics.IncCounter(MetricTimeouts, rw.labels(map[string]string{"transport": transport.String(), "timeout_policy": policy.String()}))
+	}
+
+	switch policy {
+	case TimeoutReplyAndClose:
+		if rw.request != nil {
+			m := new(dns.Msg)
+			m.SetRcode(rw.request, dns.RcodeServerFailure)
+			if err := rw.writeFallback(m); err != nil && logger != nil {
+				logger.Debug("unable to write timeout reply", "err", err)
+			}
+		}
+		fallthrough
+	case TimeoutCloseConn:
+		if err := rw.underlying.Close(); err != nil && logger != nil {
+			logger.Debug("unable to close connection on timeout", "err", err)
+		}
+	}
+}
+
+// writeFallback writes msg to the client even though the request context may
+// be done, bound by its own short write deadline. Like any other response, it
+// goes through the writers installed by middlewares (see wrapWriter). The
+// caller must hold rw.mu.
+func (rw *RespWriter) writeFallback(msg *dns.Msg) error {
+	rw.fallback = true
+	defer func() { rw.fallback = false }()
+	if rw.writer != nil {
+		return rw.writer.WriteMsg(msg)
+	}
+	return rw.writeUnderlying(msg)
+}
@@ -0,0 +1,564 @@
+package respwriter_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jimlambrt/respwriter"
+	"github.com/jimlambrt/respwriter/respwritertest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The tests of this file drive request deadlines and TTLs with a
+// respwritertest.FakeClock, which package respwriter's own tests can't import.
+
+func TestNewHandlerFunc_requestTimeout(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	clock := respwritertest.NewFakeClock(time.Time{})
+	s := respwritertest.NewServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		<-w.(*respwriter.RespWriter).RequestContext().Done()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	}, respwritertest.WithRequestTimeout(100*time.Millisecond), respwriter.WithClock(clock))
+
+	// expire the request once the handler is waiting on it.
+	go func() {
+		clock.WaitForTimers(1)
+		clock.Advance(200 * time.Millisecond)
+	}()
+
+	// the response written after the request timed out isn't sent.
+	c := s.Client(respwriter.TransportTCP)
+	c.Timeout = 500 * time.Millisecond
+	m := new(dns.Msg)
+	m.SetQuestion("go.dev.", dns.TypeTXT)
+	_, _, err := c.Exchange(m, s.Addr(respwriter.TransportTCP))
+	require.Error(err)
+	assert.Contains(err.Error(), "i/o timeout")
+}
+
+func TestNewHandlerFunc_timeoutPolicy(t *testing.T) {
+	t.Parallel()
+	testLogger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{AddSource: true}))
+
+	// slowHandler answers after the request timeout, unless it's a "fast."
+	// query.
+	slowHandler := func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name != "fast." {
+			<-w.(*respwriter.RespWriter).RequestContext().Done()
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	}
+
+	tests := []struct {
+		name       string
+		policy     respwriter.TimeoutPolicy
+		wantRcode  int
+		wantReply  bool
+		wantClosed bool
+	}{
+		{
+			name:   "keep",
+			policy: respwriter.TimeoutKeepConn,
+		},
+		{
+			name:       "close",
+			policy:     respwriter.TimeoutCloseConn,
+			wantClosed: true,
+		},
+		{
+			name:       "reply-and-close",
+			policy:     respwriter.TimeoutReplyAndClose,
+			wantReply:  true,
+			wantRcode:  dns.RcodeServerFailure,
+			wantClosed: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			metrics := respwriter.NewTestMetrics()
+			clock := respwritertest.NewFakeClock(time.Time{})
+			s := respwritertest.NewServer(t, slowHandler,
+				respwritertest.WithRequestTimeout(100*time.Millisecond),
+				respwriter.WithLogger(testLogger),
+				respwriter.WithMetrics(metrics),
+				respwriter.WithTimeoutPolicy(tc.policy),
+				respwriter.WithClock(clock),
+			)
+
+			conn, err := s.Dial(respwriter.TransportTCP)
+			require.NoError(err)
+			defer conn.Close()
+
+			r := new(dns.Msg)
+			r.SetQuestion("slow.", dns.TypeA)
+			require.NoError(conn.WriteMsg(r))
+			// expire the request once the handler is waiting on it.
+			clock.WaitForTimers(1)
+			clock.Advance(100 * time.Millisecond)
+			require.NoError(conn.SetReadDeadline(time.Now().Add(time.Second)))
+			got, err := conn.ReadMsg()
+			switch {
+			case tc.wantReply:
+				require.NoError(err)
+				assert.Equal(tc.wantRcode, got.Rcode)
+				assert.Equal(r.Id, got.Id)
+			default:
+				require.Error(err)
+				var netErr net.Error
+				if !tc.wantClosed {
+					require.ErrorAs(err, &netErr)
+					assert.True(netErr.Timeout())
+				}
+			}
+
+			if tc.wantClosed {
+				require.NoError(conn.SetReadDeadline(time.Now().Add(time.Second)))
+				_, err = conn.ReadMsg()
+				require.Error(err)
+				var netErr net.Error
+				assert.False(errors.As(err, &netErr) && netErr.Timeout(), "expected the connection to be closed: %s", err)
+			} else {
+				// the connection is still usable
+				r := new(dns.Msg)
+				r.SetQuestion("fast.", dns.TypeA)
+				require.NoError(conn.WriteMsg(r))
+				require.NoError(conn.SetReadDeadline(time.Now().Add(time.Second)))
+				got, err := conn.ReadMsg()
+				require.NoError(err)
+				assert.Equal(r.Id, got.Id)
+			}
+
+			assert.Equal(1, metrics.Counter(respwriter.MetricTimeouts))
+			assert.Equal(map[string]string{"transport": "tcp", "timeout_policy": tc.policy.String()}, metrics.LastLabels(respwriter.MetricTimeouts))
+		})
+	}
+	t.Run("written-before-timeout", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		metrics := respwriter.NewTestMetrics()
+		clock := respwritertest.NewFakeClock(time.Time{})
+		s := respwritertest.NewServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			_ = w.WriteMsg(m)
+			if r.Question[0].Name != "fast." {
+				<-w.(*respwriter.RespWriter).RequestContext().Done()
+			}
+		},
+			respwritertest.WithRequestTimeout(100*time.Millisecond),
+			respwriter.WithMetrics(metrics),
+			respwriter.WithTimeoutPolicy(respwriter.TimeoutCloseConn),
+			respwriter.WithClock(clock),
+		)
+
+		conn, err := s.Dial(respwriter.TransportTCP)
+		require.NoError(err)
+		defer conn.Close()
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		require.NoError(conn.WriteMsg(r))
+		_, err = conn.ReadMsg()
+		require.NoError(err)
+		clock.Advance(100 * time.Millisecond)
+
+		// the connection stays open once a response was written
+		r.SetQuestion("fast.", dns.TypeA)
+		require.NoError(conn.WriteMsg(r))
+		require.NoError(conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond)))
+		_, err = conn.ReadMsg()
+		require.NoError(err)
+		assert.Equal(0, metrics.Counter(respwriter.MetricTimeouts))
+	})
+	t.Run("returned-at-deadline", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		metrics := respwriter.NewTestMetrics()
+		// the handler returns as soon as the deadline expires, racing the
+		// policy being applied.
+		s := respwritertest.NewServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+			<-w.(*respwriter.RespWriter).RequestContext().Done()
+		},
+			respwritertest.WithRequestTimeout(10*time.Millisecond),
+			respwriter.WithMetrics(metrics),
+			respwriter.WithTimeoutPolicy(respwriter.TimeoutReplyAndClose),
+		)
+
+		const requests = 20
+		for i := 0; i < requests; i++ {
+			conn, err := s.Dial(respwriter.TransportTCP)
+			require.NoError(err)
+			r := new(dns.Msg)
+			r.SetQuestion("go.dev.", dns.TypeA)
+			require.NoError(conn.WriteMsg(r))
+			require.NoError(conn.SetReadDeadline(time.Now().Add(time.Second)))
+			got, err := conn.ReadMsg()
+			require.NoError(err)
+			assert.Equal(dns.RcodeServerFailure, got.Rcode)
+			conn.Close()
+		}
+		assert.Equal(requests, metrics.Counter(respwriter.MetricTimeouts))
+	})
+}
+
+func TestTimeoutPolicy_String(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "keep", respwriter.TimeoutKeepConn.String())
+	assert.Equal(t, "close", respwriter.TimeoutCloseConn.String())
+	assert.Equal(t, "reply-and-close", respwriter.TimeoutReplyAndClose.String())
+	assert.Equal(t, "unknown", respwriter.TimeoutPolicy(-1).String())
+}
+
+func TestDeadlineContext_clock(t *testing.T) {
+	t.Parallel()
+
+	t.Run("expires", func(t *testing.T) {
+		assert := assert.New(t)
+		clock := respwritertest.NewFakeClock(time.Time{})
+		deadline := clock.Now().Add(50 * time.Millisecond)
+		ctx, cancel := respwriter.NewDeadlineContext(context.Background(), deadline, clock)
+		t.Cleanup(cancel)
+		got, ok := ctx.Deadline()
+		assert.True(ok)
+		assert.Equal(deadline, got)
+		clock.Advance(49 * time.Millisecond)
+		assert.NoError(ctx.Err())
+		clock.Advance(time.Millisecond)
+		<-ctx.Done()
+		assert.Equal(context.DeadlineExceeded, ctx.Err())
+	})
+	t.Run("extended", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		clock := respwritertest.NewFakeClock(time.Time{})
+		start := clock.Now()
+		ctx, cancel := respwriter.NewDeadlineContext(context.Background(), start.Add(50*time.Millisecond), clock)
+		t.Cleanup(cancel)
+		require.True(ctx.SetDeadline(start.Add(150 * time.Millisecond)))
+		clock.Advance(149 * time.Millisecond)
+		assert.NoError(ctx.Err())
+		clock.Advance(time.Millisecond)
+		<-ctx.Done()
+		assert.Equal(context.DeadlineExceeded, ctx.Err())
+	})
+	t.Run("shortened", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		clock := respwritertest.NewFakeClock(time.Time{})
+		start := clock.Now()
+		ctx, cancel := respwriter.NewDeadlineContext(context.Background(), start.Add(time.Hour), clock)
+		t.Cleanup(cancel)
+		require.True(ctx.SetDeadline(start.Add(10 * time.Millisecond)))
+		clock.Advance(10 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+		default:
+			require.Fail("deadline wasn't shortened")
+		}
+		assert.Equal(context.DeadlineExceeded, ctx.Err())
+	})
+	t.Run("restarted", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		clock := respwritertest.NewFakeClock(time.Time{})
+		ctx, cancel := respwriter.NewDeadlineContext(context.Background(), clock.Now().Add(10*time.Millisecond), clock)
+		t.Cleanup(cancel)
+		done := ctx.Done()
+		stale := context.AfterFunc(ctx, func() {})
+		require.True(stale())
+		clock.Advance(10 * time.Millisecond)
+		<-done
+		assert.Equal(context.DeadlineExceeded, ctx.Err())
+		require.True(ctx.Finish())
+		timer := ctx.Timer()
+
+		ctx.Start(context.Background(), clock.Now().Add(50*time.Millisecond), clock)
+		assert.Same(timer, ctx.Timer())
+		assert.NoError(ctx.Err())
+		// the done channel of the previous use stays closed.
+		assert.NotEqual(done, ctx.Done())
+		select {
+		case <-done:
+		default:
+			assert.Fail("previous done channel isn't closed")
+		}
+		called := make(chan struct{})
+		context.AfterFunc(ctx, func() { close(called) })
+		// a stale stop func doesn't remove funcs registered since.
+		assert.False(stale())
+
+		clock.Advance(49 * time.Millisecond)
+		assert.NoError(ctx.Err())
+		clock.Advance(time.Millisecond)
+		<-ctx.Done()
+		assert.Equal(context.DeadlineExceeded, ctx.Err())
+		select {
+		case <-called:
+		case <-time.After(time.Second):
+			require.Fail("after func wasn't called")
+		}
+		// the func may still use the context, which can't be restarted.
+		assert.False(ctx.Finish())
+	})
+}
+
+func TestRespWriter_ExtendDeadline_clock(t *testing.T) {
+	t.Parallel()
+	const requestTimeout = 100 * time.Millisecond
+
+	// serve calls the handler created by NewHandlerFunc with fn as the wrapped
+	// handler and returns when it's done.
+	serve := func(t *testing.T, fn func(rw *respwriter.RespWriter, r *dns.Msg), opt ...respwriter.Option) {
+		t.Helper()
+		h, err := respwriter.NewHandlerFunc(requestTimeout, func(w dns.ResponseWriter, r *dns.Msg) {
+			fn(w.(*respwriter.RespWriter), r)
+		}, opt...)
+		require.NoError(t, err)
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		h(respwritertest.NewRecorder(respwritertest.WithTransport(respwriter.TransportTCP)), r)
+	}
+
+	t.Run("extended", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		metrics := respwriter.NewTestMetrics()
+		clock := respwritertest.NewFakeClock(time.Time{})
+		serve(t, func(rw *respwriter.RespWriter, r *dns.Msg) {
+			before, _ := rw.RequestContext().Deadline()
+			require.NoError(rw.ExtendDeadline(200 * time.Millisecond))
+			after, _ := rw.RequestContext().Deadline()
+			assert.Equal(200*time.Millisecond, after.Sub(before))
+
+			// still writable after the original deadline
+			clock.Advance(150 * time.Millisecond)
+			assert.NoError(rw.RequestContext().Err())
+			m := new(dns.Msg)
+			m.SetReply(r)
+			assert.NoError(rw.WriteMsg(m))
+		}, respwriter.WithMaxRequestTimeout(time.Second), respwriter.WithMetrics(metrics), respwriter.WithClock(clock))
+		assert.Equal(1, metrics.Counter(respwriter.MetricDeadlineExtensions))
+		assert.Equal(map[string]string{"transport": "tcp", "result": "extended"}, metrics.LastLabels(respwriter.MetricDeadlineExtensions))
+	})
+	t.Run("done", func(t *testing.T) {
+		t.Parallel()
+		clock := respwritertest.NewFakeClock(time.Time{})
+		serve(t, func(rw *respwriter.RespWriter, r *dns.Msg) {
+			clock.Advance(requestTimeout)
+			<-rw.RequestContext().Done()
+			assert.ErrorIs(t, rw.ExtendDeadline(time.Millisecond), context.DeadlineExceeded)
+		}, respwriter.WithMaxRequestTimeout(time.Hour), respwriter.WithClock(clock))
+	})
+}
+
+func TestRespWriter_Detach_deadline(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	respondErr := make(chan error, 1)
+	returned := make(chan struct{})
+	clock := respwritertest.NewFakeClock(time.Time{})
+	h, err := respwriter.NewHandlerFunc(100*time.Millisecond, func(w dns.ResponseWriter, r *dns.Msg) {
+		d := w.(*respwriter.RespWriter).Detach()
+		go func() {
+			<-w.(*respwriter.RespWriter).RequestContext().Done()
+			m := new(dns.Msg)
+			m.SetReply(r)
+			respondErr <- d.Respond(m)
+		}()
+	}, respwriter.WithClock(clock))
+	require.NoError(err)
+	go func() {
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		h(respwritertest.NewRecorder(respwritertest.WithTransport(respwriter.TransportTCP)), r)
+		close(returned)
+	}()
+	// the wrapper waits for the detached handle until the deadline
+	clock.WaitForTimers(1)
+	clock.Advance(99 * time.Millisecond)
+	select {
+	case <-returned:
+		require.Fail("returned before the deadline")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	<-returned
+	assert.ErrorIs(<-respondErr, context.DeadlineExceeded)
+}
+
+func TestRespWriter_StartStream_idleTimeout(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	requestTimeout := 50 * time.Millisecond
+	idleTimeout := 100 * time.Millisecond
+	done := make(chan error, 1)
+	var writes int
+	clock := respwritertest.NewFakeClock(time.Time{})
+	h, err := respwriter.NewHandlerFunc(requestTimeout, func(w dns.ResponseWriter, r *dns.Msg) {
+		rw := w.(*respwriter.RespWriter)
+		if err := rw.StartStream(); err != nil {
+			done <- err
+			return
+		}
+		// keep making progress well past the request timeout
+		for i := 0; i < 5; i++ {
+			clock.Advance(idleTimeout / 2)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if err := rw.WriteMsg(m); err != nil {
+				done <- err
+				return
+			}
+			writes++
+		}
+		// then stop making progress
+		clock.Advance(idleTimeout)
+		<-rw.RequestContext().Done()
+		done <- rw.RequestContext().Err()
+	}, respwriter.WithIdleTimeout(idleTimeout), respwriter.WithClock(clock))
+	require.NoError(err)
+
+	r := new(dns.Msg)
+	r.SetQuestion("go.dev.", dns.TypeAXFR)
+	h(respwritertest.NewRecorder(respwritertest.WithTransport(respwriter.TransportTCP)), r)
+	assert.Equal(context.DeadlineExceeded, <-done)
+	assert.Equal(5, writes)
+}
+
+func TestStreamZone_idleTimeout(t *testing.T) {
+	t.Parallel()
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{Name: "go.dev.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:  "ns.go.dev.", Mbox: "admin.go.dev.", Serial: 1, Refresh: 1, Retry: 1, Expire: 1, Minttl: 1,
+	}
+	newA := func(i int) dns.RR {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: "go.dev.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		}
+	}
+	zone := [][]dns.RR{{soa, newA(1), newA(2)}, {newA(3), newA(4)}, {newA(5), soa}}
+
+	tests := []struct {
+		name string
+		tsig bool
+	}{
+		{name: "axfr"},
+		{name: "axfr-tsig", tsig: true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			secrets := map[string]string{respwriter.TestTsigKey: respwriter.TestTsigSecret}
+			clock := respwritertest.NewFakeClock(time.Time{})
+			h, err := respwriter.NewHandlerFunc(100*time.Millisecond, func(w dns.ResponseWriter, r *dns.Msg) {
+				ch := make(chan *dns.Envelope)
+				go func() {
+					defer close(ch)
+					for _, rrs := range zone {
+						// each envelope takes longer than the request timeout
+						// in total, but makes progress within the idle timeout
+						clock.Advance(50 * time.Millisecond)
+						ch <- &dns.Envelope{RR: rrs}
+					}
+				}()
+				_ = respwriter.StreamZone(w.(*respwriter.RespWriter), r, ch)
+			}, respwriter.WithIdleTimeout(200*time.Millisecond), respwriter.WithClock(clock))
+			require.NoError(err)
+
+			mux := dns.NewServeMux()
+			mux.HandleFunc("go.dev", h)
+			l, err := net.Listen("tcp", ":0")
+			require.NoError(err)
+			_, addr, _ := respwriter.RunServer(t, nil, l, func(srv *dns.Server) {
+				srv.Handler = mux
+				srv.TsigSecret = secrets
+			})
+
+			m := new(dns.Msg)
+			m.SetAxfr("go.dev.")
+			tr := new(dns.Transfer)
+			if tc.tsig {
+				m.SetTsig(respwriter.TestTsigKey, dns.HmacSHA256, 300, time.Now().Unix())
+				tr.TsigSecret = secrets
+			}
+			ch, err := tr.In(m, addr)
+			require.NoError(err)
+			var got []dns.RR
+			var envelopes int
+			for env := range ch {
+				require.NoError(env.Error)
+				got = append(got, env.RR...)
+				envelopes++
+			}
+			assert.Equal(len(zone), envelopes)
+			assert.Len(got, 7)
+		})
+	}
+}
+
+func TestCache_expiry(t *testing.T) {
+	t.Parallel()
+
+	t.Run("expired", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var calls atomic.Int32
+		clock := respwritertest.NewFakeClock(time.Time{})
+		c, err := respwriter.NewCache(respwriter.TestTTLHandler(1, &calls), respwriter.WithClock(clock))
+		require.NoError(err)
+
+		respwriter.ServeCache(t, c, respwriter.TestCacheQuestion(1))
+		clock.Advance(1100 * time.Millisecond)
+		respwriter.ServeCache(t, c, respwriter.TestCacheQuestion(2))
+		assert.Equal(int32(2), calls.Load())
+	})
+	t.Run("max-ttl", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var calls atomic.Int32
+		clock := respwritertest.NewFakeClock(time.Time{})
+		c, err := respwriter.NewCache(respwriter.TestTTLHandler(300, &calls), respwriter.WithCacheMaxTTL(time.Millisecond), respwriter.WithClock(clock))
+		require.NoError(err)
+
+		respwriter.ServeCache(t, c, respwriter.TestCacheQuestion(1))
+		clock.Advance(10 * time.Millisecond)
+		respwriter.ServeCache(t, c, respwriter.TestCacheQuestion(2))
+		assert.Equal(int32(2), calls.Load())
+	})
+	t.Run("prefetch", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var calls atomic.Int32
+		clock := respwritertest.NewFakeClock(time.Time{})
+		c, err := respwriter.NewCache(respwriter.TestTTLHandler(1, &calls), respwriter.WithPrefetchThreshold(2), respwriter.WithPrefetchWindow(0.9), respwriter.WithClock(clock))
+		require.NoError(err)
+
+		respwriter.ServeCache(t, c, respwriter.TestCacheQuestion(1))
+		// first hit is within the window, but below the threshold
+		clock.Advance(200 * time.Millisecond)
+		respwriter.ServeCache(t, c, respwriter.TestCacheQuestion(2))
+		c.Wait()
+		assert.Equal(int32(1), calls.Load())
+
+		respwriter.ServeCache(t, c, respwriter.TestCacheQuestion(3))
+		c.Wait()
+		assert.Equal(int32(2), calls.Load())
+
+		// the prefetched entry was stored with a fresh TTL
+		clock.Advance(900 * time.Millisecond)
+		respwriter.ServeCache(t, c, respwriter.TestCacheQuestion(4))
+		c.Wait()
+		assert.Equal(int32(2), calls.Load())
+	})
+}
@@ -0,0 +1,24 @@
+package respwriter
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Tracer creates the trace spans of requests, so they can be exported with
+// the tracing library of your choice. Implementations must be safe for
+// concurrent use.
+type Tracer interface {
+	// Start starts a span and returns it along with a context, derived from
+	// ctx, which carries it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a trace span started by a Tracer.
+type Span interface {
+	// SetAttributes adds the attributes to the span.
+	SetAttributes(attrs ...slog.Attr)
+
+	// End completes the span.
+	End()
+}
@@ -0,0 +1,264 @@
+package respwriter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TrafficRecord is a request recorded by a TrafficRecorder, along with its
+// client's metadata and the response written by the handler.
+type TrafficRecord struct {
+	// Time is when the request was received.
+	Time time.Time `json:"time"`
+
+	// RemoteAddr is the address of the client.
+	RemoteAddr string `json:"remote_addr"`
+
+	// LocalAddr is the address the request was received on.
+	LocalAddr string `json:"local_addr,omitempty"`
+
+	// Transport is the transport the request was received over.
+	Transport Transport `json:"transport"`
+
+	// RequestID is the request ID (see RespWriter.RequestID).
+	RequestID string `json:"request_id,omitempty"`
+
+	// Request is the packed request.
+	Request []byte `json:"request"`
+
+	// Response is the last packed response written, it's empty when no
+	// response was written.
+	Response []byte `json:"response,omitempty"`
+
+	// Latency is how long the handler took to write the response, or to
+	// return when no response was written.
+	Latency time.Duration `json:"latency"`
+
+	// TimedOut is true when the request timed out before a response was
+	// written.
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+// TrafficSink receives the records of a TrafficRecorder. Implementations must
+// be safe for concurrent use.
+type TrafficSink interface {
+	// Record stores the record.
+	Record(TrafficRecord) error
+}
+
+// TrafficSource provides recorded traffic, in the order it was recorded.
+type TrafficSource interface {
+	// Next returns the next record, or io.EOF when there are no more
+	// records.
+	Next() (TrafficRecord, error)
+}
+
+// TrafficRecorder is a middleware which wraps a dns.HandlerFunc and records
+// every request, its client's metadata and the handler's response (with its
+// latency) to a TrafficSink, so production-shaped traffic can be replayed
+// against handler changes (see respwritertest.Replay).
+//
+// TrafficRecorder.ServeDNS is typically wrapped by NewHandlerFunc, so the
+// request ID, transport and timeouts are recorded.
+type TrafficRecorder struct {
+	handler dns.HandlerFunc
+	sink    TrafficSink
+	logger  *slog.Logger
+	clock   Clock
+}
+
+// NewTrafficRecorder returns a new TrafficRecorder which wraps the given
+// handler and records to the sink. Options supported: WithLogger, WithClock
+func NewTrafficRecorder(h dns.HandlerFunc, sink TrafficSink, opt ...Option) (*TrafficRecorder, error) {
+	const op = "respwriter.NewTrafficRecorder"
+	switch {
+	case isNil(h):
+		return nil, fmt.Errorf("%s: nil handler: %w", op, ErrInvalidParameter)
+	case isNil(sink):
+		return nil, fmt.Errorf("%s: nil sink: %w", op, ErrInvalidParameter)
+	}
+	opts := getGeneralOpts(opt...)
+	return &TrafficRecorder{
+		handler: h,
+		sink:    sink,
+		logger:  opts.withLogger,
+		clock:   opts.withClock,
+	}, nil
+}
+
+// ServeDNS calls the wrapped handler and records the request and its
+// response. Errors from the sink are logged, they never fail the request.
+//
+// When w is a RespWriter created by NewHandlerFunc, the handler is called with
+// it and the request is recorded once it's complete, so a response written
+// via Detach after the handler returned is recorded.
+func (t *TrafficRecorder) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	rec := TrafficRecord{
+		Time:      t.clock.Now(),
+		Transport: transportOf(w),
+	}
+	if outer, ok := w.(*RespWriter); ok {
+		rec.Transport = outer.Transport()
+		rec.RequestID = outer.RequestID()
+	}
+	if addr := w.RemoteAddr(); addr != nil {
+		rec.RemoteAddr = addr.String()
+	}
+	if addr := w.LocalAddr(); addr != nil {
+		rec.LocalAddr = addr.String()
+	}
+
+	var tw *trafficWriter
+	rw := wrapWrites(w, func(next dns.ResponseWriter) dns.ResponseWriter {
+		tw = &trafficWriter{ResponseWriter: next, clock: t.clock}
+		return tw
+	}, WithLogger(t.logger), WithClock(t.clock))
+	if rw.onComplete(func() { t.record(rec, r, tw, rw.RequestContext()) }) {
+		t.handler(rw, r)
+		return
+	}
+	t.handler(rw, r)
+	t.record(rec, r, tw, rw.RequestContext())
+}
+
+// record records the request, with the response kept by tw. The request timed
+// out when there's no response and ctx's deadline was exceeded.
+func (t *TrafficRecorder) record(rec TrafficRecord, r *dns.Msg, tw *trafficWriter, ctx context.Context) {
+	var err error
+	if rec.Request, err = r.Pack(); err != nil {
+		t.logError("unable to pack request", err)
+		return
+	}
+	var writtenAt time.Time
+	rec.Response, writtenAt = tw.response()
+	if rec.Response == nil {
+		writtenAt = t.clock.Now()
+		rec.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+	}
+	rec.Latency = writtenAt.Sub(rec.Time)
+	if err := t.sink.Record(rec); err != nil {
+		t.logError("unable to record traffic", err)
+	}
+}
+
+func (t *TrafficRecorder) logError(msg string, err error) {
+	if t.logger != nil {
+		t.logger.Warn(msg, "err", err)
+	}
+}
+
+// trafficWriter is a dns.ResponseWriter which keeps the last response
+// successfully written through it.
+type trafficWriter struct {
+	dns.ResponseWriter
+	clock Clock
+
+	mu        sync.Mutex
+	last      []byte
+	writtenAt time.Time
+}
+
+// WriteMsg writes the message to the wrapped writer and keeps it, packed
+// after the write, since the wrapped writer may modify the message
+// (truncation for example).
+func (w *trafficWriter) WriteMsg(m *dns.Msg) error {
+	if err := w.ResponseWriter.WriteMsg(m); err != nil {
+		return err
+	}
+	// the message was packed by the write, so packing it again succeeds.
+	if b, err := m.Pack(); err == nil {
+		w.keep(b)
+	}
+	return nil
+}
+
+// Write writes the buffer to the wrapped writer and keeps a copy of it.
+func (w *trafficWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		return n, err
+	}
+	w.keep(append([]byte(nil), b...))
+	return n, nil
+}
+
+func (w *trafficWriter) keep(b []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = b
+	w.writtenAt = w.clock.Now()
+}
+
+// response returns the last response and when it was written.
+func (w *trafficWriter) response() ([]byte, time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last, w.writtenAt
+}
+
+// JSONLSink is a TrafficSink which writes every record as a line of JSON.
+type JSONLSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONLSink returns a new JSONLSink which writes to w.
+func NewJSONLSink(w io.Writer) *JSONLSink {
+	return &JSONLSink{enc: json.NewEncoder(w)}
+}
+
+// Record writes the record as a line of JSON.
+func (s *JSONLSink) Record(rec TrafficRecord) error {
+	const op = "respwriter.(JSONLSink).Record"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(rec); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// JSONLSource is a TrafficSource which reads the records written by a
+// JSONLSink.
+type JSONLSource struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewJSONLSource returns a new JSONLSource which reads from r.
+func NewJSONLSource(r io.Reader) *JSONLSource {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return &JSONLSource{scanner: scanner}
+}
+
+// Next returns the next record, or io.EOF when there are no more records.
+// Blank lines are skipped.
+func (s *JSONLSource) Next() (TrafficRecord, error) {
+	const op = "respwriter.(JSONLSource).Next"
+	for s.scanner.Scan() {
+		s.line++
+		b := s.scanner.Bytes()
+		if len(b) == 0 {
+			continue
+		}
+		var rec TrafficRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return TrafficRecord{}, fmt.Errorf("%s: line %d: %w", op, s.line, err)
+		}
+		return rec, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return TrafficRecord{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return TrafficRecord{}, io.EOF
+}
@@ -0,0 +1,323 @@
+package respwriter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTrafficSink is a TrafficSink which keeps the records in memory.
+type testTrafficSink struct {
+	mu      sync.Mutex
+	records []TrafficRecord
+	err     error
+}
+
+func (s *testTrafficSink) Record(rec TrafficRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.records = append(s.records, rec)
+	return nil
+}
+
+func (s *testTrafficSink) all() []TrafficRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]TrafficRecord(nil), s.records...)
+}
+
+func TestNewTrafficRecorder(t *testing.T) {
+	t.Parallel()
+	testHandler := func(w dns.ResponseWriter, req *dns.Msg) {}
+
+	tests := []struct {
+		name            string
+		handler         dns.HandlerFunc
+		sink            TrafficSink
+		wantErrIs       error
+		wantErrContains string
+	}{
+		{
+			name:    "success",
+			handler: testHandler,
+			sink:    &testTrafficSink{},
+		},
+		{
+			name:            "err-nil-handler",
+			sink:            &testTrafficSink{},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "nil handler",
+		},
+		{
+			name:            "err-nil-sink",
+			handler:         testHandler,
+			sink:            (*JSONLSink)(nil),
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "nil sink",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			got, err := NewTrafficRecorder(tc.handler, tc.sink)
+			if tc.wantErrContains != "" {
+				require.Error(err)
+				assert.ErrorIs(err, tc.wantErrIs)
+				assert.Contains(err.Error(), tc.wantErrContains)
+				return
+			}
+			require.NoError(err)
+			assert.NotNil(got)
+		})
+	}
+}
+
+func TestTrafficRecorder_ServeDNS(t *testing.T) {
+	t.Parallel()
+	const requestTimeout = 50 * time.Millisecond
+
+	// testHandler answers, except for slow. (which times out) and drop.
+	// (which isn't answered).
+	testHandler := func(w dns.ResponseWriter, r *dns.Msg) {
+		switch r.Question[0].Name {
+		case "slow.":
+			<-w.(*RespWriter).RequestContext().Done()
+			return
+		case "drop.":
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   []byte{192, 0, 2, 1},
+		})
+		_ = w.WriteMsg(m)
+	}
+
+	tests := []struct {
+		name          string
+		qname         string
+		w             dns.ResponseWriter
+		wantResponse  bool
+		wantTimedOut  bool
+		wantLatency   time.Duration
+		wantTransport Transport
+	}{
+		{
+			name:          "udp",
+			qname:         "go.dev.",
+			w:             &mockUDPResponseWriter{},
+			wantResponse:  true,
+			wantLatency:   5 * time.Millisecond,
+			wantTransport: TransportUDP,
+		},
+		{
+			name:          "tcp",
+			qname:         "go.dev.",
+			w:             &mockTCPResponseWriter{},
+			wantResponse:  true,
+			wantLatency:   5 * time.Millisecond,
+			wantTransport: TransportTCP,
+		},
+		{
+			name:          "timed-out",
+			qname:         "slow.",
+			w:             &mockUDPResponseWriter{},
+			wantTimedOut:  true,
+			wantLatency:   requestTimeout,
+			wantTransport: TransportUDP,
+		},
+		{
+			name:          "no-response",
+			qname:         "drop.",
+			w:             &mockUDPResponseWriter{},
+			wantTransport: TransportUDP,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			sink := &testTrafficSink{}
+			tr, err := NewTrafficRecorder(testHandler, sink)
+			require.NoError(err)
+			h, err := NewHandlerFunc(requestTimeout, tr.ServeDNS)
+			require.NoError(err)
+
+			r := new(dns.Msg)
+			r.SetQuestion(tc.qname, dns.TypeA)
+			before := time.Now()
+			h(tc.w, r)
+
+			records := sink.all()
+			require.Len(records, 1)
+			rec := records[0]
+			assert.WithinRange(rec.Time, before, time.Now())
+			assert.Equal("127.0.0.1", rec.RemoteAddr)
+			assert.Equal("127.0.0.1", rec.LocalAddr)
+			assert.Equal(tc.wantTransport, rec.Transport)
+			assert.Len(rec.RequestID, 2*requestIDLen)
+			assert.Equal(tc.wantTimedOut, rec.TimedOut)
+			assert.GreaterOrEqual(rec.Latency, tc.wantLatency)
+
+			req := new(dns.Msg)
+			require.NoError(req.Unpack(rec.Request))
+			assert.Equal(r.Id, req.Id)
+			assert.Equal(r.Question, req.Question)
+			if !tc.wantResponse {
+				assert.Empty(rec.Response)
+				return
+			}
+			resp := new(dns.Msg)
+			require.NoError(resp.Unpack(rec.Response))
+			assert.Equal(r.Id, resp.Id)
+			require.Len(resp.Answer, 1)
+		})
+	}
+	t.Run("detached", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		sink := &testTrafficSink{}
+		var handlerWriter *RespWriter
+		tr, err := NewTrafficRecorder(func(w dns.ResponseWriter, r *dns.Msg) {
+			// the handler gets the writer of NewHandlerFunc.
+			handlerWriter = w.(*RespWriter)
+			assert.NoError(handlerWriter.ExtendDeadline(time.Second))
+			d := handlerWriter.Detach()
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				m := new(dns.Msg)
+				m.SetReply(r)
+				assert.NoError(d.Respond(m))
+			}()
+		}, sink)
+		require.NoError(err)
+		var outer *RespWriter
+		h, err := NewHandlerFunc(requestTimeout, func(w dns.ResponseWriter, r *dns.Msg) {
+			outer = w.(*RespWriter)
+			tr.ServeDNS(w, r)
+		}, WithMaxRequestTimeout(time.Minute))
+		require.NoError(err)
+
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		h(new(mockUDPResponseWriter), r)
+		assert.Same(outer, handlerWriter)
+
+		// the response written after the handler returned is recorded.
+		records := sink.all()
+		require.Len(records, 1)
+		assert.Equal(outer.RequestID(), records[0].RequestID)
+		assert.NotEmpty(records[0].Response)
+		assert.False(records[0].TimedOut)
+		assert.GreaterOrEqual(records[0].Latency, 10*time.Millisecond)
+	})
+	t.Run("timeout-reply", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		sink := &testTrafficSink{}
+		tr, err := NewTrafficRecorder(testHandler, sink)
+		require.NoError(err)
+		h, err := NewHandlerFunc(requestTimeout, tr.ServeDNS, WithTimeoutPolicy(TimeoutReplyAndClose))
+		require.NoError(err)
+
+		r := new(dns.Msg)
+		r.SetQuestion("slow.", dns.TypeA)
+		h(new(mockTCPResponseWriter), r)
+
+		// the reply written by the timeout policy is recorded.
+		records := sink.all()
+		require.Len(records, 1)
+		assert.False(records[0].TimedOut)
+		resp := new(dns.Msg)
+		require.NoError(resp.Unpack(records[0].Response))
+		assert.Equal(r.Id, resp.Id)
+		assert.Equal(dns.RcodeServerFailure, resp.Rcode)
+	})
+	t.Run("sink-error", func(t *testing.T) {
+		t.Parallel()
+		assert, require := assert.New(t), require.New(t)
+		var buf syncBuffer
+		sink := &testTrafficSink{err: errors.New("disk full")}
+		tr, err := NewTrafficRecorder(testHandler, sink, WithLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+		require.NoError(err)
+		cw := &captureWriter{ResponseWriter: new(mockDNSResponseWriter)}
+
+		r := new(dns.Msg)
+		r.SetQuestion("go.dev.", dns.TypeA)
+		tr.ServeDNS(cw, r)
+		// the request is answered even though it isn't recorded
+		assert.NotNil(cw.msg)
+		assert.Contains(buf.String(), "unable to record traffic")
+		assert.Contains(buf.String(), "disk full")
+	})
+}
+
+func TestJSONLSink(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	records := []TrafficRecord{
+		{
+			Time:       time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+			RemoteAddr: "192.0.2.1:53000",
+			LocalAddr:  "127.0.0.1:53",
+			Transport:  TransportUDP,
+			RequestID:  "0102030405060708",
+			Request:    []byte{1, 2, 3},
+			Response:   []byte{4, 5, 6},
+			Latency:    5 * time.Millisecond,
+		},
+		{
+			Time:       time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC),
+			RemoteAddr: "192.0.2.2:53000",
+			Transport:  TransportTCP,
+			Request:    []byte{1, 2, 3},
+			Latency:    time.Second,
+			TimedOut:   true,
+		},
+	}
+	var buf bytes.Buffer
+	sink := NewJSONLSink(&buf)
+	for _, rec := range records {
+		require.NoError(sink.Record(rec))
+	}
+	assert.Equal(2, strings.Count(buf.String(), "\n"))
+
+	src := NewJSONLSource(&buf)
+	for _, want := range records {
+		got, err := src.Next()
+		require.NoError(err)
+		assert.Equal(want, got)
+	}
+	_, err := src.Next()
+	assert.ErrorIs(err, io.EOF)
+}
+
+func TestJSONLSource_Next(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	src := NewJSONLSource(strings.NewReader("\n{\"remote_addr\":\"192.0.2.1:53\"}\n\n{bogus}\n"))
+	got, err := src.Next()
+	require.NoError(err)
+	assert.Equal("192.0.2.1:53", got.RemoteAddr)
+	_, err = src.Next()
+	require.Error(err)
+	assert.Contains(err.Error(), "line 4")
+}
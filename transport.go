@@ -0,0 +1,94 @@
+package respwriter
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Transport identifies the transport a request was received over.
+type Transport string
+
+const (
+	// TransportUnknown is used when the transport can't be determined.
+	TransportUnknown Transport = ""
+
+	// TransportUDP is used for requests received over UDP.
+	TransportUDP Transport = "udp"
+
+	// TransportTCP is used for requests received over TCP.
+	TransportTCP Transport = "tcp"
+
+	// TransportTLS is used for requests received over TCP with TLS (DoT).
+	TransportTLS Transport = "tcp-tls"
+)
+
+// String returns the transport's name, which matches the dns.Server.Net names.
+func (t Transport) String() string {
+	if t == TransportUnknown {
+		return "unknown"
+	}
+	return string(t)
+}
+
+// IsStream returns true when the transport is connection oriented (TCP or
+// TLS), which means messages are length prefixed and not limited to the UDP
+// payload size.
+func (t Transport) IsStream() bool {
+	return t == TransportTCP || t == TransportTLS
+}
+
+// ExposesUnderlyingConns is implemented by dns.ResponseWriters which expose
+// the connection a request was received on. IncomingConn returns nil for
+// packet transports and IncomingPacketConn returns nil for stream transports.
+//
+// The write deadlines of RespWriter (including WithEnvelopeTimeout) and
+// RespWriter.HijackConn need the connection. The writer of a stock dns.Server
+// (as of miekg/dns v1.1.58) doesn't implement it, and the server doesn't set
+// write deadlines either (its WriteTimeout is unused), so with a stock server
+// a write that has started isn't bound by any deadline, WithEnvelopeTimeout
+// has no effect and HijackConn always returns ErrUnsupportedTransport.
+type ExposesUnderlyingConns interface {
+	IncomingPacketConn() net.PacketConn
+	IncomingConn() net.Conn
+}
+
+// transportOf determines the transport of the given writer. It prefers the
+// underlying connections (ExposesUnderlyingConns) and falls back to the
+// network of the remote address.
+func transportOf(w dns.ResponseWriter) Transport {
+	type connectionStater interface {
+		ConnectionState() *tls.ConnectionState
+	}
+	if e, ok := w.(ExposesUnderlyingConns); ok {
+		if c := e.IncomingConn(); !isNil(c) {
+			if _, ok := c.(*tls.Conn); ok {
+				return TransportTLS
+			}
+			if cs, ok := w.(connectionStater); ok && cs.ConnectionState() != nil {
+				return TransportTLS
+			}
+			return TransportTCP
+		}
+		if pc := e.IncomingPacketConn(); !isNil(pc) {
+			return TransportUDP
+		}
+	}
+	addr := w.RemoteAddr()
+	if isNil(addr) {
+		return TransportUnknown
+	}
+	switch network := addr.Network(); {
+	case strings.HasPrefix(network, "udp"):
+		return TransportUDP
+	case strings.HasPrefix(network, "tcp"):
+		if cs, ok := w.(connectionStater); ok && cs.ConnectionState() != nil {
+			return TransportTLS
+		}
+		return TransportTCP
+	default:
+		return TransportUnknown
+	}
+}
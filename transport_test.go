@@ -0,0 +1,115 @@
+package respwriter
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_transportOf(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		w    dns.ResponseWriter
+		want Transport
+	}{
+		{
+			name: "exposed-tcp",
+			w:    new(mockDNSResponseWriter),
+			want: TransportTCP,
+		},
+		{
+			name: "exposed-udp",
+			w:    new(mockUDPResponseWriter),
+			want: TransportUDP,
+		},
+		{
+			name: "exposed-tls",
+			w:    &mockConnResponseWriter{conn: &tls.Conn{}},
+			want: TransportTLS,
+		},
+		{
+			name: "addr-udp",
+			w:    &mockAddrResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}},
+			want: TransportUDP,
+		},
+		{
+			name: "addr-tcp",
+			w:    &mockAddrResponseWriter{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}},
+			want: TransportTCP,
+		},
+		{
+			name: "addr-unknown",
+			w:    &mockAddrResponseWriter{remote: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}},
+			want: TransportUnknown,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+			got := transportOf(tc.w)
+			assert.Equal(tc.want, got)
+			assert.Equal(tc.want == TransportTCP || tc.want == TransportTLS, got.IsStream())
+		})
+	}
+}
+
+func TestTransport_String(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "udp", TransportUDP.String())
+	assert.Equal(t, "tcp", TransportTCP.String())
+	assert.Equal(t, "tcp-tls", TransportTLS.String())
+	assert.Equal(t, "unknown", TransportUnknown.String())
+}
+
+// mockAddrResponseWriter doesn't expose its underlying conns, so its
+// transport is determined by its remote address.
+type mockAddrResponseWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+}
+
+func (w *mockAddrResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+// mockConnResponseWriter exposes the given stream conn.
+type mockConnResponseWriter struct {
+	mockDNSResponseWriter
+	conn net.Conn
+}
+
+func (w *mockConnResponseWriter) IncomingConn() net.Conn {
+	return w.conn
+}
+
+// TestExposesUnderlyingConns_stockServer documents that the writer of a stock
+// dns.Server doesn't expose its connection, so the write deadlines of
+// RespWriter don't apply with it (see withWriteDeadline).
+func TestExposesUnderlyingConns_stockServer(t *testing.T) {
+	t.Parallel()
+	assert, require := assert.New(t), require.New(t)
+	exposed := make(chan bool, 1)
+	h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+		_, ok := w.(*RespWriter).Underlying().(ExposesUnderlyingConns)
+		exposed <- ok
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})
+	require.NoError(err)
+	_, c, addr := runTestDnsServer(t, ".", h)
+
+	r := new(dns.Msg)
+	r.SetQuestion("go.dev.", dns.TypeA)
+	_, _, err = c.Exchange(r, addr)
+	require.NoError(err)
+	assert.False(<-exposed)
+}
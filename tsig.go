@@ -0,0 +1,210 @@
+package respwriter
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TsigKey is a TSIG key (RFC 8945) accepted by Tsig.
+type TsigKey struct {
+	// Name is the name of the key.
+	Name string
+
+	// Algorithm is the HMAC algorithm of the key, for example dns.HmacSHA256.
+	Algorithm string
+
+	// Secret is the base64 encoded secret of the key.
+	Secret string
+}
+
+// Tsig is a dns.Handler which requires a valid TSIG for requests matching its
+// opcodes or question types (UPDATE, AXFR and IXFR by default), optionally
+// limited to a set of zones, before calling the handler it wraps.
+//
+// Tsig relies on the dns.Server to verify the request's TSIG (which is reported
+// by RespWriter.TsigStatus), so the server's TsigSecret must be set to the
+// value returned by Tsig.Secrets.
+type Tsig struct {
+	handler dns.HandlerFunc
+	logger  *slog.Logger
+	keys    map[string]TsigKey
+	opcodes map[int]struct{}
+	qtypes  map[uint16]struct{}
+	zones   []string
+	clock   Clock
+}
+
+// NewTsig returns a new Tsig which wraps the given handler and accepts the
+// given keys. Options supported: WithLogger, WithTsigOpcodes, WithTsigQtypes,
+// WithTsigZones, WithClock
+func NewTsig(h dns.HandlerFunc, keys []TsigKey, opt ...Option) (*Tsig, error) {
+	const op = "respwriter.NewTsig"
+	switch {
+	case isNil(h):
+		return nil, fmt.Errorf("%s: nil handler: %w", op, ErrInvalidParameter)
+	case len(keys) == 0:
+		return nil, fmt.Errorf("%s: missing keys: %w", op, ErrInvalidParameter)
+	}
+	opts := getGeneralOpts(opt...)
+	t := &Tsig{
+		handler: h,
+		logger:  opts.withLogger,
+		keys:    make(map[string]TsigKey, len(keys)),
+		opcodes: make(map[int]struct{}, len(opts.withTsigOpcodes)),
+		qtypes:  make(map[uint16]struct{}, len(opts.withTsigQtypes)),
+		clock:   opts.withClock,
+	}
+	for _, k := range keys {
+		switch {
+		case k.Name == "":
+			return nil, fmt.Errorf("%s: missing key name: %w", op, ErrInvalidParameter)
+		case k.Algorithm == "":
+			return nil, fmt.Errorf("%s: missing algorithm for key %q: %w", op, k.Name, ErrInvalidParameter)
+		case k.Secret == "":
+			return nil, fmt.Errorf("%s: missing secret for key %q: %w", op, k.Name, ErrInvalidParameter)
+		}
+		k.Name = dns.CanonicalName(k.Name)
+		k.Algorithm = dns.CanonicalName(k.Algorithm)
+		if _, ok := t.keys[k.Name]; ok {
+			return nil, fmt.Errorf("%s: duplicate key %q: %w", op, k.Name, ErrInvalidParameter)
+		}
+		t.keys[k.Name] = k
+	}
+	for _, o := range opts.withTsigOpcodes {
+		t.opcodes[o] = struct{}{}
+	}
+	for _, q := range opts.withTsigQtypes {
+		t.qtypes[q] = struct{}{}
+	}
+	for _, z := range opts.withTsigZones {
+		t.zones = append(t.zones, dns.CanonicalName(z))
+	}
+	return t, nil
+}
+
+// Secrets returns the keys' secrets by name, which must be used as the
+// dns.Server's TsigSecret so the server verifies the requests' TSIG.
+func (t *Tsig) Secrets() map[string]string {
+	secrets := make(map[string]string, len(t.keys))
+	for name, k := range t.keys {
+		secrets[name] = k.Secret
+	}
+	return secrets
+}
+
+// ServeDNS calls the wrapped handler when the request doesn't require a TSIG
+// or its TSIG is valid. Unsigned requests which require a TSIG are answered
+// with REFUSED and requests which fail verification are answered with NOTAUTH
+// and a TSIG with the error (BADKEY, BADSIG or BADTIME).
+func (t *Tsig) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	rw, ok := w.(*RespWriter)
+	if !ok {
+		rw = NewRespWriter(context.Background(), w, WithLogger(t.logger), WithRequest(r), WithClock(t.clock))
+	}
+	if !t.required(r) {
+		t.handler(rw, r)
+		return
+	}
+	logger := rw.Logger()
+	if logger == nil {
+		logger = t.logger
+	}
+
+	sig := r.IsTsig()
+	if sig == nil {
+		if logger != nil {
+			logger.Warn("tsig required", "remote_addr", rw.RemoteAddr().String(), "opcode", dns.OpcodeToString[r.Opcode])
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		_ = rw.WriteMsg(m)
+		return
+	}
+
+	name, alg := dns.CanonicalName(sig.Hdr.Name), dns.CanonicalName(sig.Algorithm)
+	tsigErr := dns.RcodeSuccess
+	key, ok := t.keys[name]
+	switch {
+	case !ok, key.Algorithm != alg:
+		tsigErr = dns.RcodeBadKey
+	default:
+		tsigErr = tsigRcode(rw.TsigStatus())
+	}
+	if tsigErr != dns.RcodeSuccess {
+		if logger != nil {
+			logger.Warn("tsig verification failed", "remote_addr", rw.RemoteAddr().String(), "key", name, "algorithm", alg, "tsig_error", dns.RcodeToString[tsigErr])
+		}
+		_ = rw.WriteMsg(tsigErrorReply(r, sig, tsigErr, t.clock.Now()))
+		return
+	}
+	if logger != nil {
+		logger.Debug("tsig verified", "remote_addr", rw.RemoteAddr().String(), "key", name, "algorithm", alg)
+	}
+	t.handler(rw, r)
+}
+
+// required returns true when the request requires a TSIG.
+func (t *Tsig) required(r *dns.Msg) bool {
+	_, required := t.opcodes[r.Opcode]
+	if !required && len(r.Question) > 0 {
+		_, required = t.qtypes[r.Question[0].Qtype]
+	}
+	if !required || len(t.zones) == 0 {
+		return required
+	}
+	if len(r.Question) == 0 {
+		return true
+	}
+	name := dns.CanonicalName(r.Question[0].Name)
+	for _, z := range t.zones {
+		if dns.IsSubDomain(z, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// tsigRcode maps the TSIG status reported by the dns.Server to a TSIG error.
+func tsigRcode(status error) int {
+	switch {
+	case status == nil:
+		return dns.RcodeSuccess
+	case errors.Is(status, dns.ErrSecret), errors.Is(status, dns.ErrKeyAlg):
+		return dns.RcodeBadKey
+	case errors.Is(status, dns.ErrTime):
+		return dns.RcodeBadTime
+	default:
+		return dns.RcodeBadSig
+	}
+}
+
+// tsigErrorReply returns a NOTAUTH reply to r with a TSIG carrying the TSIG
+// error (RFC 8945 section 5.3.2). The dns.Server only signs the reply for
+// BADTIME.
+func tsigErrorReply(r *dns.Msg, sig *dns.TSIG, tsigErr int, now time.Time) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNotAuth)
+	t := &dns.TSIG{
+		Hdr:        dns.RR_Header{Name: sig.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm:  sig.Algorithm,
+		TimeSigned: sig.TimeSigned,
+		Fudge:      sig.Fudge,
+		OrigId:     r.Id,
+		Error:      uint16(tsigErr),
+	}
+	if tsigErr == dns.RcodeBadTime {
+		// the other data is the server's current time as a 48 bit integer.
+		ts := uint64(now.Unix())
+		other := []byte{byte(ts >> 40), byte(ts >> 32), byte(ts >> 24), byte(ts >> 16), byte(ts >> 8), byte(ts)}
+		t.OtherData = hex.EncodeToString(other)
+		t.OtherLen = uint16(len(other))
+	}
+	m.Extra = append(m.Extra, t)
+	return m
+}
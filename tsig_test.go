@@ -0,0 +1,328 @@
+package respwriter
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTsigKey    = "xfr.go.dev."
+	testTsigSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+func TestNewTsig(t *testing.T) {
+	t.Parallel()
+	testHandler := func(w dns.ResponseWriter, req *dns.Msg) {}
+	testKey := TsigKey{Name: testTsigKey, Algorithm: dns.HmacSHA256, Secret: testTsigSecret}
+
+	tests := []struct {
+		name            string
+		handler         dns.HandlerFunc
+		keys            []TsigKey
+		wantErrIs       error
+		wantErrContains string
+	}{
+		{
+			name:    "success",
+			handler: testHandler,
+			keys:    []TsigKey{testKey, {Name: "other.", Algorithm: dns.HmacSHA512, Secret: testTsigSecret}},
+		},
+		{
+			name:            "err-nil-handler",
+			keys:            []TsigKey{testKey},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "nil handler",
+		},
+		{
+			name:            "err-missing-keys",
+			handler:         testHandler,
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "missing keys",
+		},
+		{
+			name:            "err-missing-name",
+			handler:         testHandler,
+			keys:            []TsigKey{{Algorithm: dns.HmacSHA256, Secret: testTsigSecret}},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "missing key name",
+		},
+		{
+			name:            "err-missing-algorithm",
+			handler:         testHandler,
+			keys:            []TsigKey{{Name: testTsigKey, Secret: testTsigSecret}},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "missing algorithm",
+		},
+		{
+			name:            "err-missing-secret",
+			handler:         testHandler,
+			keys:            []TsigKey{{Name: testTsigKey, Algorithm: dns.HmacSHA256}},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "missing secret",
+		},
+		{
+			name:            "err-duplicate-key",
+			handler:         testHandler,
+			keys:            []TsigKey{testKey, {Name: "XFR.go.dev", Algorithm: dns.HmacSHA256, Secret: testTsigSecret}},
+			wantErrIs:       ErrInvalidParameter,
+			wantErrContains: "duplicate key",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			got, err := NewTsig(tc.handler, tc.keys)
+			if tc.wantErrContains != "" {
+				require.Error(err)
+				assert.ErrorIs(err, tc.wantErrIs)
+				assert.Contains(err.Error(), tc.wantErrContains)
+				return
+			}
+			require.NoError(err)
+			assert.Len(got.Secrets(), len(tc.keys))
+		})
+	}
+}
+
+func TestTsig_ServeDNS(t *testing.T) {
+	t.Parallel()
+	testLogger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{AddSource: true}))
+	keys := []TsigKey{
+		{Name: testTsigKey, Algorithm: dns.HmacSHA256, Secret: testTsigSecret},
+		{Name: "update.go.dev.", Algorithm: dns.HmacSHA512, Secret: testTsigSecret},
+	}
+
+	newReq := func(opcode int, qtype uint16, name string, key, alg string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		r.Opcode = opcode
+		if key != "" {
+			r.SetTsig(key, alg, 300, time.Now().Unix())
+		}
+		return r
+	}
+
+	tests := []struct {
+		name         string
+		req          *dns.Msg
+		status       error
+		opts         []Option
+		wantHandler  bool
+		wantRcode    int
+		wantTsigErr  int
+		wantNoTsigRR bool
+	}{
+		{
+			name:        "not-required",
+			req:         newReq(dns.OpcodeQuery, dns.TypeA, "go.dev.", "", ""),
+			wantHandler: true,
+		},
+		{
+			name:         "unsigned-axfr",
+			req:          newReq(dns.OpcodeQuery, dns.TypeAXFR, "go.dev.", "", ""),
+			wantRcode:    dns.RcodeRefused,
+			wantNoTsigRR: true,
+		},
+		{
+			name:         "unsigned-update",
+			req:          newReq(dns.OpcodeUpdate, dns.TypeSOA, "go.dev.", "", ""),
+			wantRcode:    dns.RcodeRefused,
+			wantNoTsigRR: true,
+		},
+		{
+			name:        "valid-axfr",
+			req:         newReq(dns.OpcodeQuery, dns.TypeAXFR, "go.dev.", testTsigKey, dns.HmacSHA256),
+			wantHandler: true,
+		},
+		{
+			name:        "valid-ixfr-second-key",
+			req:         newReq(dns.OpcodeQuery, dns.TypeIXFR, "go.dev.", "update.go.dev.", dns.HmacSHA512),
+			wantHandler: true,
+		},
+		{
+			name:        "unknown-key",
+			req:         newReq(dns.OpcodeQuery, dns.TypeAXFR, "go.dev.", "unknown.", dns.HmacSHA256),
+			wantRcode:   dns.RcodeNotAuth,
+			wantTsigErr: dns.RcodeBadKey,
+		},
+		{
+			name:        "wrong-algorithm",
+			req:         newReq(dns.OpcodeQuery, dns.TypeAXFR, "go.dev.", testTsigKey, dns.HmacSHA512),
+			wantRcode:   dns.RcodeNotAuth,
+			wantTsigErr: dns.RcodeBadKey,
+		},
+		{
+			name:        "status-bad-secret",
+			req:         newReq(dns.OpcodeQuery, dns.TypeAXFR, "go.dev.", testTsigKey, dns.HmacSHA256),
+			status:      dns.ErrSecret,
+			wantRcode:   dns.RcodeNotAuth,
+			wantTsigErr: dns.RcodeBadKey,
+		},
+		{
+			name:        "status-bad-sig",
+			req:         newReq(dns.OpcodeQuery, dns.TypeAXFR, "go.dev.", testTsigKey, dns.HmacSHA256),
+			status:      dns.ErrSig,
+			wantRcode:   dns.RcodeNotAuth,
+			wantTsigErr: dns.RcodeBadSig,
+		},
+		{
+			name:        "status-bad-time",
+			req:         newReq(dns.OpcodeQuery, dns.TypeAXFR, "go.dev.", testTsigKey, dns.HmacSHA256),
+			status:      dns.ErrTime,
+			wantRcode:   dns.RcodeNotAuth,
+			wantTsigErr: dns.RcodeBadTime,
+		},
+		{
+			name:        "zone-not-included",
+			req:         newReq(dns.OpcodeQuery, dns.TypeAXFR, "go.dev.", "", ""),
+			opts:        []Option{WithTsigZones("example.com")},
+			wantHandler: true,
+		},
+		{
+			name:         "zone-included",
+			req:          newReq(dns.OpcodeQuery, dns.TypeAXFR, "sub.example.com.", "", ""),
+			opts:         []Option{WithTsigZones("example.com")},
+			wantRcode:    dns.RcodeRefused,
+			wantNoTsigRR: true,
+		},
+		{
+			name:         "custom-qtypes",
+			req:          newReq(dns.OpcodeQuery, dns.TypeTXT, "go.dev.", "", ""),
+			opts:         []Option{WithTsigQtypes(dns.TypeTXT)},
+			wantRcode:    dns.RcodeRefused,
+			wantNoTsigRR: true,
+		},
+		{
+			name:        "custom-opcodes",
+			req:         newReq(dns.OpcodeUpdate, dns.TypeSOA, "go.dev.", "", ""),
+			opts:        []Option{WithTsigOpcodes(dns.OpcodeNotify)},
+			wantHandler: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			assert, require := assert.New(t), require.New(t)
+			var executedHandler bool
+			h := func(w dns.ResponseWriter, r *dns.Msg) {
+				executedHandler = true
+				m := new(dns.Msg)
+				m.SetReply(r)
+				_ = w.WriteMsg(m)
+			}
+			tsig, err := NewTsig(h, keys, append(tc.opts, WithLogger(testLogger))...)
+			require.NoError(err)
+
+			cw := &captureWriter{ResponseWriter: &mockTsigResponseWriter{status: tc.status}}
+			tsig.ServeDNS(NewRespWriter(context.Background(), cw, WithLogger(testLogger)), tc.req)
+			require.NotNil(cw.msg)
+			assert.Equal(tc.wantHandler, executedHandler)
+			assert.Equal(tc.wantRcode, cw.msg.Rcode)
+			if tc.wantHandler {
+				return
+			}
+			sig := cw.msg.IsTsig()
+			if tc.wantNoTsigRR {
+				assert.Nil(sig)
+				return
+			}
+			require.NotNil(sig)
+			assert.Equal(uint16(tc.wantTsigErr), sig.Error)
+			assert.Equal(tc.req.IsTsig().Hdr.Name, sig.Hdr.Name)
+			assert.Equal(tc.req.Id, sig.OrigId)
+			if tc.wantTsigErr == dns.RcodeBadTime {
+				assert.Equal(uint16(6), sig.OtherLen)
+			}
+		})
+	}
+}
+
+func TestTsig_server(t *testing.T) {
+	t.Parallel()
+	keys := []TsigKey{{Name: testTsigKey, Algorithm: dns.HmacSHA256, Secret: testTsigSecret}}
+	h := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.SOA{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:  "ns.go.dev.", Mbox: "admin.go.dev.", Serial: 1, Refresh: 1, Retry: 1, Expire: 1, Minttl: 1,
+		})
+		if sig := r.IsTsig(); sig != nil {
+			m.SetTsig(sig.Hdr.Name, sig.Algorithm, 300, time.Now().Unix())
+		}
+		_ = w.WriteMsg(m)
+	}
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		wantEDNS bool
+	}{
+		{name: "default"},
+		{
+			// the OPT added to the reply must precede its TSIG, otherwise
+			// the reply isn't signed.
+			name:     "edns",
+			opts:     []Option{WithEDNS(true)},
+			wantEDNS: true,
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert, require := assert.New(t), require.New(t)
+			tsig, err := NewTsig(h, keys)
+			require.NoError(err)
+			got, err := NewHandlerFunc(time.Second, tsig.ServeDNS, tc.opts...)
+			require.NoError(err)
+
+			mux := dns.NewServeMux()
+			mux.HandleFunc("go.dev", got)
+			l, err := net.Listen("tcp", ":0")
+			require.NoError(err)
+			_, addr, _ := runServer(t, nil, l, func(srv *dns.Server) {
+				srv.Handler = mux
+				srv.TsigSecret = tsig.Secrets()
+			})
+
+			// the client verifies the TSIG of the responses to signed
+			// requests.
+			c := &dns.Client{Net: "tcp", TsigSecret: tsig.Secrets()}
+			m := new(dns.Msg)
+			m.SetQuestion("go.dev.", dns.TypeAXFR)
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			r, _, err := c.Exchange(m, addr)
+			require.NoError(err)
+			assert.Equal(dns.RcodeRefused, r.Rcode)
+
+			m.SetTsig(testTsigKey, dns.HmacSHA256, 300, time.Now().Unix())
+			r, _, err = c.Exchange(m, addr)
+			require.NoError(err)
+			assert.Equal(dns.RcodeSuccess, r.Rcode)
+			assert.Len(r.Answer, 1)
+			require.NotNil(r.IsTsig())
+			assert.Equal(tc.wantEDNS, r.IsEdns0() != nil)
+		})
+	}
+}
+
+// mockTsigResponseWriter is a mockDNSResponseWriter which reports the given
+// TSIG status.
+type mockTsigResponseWriter struct {
+	mockDNSResponseWriter
+	status error
+}
+
+func (w *mockTsigResponseWriter) TsigStatus() error {
+	return w.status
+}
@@ -0,0 +1,71 @@
+package respwriter
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// wrapWriter replaces the writer the messages of rw are written to with the
+// one returned by wrap, which is given the current writer to write to.
+// Middlewares use it to observe or alter the responses of a request without
+// wrapping rw in a new RespWriter, so the handler keeps the request's
+// deadline, request ID, annotations and detached handle. The wrapper stays in
+// place until the request is done, so responses written via Detach go through
+// it as well.
+//
+// Wrappers see the messages written by the handler: they're made consistent
+// with the request (EDNS0, truncation and padding) and bound by the request's
+// deadline once they reach the end of the chain. The connection, transport
+// and addresses of the request are still those of the underlying writer.
+func (rw *RespWriter) wrapWriter(wrap func(next dns.ResponseWriter) dns.ResponseWriter) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.writer == nil {
+		rw.writer = &underlyingWriter{rw: rw}
+	}
+	rw.writer = wrap(rw.writer)
+}
+
+// wrapWrites returns w, with its writes going through the writer returned by
+// wrap (see wrapWriter), when it's a RespWriter. Otherwise, it returns a new
+// RespWriter which wraps the writer returned by wrap for w, with the given
+// options.
+func wrapWrites(w dns.ResponseWriter, wrap func(next dns.ResponseWriter) dns.ResponseWriter, opt ...Option) *RespWriter {
+	if rw, ok := w.(*RespWriter); ok {
+		rw.wrapWriter(wrap)
+		return rw
+	}
+	return NewRespWriter(context.Background(), wrap(w), opt...)
+}
+
+// onComplete registers f to be called once the request is complete, after
+// the handler returned and its detached response, if any, was written or the
+// request timed out. It returns false, without registering f, when rw wasn't
+// created by NewHandlerFunc, since the completion of its request isn't known.
+func (rw *RespWriter) onComplete(f func()) bool {
+	if rw.deadlineCtx == nil {
+		return false
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.completeFuncs = append(rw.completeFuncs, f)
+	return true
+}
+
+// underlyingWriter is the end of the chain of writers installed by
+// wrapWriter, it writes to the underlying writer of its RespWriter. Its
+// WriteMsg and Write are called by the RespWriter's, with its mu held.
+type underlyingWriter struct {
+	rw *RespWriter
+}
+
+func (w *underlyingWriter) WriteMsg(m *dns.Msg) error   { return w.rw.writeUnderlying(m) }
+func (w *underlyingWriter) Write(b []byte) (int, error) { return w.rw.writeRawUnderlying(b) }
+func (w *underlyingWriter) RemoteAddr() net.Addr        { return w.rw.underlying.RemoteAddr() }
+func (w *underlyingWriter) LocalAddr() net.Addr         { return w.rw.underlying.LocalAddr() }
+func (w *underlyingWriter) TsigStatus() error           { return w.rw.underlying.TsigStatus() }
+func (w *underlyingWriter) TsigTimersOnly(b bool)       { w.rw.underlying.TsigTimersOnly(b) }
+func (w *underlyingWriter) Hijack()                     { w.rw.underlying.Hijack() }
+func (w *underlyingWriter) Close() error                { return w.rw.underlying.Close() }
@@ -0,0 +1,95 @@
+package respwriter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingWrapper is a writer installed via wrapWriter which records the
+// messages written through it, before they're written to next.
+type recordingWrapper struct {
+	dns.ResponseWriter
+	name string
+	log  *[]string
+	msgs []*dns.Msg
+}
+
+func (w *recordingWrapper) WriteMsg(m *dns.Msg) error {
+	*w.log = append(*w.log, w.name)
+	w.msgs = append(w.msgs, m.Copy())
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func TestRespWriter_wrapWriter(t *testing.T) {
+	t.Parallel()
+
+	// a response which doesn't fit the 512 bytes of a UDP request without
+	// EDNS0.
+	r := new(dns.Msg)
+	r.SetQuestion("go.dev.", dns.TypeTXT)
+	reply := new(dns.Msg)
+	reply.SetReply(r)
+	for i := 0; i < 10; i++ {
+		reply.Answer = append(reply.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "go.dev.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{string(make([]byte, 100))},
+		})
+	}
+
+	t.Run("chain", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var (
+			log            []string
+			first, second  *recordingWrapper
+			completed      bool
+			handlerWriter  *RespWriter
+			completeCalled bool
+		)
+		h, err := NewHandlerFunc(time.Second, func(w dns.ResponseWriter, r *dns.Msg) {
+			handlerWriter = wrapWrites(w, func(next dns.ResponseWriter) dns.ResponseWriter {
+				first = &recordingWrapper{ResponseWriter: next, name: "first", log: &log}
+				return first
+			})
+			handlerWriter.wrapWriter(func(next dns.ResponseWriter) dns.ResponseWriter {
+				second = &recordingWrapper{ResponseWriter: next, name: "second", log: &log}
+				return second
+			})
+			completeCalled = handlerWriter.onComplete(func() { completed = true })
+			assert.Same(w, handlerWriter)
+			require.NoError(handlerWriter.WriteMsg(reply.Copy()))
+		})
+		require.NoError(err)
+		h(new(mockUDPResponseWriter), r)
+
+		// the last wrapper installed is the first to see the message.
+		assert.Equal([]string{"second", "first"}, log)
+		// wrappers see the message before it's truncated.
+		assert.Len(second.msgs[0].Answer, 10)
+		assert.Len(first.msgs[0].Answer, 10)
+		assert.True(completeCalled)
+		assert.True(completed)
+		assert.Equal(dns.RcodeSuccess, handlerWriter.rcode)
+		assert.True(handlerWriter.written)
+	})
+	t.Run("not-a-respwriter", func(t *testing.T) {
+		assert, require := assert.New(t), require.New(t)
+		var wrapper *recordingWrapper
+		w := new(mockUDPResponseWriter)
+		rw := wrapWrites(w, func(next dns.ResponseWriter) dns.ResponseWriter {
+			assert.Same(w, next)
+			wrapper = &recordingWrapper{ResponseWriter: next, log: new([]string)}
+			return wrapper
+		})
+		assert.Same(wrapper, rw.Underlying())
+		require.NoError(rw.WriteMsg(reply.Copy()))
+		assert.Len(wrapper.msgs, 1)
+		// the completion of the request isn't known.
+		assert.False(rw.onComplete(func() {}))
+		assert.False(NewRespWriter(context.Background(), w).onComplete(func() {}))
+	})
+}